@@ -0,0 +1,144 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent/iplist"
+)
+
+// The longest to wait before retrying a failed blocklist update.
+const maxIPBlocklistRetryInterval = 15 * time.Minute
+
+// An iplist.Ranger whose underlying list can be replaced while lookups are in progress.
+type swappableRanger struct {
+	v atomic.Value // rangerBox
+}
+
+// atomic.Value requires a consistent concrete type.
+type rangerBox struct {
+	iplist.Ranger
+}
+
+var _ iplist.Ranger = (*swappableRanger)(nil)
+
+func (me *swappableRanger) load() iplist.Ranger {
+	b, _ := me.v.Load().(rangerBox)
+	return b.Ranger
+}
+
+func (me *swappableRanger) store(r iplist.Ranger) {
+	me.v.Store(rangerBox{r})
+}
+
+func (me *swappableRanger) Lookup(ip net.IP) (r iplist.Range, ok bool) {
+	if l := me.load(); l != nil {
+		return l.Lookup(ip)
+	}
+	return
+}
+
+func (me *swappableRanger) NumRanges() int {
+	if l := me.load(); l != nil {
+		return l.NumRanges()
+	}
+	return 0
+}
+
+// Parses a blocklist in the P2P plaintext or CIDR formats, which may be gzipped.
+func parseIPBlocklist(r io.Reader) (*iplist.IPList, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening gzip: %w", err)
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+	b, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	for _, l := range bytes.Split(b, []byte("\n")) {
+		l = bytes.TrimSpace(l)
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) == 0 {
+		return iplist.New(nil), nil
+	}
+	if _, _, err := net.ParseCIDR(string(lines[0])); err != nil {
+		return iplist.NewFromReader(bytes.NewReader(b))
+	}
+	ranges, err := iplist.ParseCIDRListReader(bytes.NewReader(bytes.Join(lines, []byte("\n"))))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].First, ranges[j].First) < 0
+	})
+	return iplist.New(ranges), nil
+}
+
+// Fetches the blocklist from ClientConfig.IPBlocklistURL, and replaces the current one if it's
+// valid. Existing connections are unaffected.
+func (cl *Client) updateIPBlocklist(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, cl.config.IPBlocklistURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response from %q: %v", cl.config.IPBlocklistURL, resp.Status)
+	}
+	ipl, err := parseIPBlocklist(resp.Body)
+	if err != nil {
+		return fmt.Errorf("parsing blocklist: %w", err)
+	}
+	cl.lock()
+	defer cl.unlock()
+	cl.ipBlockListUpdater.store(ipl)
+	cl.ipBlockListUpdated = time.Now()
+	return nil
+}
+
+func (cl *Client) ipBlocklistUpdater(ctx context.Context) {
+	for {
+		wait := cl.config.IPBlocklistUpdateInterval
+		if err := cl.updateIPBlocklist(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			cl.logger.Printf("error updating ip blocklist: %v", err)
+			if wait <= 0 || wait > maxIPBlocklistRetryInterval {
+				wait = maxIPBlocklistRetryInterval
+			}
+		} else if wait <= 0 {
+			// No periodic updates.
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
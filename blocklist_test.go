@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestParseIPBlocklist(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("# comment\n10.0.0.0/8\n\n1.2.3.0/24\n"),
+		[]byte("a:1.2.3.0-1.2.3.255\nb:10.0.0.0-10.255.255.255\n"),
+		gzipBytes([]byte("10.0.0.0/8\n1.2.3.0/24\n")),
+	} {
+		ipl, err := parseIPBlocklist(bytes.NewReader(b))
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, ipl.NumRanges())
+		_, ok := ipl.Lookup(net.ParseIP("10.1.2.3"))
+		assert.True(t, ok)
+		_, ok = ipl.Lookup(net.ParseIP("1.2.3.4"))
+		assert.True(t, ok)
+		_, ok = ipl.Lookup(net.ParseIP("1.2.4.4"))
+		assert.False(t, ok)
+	}
+}
+
+func TestIPBlocklistUpdate(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		status = http.StatusOK
+		body   = gzipBytes([]byte("1.2.3.0/24\n"))
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.IPBlocklistURL = s.URL
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	for cl.Stats().IPBlocklistUpdated.IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualValues(t, 1, cl.Stats().IPBlocklistRanges)
+	assert.True(t, cl.ipIsBlocked(net.ParseIP("1.2.3.4")))
+	mu.Lock()
+	body = []byte("a:5.6.7.0-5.6.7.255\nb:8.8.8.8-8.8.8.8\n")
+	mu.Unlock()
+	require.NoError(t, cl.updateIPBlocklist(context.Background()))
+	assert.EqualValues(t, 2, cl.Stats().IPBlocklistRanges)
+	assert.False(t, cl.ipIsBlocked(net.ParseIP("1.2.3.4")))
+	assert.True(t, cl.ipIsBlocked(net.ParseIP("5.6.7.8")))
+	// Failed updates keep the existing list.
+	updated := cl.Stats().IPBlocklistUpdated
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	require.Error(t, cl.updateIPBlocklist(context.Background()))
+	assert.EqualValues(t, 2, cl.Stats().IPBlocklistRanges)
+	assert.Equal(t, updated, cl.Stats().IPBlocklistUpdated)
+	assert.True(t, cl.ipIsBlocked(net.ParseIP("5.6.7.8")))
+}
@@ -0,0 +1,93 @@
+package torrent
+
+import (
+	"io"
+	"time"
+
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+// Functions the Client calls at points in its operation. Nil fields are skipped.
+type Callbacks struct {
+	// Transforms piece data before it's written to storage, such as to encrypt it at rest. off is
+	// the offset of data within the piece, and data may be modified in place. The returned slice
+	// must be the same length. It's called without the Client lock, possibly concurrently.
+	BeforePieceWrite func(t *Torrent, piece int, off int64, data []byte) []byte
+	// Reverses BeforePieceWrite on data read from storage, with the same conventions. All reads go
+	// through it, including those hashing pieces, so verification is of the original torrent data,
+	// never the stored form. Data already in storage that wasn't written through BeforePieceWrite
+	// fails verification.
+	AfterPieceRead func(t *Torrent, piece int, off int64, data []byte) []byte
+	// Called when a torrent has had no connected peers, and no successful tracker or DHT
+	// announces, for ClientConfig.TorrentStallTimeout. duration is how long it's been. It's called
+	// once per stall, in its own goroutine. The torrent can stall again once peers return and leave.
+	OnTorrentStalled func(t *Torrent, duration time.Duration)
+	// Called with each wire protocol message received from a peer, including keep-alives, before
+	// it's handled. Returning false drops the message as though it was never received. It's called
+	// with the Client lock held, from the connection's reader goroutine, so it mustn't block or
+	// call methods that take the lock. Piece data isn't valid after it returns.
+	IncomingMessage func(c *PeerConn, msg pp.Message) bool
+	// Called with each wire protocol message as it's queued for sending to a peer, with the same
+	// constraints as IncomingMessage. Returning false discards the message, but our state is
+	// updated as though it was sent, so a dropped request is left to time out, for example.
+	OutgoingMessage func(c *PeerConn, msg pp.Message) bool
+	// Called once for each connection added to a torrent, after the handshake and the peer's
+	// extended handshake, if it supports the extension protocol, so the peer's client name and
+	// extensions are known. It's called from the connection's reader goroutine without the Client
+	// lock held, and nothing more is read from the peer until it returns.
+	PeerConnected func(c *PeerConn)
+}
+
+// Calls Callbacks.PeerConnected if it hasn't been for the connection. The lock is released while
+// it runs.
+func (c *PeerConn) onConnected() {
+	f := c.t.callbacks.PeerConnected
+	if f == nil || c.connectedCallbackCalled {
+		return
+	}
+	c.connectedCallbackCalled = true
+	cl := c.t.cl
+	cl.unlock()
+	defer cl.lock()
+	f(c)
+}
+
+// Whether the incoming message should be handled, per Callbacks.IncomingMessage.
+func (c *PeerConn) allowIncomingMessage(msg pp.Message) bool {
+	if f := c.t.callbacks.IncomingMessage; f != nil {
+		return f(c, msg)
+	}
+	return true
+}
+
+// Writes the message to the write buffer, unless Callbacks.OutgoingMessage drops it.
+func (c *PeerConn) bufferMessage(msg pp.Message) {
+	if f := c.t.callbacks.OutgoingMessage; f != nil && !f(c, msg) {
+		return
+	}
+	c.writeBuffer.Write(msg.MustMarshalBinary())
+}
+
+// Writes to the piece's storage through Callbacks.BeforePieceWrite.
+func (p *Piece) writeStorage(b []byte, off int64) (int, error) {
+	if f := p.t.callbacks.BeforePieceWrite; f != nil {
+		// The caller's buffer isn't ours to transform.
+		b = f(p.t, int(p.index), off, append([]byte(nil), b...))
+	}
+	return p.Storage().WriteAt(b, off)
+}
+
+// Reads the piece's storage through Callbacks.AfterPieceRead.
+type pieceStorageReader struct {
+	p *Piece
+}
+
+var _ io.ReaderAt = pieceStorageReader{}
+
+func (me pieceStorageReader) ReadAt(b []byte, off int64) (n int, err error) {
+	n, err = me.p.Storage().ReadAt(b, off)
+	if f := me.p.t.callbacks.AfterPieceRead; f != nil && n != 0 {
+		copy(b[:n], f(me.p.t, int(me.p.index), off, b[:n]))
+	}
+	return
+}
@@ -5,10 +5,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -46,6 +48,10 @@ type Client struct {
 	// An aggregate of stats over all connections. First in struct to ensure
 	// 64-bit alignment of fields. See #262.
 	stats ConnStats
+	// Incoming connections rejected for not obfuscating their header when it's required.
+	plaintextConnsRejected Count
+	// Counts of ClientConfig.PeerClassifier decisions, by PeerDecision.
+	peerDecisions [numPeerDecisions]Count
 
 	_mu    lockWithDeferreds
 	event  sync.Cond
@@ -56,13 +62,33 @@ type Client struct {
 
 	peerID         PeerID
 	defaultStorage *storage.Client
-	onClose        []func()
-	dialers        []Dialer
-	listeners      []Listener
-	dhtServers     []DhtServer
-	ipBlockList    iplist.Ranger
+	// The piece completion of the default storage, if the Client created it. It's shared with
+	// storage for torrents added with their own data directory.
+	defaultPieceCompletion storage.PieceCompletion
+	onClose                []func()
+	dialers                []Dialer
+	listeners              []Listener
+	dhtServers             []DhtServer
+	ipBlockList            iplist.Ranger
+	// Set if the blocklist is updated from ClientConfig.IPBlocklistURL. It's also the ipBlockList.
+	ipBlockListUpdater *swappableRanger
+	ipBlockListUpdated time.Time
+	// UDP tracker announces waiting to be sent together, by tracker URL.
+	trackerAnnounceBatches map[string]*trackerAnnounceBatch
+	// The trackers last fetched from ClientConfig.TrackerListURL.
+	trackerList        []string
+	trackerListUpdated time.Time
 	// Our BitTorrent protocol extension bytes, sent in our BT handshakes.
 	extensionBytes pp.PeerExtensionBits
+	// Extensions added with RegisterExtension, by name and by our extended message ID.
+	extensions     map[pp.ExtensionName]*registeredExtension
+	extensionsById map[pp.ExtensionNumber]*registeredExtension
+	// Connections waiting on the upload rate limiter, served a chunk at a time in turn.
+	uploadQueue []*PeerConn
+
+	// Our external IPs as reported by trackers and peers.
+	externalIp4 externalIpVotes
+	externalIp6 externalIpVotes
 
 	// Set of addresses that have our client ID. This intentionally will
 	// include ourselves if we end up trying to connect to our own address
@@ -70,9 +96,29 @@ type Client struct {
 	dopplegangerAddrs map[string]struct{}
 	badPeerIPs        map[string]struct{}
 	torrents          map[InfoHash]*Torrent
+	// Torrents by their v2 infohash, for hybrid torrents once it's known.
+	torrentsV2 map[[sha256.Size]byte]*Torrent
 
 	acceptLimiter   map[ipStr]int
 	dialRateLimiter *rate.Limiter
+	// Torrent announces to DHT servers that are in progress.
+	activeDhtAnnounces int
+	downloadRate       rateEstimator
+	uploadRate         rateEstimator
+
+	// Tracker and DHT announces in progress, and those waiting to start, by discovery priority.
+	activeDiscovery  int
+	discoveryWaiting [numDiscoveryPriorities]int
+	// Tracker announces waiting on ClientConfig.TrackerStartedAnnounceRateLimiter.
+	startedAnnouncesWaiting int
+	// Set between Client.PauseAll and Client.ResumeAll. Torrents added meanwhile start paused.
+	pausedAll bool
+	// Established peer connections and their drops over all torrents.
+	connChurn connChurn
+	// Peer reputation by IP. See peer_reputation.go.
+	reputations map[string]peerReputation
+	// Torrents writing priorities to ClientConfig.PiecePriorityStore. Close waits for them.
+	priorityStores sync.WaitGroup
 }
 
 type ipStr string
@@ -162,6 +208,9 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 		cfg = NewDefaultClientConfig()
 		cfg.ListenPort = 0
 	}
+	if cfg.MaxPeerMessageLength < 0 {
+		return nil, errors.New("ClientConfig.MaxPeerMessageLength can't be negative")
+	}
 	defer func() {
 		if err != nil {
 			cl = nil
@@ -174,6 +223,7 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 		dialRateLimiter:   rate.NewLimiter(10, 10),
 	}
 	go cl.acceptLimitClearer()
+	go cl.rateSampler()
 	cl.initLogger()
 	defer func() {
 		if err == nil {
@@ -183,10 +233,13 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 	}()
 	cl.extensionBytes = defaultPeerExtensionBytes()
 	cl.event.L = cl.locker()
+	cl.loadPeerReputations()
+	cl.onClose = append(cl.onClose, cl.savePeerReputations)
 	storageImpl := cfg.DefaultStorage
 	if storageImpl == nil {
 		// We'd use mmap by default but HFS+ doesn't support sparse files.
-		storageImplCloser := storage.NewFile(cfg.DataDir)
+		cl.defaultPieceCompletion = storage.NewDefaultPieceCompletionForDir(cfg.DataDir)
+		storageImplCloser := storage.NewFileWithCompletion(cfg.DataDir, cl.defaultPieceCompletion)
 		cl.onClose = append(cl.onClose, func() {
 			if err := storageImplCloser.Close(); err != nil {
 				cl.logger.Printf("error closing default storage: %s", err)
@@ -198,6 +251,21 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 	if cfg.IPBlocklist != nil {
 		cl.ipBlockList = cfg.IPBlocklist
 	}
+	if cfg.IPBlocklistURL != "" && !cfg.DisableNetwork {
+		cl.ipBlockListUpdater = new(swappableRanger)
+		if cfg.IPBlocklist != nil {
+			cl.ipBlockListUpdater.store(cfg.IPBlocklist)
+		}
+		cl.ipBlockList = cl.ipBlockListUpdater
+		ctx, cancel := context.WithCancel(context.Background())
+		cl.onClose = append(cl.onClose, cancel)
+		go cl.ipBlocklistUpdater(ctx)
+	}
+	if cfg.TrackerListURL != "" && !cfg.DisableNetwork && !cfg.DisableTrackers {
+		ctx, cancel := context.WithCancel(context.Background())
+		cl.onClose = append(cl.onClose, cancel)
+		go cl.trackerListUpdater(ctx)
+	}
 
 	if cfg.PeerID != "" {
 		missinggo.CopyExact(&cl.peerID, cfg.PeerID)
@@ -209,7 +277,20 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 		}
 	}
 
-	sockets, err := listenAll(cl.listenNetworks(), cl.config.ListenHost, cl.config.ListenPort, cl.firewallCallback)
+	if cfg.DisableNetwork {
+		return
+	}
+
+	opts := cl.socketOpts()
+	for _, bufs := range []socketBufferSizes{opts.tcpBuffers, opts.utpBuffers} {
+		if err = bufs.validate(); err != nil {
+			return
+		}
+	}
+	if err = validateDscp(opts.dscp); err != nil {
+		return
+	}
+	sockets, err := listenAll(cl.listenNetworks(), cl.config.ListenHost, cl.config.ListenPort, cl.firewallCallback, opts)
 	if err != nil {
 		return
 	}
@@ -228,6 +309,9 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 	}
 
 	go cl.forwardPort()
+	if cfg.LocalServiceDiscovery {
+		cl.startLsd()
+	}
 	if !cfg.NoDHT {
 		for _, s := range sockets {
 			if pc, ok := s.(net.PacketConn); ok {
@@ -279,10 +363,10 @@ func (cl *Client) firewallCallback(net.Addr) bool {
 }
 
 func (cl *Client) listenOnNetwork(n network) bool {
-	if n.Ipv4 && cl.config.DisableIPv4 {
+	if n.Ipv4 && !ipv4Enabled(cl.config) {
 		return false
 	}
-	if n.Ipv6 && cl.config.DisableIPv6 {
+	if n.Ipv6 && !ipv6Enabled(cl.config) {
 		return false
 	}
 	if n.Tcp && cl.config.DisableTCP {
@@ -291,7 +375,19 @@ func (cl *Client) listenOnNetwork(n network) bool {
 	if n.Udp && cl.config.DisableUTP && cl.config.NoDHT {
 		return false
 	}
-	return true
+	return listenNetworksAllow(n, cl.config)
+}
+
+// Whether we connect to peers with the address's IP family.
+func (cl *Client) peerAddrFamilyEnabled(addr net.Addr) bool {
+	ip := addrIpOrNil(addr)
+	if ip == nil {
+		return true
+	}
+	if ip.To4() != nil {
+		return ipv4Enabled(cl.config)
+	}
+	return ipv6Enabled(cl.config)
 }
 
 func (cl *Client) listenNetworks() (ns []network) {
@@ -303,6 +399,33 @@ func (cl *Client) listenNetworks() (ns []network) {
 	return
 }
 
+func (cl *Client) dhtStartingNodes(network string) dht.StartingNodesGetter {
+	if cl.config.DhtBootstrapNodes == nil {
+		return cl.config.DhtStartingNodes(network)
+	}
+	var addrs []dht.Addr
+	for _, s := range cl.config.DhtBootstrapNodes {
+		ua, err := cl.resolveUDPAddr(context.Background(), network, s)
+		if err != nil {
+			cl.logger.Printf("error resolving dht bootstrap node %q: %v", s, err)
+			continue
+		}
+		addrs = append(addrs, dht.NewAddr(ua))
+	}
+	if !cl.config.DhtBootstrapIncludeDefaults {
+		return func() ([]dht.Addr, error) { return addrs, nil }
+	}
+	defaults := cl.config.DhtStartingNodes(network)
+	return func() ([]dht.Addr, error) {
+		ret, err := defaults()
+		ret = append(ret, addrs...)
+		if len(ret) != 0 {
+			err = nil
+		}
+		return ret, err
+	}
+}
+
 func (cl *Client) newAnacrolixDhtServer(conn net.PacketConn) (s *dht.Server, err error) {
 	cfg := dht.ServerConfig{
 		IPBlocklist:    cl.ipBlockList,
@@ -314,10 +437,10 @@ func (cl *Client) newAnacrolixDhtServer(conn net.PacketConn) (s *dht.Server, err
 			}
 			return cl.config.PublicIp4
 		}(),
-		StartingNodes:      cl.config.DhtStartingNodes(conn.LocalAddr().Network()),
+		StartingNodes:      cl.dhtStartingNodes(conn.LocalAddr().Network()),
 		ConnectionTracking: cl.config.ConnTracker,
 		OnQuery:            cl.config.DHTOnQuery,
-		Logger: cl.logger.WithText(func(m log.Msg) string {
+		Logger: cl.subsystemLogger(LogSubsystemDht).WithText(func(m log.Msg) string {
 			return fmt.Sprintf("dht server on %v: %s", conn.LocalAddr().String(), m.Text())
 		}),
 	}
@@ -350,11 +473,16 @@ func (cl *Client) eachDhtServer(f func(DhtServer)) {
 // come to a halt.
 func (cl *Client) Close() {
 	cl.lock()
-	defer cl.unlock()
 	cl.closed.Set()
 	for _, t := range cl.torrents {
 		t.close()
 	}
+	cl.unlock()
+	// Let the last priorities set be stored before the stores are closed, so they survive a
+	// restart.
+	cl.priorityStores.Wait()
+	cl.lock()
+	defer cl.unlock()
 	for i := range cl.onClose {
 		cl.onClose[len(cl.onClose)-1-i]()
 	}
@@ -401,11 +529,11 @@ func (cl *Client) rejectAccepted(conn net.Conn) error {
 		if cl.config.DisableIPv4Peers && rip.To4() != nil {
 			return errors.New("ipv4 peers disabled")
 		}
-		if cl.config.DisableIPv4 && len(rip) == net.IPv4len {
+		if !ipv4Enabled(cl.config) && len(rip) == net.IPv4len {
 			return errors.New("ipv4 disabled")
 
 		}
-		if cl.config.DisableIPv6 && len(rip) == net.IPv6len && rip.To4() == nil {
+		if !ipv6Enabled(cl.config) && len(rip) == net.IPv6len && rip.To4() == nil {
 			return errors.New("ipv6 disabled")
 		}
 		if cl.rateLimitAccept(rip) {
@@ -414,6 +542,12 @@ func (cl *Client) rejectAccepted(conn net.Conn) error {
 		if cl.badPeerIPPort(rip, missinggo.AddrPort(ra)) {
 			return errors.New("bad source addr")
 		}
+		if cl.classifyPeer(rip) == PeerDeny {
+			return errPeerDenied
+		}
+		if cl.rejectPeerReputation(rip) {
+			return errPeerReputation
+		}
 	}
 	return nil
 }
@@ -490,6 +624,8 @@ func (cl *Client) torrent(ih metainfo.Hash) *Torrent {
 type dialResult struct {
 	Conn    net.Conn
 	Network string
+	// Why the dial failed, if known.
+	Err error
 }
 
 func countDialResult(err error) {
@@ -515,7 +651,7 @@ func (cl *Client) dopplegangerAddr(addr string) bool {
 }
 
 // Returns a connection over UTP or TCP, whichever is first to connect.
-func (cl *Client) dialFirst(ctx context.Context, addr string) (res dialResult) {
+func (cl *Client) dialFirst(ctx context.Context, addr string, dialers []Dialer) (res dialResult) {
 	{
 		t := perf.NewTimer(perf.CallerName(0))
 		defer func() {
@@ -531,23 +667,19 @@ func (cl *Client) dialFirst(ctx context.Context, addr string) (res dialResult) {
 	defer cancel()
 	left := 0
 	resCh := make(chan dialResult, left)
-	func() {
-		cl.lock()
-		defer cl.unlock()
-		cl.eachDialer(func(s Dialer) bool {
-			func() {
-				left++
-				//cl.logger.Printf("dialing %s on %s/%s", addr, s.Addr().Network(), s.Addr())
-				go func() {
-					resCh <- dialResult{
-						cl.dialFromSocket(ctx, s, addr),
-						s.LocalAddr().Network(),
-					}
-				}()
-			}()
-			return true
-		})
-	}()
+	for _, s := range dialers {
+		s := s
+		left++
+		//cl.logger.Printf("dialing %s on %s/%s", addr, s.Addr().Network(), s.Addr())
+		go func() {
+			c, err := cl.dialFromSocket(ctx, s, addr)
+			resCh <- dialResult{
+				c,
+				s.LocalAddr().Network(),
+				err,
+			}
+		}()
+	}
 	// Wait for a successful connection.
 	func() {
 		defer perf.ScopeTimer()()
@@ -575,7 +707,7 @@ func (cl *Client) dialFirst(ctx context.Context, addr string) (res dialResult) {
 	return res
 }
 
-func (cl *Client) dialFromSocket(ctx context.Context, s Dialer, addr string) net.Conn {
+func (cl *Client) dialFromSocket(ctx context.Context, s Dialer, addr string) (net.Conn, error) {
 	network := s.LocalAddr().Network()
 	cte := cl.config.ConnTracker.Wait(
 		ctx,
@@ -589,7 +721,7 @@ func (cl *Client) dialFromSocket(ctx context.Context, s Dialer, addr string) net
 		if cte != nil {
 			cte.Forget()
 		}
-		return nil
+		return nil, ctx.Err()
 	}
 	c, err := s.Dial(ctx, addr)
 	// This is a bit optimistic, but it looks non-trivial to thread this through the proxy code. Set
@@ -604,13 +736,13 @@ func (cl *Client) dialFromSocket(ctx context.Context, s Dialer, addr string) net
 		} else {
 			cte.Done()
 		}
-		return nil
+		return nil, err
 	}
 	return closeWrapper{c, func() error {
 		err := c.Close()
 		cte.Done()
 		return err
-	}}
+	}}, nil
 }
 
 func forgettableDialError(err error) bool {
@@ -632,7 +764,7 @@ func (cl *Client) handshakesConnection(ctx context.Context, nc net.Conn, t *Torr
 ) (c *PeerConn, err error) {
 	c = cl.newConnection(nc, true, remoteAddr, network, connString)
 	c.headerEncrypted = encryptHeader
-	ctx, cancel := context.WithTimeout(ctx, cl.config.HandshakesTimeout)
+	ctx, cancel := context.WithDeadline(ctx, cl.handshakesDeadline(c))
 	defer cancel()
 	dl, ok := ctx.Deadline()
 	if !ok {
@@ -647,58 +779,77 @@ func (cl *Client) handshakesConnection(ctx context.Context, nc net.Conn, t *Torr
 }
 
 // Returns nil connection and nil error if no connection could be established for valid reasons.
-func (cl *Client) establishOutgoingConnEx(t *Torrent, addr net.Addr, obfuscatedHeader bool) (*PeerConn, error) {
-	dialCtx, cancel := context.WithTimeout(context.Background(), func() time.Duration {
+// The network is the transport that was used, if any. The dialers race, and if dialTimeout is zero,
+// the torrent's dial timeout is used.
+func (cl *Client) establishOutgoingConnEx(t *Torrent, addr net.Addr, obfuscatedHeader bool, dialers []Dialer, dialTimeout time.Duration) (_ *PeerConn, network string, _ error) {
+	if dialTimeout == 0 {
 		cl.rLock()
-		defer cl.rUnlock()
-		return t.dialTimeout()
-	}())
+		dialTimeout = t.dialTimeout()
+		cl.rUnlock()
+	}
+	dialCtx, cancel := context.WithTimeout(context.Background(), dialTimeout)
 	defer cancel()
-	dr := cl.dialFirst(dialCtx, addr.String())
+	dr := cl.dialFirst(dialCtx, addr.String(), dialers)
 	nc := dr.Conn
 	if nc == nil {
 		if dialCtx.Err() != nil {
-			return nil, xerrors.Errorf("dialing: %w", dialCtx.Err())
+			return nil, dr.Network, xerrors.Errorf("dialing: %w", dialCtx.Err())
+		}
+		if dr.Err != nil {
+			return nil, dr.Network, xerrors.Errorf("dialing: %w", dr.Err)
 		}
-		return nil, errors.New("dial failed")
+		return nil, dr.Network, errors.New("dial failed")
 	}
 	c, err := cl.handshakesConnection(context.Background(), nc, t, obfuscatedHeader, addr, dr.Network, regularConnString(nc))
 	if err != nil {
 		nc.Close()
 	}
-	return c, err
+	return c, dr.Network, err
 }
 
 // Returns nil connection and nil error if no connection could be established
 // for valid reasons.
-func (cl *Client) establishOutgoingConn(t *Torrent, addr net.Addr) (c *PeerConn, err error) {
+func (cl *Client) establishOutgoingConn(t *Torrent, addr net.Addr) (c *PeerConn, network string, err error) {
 	torrent.Add("establish outgoing connection", 1)
-	obfuscatedHeaderFirst := cl.config.HeaderObfuscationPolicy.Preferred
-	c, err = cl.establishOutgoingConnEx(t, addr, obfuscatedHeaderFirst)
-	if err == nil {
-		torrent.Add("initiated conn with preferred header obfuscation", 1)
-		return
+	if len(cl.config.DialEscalation) != 0 {
+		return cl.establishOutgoingConnEscalating(t, addr)
 	}
-	//cl.logger.Printf("error establishing connection to %s (obfuscatedHeader=%t): %v", addr, obfuscatedHeaderFirst, err)
-	if cl.config.HeaderObfuscationPolicy.RequirePreferred {
-		// We should have just tried with the preferred header obfuscation. If it was required,
-		// there's nothing else to try.
-		return
-	}
-	// Try again with encryption if we didn't earlier, or without if we did.
-	c, err = cl.establishOutgoingConnEx(t, addr, !obfuscatedHeaderFirst)
-	if err == nil {
-		torrent.Add("initiated conn with fallback header obfuscation", 1)
+	cl.rLock()
+	dialers := t.peerDialers()
+	cl.rUnlock()
+	for i, obfuscatedHeader := range outgoingHeaderObfuscationAttempts(cl.config.HeaderObfuscationPolicy) {
+		c, network, err = cl.establishOutgoingConnEx(t, addr, obfuscatedHeader, dialers, 0)
+		if err == nil {
+			if i == 0 {
+				torrent.Add("initiated conn with preferred header obfuscation", 1)
+			} else {
+				torrent.Add("initiated conn with fallback header obfuscation", 1)
+			}
+			if c != nil {
+				c.dialAttempt = i + 1
+			}
+			return
+		}
+		//cl.logger.Printf("error establishing connection to %s (obfuscatedHeader=%t): %v", addr, obfuscatedHeader, err)
 	}
-	//cl.logger.Printf("error establishing fallback connection to %v: %v", addr, err)
 	return
 }
 
+// Returns whether to obfuscate the header for each attempt at an outgoing connection, in order.
+// If the preferred obfuscation is required, there's nothing to fall back to.
+func outgoingHeaderObfuscationAttempts(policy HeaderObfuscationPolicy) []bool {
+	if policy.RequirePreferred {
+		return []bool{policy.Preferred}
+	}
+	// Try again with encryption if we didn't first, or without if we did.
+	return []bool{policy.Preferred, !policy.Preferred}
+}
+
 // Called to dial out and run a connection. The addr we're given is already
 // considered half-open.
 func (cl *Client) outgoingConnection(t *Torrent, addr net.Addr, ps PeerSource, trusted bool) {
 	cl.dialRateLimiter.Wait(context.Background())
-	c, err := cl.establishOutgoingConn(t, addr)
+	c, network, err := cl.establishOutgoingConn(t, addr)
 	cl.lock()
 	defer cl.unlock()
 	// Don't release lock between here and addConnection, unless it's for
@@ -708,6 +859,15 @@ func (cl *Client) outgoingConnection(t *Torrent, addr net.Addr, ps PeerSource, t
 		if cl.config.Debug {
 			cl.logger.Printf("error establishing outgoing connection to %v: %v", addr, err)
 		}
+		t.onConnFailure(ConnFailure{
+			Addr:    addr,
+			Network: network,
+			Reason:  connFailureReason(err),
+			Err:     err,
+		})
+		if ps != PeerSourceUtHolepunch {
+			t.startHolepunchRendezvous(addr)
+		}
 		return
 	}
 	defer c.close()
@@ -716,6 +876,39 @@ func (cl *Client) outgoingConnection(t *Torrent, addr net.Addr, ps PeerSource, t
 	cl.runHandshookConn(c, t)
 }
 
+// The chunk size for torrents that don't specify their own, per ClientConfig.ChunkSize.
+func (cl *Client) chunkSize() pp.Integer {
+	if cl.config.ChunkSize == 0 {
+		return defaultChunkSize
+	}
+	return pp.Integer(clamp(minChunkSize, int64(cl.config.ChunkSize), maxChunkSize))
+}
+
+// The largest request we accept from peers, which is the larger of the configured chunk size and
+// the usual 16KiB.
+func (cl *Client) maxPeerRequestLength() pp.Integer {
+	if cs := cl.chunkSize(); cs > defaultChunkSize {
+		return cs
+	}
+	return defaultChunkSize
+}
+
+// The longest wire protocol message we read from peers, per ClientConfig.MaxPeerMessageLength.
+func (cl *Client) maxPeerMessageLength() pp.Integer {
+	if cl.config.MaxPeerMessageLength == 0 {
+		return defaultMaxPeerMessageLength
+	}
+	return pp.Integer(clamp(0, int64(cl.config.MaxPeerMessageLength), math.MaxUint32))
+}
+
+// The most requests queued from a peer, per ClientConfig.MaxPeerRequests.
+func (cl *Client) maxPeerRequests() int {
+	if cl.config.MaxPeerRequests <= 0 {
+		return maxRequests
+	}
+	return cl.config.MaxPeerRequests
+}
+
 // The port number for incoming peer connections. 0 if the client isn't listening.
 func (cl *Client) incomingPeerPort() int {
 	return cl.LocalPort()
@@ -736,15 +929,15 @@ func (cl *Client) initiateHandshakes(c *PeerConn, t *Torrent) error {
 		)
 		c.setRW(rw)
 		if err != nil {
-			return xerrors.Errorf("header obfuscation handshake: %w", err)
+			return connFailureError{ConnFailureHeaderObfuscation, xerrors.Errorf("header obfuscation handshake: %w", err)}
 		}
 	}
 	ih, err := cl.connBtHandshake(c, &t.infoHash)
 	if err != nil {
-		return xerrors.Errorf("bittorrent protocol handshake: %w", err)
+		return connFailureError{ConnFailureHandshake, xerrors.Errorf("bittorrent protocol handshake: %w", err)}
 	}
 	if ih != t.infoHash {
-		return errors.New("bittorrent protocol handshake: peer infohash didn't match")
+		return connFailureError{ConnFailureHandshake, errors.New("bittorrent protocol handshake: peer infohash didn't match")}
 	}
 	return nil
 }
@@ -785,6 +978,9 @@ func (cl *Client) receiveHandshakes(c *PeerConn) (t *Torrent, err error) {
 		} else {
 			torrent.Add("handshakes received unencrypted", 1)
 		}
+	} else if err == errPlaintextRejected {
+		torrent.Add("handshakes received unencrypted and rejected", 1)
+		cl.plaintextConnsRejected.Add(1)
 	} else {
 		torrent.Add("handshakes received with error while handling encryption", 1)
 	}
@@ -822,7 +1018,7 @@ func (cl *Client) connBtHandshake(c *PeerConn, ih *metainfo.Hash) (ret metainfo.
 }
 
 func (cl *Client) runReceivedConn(c *PeerConn) {
-	err := c.conn.SetDeadline(time.Now().Add(cl.config.HandshakesTimeout))
+	err := c.conn.SetDeadline(cl.handshakesDeadline(c))
 	if err != nil {
 		panic(err)
 	}
@@ -854,6 +1050,55 @@ func (cl *Client) runReceivedConn(c *PeerConn) {
 	cl.runHandshookConn(c, t)
 }
 
+// Returns when the encryption and BitTorrent handshakes for the connection must be completed by.
+func (cl *Client) handshakesDeadline(c *PeerConn) time.Time {
+	ret := time.Now().Add(cl.config.HandshakesTimeout)
+	if timeout := cl.config.ConnEstablishmentTimeout; timeout != 0 {
+		if est := c.opened.Add(timeout); est.Before(ret) {
+			ret = est
+		}
+	}
+	return ret
+}
+
+// Drops the connection if the peer's extended handshake isn't received before the connection
+// establishment timeout expires. The returned func stops the check.
+func (cl *Client) limitExtendedHandshake(c *PeerConn) (stop func() bool) {
+	timeout := cl.config.ConnEstablishmentTimeout
+	if timeout == 0 || !c.PeerExtensionBytes.SupportsExtended() || !cl.extensionBytes.SupportsExtended() {
+		return func() bool { return false }
+	}
+	return time.AfterFunc(time.Until(c.opened.Add(timeout)), func() {
+		cl.lock()
+		defer cl.unlock()
+		if c.PeerExtensionIDs == nil && !c.closed.IsSet() {
+			torrent.Add("extended handshake timeouts", 1)
+			c.logger.Printf("timed out waiting for extended handshake")
+			c.closeWithReason(ConnDropHandshakeTimeout)
+		}
+	}).Stop
+}
+
+// Returns how long a connection may go without sending before a keepalive is sent.
+func (cl *Client) keepAliveInterval() time.Duration {
+	if d := cl.config.KeepAliveInterval; d > 0 {
+		return d
+	}
+	return defaultKeepAliveInterval
+}
+
+// Returns how long a connection may go without receiving anything. Zero means there's no limit.
+func (cl *Client) peerIdleTimeout() time.Duration {
+	switch d := cl.config.PeerIdleTimeout; {
+	case d < 0:
+		return 0
+	case d == 0:
+		return defaultPeerIdleTimeout
+	default:
+		return d
+	}
+}
+
 // Client lock must be held before entering this.
 func (cl *Client) runHandshookConn(c *PeerConn, t *Torrent) {
 	c.setTorrent(t)
@@ -870,7 +1115,7 @@ func (cl *Client) runHandshookConn(c *PeerConn, t *Torrent) {
 		return
 	}
 	c.conn.SetWriteDeadline(time.Time{})
-	c.r = deadlineReader{c.conn, c.r}
+	c.r = deadlineReader{c.conn, c.r, cl.peerIdleTimeout()}
 	completedHandshakeConnectionFlags.Add(c.connectionFlags(), 1)
 	if connIsIpv6(c.conn) {
 		torrent.Add("completed handshake over ipv6", 1)
@@ -880,9 +1125,15 @@ func (cl *Client) runHandshookConn(c *PeerConn, t *Torrent) {
 		return
 	}
 	defer t.dropConnection(c)
-	go c.writer(time.Minute)
+	defer cl.limitExtendedHandshake(c)()
+	go c.writer(cl.keepAliveInterval())
 	cl.sendInitialMessages(c, t)
+	if !c.PeerExtensionBytes.SupportsExtended() || !cl.extensionBytes.SupportsExtended() {
+		// There won't be an extended handshake.
+		c.onConnected()
+	}
 	err := c.mainReadLoop()
+	c.setDropReason(connDropReasonForReadErr(err))
 	if err != nil && cl.config.Debug {
 		cl.logger.Printf("error during connection main read loop: %s", err)
 	}
@@ -897,10 +1148,13 @@ func (cl *Client) sendInitialMessages(conn *PeerConn, torrent *Torrent) {
 			ExtendedPayload: func() []byte {
 				msg := pp.ExtendedHandshakeMessage{
 					M: map[pp.ExtensionName]pp.ExtensionNumber{
-						pp.ExtensionNameMetadata: metadataExtendedId,
+						pp.ExtensionNameMetadata:    metadataExtendedId,
+						pp.ExtensionNameDontHave:    dontHaveExtendedId,
+						pp.ExtensionNameUtHolepunch: utHolepunchExtendedId,
+						pp.ExtensionNameSettings:    settingsExtendedId,
 					},
 					V:            cl.config.ExtendedHandshakeClientVersion,
-					Reqq:         64, // TODO: Really?
+					Reqq:         int(min(64, int64(cl.maxPeerRequests()))), // TODO: Really?
 					YourIp:       pp.CompactIp(addrIpOrNil(conn.remoteAddr)),
 					Encryption:   cl.config.HeaderObfuscationPolicy.Preferred || !cl.config.HeaderObfuscationPolicy.RequirePreferred,
 					Port:         cl.incomingPeerPort(),
@@ -909,17 +1163,24 @@ func (cl *Client) sendInitialMessages(conn *PeerConn, torrent *Torrent) {
 					// used.
 					Ipv4: pp.CompactIp(cl.config.PublicIp4.To4()),
 					Ipv6: cl.config.PublicIp6.To16(),
+					Settings: &pp.ExtendedHandshakeSettings{
+						BlockSize:   int(cl.maxPeerRequestLength()),
+						MaxRequests: cl.maxPeerRequests(),
+					},
 				}
-				if !cl.config.DisablePEX {
+				if !cl.config.DisablePEX && !torrent.private() {
 					msg.M[pp.ExtensionNamePex] = pexExtendedId
 				}
+				for name, re := range cl.extensions {
+					msg.M[name] = re.id
+				}
 				return bencode.MustMarshal(msg)
 			}(),
 		})
 	}
 	func() {
 		if conn.fastEnabled() {
-			if torrent.haveAllPieces() {
+			if torrent.haveAllPieces() && !cl.config.DisableHaveAllForSeeds {
 				conn.post(pp.Message{Type: pp.HaveAll})
 				conn.sentHaves.AddRange(0, bitmap.BitIndex(conn.t.NumPieces()))
 				return
@@ -977,17 +1238,11 @@ func (cl *Client) gotMetadataExtensionMsg(payload []byte, t *Torrent, c *PeerCon
 		if begin < 0 || begin >= len(payload) {
 			return fmt.Errorf("data has bad offset in payload: %d", begin)
 		}
-		t.saveMetadataPiece(piece, payload[begin:])
+		t.saveMetadataPiece(piece, payload[begin:], c)
 		c.lastUsefulChunkReceived = time.Now()
 		return t.maybeCompleteMetadata()
 	case pp.RequestMetadataExtensionMsgType:
-		if !t.haveMetadataPiece(piece) {
-			c.post(t.newMetadataExtensionMessage(c, pp.RejectMetadataExtensionMsgType, d["piece"], nil))
-			return nil
-		}
-		start := (1 << 14) * piece
-		c.logger.Printf("sending metadata piece %d", piece)
-		c.post(t.newMetadataExtensionMessage(c, pp.DataMetadataExtensionMsgType, piece, t.metadataBytes[start:start+t.metadataPieceSize(piece)]))
+		c.serveMetadataPiece(piece)
 		return nil
 	case pp.RejectMetadataExtensionMsgType:
 		return nil
@@ -1010,6 +1265,9 @@ func (cl *Client) badPeerIPPort(ip net.IP, port int) bool {
 	if cl.dopplegangerAddr(net.JoinHostPort(ip.String(), strconv.FormatInt(int64(port), 10))) {
 		return true
 	}
+	if cl.isExternalAddr(ip, port) {
+		return true
+	}
 	if _, ok := cl.ipBlockRange(ip); ok {
 		return true
 	}
@@ -1033,7 +1291,7 @@ func (cl *Client) newTorrent(ih metainfo.Hash, specStorage storage.ClientImpl) (
 		peers: prioritizedPeers{
 			om: btree.New(32),
 			getPrio: func(p Peer) peerPriority {
-				return bep40PriorityIgnoreError(cl.publicAddr(addrIpOrNil(p.Addr)), p.addr())
+				return t.peerDialPriority(p)
 			},
 		},
 		conns: make(map[*PeerConn]struct{}, 2*cl.config.EstablishedConnsPerTorrent),
@@ -1043,6 +1301,7 @@ func (cl *Client) newTorrent(ih metainfo.Hash, specStorage storage.ClientImpl) (
 
 		storageOpener:       storageClient,
 		maxEstablishedConns: cl.config.EstablishedConnsPerTorrent,
+		callbacks:           cl.config.Callbacks,
 
 		networkingEnabled: true,
 		metadataChanged: sync.Cond{
@@ -1051,10 +1310,8 @@ func (cl *Client) newTorrent(ih metainfo.Hash, specStorage storage.ClientImpl) (
 	}
 	t._pendingPieces.NewSet = priorityBitmapStableNewSet
 	t.requestStrategy = cl.config.DefaultRequestStrategy(t.requestStrategyCallbacks(), &cl._mu)
-	t.logger = cl.logger.WithValues(t).WithText(func(m log.Msg) string {
-		return fmt.Sprintf("%v: %s", t, m.Text())
-	})
-	t.setChunkSize(defaultChunkSize)
+	t.logger = t.wrapLogger(cl.logger)
+	t.setChunkSize(cl.chunkSize())
 	return
 }
 
@@ -1076,6 +1333,10 @@ func (cl *Client) AddTorrentInfoHash(infoHash metainfo.Hash) (t *Torrent, new bo
 func (cl *Client) AddTorrentInfoHashWithStorage(infoHash metainfo.Hash, specStorage storage.ClientImpl) (t *Torrent, new bool) {
 	cl.lock()
 	defer cl.unlock()
+	return cl.addTorrentInfoHashWithStorage(infoHash, specStorage)
+}
+
+func (cl *Client) addTorrentInfoHashWithStorage(infoHash metainfo.Hash, specStorage storage.ClientImpl) (t *Torrent, new bool) {
 	t, ok := cl.torrents[infoHash]
 	if ok {
 		return
@@ -1087,36 +1348,97 @@ func (cl *Client) AddTorrentInfoHashWithStorage(infoHash metainfo.Hash, specStor
 		go t.dhtAnnouncer(s)
 	})
 	cl.torrents[infoHash] = t
+	if cl.pausedAll {
+		t.pause()
+		t.pausedByClient = true
+	}
 	cl.clearAcceptLimits()
 	t.updateWantPeersEvent()
+	t.startStallTimer()
+	t.startRateHistory()
 	// Tickle Client.waitAccept, new torrent may want conns.
 	cl.event.Broadcast()
 	return
 }
 
 // Add or merge a torrent spec. If the torrent is already present, the
-// trackers will be merged with the existing ones. If the Info isn't yet
+// trackers, web seeds and DHT nodes will be merged with the existing ones. If the Info isn't yet
 // known, it will be set. The display name is replaced if the new spec
 // provides one. Returns new if the torrent wasn't already in the client.
-// Note that any `Storage` defined on the spec will be ignored if the
-// torrent is already present (i.e. `new` return value is `true`)
+// Note that any `Storage`, `DataDir`, `Dialers` or `TrackerDialContext` defined on the spec will be
+// ignored if the torrent is already present (i.e. `new` return value is `false`). If
+// ClientConfig.DisableTorrentMerging is set, only a missing Info is taken from the spec.
 func (cl *Client) AddTorrentSpec(spec *TorrentSpec) (t *Torrent, new bool, err error) {
-	t, new = cl.AddTorrentInfoHashWithStorage(spec.InfoHash, spec.Storage)
-	if spec.DisplayName != "" {
-		t.SetDisplayName(spec.DisplayName)
+	specStorage := spec.Storage
+	if specStorage == nil && spec.DataDir != "" {
+		if cl.defaultPieceCompletion == nil {
+			err = errors.New("TorrentSpec.DataDir requires the default storage, use TorrentSpec.Storage instead")
+			return
+		}
+		// The piece completion is owned by the default storage, so this doesn't need closing.
+		specStorage = storage.NewFileWithCompletion(spec.DataDir, cl.defaultPieceCompletion)
 	}
-	if spec.InfoBytes != nil {
-		err = t.SetInfoBytes(spec.InfoBytes)
+	var localIpDialer Dialer
+	if spec.PeerLocalIp != nil {
+		if spec.Dialers != nil {
+			err = errors.New("TorrentSpec.PeerLocalIp can't be used with TorrentSpec.Dialers")
+			return
+		}
+		localIpDialer, err = cl.localIpDialer(spec.PeerLocalIp)
 		if err != nil {
 			return
 		}
 	}
+	// The lock is held throughout so that nothing sees the torrent before the spec is applied,
+	// such as announcing a private torrent to the DHT before its info is set.
 	cl.lock()
 	defer cl.unlock()
+	infoHash, err := cl.specInfoHash(spec)
+	if err != nil {
+		return
+	}
+	t, new = cl.addTorrentInfoHashWithStorage(infoHash, specStorage)
+	if spec.InfoHashV2 != ([sha256.Size]byte{}) && !t.haveInfo() {
+		t.setInfoHashV2(spec.InfoHashV2)
+	}
+	if new {
+		t.dialers = spec.Dialers
+		t.localIpDialer = localIpDialer
+		t.trackerDialContext = spec.TrackerDialContext
+	} else if cl.config.DisableTorrentMerging {
+		if spec.InfoBytes != nil && !t.haveInfo() {
+			err = t.setInfoBytes(spec.InfoBytes)
+		}
+		return
+	}
+	if spec.SeedOnly {
+		t.seedOnly = true
+		t.updateWantPeersEvent()
+		for c := range t.conns {
+			c.updateRequests()
+		}
+	}
+	if spec.DisplayName != "" {
+		t.SetDisplayName(spec.DisplayName)
+	}
+	// Setting the info again would reopen the storage.
+	if spec.InfoBytes != nil && !t.haveInfo() {
+		err = t.setInfoBytes(spec.InfoBytes)
+		if err != nil {
+			return
+		}
+	}
 	if spec.ChunkSize != 0 {
 		t.setChunkSize(pp.Integer(spec.ChunkSize))
 	}
 	t.addTrackers(spec.Trackers)
+	if err := t.addWebSeeds(spec.Webseeds, false); err != nil {
+		t.logger.Printf("%v", err)
+	}
+	if err := t.addWebSeeds(spec.HttpSeeds, true); err != nil {
+		t.logger.Printf("%v", err)
+	}
+	t.addDhtNodes(spec.DhtNodes)
 	t.maybeNewConns()
 	return
 }
@@ -1132,6 +1454,7 @@ func (cl *Client) dropTorrent(infoHash metainfo.Hash) (err error) {
 		panic(err)
 	}
 	delete(cl.torrents, infoHash)
+	t.deleteInfoHashV2()
 	return
 }
 
@@ -1147,6 +1470,45 @@ func (cl *Client) allTorrentsCompleted() bool {
 	return true
 }
 
+// Pauses every torrent, including those added until ResumeAll is called. Torrents that were already
+// paused aren't resumed by ResumeAll.
+func (cl *Client) PauseAll() {
+	cl.lock()
+	defer cl.unlock()
+	if cl.pausedAll {
+		return
+	}
+	cl.pausedAll = true
+	for _, t := range cl.torrents {
+		if t.paused.IsSet() {
+			continue
+		}
+		t.pause()
+		t.pausedByClient = true
+	}
+}
+
+// Resumes the torrents paused by PauseAll. Their started announces are subject to
+// ClientConfig.TrackerStartedAnnounceRateLimiter, so a limit there spreads them out.
+func (cl *Client) ResumeAll() {
+	cl.lock()
+	defer cl.unlock()
+	cl.pausedAll = false
+	for _, t := range cl.torrents {
+		if !t.pausedByClient {
+			continue
+		}
+		t.resume()
+	}
+}
+
+// Returns whether PauseAll is in effect.
+func (cl *Client) AllPaused() bool {
+	cl.rLock()
+	defer cl.rUnlock()
+	return cl.pausedAll
+}
+
 // Returns true when all torrents are completely downloaded and false if the
 // client is stopped before that.
 func (cl *Client) WaitAll() bool {
@@ -1168,6 +1530,18 @@ func (cl *Client) Torrents() []*Torrent {
 	return cl.torrentsAsSlice()
 }
 
+// Returns handles to the torrents with the given label. See Torrent.SetLabel.
+func (cl *Client) TorrentsByLabel(label string) (ret []*Torrent) {
+	cl.rLock()
+	defer cl.rUnlock()
+	for _, t := range cl.torrents {
+		if t.label == label {
+			ret = append(ret, t)
+		}
+	}
+	return
+}
+
 func (cl *Client) torrentsAsSlice() (ret []*Torrent) {
 	for _, t := range cl.torrents {
 		ret = append(ret, t)
@@ -1184,11 +1558,42 @@ func (cl *Client) AddMagnet(uri string) (T *Torrent, err error) {
 	return
 }
 
-func (cl *Client) AddTorrent(mi *metainfo.MetaInfo) (T *Torrent, err error) {
-	T, _, err = cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
-	var ss []string
-	slices.MakeInto(&ss, mi.Nodes)
-	cl.AddDHTNodes(ss)
+// Adds the magnet, and waits until the torrent has its info, the torrent is closed, or the context
+// is done. If the torrent was added by this call and doesn't get its info, it's dropped.
+func (cl *Client) AddTorrentMagnetContext(ctx context.Context, uri string) (*Torrent, error) {
+	spec, err := TorrentSpecFromMagnetURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	t, new, err := cl.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-t.GotInfo():
+		return t, nil
+	case <-t.Closed():
+		return nil, errors.New("torrent closed")
+	case <-ctx.Done():
+	}
+	select {
+	case <-t.GotInfo():
+		// The info arrived as the context finished.
+		return t, nil
+	default:
+	}
+	if new {
+		t.Drop()
+	}
+	return nil, ctx.Err()
+}
+
+// Adds the torrent, or returns the existing one with the same infohash, with existed set. An
+// existing torrent gets the metainfo's trackers, web seeds and nodes merged in, as for
+// AddTorrentSpec.
+func (cl *Client) AddTorrent(mi *metainfo.MetaInfo) (T *Torrent, existed bool, err error) {
+	T, new, err := cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	existed = T != nil && !new
 	return
 }
 
@@ -1197,33 +1602,61 @@ func (cl *Client) AddTorrentFromFile(filename string) (T *Torrent, err error) {
 	if err != nil {
 		return
 	}
-	return cl.AddTorrent(mi)
+	T, _, err = cl.AddTorrent(mi)
+	return
 }
 
 func (cl *Client) DhtServers() []DhtServer {
 	return cl.dhtServers
 }
 
+// Adds nodes given as "host:port" to the DHT servers. Host names are resolved in the background.
 func (cl *Client) AddDHTNodes(nodes []string) {
 	for _, n := range nodes {
 		hmp := missinggo.SplitHostMaybePort(n)
+		if hmp.Err != nil || hmp.NoPort || hmp.Host == "" {
+			cl.logger.Printf("won't add bad DHT node %q", n)
+			continue
+		}
 		ip := net.ParseIP(hmp.Host)
 		if ip == nil {
-			cl.logger.Printf("won't add DHT node with bad IP: %q", hmp.Host)
+			go cl.addDhtNodeHost(hmp.Host, hmp.Port)
 			continue
 		}
-		ni := krpc.NodeInfo{
-			Addr: krpc.NodeAddr{
-				IP:   ip,
-				Port: hmp.Port,
-			},
-		}
-		cl.eachDhtServer(func(s DhtServer) {
-			s.AddNode(ni)
-		})
+		cl.addDhtNode(ip, hmp.Port)
+	}
+}
+
+func (cl *Client) addDhtNodeHost(host string, port int) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		cl.logger.Printf("won't add DHT node %q: %v", host, err)
+		return
+	}
+	for _, ip := range ips {
+		cl.addDhtNode(ip, port)
 	}
 }
 
+func (cl *Client) addDhtNode(ip net.IP, port int) {
+	cl.addDhtNodeInfo(krpc.NodeInfo{
+		Addr: krpc.NodeAddr{
+			IP:   ip,
+			Port: port,
+		},
+	})
+}
+
+func (cl *Client) addDhtNodeInfo(ni krpc.NodeInfo) {
+	cl.eachDhtServer(func(s DhtServer) {
+		if cl.dhtServerFull(s) {
+			torrent.Add("dht nodes not added over limit", 1)
+			return
+		}
+		s.AddNode(ni)
+	})
+}
+
 func (cl *Client) banPeerIP(ip net.IP) {
 	cl.logger.Printf("banning ip %v", ip)
 	if cl.badPeerIPs == nil {
@@ -1243,15 +1676,21 @@ func (cl *Client) newConnection(nc net.Conn, outgoing bool, remoteAddr net.Addr,
 		remoteAddr:      remoteAddr,
 		network:         network,
 		connString:      connString,
+		opened:          time.Now(),
 	}
-	c.logger = cl.logger.WithValues(c).WithDefaultLevel(log.Debug).WithText(func(m log.Msg) string {
+	c.logger = cl.subsystemLogger(LogSubsystemPeerConn).WithValues(c).WithDefaultLevel(log.Debug).WithText(func(m log.Msg) string {
 		return fmt.Sprintf("%v: %s", c, m.Text())
 	})
 	c.writerCond.L = cl.locker()
 	c.setRW(connStatsReadWriter{nc, c})
+	c.downloadLimiter = newConnLimiter()
+	c.uploadLimiter = newConnLimiter()
 	c.r = &rateLimitedReader{
 		l: cl.config.DownloadRateLimiter,
-		r: c.r,
+		r: &rateLimitedReader{
+			l: c.downloadLimiter,
+			r: c.r,
+		},
 	}
 	c.logger.Printf("initialized with remote %v over network %v (outgoing=%t)", remoteAddr, network, outgoing)
 	return
@@ -1261,7 +1700,7 @@ func (cl *Client) onDHTAnnouncePeer(ih metainfo.Hash, ip net.IP, port int, portO
 	cl.lock()
 	defer cl.unlock()
 	t := cl.torrent(ih)
-	if t == nil {
+	if t == nil || t.private() {
 		return
 	}
 	t.addPeers([]Peer{{
@@ -1279,14 +1718,6 @@ func firstNotNil(ips ...net.IP) net.IP {
 	return nil
 }
 
-func (cl *Client) eachDialer(f func(Dialer) bool) {
-	for _, s := range cl.dialers {
-		if !f(s) {
-			break
-		}
-	}
-}
-
 func (cl *Client) eachListener(f func(Listener) bool) {
 	for _, s := range cl.listeners {
 		if !f(s) {
@@ -1308,16 +1739,64 @@ func (cl *Client) publicIp(peer net.IP) net.IP {
 	if peer.To4() != nil {
 		return firstNotNil(
 			cl.config.PublicIp4,
+			cl.externalIp4.ip,
 			cl.findListenerIp(func(ip net.IP) bool { return ip.To4() != nil }),
 		)
 	}
 
 	return firstNotNil(
 		cl.config.PublicIp6,
+		cl.externalIp6.ip,
 		cl.findListenerIp(func(ip net.IP) bool { return ip.To4() == nil }),
 	)
 }
 
+func (cl *Client) resolver() *net.Resolver {
+	if cl.config.Resolver != nil {
+		return cl.config.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Resolves a "host:port" address on a UDP network with the configured resolver.
+func (cl *Client) resolveUDPAddr(ctx context.Context, network, addr string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := cl.resolver().LookupPort(ctx, network, portStr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := cl.resolver().LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.IP.To4() == nil && network == "udp4" || ip.IP.To4() != nil && network == "udp6" {
+			continue
+		}
+		return &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}, nil
+	}
+	return nil, fmt.Errorf("no %v addresses for %q", network, host)
+}
+
+// The IPv4 address announced to trackers, if IPv4 is enabled.
+func (cl *Client) announceIp4() net.IP {
+	if !ipv4Enabled(cl.config) {
+		return nil
+	}
+	return firstNotNil(cl.config.PublicIp4, cl.externalIp4.ip)
+}
+
+// The IPv6 address announced to trackers, if IPv6 is enabled.
+func (cl *Client) announceIp6() net.IP {
+	if !ipv6Enabled(cl.config) {
+		return nil
+	}
+	return firstNotNil(cl.config.PublicIp6, cl.externalIp6.ip)
+}
+
 func (cl *Client) findListenerIp(f func(net.IP) bool) net.IP {
 	l := cl.findListener(
 		func(l net.Listener) bool {
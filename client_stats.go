@@ -0,0 +1,234 @@
+package torrent
+
+import (
+	"math"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+)
+
+// Due to ConnStats, may require special alignment on some platforms. See
+// https://github.com/anacrolix/torrent/issues/383.
+type ClientStats struct {
+	// Aggregates stats over all connections past and present.
+	ConnStats
+
+	// Aggregated over all the Client's DHT servers, such as when both IPv4 and IPv6 are in use.
+	Dht DhtStats
+
+	Torrents TorrentCounts
+	// Torrent data transfer rates over all connections in bytes per second. These are
+	// exponentially weighted moving averages, updated every rateSampleInterval.
+	DownloadRate float64
+	UploadRate   float64
+	// The completed fraction of the torrents with info, weighted by their lengths.
+	Completion float64
+
+	// Ranges in the IP blocklist in use, and when it was last updated from
+	// ClientConfig.IPBlocklistURL.
+	IPBlocklistRanges  int
+	IPBlocklistUpdated time.Time
+	// When the trackers were last updated from ClientConfig.TrackerListURL.
+	TrackerListUpdated time.Time
+
+	// Incoming connections rejected for sending a plaintext handshake when header obfuscation is
+	// required.
+	PlaintextConnsRejected int64
+
+	// Our IPs as reported by trackers and peers, once they're trusted, and how many of the
+	// recent sources report them. Trackers also report our IP by listing it at our listen port.
+	// See ClientConfig.TrustTrackerExternalIp.
+	ExternalIp4        net.IP
+	ExternalIp4Sources int
+	ExternalIp6        net.IP
+	ExternalIp6Sources int
+
+	// Counts of ClientConfig.PeerClassifier decisions for peers added to torrents and incoming
+	// connections. Decisions that never occurred are omitted.
+	PeerDecisions map[PeerDecision]int64
+
+	// "started" tracker announces waiting on ClientConfig.TrackerStartedAnnounceRateLimiter.
+	TrackerStartedAnnouncesWaiting int
+
+	// Peer connections established over all torrents, and those since dropped by reason. Reasons
+	// that never occurred are omitted.
+	ConnsEstablished int
+	ConnDrops        map[ConnDropReason]int
+
+	// The peers with the best and worst reputations, best and worst first respectively. Reputation
+	// rises for good pieces, and falls for bad pieces a peer sent alone, short-lived connections,
+	// and connections that never gave us data. It decays back to zero over time.
+	TopPeers    []PeerReputation
+	BottomPeers []PeerReputation
+}
+
+// Counts of the Client's torrents by state. Each torrent is counted in exactly one of the states.
+type TorrentCounts struct {
+	Total        int
+	Downloading  int
+	Seeding      int
+	Paused       int
+	AwaitingInfo int
+}
+
+const (
+	// The period over which transfer rates are averaged.
+	rateEstimateWindow = 20 * time.Second
+	// How often the Client's transfer rates are sampled.
+	rateSampleInterval = time.Second
+)
+
+// Estimates the rate of change of a counter using an exponentially weighted moving average that
+// takes into account the time between samples.
+type rateEstimator struct {
+	lastSampled time.Time
+	lastValue   int64
+	rate        float64
+}
+
+func (me *rateEstimator) sample(now time.Time, value int64) float64 {
+	if !me.lastSampled.IsZero() {
+		if dt := now.Sub(me.lastSampled); dt > 0 {
+			alpha := 1 - math.Exp(-float64(dt)/float64(rateEstimateWindow))
+			instant := float64(value-me.lastValue) / dt.Seconds()
+			me.rate += alpha * (instant - me.rate)
+		}
+	}
+	me.lastSampled = now
+	me.lastValue = value
+	return me.rate
+}
+
+// Samples the transfer rates until the Client is closed, so that they don't depend on how often
+// stats are obtained.
+func (cl *Client) rateSampler() {
+	ticker := time.NewTicker(rateSampleInterval)
+	defer ticker.Stop()
+	closed := cl.closed.LockedChan(cl.locker())
+	for {
+		select {
+		case <-closed:
+			return
+		case now := <-ticker.C:
+			cl.lock()
+			cl.sampleRates(now)
+			cl.unlock()
+		}
+	}
+}
+
+func (cl *Client) sampleRates(now time.Time) {
+	cl.downloadRate.sample(now, cl.stats.BytesReadData.Int64())
+	cl.uploadRate.sample(now, cl.stats.BytesWrittenData.Int64())
+}
+
+// Routing table and activity stats for DHT servers.
+type DhtStats struct {
+	// Nodes that responded to our last query, or haven't been queried yet.
+	GoodNodes int
+	// Nodes in the routing table that aren't currently good.
+	QuestionableNodes int
+	// Nodes that have been blocked.
+	BadNodes int
+	// Routing table buckets containing at least one node. Only known for the builtin DHT server
+	// implementation.
+	Buckets int
+	// Transactions awaiting a response. This includes queries for lookups and announces.
+	OutstandingTransactions int
+	// Torrent announces to the DHT that are in progress.
+	ActiveAnnounces int
+}
+
+func (me *DhtStats) addServerStats(ss dht.ServerStats) {
+	me.GoodNodes += ss.GoodNodes
+	me.QuestionableNodes += ss.Nodes - ss.GoodNodes
+	me.BadNodes += int(ss.BadNodes)
+	me.OutstandingTransactions += ss.OutstandingTransactions
+}
+
+// Returns a consistent snapshot of the Client's stats.
+func (cl *Client) Stats() (ret ClientStats) {
+	cl.rLock()
+	defer cl.rUnlock()
+	ret.ConnStats = cl.stats.Copy()
+	ret.DownloadRate = cl.downloadRate.rate
+	ret.UploadRate = cl.uploadRate.rate
+	var completed, length int64
+	for _, t := range cl.torrents {
+		ret.Torrents.Total++
+		switch {
+		case t.paused.IsSet():
+			ret.Torrents.Paused++
+		case !t.haveInfo():
+			ret.Torrents.AwaitingInfo++
+		case t.haveAllPieces():
+			ret.Torrents.Seeding++
+		default:
+			ret.Torrents.Downloading++
+		}
+		if t.haveInfo() {
+			completed += t.bytesCompleted()
+			length += t.info.TotalLength()
+		}
+	}
+	if length != 0 {
+		ret.Completion = float64(completed) / float64(length)
+	}
+	if cl.ipBlockList != nil {
+		ret.IPBlocklistRanges = cl.ipBlockList.NumRanges()
+	}
+	ret.IPBlocklistUpdated = cl.ipBlockListUpdated
+	ret.TrackerListUpdated = cl.trackerListUpdated
+	ret.PlaintextConnsRejected = cl.plaintextConnsRejected.Int64()
+	ret.ExternalIp4 = cl.externalIp4.ip
+	ret.ExternalIp4Sources = cl.externalIp4.agreement(ret.ExternalIp4)
+	ret.ExternalIp6 = cl.externalIp6.ip
+	ret.ExternalIp6Sources = cl.externalIp6.agreement(ret.ExternalIp6)
+	for d := range cl.peerDecisions {
+		if n := cl.peerDecisions[d].Int64(); n != 0 {
+			if ret.PeerDecisions == nil {
+				ret.PeerDecisions = make(map[PeerDecision]int64)
+			}
+			ret.PeerDecisions[PeerDecision(d)] = n
+		}
+	}
+	ret.TrackerStartedAnnouncesWaiting = cl.startedAnnouncesWaiting
+	ret.ConnsEstablished = cl.connChurn.established
+	ret.ConnDrops = cl.connChurn.dropsMap()
+	ret.TopPeers, ret.BottomPeers = cl.reputationStats()
+	cl.eachDhtServer(func(s DhtServer) {
+		if ss, ok := s.Stats().(dht.ServerStats); ok {
+			ret.Dht.addServerStats(ss)
+		}
+		if w, ok := s.(anacrolixDhtServerWrapper); ok {
+			ret.Dht.Buckets += dhtNumNonEmptyBuckets(w.Server)
+		}
+	})
+	ret.Dht.ActiveAnnounces = cl.activeDhtAnnounces
+	return
+}
+
+func dhtNumNonEmptyBuckets(s *dht.Server) int {
+	root := s.ID()
+	buckets := make(map[int]struct{})
+	for _, ni := range s.Nodes() {
+		if ni.ID == root {
+			continue
+		}
+		buckets[dhtBucketIndex(root, ni.ID)] = struct{}{}
+	}
+	return len(buckets)
+}
+
+// Returns the routing table bucket for id relative to the root ID, using the same numbering as the
+// dht package: the length of the common prefix of the IDs.
+func dhtBucketIndex(root, id [20]byte) int {
+	for i := range root {
+		if x := root[i] ^ id[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
@@ -1,13 +1,27 @@
 package torrent
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -16,6 +30,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo"
 	"github.com/anacrolix/missinggo/v2/filecache"
 
@@ -23,7 +39,10 @@ import (
 	"github.com/anacrolix/torrent/internal/testutil"
 	"github.com/anacrolix/torrent/iplist"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/mse"
+	pp "github.com/anacrolix/torrent/peer_protocol"
 	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/tracker"
 )
 
 func TestClientDefault(t *testing.T) {
@@ -33,11 +52,34 @@ func TestClientDefault(t *testing.T) {
 }
 
 func TestClientNilConfig(t *testing.T) {
+	// The default DataDir is the working directory, and the piece completion database is created
+	// in it.
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
 	cl, err := NewClient(nil)
 	require.NoError(t, err)
 	cl.Close()
 }
 
+func TestClientListenNetworks(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.ListenNetworks = []string{"tcp4"}
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	require.NotEmpty(t, cl.ListenAddrs())
+	for _, a := range cl.ListenAddrs() {
+		assert.EqualValues(t, "tcp", a.Network())
+		assert.NotNil(t, a.(*net.TCPAddr).IP.To4())
+	}
+	assert.True(t, cl.peerAddrFamilyEnabled(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}))
+	assert.False(t, cl.peerAddrFamilyEnabled(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}))
+	cl.config.PublicIp6 = net.ParseIP("2001:db8::2")
+	assert.Nil(t, cl.announceIp6())
+}
+
 func TestBoltPieceCompletionClosedWhenClientClosed(t *testing.T) {
 	cfg := TestingConfig()
 	pc, err := storage.NewBoltPieceCompletion(cfg.DataDir)
@@ -68,6 +110,29 @@ func TestAddDropTorrent(t *testing.T) {
 	tt.Drop()
 }
 
+func TestClientDisableNetwork(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig()
+	cfg.DisableNetwork = true
+	cfg.DisableTrackers = false
+	cfg.DataDir = dir
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	assert.Empty(t, cl.ListenAddrs())
+	assert.Empty(t, cl.DhtServers())
+	mi.Announce = "http://localhost:1/announce"
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	tt.AddPeers([]Peer{{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}})
+	tt.VerifyData()
+	assert.EqualValues(t, tt.Length(), tt.BytesCompleted())
+	cl.lock()
+	assert.Empty(t, tt.trackerAnnouncers)
+	cl.unlock()
+}
+
 func TestAddTorrentNoSupportedTrackerSchemes(t *testing.T) {
 	// TODO?
 	t.SkipNow()
@@ -399,7 +464,7 @@ func testAddTorrentPriorPieceCompletion(t *testing.T, alreadyCompleted bool, csf
 	cl, err := NewClient(cfg)
 	require.NoError(t, err)
 	defer cl.Close()
-	tt, err := cl.AddTorrent(greetingMetainfo)
+	tt, _, err := cl.AddTorrent(greetingMetainfo)
 	require.NoError(t, err)
 	psrs := tt.PieceStateRuns()
 	assert.Len(t, psrs, 1)
@@ -668,7 +733,7 @@ func makeMagnet(t *testing.T, cl *Client, dir string, name string) string {
 	mi.InfoBytes, err = bencode.Marshal(info)
 	require.NoError(t, err)
 	magnet := mi.Magnet(name, mi.HashInfoBytes()).String()
-	tr, err := cl.AddTorrent(&mi)
+	tr, _, err := cl.AddTorrent(&mi)
 	require.NoError(t, err)
 	require.True(t, tr.Seeding())
 	tr.VerifyData()
@@ -754,6 +819,109 @@ func TestObfuscatedHeaderFallbackSeederRequiresLeecherPrefersNot(t *testing.T) {
 	)
 }
 
+func TestOutgoingHeaderObfuscationAttempts(t *testing.T) {
+	assert.EqualValues(t, []bool{true}, outgoingHeaderObfuscationAttempts(HeaderObfuscationPolicy{Preferred: true, RequirePreferred: true}))
+	assert.EqualValues(t, []bool{false}, outgoingHeaderObfuscationAttempts(HeaderObfuscationPolicy{Preferred: false, RequirePreferred: true}))
+	assert.EqualValues(t, []bool{true, false}, outgoingHeaderObfuscationAttempts(HeaderObfuscationPolicy{Preferred: true}))
+}
+
+func TestDialEscalation(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	// The first attempt fails, as it's obfuscated.
+	cfg.HeaderObfuscationPolicy = HeaderObfuscationPolicy{Preferred: false, RequirePreferred: true}
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, _ := seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	seederTorrent.VerifyData()
+	cfg = TestingConfig()
+	cfg.DialEscalation = []DialAttempt{
+		{Network: "tcp", ObfuscateHeader: true},
+		{Network: "tcp"},
+	}
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherTorrent, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	conns := leecherTorrent.PeerConns()
+	require.NotEmpty(t, conns)
+	for _, c := range conns {
+		attempt, network := c.DialAttempt()
+		assert.Equal(t, 2, attempt)
+		assert.Contains(t, network, "tcp")
+	}
+}
+
+func TestHandleEncryptionRejectsPlaintext(t *testing.T) {
+	var written bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(pp.Protocol + strings.Repeat("\x00", 48)),
+		&written,
+	}
+	_, headerEncrypted, _, err := handleEncryption(rw, func(func([]byte) bool) {}, HeaderObfuscationPolicy{Preferred: true, RequirePreferred: true}, mse.DefaultCryptoSelector)
+	assert.Equal(t, errPlaintextRejected, err)
+	assert.False(t, headerEncrypted)
+	assert.Zero(t, written.Len())
+}
+
+func requiredHeaderObfuscationClient(t *testing.T) (*Client, *Torrent) {
+	cfg := TestingConfig()
+	cfg.DisableUTP = true
+	cfg.HeaderObfuscationPolicy = HeaderObfuscationPolicy{Preferred: true, RequirePreferred: true}
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	tt, _, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	require.NoError(t, err)
+	return cl, tt
+}
+
+func TestRequiredHeaderObfuscationRejectsIncomingPlaintext(t *testing.T) {
+	cl, tt := requiredHeaderObfuscationClient(t)
+	defer cl.Close()
+	nc, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", cl.LocalPort()))
+	require.NoError(t, err)
+	defer nc.Close()
+	ih := tt.InfoHash()
+	_, err = nc.Write([]byte(pp.Protocol + strings.Repeat("\x00", 8) + string(ih[:]) + strings.Repeat("a", 20)))
+	require.NoError(t, err)
+	require.NoError(t, nc.SetReadDeadline(time.Now().Add(10*time.Second)))
+	// The connection may be reset, as the client closes it without reading everything we sent.
+	b, err := ioutil.ReadAll(nc)
+	if ne, ok := err.(net.Error); ok {
+		require.False(t, ne.Timeout())
+	}
+	assert.Empty(t, b)
+	assert.EqualValues(t, 1, cl.Stats().PlaintextConnsRejected)
+}
+
+func TestRequiredHeaderObfuscationOutgoingNotPlaintext(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	cl, tt := requiredHeaderObfuscationClient(t)
+	defer cl.Close()
+	tt.DownloadAll()
+	tt.AddPeers([]Peer{{Addr: l.Addr()}})
+	nc, err := l.Accept()
+	require.NoError(t, err)
+	defer nc.Close()
+	require.NoError(t, nc.SetReadDeadline(time.Now().Add(10*time.Second)))
+	var b [len(pp.Protocol)]byte
+	_, err = io.ReadFull(nc, b[:])
+	require.NoError(t, err)
+	assert.NotEqual(t, pp.Protocol, string(b[:]))
+}
+
 func TestClientAddressInUse(t *testing.T) {
 	s, _ := NewUtpSocket("udp", ":50007", nil)
 	if s != nil {
@@ -811,3 +979,1998 @@ func TestClientDisabledImplicitNetworksButDhtEnabled(t *testing.T) {
 	assert.Empty(t, cl.listeners)
 	assert.NotEmpty(t, cl.DhtServers())
 }
+
+func TestTorrentsByLabel(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	a, _ := cl.AddTorrentInfoHash(metainfo.Hash{1})
+	b, _ := cl.AddTorrentInfoHash(metainfo.Hash{2})
+	cl.AddTorrentInfoHash(metainfo.Hash{3})
+	a.SetLabel("linux")
+	b.SetLabel("linux")
+	assert.Equal(t, "linux", a.Label())
+	assert.ElementsMatch(t, []*Torrent{a, b}, cl.TorrentsByLabel("linux"))
+	assert.Empty(t, cl.TorrentsByLabel("bsd"))
+	b.SetLabel("")
+	assert.Equal(t, []*Torrent{a}, cl.TorrentsByLabel("linux"))
+}
+
+type statsDhtServer struct {
+	DhtServer
+	stats dht.ServerStats
+}
+
+func (me statsDhtServer) Stats() interface{} { return me.stats }
+
+func TestClientStatsDhtAggregated(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	cl.AddDhtServer(statsDhtServer{stats: dht.ServerStats{Nodes: 5, GoodNodes: 3, BadNodes: 1, OutstandingTransactions: 2}})
+	cl.AddDhtServer(statsDhtServer{stats: dht.ServerStats{Nodes: 2, GoodNodes: 2, OutstandingTransactions: 1}})
+	assert.EqualValues(t, DhtStats{
+		GoodNodes:               5,
+		QuestionableNodes:       2,
+		BadNodes:                1,
+		OutstandingTransactions: 3,
+	}, cl.Stats().Dht)
+}
+
+// Counts the nodes added to it as its routing table.
+type nodeCountingDhtServer struct {
+	DhtServer
+	nodes *[]krpc.NodeInfo
+}
+
+func (me nodeCountingDhtServer) Stats() interface{} {
+	return dht.ServerStats{Nodes: len(*me.nodes)}
+}
+
+func (me nodeCountingDhtServer) AddNode(ni krpc.NodeInfo) error {
+	*me.nodes = append(*me.nodes, ni)
+	return nil
+}
+
+func TestDhtMaxNodes(t *testing.T) {
+	cl := Client{config: TestingConfig()}
+	cl.initLogger()
+	cl.config.DhtMaxNodes = 3
+	var nodes []krpc.NodeInfo
+	cl.AddDhtServer(nodeCountingDhtServer{nodes: &nodes})
+	cl.AddDHTNodes([]string{"1.2.3.4:1", "1.2.3.4:2", "1.2.3.4:3", "1.2.3.4:4", "1.2.3.4:5"})
+	assert.Len(t, nodes, 3)
+	assert.EqualValues(t, 3, cl.Stats().Dht.QuestionableNodes)
+	cl.config.DhtMaxNodes = 0
+	cl.AddDHTNodes([]string{"1.2.3.4:6"})
+	assert.Len(t, nodes, 4)
+}
+
+func TestExportImportDHTNodes(t *testing.T) {
+	newClient := func() *Client {
+		cfg := TestingConfig()
+		cfg.NoDHT = false
+		cfg.DhtStartingNodes = func(string) dht.StartingNodesGetter { return func() ([]dht.Addr, error) { return nil, nil } }
+		cl, err := NewClient(cfg)
+		require.NoError(t, err)
+		return cl
+	}
+	src := newClient()
+	defer src.Close()
+	var nodes []krpc.NodeInfo
+	for i := 1; i <= 3; i++ {
+		ni := krpc.NodeInfo{Addr: krpc.NodeAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 6881}}
+		dht.SecureNodeId(&ni.ID, ni.Addr.IP)
+		nodes = append(nodes, ni)
+	}
+	src.ImportDHTNodes(nodes)
+	exported := src.ExportDHTNodes()
+	require.Len(t, exported, len(nodes))
+	dst := newClient()
+	defer dst.Close()
+	assert.Empty(t, dst.ExportDHTNodes())
+	dst.ImportDHTNodes(exported)
+	assert.ElementsMatch(t, exported, dst.ExportDHTNodes())
+	ds := dst.Stats().Dht
+	assert.NotZero(t, ds.GoodNodes+ds.QuestionableNodes)
+}
+
+func TestDhtBucketIndex(t *testing.T) {
+	assert.EqualValues(t, 0, dhtBucketIndex([20]byte{}, [20]byte{0x80}))
+	assert.EqualValues(t, 7, dhtBucketIndex([20]byte{}, [20]byte{0x01}))
+	assert.EqualValues(t, 12, dhtBucketIndex([20]byte{0xff}, [20]byte{0xff, 0x08}))
+	assert.EqualValues(t, 160, dhtBucketIndex([20]byte{1}, [20]byte{1}))
+}
+
+func TestDhtBootstrapNodes(t *testing.T) {
+	cl := Client{config: TestingConfig()}
+	cl.initLogger()
+	var defaultCalled bool
+	cl.config.DhtStartingNodes = func(string) dht.StartingNodesGetter {
+		return func() ([]dht.Addr, error) {
+			defaultCalled = true
+			return nil, errors.New("no defaults")
+		}
+	}
+	cl.config.DhtBootstrapNodes = []string{"127.0.0.1:6881", "not an address"}
+	addrs, err := cl.dhtStartingNodes("udp")()
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.EqualValues(t, "127.0.0.1:6881", addrs[0].String())
+	assert.False(t, defaultCalled)
+	cl.config.DhtBootstrapIncludeDefaults = true
+	addrs, err = cl.dhtStartingNodes("udp")()
+	require.NoError(t, err)
+	assert.Len(t, addrs, 1)
+	assert.True(t, defaultCalled)
+	cl.config.DhtBootstrapNodes = []string{}
+	cl.config.DhtBootstrapIncludeDefaults = false
+	addrs, err = cl.dhtStartingNodes("udp")()
+	require.NoError(t, err)
+	assert.Empty(t, addrs)
+}
+
+func TestSeedOnlyTorrent(t *testing.T) {
+	greetingDataTempDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataTempDir)
+	cfg := TestingConfig()
+	cfg.DataDir = greetingDataTempDir
+	cfg.Seed = true
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	spec := TorrentSpecFromMetaInfo(greetingMetainfo)
+	spec.SeedOnly = true
+	tt, _, err := cl.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	// The existing data is verified, and then seeded.
+	require.True(t, cl.WaitAll())
+	assert.True(t, tt.Seeding())
+}
+
+func TestSeedOnlyTorrentMissingData(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	spec := TorrentSpecFromMetaInfo(testutil.GreetingMetaInfo())
+	spec.SeedOnly = true
+	tt, _, err := cl.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	tt.DownloadAll()
+	cl.lock()
+	defer cl.unlock()
+	assert.False(t, tt.haveAllPieces())
+	assert.False(t, tt.needData())
+}
+
+func TestPiecePrioritiesPersist(t *testing.T) {
+	info := metainfo.Info{
+		Name:        "prios",
+		PieceLength: 1,
+		Pieces:      make([]byte, 4*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 2},
+			{Path: []string{"b"}, Length: 2},
+		},
+	}
+	ib, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	mi := &metainfo.MetaInfo{InfoBytes: ib}
+	store := storage.NewMapPieceCompletion().(storage.PiecePriorityStore)
+	prios := func(tt *Torrent) (ret []piecePriority) {
+		tt.cl.lock()
+		defer tt.cl.unlock()
+		for i := range tt.pieces {
+			ret = append(ret, tt.pieces[i].requestedPriority())
+		}
+		return
+	}
+	addTorrent := func() (*Client, *Torrent) {
+		cfg := TestingConfig()
+		cfg.PiecePriorityStore = store
+		cl, err := NewClient(cfg)
+		require.NoError(t, err)
+		tt, _, err := cl.AddTorrent(mi)
+		require.NoError(t, err)
+		return cl, tt
+	}
+	cl, tt := addTorrent()
+	tt.Files()[0].Download()
+	tt.Piece(3).SetPriority(PiecePriorityHigh)
+	cl.Close()
+	// The deselected file stays deselected when the torrent is added again.
+	cl, tt = addTorrent()
+	assert.Equal(t, PiecePriorityNormal, tt.Files()[0].Priority())
+	assert.Equal(t, PiecePriorityNone, tt.Files()[1].Priority())
+	assert.EqualValues(t, []piecePriority{
+		PiecePriorityNormal, PiecePriorityNormal, PiecePriorityNone, PiecePriorityHigh,
+	}, prios(tt))
+	// Restored file priorities can be changed.
+	tt.Files()[0].SetPriority(PiecePriorityNone)
+	assert.EqualValues(t, []piecePriority{
+		PiecePriorityNone, PiecePriorityNone, PiecePriorityNone, PiecePriorityHigh,
+	}, prios(tt))
+	cl.Close()
+	cl, tt = addTorrent()
+	assert.Equal(t, PiecePriorityNone, tt.Files()[0].Priority())
+	tt.ResetPiecePriorities()
+	cl.Close()
+	cl, tt = addTorrent()
+	defer cl.Close()
+	assert.EqualValues(t, make([]piecePriority, 4), prios(tt))
+}
+
+// Writes random data for a torrent with the given pieces to dir, and returns its info bytes.
+func writeRandomTorrentData(tb testing.TB, dir string, numPieces int, pieceLength int64) []byte {
+	data := make([]byte, int64(numPieces)*pieceLength)
+	rand.Read(data)
+	require.NoError(tb, ioutil.WriteFile(filepath.Join(dir, "data"), data, 0644))
+	info := metainfo.Info{PieceLength: pieceLength}
+	require.NoError(tb, info.BuildFromFilePath(filepath.Join(dir, "data")))
+	ib, err := bencode.Marshal(info)
+	require.NoError(tb, err)
+	return ib
+}
+
+// Adds a torrent over existing data, and returns the progress of the initial verification once
+// it's complete.
+func verifyExistingData(tb testing.TB, cl *Client, dir string, ib []byte) (progress []VerificationProgress) {
+	tt, _ := cl.AddTorrentInfoHashWithStorage(
+		metainfo.HashBytes(ib),
+		storage.NewFileWithCompletion(dir, storage.NewMapPieceCompletion()))
+	defer tt.Drop()
+	ch, unsubscribe := tt.SubscribeVerification()
+	defer unsubscribe()
+	require.NoError(tb, tt.SetInfoBytes(ib))
+	for vp := range ch {
+		progress = append(progress, vp)
+		if vp.Remaining == 0 {
+			break
+		}
+	}
+	return
+}
+
+func TestInitialVerificationProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ib := writeRandomTorrentData(t, dir, 16, 1<<14)
+	cfg := TestingConfig()
+	cfg.PieceHashersPerTorrent = 4
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	progress := verifyExistingData(t, cl, dir, ib)
+	require.Len(t, progress, 16)
+	seen := make(map[int]bool)
+	for _, vp := range progress {
+		assert.True(t, vp.Passed)
+		seen[vp.Piece] = true
+	}
+	assert.Len(t, seen, 16)
+}
+
+func BenchmarkInitialVerification(b *testing.B) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	const numPieces = 64
+	ib := writeRandomTorrentData(b, dir, numPieces, 1<<18)
+	for _, hashers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("hashers=%d", hashers), func(b *testing.B) {
+			cfg := TestingConfig()
+			cfg.PieceHashersPerTorrent = hashers
+			cl, err := NewClient(cfg)
+			require.NoError(b, err)
+			defer cl.Close()
+			b.SetBytes(numPieces << 18)
+			for range iter.N(b.N) {
+				if len(verifyExistingData(b, cl, dir, ib)) != numPieces {
+					b.Fatal("missing verification progress")
+				}
+			}
+		})
+	}
+}
+
+// Simulates a crash after pieces were written but before their completion was stored. Only the
+// journalled pieces are verified when the torrent is added again.
+func TestPieceWriteJournalRecoversAfterCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	const pieceLength = 1 << 14
+	data := make([]byte, 4*pieceLength)
+	rand.Read(data)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data"), data, 0644))
+	info := metainfo.Info{PieceLength: pieceLength}
+	require.NoError(t, info.BuildFromFilePath(filepath.Join(dir, "data")))
+	mi := &metainfo.MetaInfo{}
+	mi.InfoBytes, err = bencode.Marshal(info)
+	require.NoError(t, err)
+	ih := mi.HashInfoBytes()
+	pk := func(i int) metainfo.PieceKey { return metainfo.PieceKey{InfoHash: ih, Index: i} }
+	pc := storage.NewMapPieceCompletion()
+	journal := pc.(storage.PieceWriteJournal)
+	// Every piece was known to be incomplete, then all the data was written, but only pieces 1
+	// and 2 were journalled, and nothing was marked complete before the crash.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, pc.Set(pk(i), false))
+	}
+	require.NoError(t, journal.SetPieceWritten(pk(1), true))
+	require.NoError(t, journal.SetPieceWritten(pk(2), true))
+
+	cfg := TestingConfig()
+	cfg.DefaultStorage = storage.NewFileWithCompletion(dir, pc)
+	cfg.PieceWriteJournal = journal
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	cl.lock()
+	for tt.piecesQueuedForHash.Len() != 0 || tt.activePieceHashes != 0 {
+		cl.event.Wait()
+	}
+	var verifies []int64
+	for i := range tt.pieces {
+		verifies = append(verifies, tt.pieces[i].numVerifies)
+	}
+	cl.unlock()
+	assert.EqualValues(t, []int64{0, 1, 1, 0}, verifies)
+	for i, complete := range []bool{false, true, true, false} {
+		c, err := pc.Get(pk(i))
+		require.NoError(t, err)
+		assert.Equal(t, storage.Completion{Complete: complete, Ok: true}, c, i)
+	}
+	written, err := journal.GetWrittenPieces(ih)
+	require.NoError(t, err)
+	assert.Empty(t, written)
+}
+
+// A peer that completes the BitTorrent handshake but never sends its extended handshake is dropped.
+func TestConnEstablishmentTimeoutStalledExtendedHandshake(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.ConnEstablishmentTimeout = 100 * time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	ih := testutil.GreetingMetaInfo().HashInfoBytes()
+	cl.AddTorrentInfoHash(ih)
+	nc, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", cl.LocalPort()))
+	require.NoError(t, err)
+	defer nc.Close()
+	var pex PeerExtensionBits
+	pex.SetBit(pp.ExtensionBitExtended)
+	_, err = pp.Handshake(nc, &ih, [20]byte{}, pex)
+	require.NoError(t, err)
+	nc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.Copy(ioutil.Discard, nc)
+	if ne, ok := err.(net.Error); ok {
+		require.False(t, ne.Timeout())
+	}
+}
+
+func TestClientStatsTorrentCounts(t *testing.T) {
+	greetingDataTempDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataTempDir)
+	cfg := TestingConfig()
+	cfg.DataDir = greetingDataTempDir
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	seeding, _, err := cl.AddTorrent(greetingMetainfo)
+	require.NoError(t, err)
+	require.True(t, cl.WaitAll())
+	cl.AddTorrentInfoHash(metainfo.Hash{1})
+	paused, _ := cl.AddTorrentInfoHash(metainfo.Hash{2})
+	paused.Pause()
+	stats := cl.Stats()
+	assert.EqualValues(t, TorrentCounts{Total: 3, Seeding: 1, Paused: 1, AwaitingInfo: 1}, stats.Torrents)
+	assert.EqualValues(t, 1, stats.Completion)
+	seeding.Drop()
+	assert.EqualValues(t, 0, cl.Stats().Completion)
+}
+
+func TestClientPauseAll(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	running, _ := cl.AddTorrentInfoHash(metainfo.Hash{1})
+	paused, _ := cl.AddTorrentInfoHash(metainfo.Hash{2})
+	paused.Pause()
+	cl.PauseAll()
+	assert.True(t, cl.AllPaused())
+	assert.True(t, running.Paused())
+	added, _ := cl.AddTorrentInfoHash(metainfo.Hash{3})
+	assert.True(t, added.Paused())
+	cl.ResumeAll()
+	assert.False(t, cl.AllPaused())
+	assert.False(t, running.Paused())
+	assert.False(t, added.Paused())
+	// Torrents paused before PauseAll stay paused.
+	assert.True(t, paused.Paused())
+}
+
+func TestTorrentWaitForPeers(t *testing.T) {
+	greetingDataTempDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataTempDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDataTempDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, err := seeder.AddTorrent(greetingMetainfo)
+	require.NoError(t, err)
+	leecher, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherTorrent, _ := leecher.AddTorrentInfoHash(greetingMetainfo.HashInfoBytes())
+	// Already satisfied.
+	require.NoError(t, leecherTorrent.WaitForPeers(context.Background(), 0))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, leecherTorrent.WaitForPeers(ctx, 1))
+	leecherTorrent.AddClientPeer(seeder)
+	require.NoError(t, leecherTorrent.WaitForPeers(context.Background(), 1))
+	assert.NotEmpty(t, leecherTorrent.PeerConns())
+	require.NoError(t, seederTorrent.WaitForPeers(context.Background(), 1))
+}
+
+func TestPieceStorageCallbacks(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, err := seeder.AddTorrent(mi)
+	require.NoError(t, err)
+	seederTorrent.VerifyData()
+	require.True(t, seederTorrent.Seeding())
+
+	// Stores the data XORed with its offset.
+	xor := func(tt *Torrent, piece int, off int64, data []byte) []byte {
+		for i := range data {
+			data[i] ^= byte(off + int64(i))
+		}
+		return data
+	}
+	var writes, reads int32
+	cfg = TestingConfig()
+	cfg.Callbacks.BeforePieceWrite = func(tt *Torrent, piece int, off int64, data []byte) []byte {
+		atomic.AddInt32(&writes, 1)
+		return xor(tt, piece, off, data)
+	}
+	cfg.Callbacks.AfterPieceRead = func(tt *Torrent, piece int, off int64, data []byte) []byte {
+		atomic.AddInt32(&reads, 1)
+		return xor(tt, piece, off, data)
+	}
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	tt, _, err := leecher.AddTorrent(mi)
+	require.NoError(t, err)
+	tt.DownloadAll()
+	tt.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	assert.NotZero(t, atomic.LoadInt32(&writes))
+	// Verification was of the original data.
+	assert.NotZero(t, atomic.LoadInt32(&reads))
+	stored, err := ioutil.ReadFile(filepath.Join(cfg.DataDir, testutil.GreetingFileName))
+	require.NoError(t, err)
+	// Offsets are within pieces.
+	info, err := mi.UnmarshalInfo()
+	require.NoError(t, err)
+	for i := range stored {
+		stored[i] ^= byte(int64(i) % info.PieceLength)
+	}
+	assert.Equal(t, testutil.GreetingFileContents, string(stored))
+	r := tt.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, testutil.GreetingFileContents, string(b))
+	tt.VerifyData()
+	assert.Zero(t, tt.BytesMissing())
+}
+
+func TestAddTorrentExceedingLimits(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.MaxPieces = 100
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	add := func(info metainfo.Info) error {
+		_, _, err := cl.AddTorrent(&metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)})
+		return err
+	}
+	assert.NoError(t, add(metainfo.Info{Name: "ok", PieceLength: 1, Length: 100, Pieces: make([]byte, 100*metainfo.HashSize)}))
+	err = add(metainfo.Info{Name: "pieces", PieceLength: 1, Length: 101, Pieces: make([]byte, 101*metainfo.HashSize)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "101 pieces exceeds maximum of 100")
+	// Absurd lengths are rejected by the default limit without touching storage.
+	err = add(metainfo.Info{
+		Name:        "size",
+		PieceLength: 1 << 50,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1 << 50},
+			{Path: []string{"b"}, Length: math.MaxInt64},
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "length exceeds maximum")
+	_, err = os.Stat(filepath.Join(cfg.DataDir, "size"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAddTorrentSpecDuplicate(t *testing.T) {
+	test := func(t *testing.T, disableMerging bool) {
+		cfg := TestingConfig()
+		cfg.DisableTorrentMerging = disableMerging
+		cl, err := NewClient(cfg)
+		require.NoError(t, err)
+		defer cl.Close()
+		ih := testutil.GreetingMetaInfo().HashInfoBytes()
+		tt, new, err := cl.AddTorrentSpec(&TorrentSpec{
+			InfoHash: ih,
+			Trackers: [][]string{{"http://a.invalid/announce"}},
+		})
+		require.NoError(t, err)
+		require.True(t, new)
+		dup, new, err := cl.AddTorrentSpec(&TorrentSpec{
+			InfoHash:    ih,
+			Trackers:    [][]string{{"http://b.invalid/announce"}},
+			Webseeds:    []string{"http://c.invalid/"},
+			DisplayName: "dup",
+		})
+		require.NoError(t, err)
+		assert.False(t, new)
+		assert.Equal(t, tt, dup)
+		mi := tt.Metainfo()
+		if disableMerging {
+			assert.EqualValues(t, [][]string{{"http://a.invalid/announce"}}, mi.AnnounceList)
+			assert.Empty(t, mi.UrlList)
+			assert.NotEqual(t, "dup", tt.Name())
+		} else {
+			assert.EqualValues(t, [][]string{{"http://a.invalid/announce", "http://b.invalid/announce"}}, mi.AnnounceList)
+			assert.EqualValues(t, []string{"http://c.invalid/"}, mi.UrlList)
+			assert.Equal(t, "dup", tt.Name())
+		}
+		// A missing info is always taken from the duplicate.
+		dup, existed, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+		require.NoError(t, err)
+		assert.True(t, existed)
+		assert.Equal(t, tt, dup)
+		assert.NotNil(t, tt.Info())
+	}
+	t.Run("Merge", func(t *testing.T) { test(t, false) })
+	t.Run("DisableMerging", func(t *testing.T) { test(t, true) })
+}
+
+func TestRateEstimator(t *testing.T) {
+	var re rateEstimator
+	now := time.Now()
+	assert.EqualValues(t, 0, re.sample(now, 0))
+	// A sample well beyond the window is dominated by the latest instantaneous rate.
+	now = now.Add(10 * rateEstimateWindow)
+	assert.InEpsilon(t, 100, re.sample(now, int64(100*(10*rateEstimateWindow).Seconds())), 0.001)
+	// A short burst only partially raises the average.
+	now = now.Add(time.Second)
+	r := re.sample(now, re.lastValue+1000)
+	assert.True(t, r > 100 && r < 1000, r)
+}
+
+func TestClientStatsRates(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	now := time.Now()
+	cl.sampleRates(now)
+	cl.stats.BytesReadData.Add(1000)
+	cl.sampleRates(now.Add(rateSampleInterval))
+	stats := cl.Stats()
+	assert.True(t, stats.DownloadRate > 0, stats.DownloadRate)
+	assert.Zero(t, stats.UploadRate)
+	// Obtaining stats doesn't take a sample.
+	assert.Equal(t, stats.DownloadRate, cl.Stats().DownloadRate)
+}
+
+func TestTorrentSpecDataDir(t *testing.T) {
+	greetingDataTempDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataTempDir)
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	spec := TorrentSpecFromMetaInfo(greetingMetainfo)
+	spec.DataDir = greetingDataTempDir
+	tt, _, err := cl.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	// The data is found in the torrent's directory, not the Client's.
+	require.True(t, cl.WaitAll())
+	assert.EqualValues(t, tt.Length(), tt.BytesCompleted())
+}
+
+func TestTorrentSpecDataDirCustomDefaultStorage(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.DefaultStorage = storage.NewMMap(cfg.DataDir)
+	defer cfg.DefaultStorage.(storage.ClientImplCloser).Close()
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	spec := TorrentSpecFromMetaInfo(testutil.GreetingMetaInfo())
+	spec.DataDir = cfg.DataDir
+	_, _, err = cl.AddTorrentSpec(spec)
+	assert.Error(t, err)
+}
+
+type announceRecordingDhtServer struct {
+	DhtServer
+	mu        sync.Mutex
+	announced map[[20]byte]bool
+}
+
+type nopDhtAnnounce chan dht.PeersValues
+
+func (me nopDhtAnnounce) Close()                        {}
+func (me nopDhtAnnounce) Peers() <-chan dht.PeersValues { return me }
+
+func (me *announceRecordingDhtServer) Announce(hash [20]byte, port int, impliedPort bool) (DhtAnnounce, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.announced[hash] = true
+	return make(nopDhtAnnounce), nil
+}
+
+func (me *announceRecordingDhtServer) wasAnnounced(hash [20]byte) bool {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.announced[hash]
+}
+
+type nodeRecordingDhtServer struct {
+	DhtServer
+	mu    sync.Mutex
+	nodes []string
+}
+
+func (me *nodeRecordingDhtServer) AddNode(ni krpc.NodeInfo) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.nodes = append(me.nodes, ni.Addr.String())
+	return nil
+}
+
+func (me *nodeRecordingDhtServer) Announce(hash [20]byte, port int, impliedPort bool) (DhtAnnounce, error) {
+	return make(nopDhtAnnounce), nil
+}
+
+func TestMetainfoDhtNodes(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	ds := &nodeRecordingDhtServer{}
+	cl.AddDhtServer(ds)
+	mi := testutil.GreetingMetaInfo()
+	// Nodes are given as host and port pairs.
+	b, err := bencode.Marshal(map[string]interface{}{
+		"info":  mi.InfoBytes,
+		"nodes": []interface{}{[]interface{}{"1.2.3.4", 6881}, []interface{}{"5.6.7.8", 6882}},
+	})
+	require.NoError(t, err)
+	mi, err = metainfo.Load(bytes.NewReader(b))
+	require.NoError(t, err)
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	ds.mu.Lock()
+	assert.EqualValues(t, []string{"1.2.3.4:6881", "5.6.7.8:6882"}, ds.nodes)
+	ds.mu.Unlock()
+	assert.EqualValues(t, mi.Nodes, tt.Metainfo().Nodes)
+}
+
+func TestPrivateTorrentNoDhtOrPex(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	ds := &announceRecordingDhtServer{announced: make(map[[20]byte]bool)}
+	cl.AddDhtServer(ds)
+	private := true
+	ib, err := bencode.Marshal(metainfo.Info{
+		Name:        "private",
+		PieceLength: 1,
+		Length:      1,
+		Pieces:      make([]byte, metainfo.HashSize),
+		Private:     &private,
+	})
+	require.NoError(t, err)
+	privateTorrent, _, err := cl.AddTorrent(&metainfo.MetaInfo{InfoBytes: ib})
+	require.NoError(t, err)
+	publicTorrent, _ := cl.AddTorrentInfoHash(metainfo.Hash{1})
+	for !ds.wasAnnounced(publicTorrent.InfoHash()) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, ds.wasAnnounced(privateTorrent.InfoHash()))
+	cl.onDHTAnnouncePeer(privateTorrent.InfoHash(), net.IPv4(1, 2, 3, 4), 1234, true)
+	cl.lock()
+	defer cl.unlock()
+	assert.True(t, privateTorrent.info.IsPrivate())
+	assert.EqualValues(t, 0, privateTorrent.peers.Len())
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.PeerExtensionIDs = map[pp.ExtensionName]pp.ExtensionNumber{pp.ExtensionNamePex: 1}
+	c.setTorrent(privateTorrent)
+	c.pex.Init(c)
+	assert.False(t, c.pex.IsEnabled())
+}
+
+// A Dialer that records the addresses dialed, and fails.
+type recordingDialer chan string
+
+func (me recordingDialer) Dial(_ context.Context, addr string) (net.Conn, error) {
+	me <- addr
+	return nil, errors.New("refused")
+}
+
+func (me recordingDialer) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestTorrentSpecDialers(t *testing.T) {
+	s, events := newAnnounceEventServer()
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	ds := &announceRecordingDhtServer{announced: make(map[[20]byte]bool)}
+	cl.AddDhtServer(ds)
+	dialer := make(recordingDialer, 1)
+	var trackerDials int32
+	bound, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash: metainfo.Hash{2},
+		Trackers: [][]string{{s.URL + "/announce"}},
+		Dialers:  []Dialer{dialer},
+		TrackerDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&trackerDials, 1)
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "started", <-events)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&trackerDials))
+	bound.AddPeers([]Peer{{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}}})
+	assert.Equal(t, "127.0.0.2:1", <-dialer)
+	// The bound torrent isn't announced to the DHT, though others are.
+	other, _ := cl.AddTorrentInfoHash(metainfo.Hash{3})
+	for !ds.wasAnnounced(other.InfoHash()) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, ds.wasAnnounced(bound.InfoHash()))
+}
+
+func TestTorrentSpecPeerLocalIp(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.RemoteAddr()
+		c.Close()
+	}()
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	ds := &announceRecordingDhtServer{announced: make(map[[20]byte]bool)}
+	cl.AddDhtServer(ds)
+	_, _, err = cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:    metainfo.Hash{1},
+		PeerLocalIp: net.ParseIP("192.0.2.1"),
+	})
+	assert.Error(t, err)
+	_, _, err = cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:    metainfo.Hash{1},
+		PeerLocalIp: net.IPv4(127, 0, 0, 2),
+		Dialers:     []Dialer{make(recordingDialer, 1)},
+	})
+	assert.Error(t, err)
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:    metainfo.Hash{1},
+		PeerLocalIp: net.IPv4(127, 0, 0, 2),
+	})
+	require.NoError(t, err)
+	tt.AddPeers([]Peer{{Addr: l.Addr()}})
+	select {
+	case addr := <-accepted:
+		assert.Equal(t, "127.0.0.2", addr.(*net.TCPAddr).IP.String())
+	case <-time.After(10 * time.Second):
+		t.Fatal("peer wasn't dialed")
+	}
+	// Unlike with Dialers, the torrent is still announced to the DHT.
+	assert.Eventually(t, func() bool { return ds.wasAnnounced(tt.InfoHash()) }, 10*time.Second, time.Millisecond)
+}
+
+func TestConnFailureReason(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	assert.Equal(t, ConnFailureRefused, connFailureReason(fmt.Errorf("dialing: %w", refused)))
+	assert.Equal(t, ConnFailureTimeout, connFailureReason(fmt.Errorf("dialing: %w", context.DeadlineExceeded)))
+	assert.Equal(t, ConnFailureTimeout, connFailureReason(connFailureError{ConnFailureHandshake, os.ErrDeadlineExceeded}))
+	assert.Equal(t, ConnFailureHeaderObfuscation, connFailureReason(connFailureError{ConnFailureHeaderObfuscation, io.EOF}))
+	assert.Equal(t, ConnFailureHandshake, connFailureReason(connFailureError{ConnFailureHandshake, io.ErrUnexpectedEOF}))
+	assert.Equal(t, ConnFailureUnknown, connFailureReason(errors.New("dial failed")))
+}
+
+func TestTorrentConnFailures(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.DisableUTP = true
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{InfoHash: testutil.GreetingMetaInfo().HashInfoBytes()})
+	require.NoError(t, err)
+	failures := make(chan ConnFailure, 1)
+	tt.SetOnConnFailure(func(f ConnFailure) { failures <- f })
+	// Get a local address that nothing is listening on.
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	refusedAddr := l.Addr()
+	l.Close()
+	// The peer with a bad address isn't added, so it isn't a connection failure.
+	tt.AddPeers([]Peer{
+		{Addr: refusedAddr},
+		{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}},
+	})
+	var f ConnFailure
+	select {
+	case f = <-failures:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for connection failure")
+	}
+	assert.Equal(t, ConnFailureRefused, f.Reason)
+	assert.Equal(t, refusedAddr, f.Addr)
+	assert.Contains(t, f.Network, "tcp")
+	assert.Error(t, f.Err)
+	assert.EqualValues(t, map[ConnFailureReason]int{ConnFailureRefused: 1}, tt.Stats().ConnFailures)
+}
+
+// Check the Info and Name accessors through the transition from a magnet to having the info.
+func TestTorrentInfoAndNameBeforeAndAfterMetadata(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:    mi.HashInfoBytes(),
+		DisplayName: "placeholder",
+	})
+	require.NoError(t, err)
+	assert.Nil(t, tt.Info())
+	_, ok := tt.InfoOk()
+	assert.False(t, ok)
+	assert.Equal(t, "placeholder", tt.Name())
+	select {
+	case <-tt.GotInfo():
+		t.Fatal("shouldn't have info yet")
+	default:
+	}
+	names, unsubscribe := tt.SubscribeName()
+	defer unsubscribe()
+	_, _, err = cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	require.NoError(t, err)
+	<-tt.GotInfo()
+	require.NotNil(t, tt.Info())
+	info, ok := tt.InfoOk()
+	assert.True(t, ok)
+	assert.Equal(t, tt.Info(), info)
+	assert.Equal(t, testutil.GreetingFileName, tt.Name())
+	// The real name replacing the placeholder is sent to subscribers.
+	assert.Equal(t, testutil.GreetingFileName, <-names)
+	// The display name no longer applies.
+	tt.SetDisplayName("other")
+	assert.Equal(t, testutil.GreetingFileName, tt.Name())
+	select {
+	case name := <-names:
+		t.Fatalf("unexpected name change to %q", name)
+	default:
+	}
+	tt.Drop()
+	_, ok = <-names
+	assert.False(t, ok)
+}
+
+func TestAddTorrentMagnetContext(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	ih := mi.HashInfoBytes()
+	uri := "magnet:?xt=urn:btih:" + ih.HexString()
+
+	// Nothing supplies the info.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tt, err := cl.AddTorrentMagnetContext(ctx, uri)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, tt)
+	_, ok := cl.Torrent(ih)
+	assert.False(t, ok, "torrent should have been dropped")
+
+	type result struct {
+		t   *Torrent
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		tt, err := cl.AddTorrentMagnetContext(context.Background(), uri)
+		done <- result{tt, err}
+	}()
+	require.Eventually(t, func() bool {
+		_, ok := cl.Torrent(ih)
+		return ok
+	}, 10*time.Second, time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("returned before the info arrived")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, _, err = cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	require.NoError(t, err)
+	r := <-done
+	require.NoError(t, r.err)
+	assert.NotNil(t, r.t.Info())
+}
+
+// Returns a resolver that answers A and AAAA queries for any name with the ips of each family.
+func fakeResolver(ips ...net.IP) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go serveFakeDNS(s, ips)
+			return c, nil
+		},
+	}
+}
+
+// Serves DNS over a stream connection, which is used because net.Pipe isn't a net.PacketConn.
+func serveFakeDNS(c net.Conn, ips []net.IP) {
+	defer c.Close()
+	for {
+		var l uint16
+		if binary.Read(c, binary.BigEndian, &l) != nil {
+			return
+		}
+		q := make([]byte, l)
+		if _, err := io.ReadFull(c, q); err != nil {
+			return
+		}
+		// The question follows the 12 byte header: a name, then its type and class.
+		end := 12
+		for q[end] != 0 {
+			end += int(q[end]) + 1
+		}
+		end += 5
+		qType := binary.BigEndian.Uint16(q[end-4:])
+		var answers [][]byte
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				if qType == 1 {
+					answers = append(answers, ip4)
+				}
+			} else if qType == 28 {
+				answers = append(answers, ip.To16())
+			}
+		}
+		var resp bytes.Buffer
+		resp.Write(q[:2])
+		binary.Write(&resp, binary.BigEndian, []uint16{0x8180, 1, uint16(len(answers)), 0, 0})
+		resp.Write(q[12:end])
+		for _, a := range answers {
+			// A pointer to the question name, the type, class IN, a TTL and the address.
+			binary.Write(&resp, binary.BigEndian, []uint16{0xc00c, qType, 1, 0, 60, uint16(len(a))})
+			resp.Write(a)
+		}
+		binary.Write(c, binary.BigEndian, uint16(resp.Len()))
+		resp.WriteTo(c)
+	}
+}
+
+func TestClientResolver(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Resolver = fakeResolver(net.IPv4(1, 2, 3, 4))
+	cl.initLogger()
+	ts := trackerScraper{
+		u: url.URL{Scheme: "http", Host: "tracker.example", Path: "/announce"},
+		t: cl.newTorrent(metainfo.Hash{}, badStorage{}),
+	}
+	ip, err := ts.getIp()
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", ip.String())
+	assert.Equal(t, "http://1.2.3.4:80/announce", ts.trackerUrl(ip))
+	ua, err := cl.resolveUDPAddr(context.Background(), "udp4", "router.example:6881")
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4:6881", ua.String())
+	_, err = cl.resolveUDPAddr(context.Background(), "udp6", "router.example:6881")
+	assert.Error(t, err)
+}
+
+func TestTrackerIpPreference(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Resolver = fakeResolver(net.IPv4(1, 2, 3, 4), net.ParseIP("2001:db8::1"))
+	cl.initLogger()
+	getIp := func(scheme string, pref IpPreference) string {
+		cl.config.TrackerIpPreference = pref
+		ts := trackerScraper{
+			u: url.URL{Scheme: scheme, Host: "tracker.example", Path: "/announce"},
+			t: cl.newTorrent(metainfo.Hash{}, badStorage{}),
+		}
+		ip, err := ts.getIp()
+		require.NoError(t, err)
+		return ip.String()
+	}
+	assert.Equal(t, "1.2.3.4", getIp("http", IpPreferenceV4))
+	assert.Equal(t, "2001:db8::1", getIp("http", IpPreferenceV6))
+	assert.Equal(t, "2001:db8::1", getIp("udp", IpPreferenceV6))
+	// The scheme takes precedence.
+	assert.Equal(t, "1.2.3.4", getIp("udp4", IpPreferenceV6))
+	// The other version is used if the preferred one doesn't resolve.
+	cl.config.Resolver = fakeResolver(net.IPv4(1, 2, 3, 4))
+	assert.Equal(t, "1.2.3.4", getIp("http", IpPreferenceV6))
+}
+
+func TestTrackerListUpdateUsesProxy(t *testing.T) {
+	proxied := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		io.WriteString(w, "udp://127.0.0.1:2\n")
+	}))
+	defer proxy.Close()
+	proxyUrl, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	cfg := TestingConfig()
+	cfg.TrackerListURL = "http://trackers.invalid/list"
+	cfg.HTTPProxy = http.ProxyURL(proxyUrl)
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	require.NoError(t, cl.updateTrackerList(context.Background()))
+	assert.Equal(t, cfg.TrackerListURL, <-proxied)
+}
+
+func TestTrackerListUpdate(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		status = http.StatusOK
+		body   = "# best trackers\nhttp://127.0.0.1:1/announce\n\nudp://127.0.0.1:2\nhttp://127.0.0.1:1/announce\n"
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TrackerListURL = s.URL
+	cfg.TrackerListFilter = func(t *Torrent) bool {
+		return t.Name() != "excluded"
+	}
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	addTorrent := func(name string, private bool) *Torrent {
+		info := metainfo.Info{Name: name, PieceLength: 1, Length: 1, Pieces: make([]byte, 20)}
+		if private {
+			info.Private = &private
+		}
+		ib, err := bencode.Marshal(info)
+		require.NoError(t, err)
+		tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+			InfoHash:  metainfo.HashBytes(ib),
+			InfoBytes: ib,
+			Trackers:  [][]string{{"http://127.0.0.1:1/announce"}},
+		})
+		require.NoError(t, err)
+		return tt
+	}
+	trackers := func(tt *Torrent) (ret []string) {
+		for _, u := range tt.Trackers() {
+			ret = append(ret, u.String())
+		}
+		return
+	}
+	tt := addTorrent("public", false)
+	// The list may be fetched before or after the torrent is added.
+	assert.Eventually(t, func() bool {
+		return len(trackers(tt)) == 2
+	}, 10*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"http://127.0.0.1:1/announce", "udp://127.0.0.1:2"}, trackers(tt))
+	assert.False(t, cl.Stats().TrackerListUpdated.IsZero())
+	// Torrents added later get the trackers once their info is known.
+	later := addTorrent("later", false)
+	assert.Eventually(t, func() bool {
+		return len(trackers(later)) == 2
+	}, 10*time.Second, time.Millisecond)
+	private := addTorrent("private", true)
+	excluded := addTorrent("excluded", false)
+	mu.Lock()
+	body = "udp://127.0.0.1:3\n"
+	mu.Unlock()
+	require.NoError(t, cl.updateTrackerList(context.Background()))
+	assert.Equal(t, []string{"http://127.0.0.1:1/announce", "udp://127.0.0.1:2", "udp://127.0.0.1:3"}, trackers(tt))
+	assert.Len(t, trackers(private), 1)
+	assert.Len(t, trackers(excluded), 1)
+	// Failed updates keep the trackers.
+	updated := cl.Stats().TrackerListUpdated
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	require.Error(t, cl.updateTrackerList(context.Background()))
+	assert.Equal(t, updated, cl.Stats().TrackerListUpdated)
+	assert.Len(t, trackers(tt), 3)
+}
+
+func TestTrackerExternalIp(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	cl.lock()
+	port := cl.incomingPeerPort()
+	ip := net.ParseIP("203.0.113.1")
+	// A single tracker isn't trusted.
+	cl.onExternalIpReported("a.example", ip, false)
+	cl.onExternalIpReported("a.example", ip, false)
+	assert.Nil(t, cl.announceIp4())
+	assert.False(t, cl.badPeerIPPort(ip, port))
+	// Nor is one that disagrees.
+	cl.onExternalIpReported("b.example", net.ParseIP("203.0.113.2"), false)
+	assert.Nil(t, cl.announceIp4())
+	cl.onExternalIpReported("c.example", ip, false)
+	assert.Equal(t, "203.0.113.1", cl.announceIp4().String())
+	assert.Equal(t, "203.0.113.1", cl.publicIp(net.IPv4(1, 2, 3, 4)).String())
+	assert.Nil(t, cl.announceIp6())
+	// Peers at our external address are ourselves.
+	assert.True(t, cl.badPeerIPPort(ip, port))
+	assert.False(t, cl.badPeerIPPort(ip, port+1))
+	cl.config.TrustTrackerExternalIp = true
+	cl.onExternalIpReported("d.example", net.ParseIP("2001:db8::1"), true)
+	assert.Equal(t, "2001:db8::1", cl.announceIp6().String())
+	cl.config.PublicIp4 = net.ParseIP("198.51.100.1")
+	assert.Equal(t, "198.51.100.1", cl.announceIp4().String())
+	cl.unlock()
+	stats := cl.Stats()
+	assert.Equal(t, "203.0.113.1", stats.ExternalIp4.String())
+	assert.Equal(t, "2001:db8::1", stats.ExternalIp6.String())
+	assert.Equal(t, 2, stats.ExternalIp4Sources)
+	assert.Equal(t, 1, stats.ExternalIp6Sources)
+}
+
+func TestPeerReportedExternalIp(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	cl.lock()
+	defer cl.unlock()
+	ip := net.ParseIP("203.0.113.1")
+	peer := func(i int) net.IP { return net.IPv4(198, 51, 100, byte(i)) }
+	// Peers are never trusted alone, even with TrustTrackerExternalIp, and many must agree.
+	cl.config.TrustTrackerExternalIp = true
+	for i := 1; i < externalIpPeerAgreement; i++ {
+		cl.onPeerReportedExternalIp(peer(i), ip)
+	}
+	assert.Nil(t, cl.announceIp4())
+	// Addresses that can't be public are ignored.
+	cl.onPeerReportedExternalIp(peer(100), net.ParseIP("192.168.1.1"))
+	assert.Len(t, cl.externalIp4.peers, externalIpPeerAgreement-1)
+	cl.onPeerReportedExternalIp(peer(externalIpPeerAgreement), ip)
+	assert.Equal(t, "203.0.113.1", cl.announceIp4().String())
+	// Old sources are forgotten rather than growing without bound.
+	for i := 0; i < 2*maxExternalIpSources; i++ {
+		cl.onPeerReportedExternalIp(net.IPv4(198, 18, byte(i>>8), byte(i)), net.ParseIP("203.0.113.2"))
+	}
+	assert.Len(t, cl.externalIp4.peers, maxExternalIpSources)
+	assert.Equal(t, "203.0.113.2", cl.announceIp4().String())
+	// Once trackers agree, their votes outlast any number of peer votes, which no longer override
+	// them.
+	cl.config.TrustTrackerExternalIp = false
+	cl.onExternalIpReported("a.example", ip, false)
+	cl.onExternalIpReported("b.example", ip, false)
+	assert.Equal(t, "203.0.113.1", cl.announceIp4().String())
+	for i := 0; i < 2*maxExternalIpSources; i++ {
+		cl.onPeerReportedExternalIp(net.IPv4(198, 19, byte(i>>8), byte(i)), net.ParseIP("203.0.113.3"))
+	}
+	assert.Len(t, cl.externalIp4.trackers, 2)
+	assert.Equal(t, "203.0.113.1", cl.announceIp4().String())
+}
+
+func TestTrackerSelfEntryExternalIp(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	// Tracker hostnames all resolve to the test server.
+	cfg.Resolver = fakeResolver(net.IPv4(127, 0, 0, 1))
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	port := cl.LocalPort()
+	compactPeer := func(ip string, port int) string {
+		return string(append(net.ParseIP(ip).To4(), byte(port>>8), byte(port)))
+	}
+	// Us, a peer on another port, and a LAN peer on our port.
+	peers := compactPeer("203.0.113.7", port) + compactPeer("198.51.100.9", port+1) + compactPeer("192.168.1.2", port)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bencode.MustMarshal(map[string]interface{}{"interval": 1800, "peers": peers}))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+	cl.lock()
+	assert.Equal(t, "203.0.113.7", cl.trackerSelfEntry([]tracker.Peer{
+		{IP: net.ParseIP("203.0.113.7"), Port: port},
+		{IP: net.ParseIP("192.168.1.2"), Port: port},
+	}).String())
+	// Can't tell which is us.
+	assert.Nil(t, cl.trackerSelfEntry([]tracker.Peer{
+		{IP: net.ParseIP("203.0.113.7"), Port: port},
+		{IP: net.ParseIP("203.0.113.8"), Port: port},
+	}))
+	cl.unlock()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{"http://a.example:" + u.Port() + "/announce"}},
+	})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		cl.lock()
+		defer cl.unlock()
+		return cl.externalIp4.agreement(net.ParseIP("203.0.113.7")) == 1
+	}, 10*time.Second, time.Millisecond)
+	// A single tracker isn't enough.
+	assert.Nil(t, cl.Stats().ExternalIp4)
+	tt.AddTrackers([][]string{{"http://b.example:" + u.Port() + "/announce"}})
+	assert.Eventually(t, func() bool { return cl.Stats().ExternalIp4 != nil }, 10*time.Second, time.Millisecond)
+	stats := cl.Stats()
+	assert.Equal(t, "203.0.113.7", stats.ExternalIp4.String())
+	assert.Equal(t, 2, stats.ExternalIp4Sources)
+}
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	mi.AnnounceList = [][]string{{"http://tracker.example/announce"}}
+	newClient := func() *Client {
+		cfg := TestingConfig()
+		// Completion isn't persisted, so only the resume data can say what's complete.
+		cfg.DefaultStorage = storage.NewFileWithCompletion(greetingDir, storage.NewMapPieceCompletion())
+		cl, err := NewClient(cfg)
+		require.NoError(t, err)
+		return cl
+	}
+	cl := newClient()
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	tt.VerifyData()
+	require.EqualValues(t, tt.Length(), tt.BytesCompleted())
+	tt.Files()[0].SetPriority(PiecePriorityHigh)
+	cl.lock()
+	tt.stats.BytesWrittenData.Add(100)
+	tt.seedingSince = time.Now().Add(-time.Hour)
+	cl.unlock()
+	data, err := tt.ExportResumeData()
+	require.NoError(t, err)
+
+	cl2 := newClient()
+	defer cl2.Close()
+	tt2, err := cl2.AddTorrentWithResumeData(data)
+	require.NoError(t, err)
+	assert.Equal(t, tt.InfoHash(), tt2.InfoHash())
+	assert.EqualValues(t, tt.Length(), tt2.BytesCompleted())
+	cl2.lock()
+	for i := range tt2.pieces {
+		// Completion was trusted instead of verified.
+		assert.EqualValues(t, 0, tt2.pieces[i].numVerifies)
+	}
+	assert.EqualValues(t, 100, tt2.stats.BytesWrittenData.Int64())
+	assert.InDelta(t, time.Hour.Seconds(), time.Since(tt2.seedingSince).Seconds(), 5)
+	cl2.unlock()
+	assert.Equal(t, PiecePriorityHigh, tt2.Files()[0].Priority())
+	assert.Equal(t, mi.AnnounceList, tt2.Metainfo().AnnounceList)
+
+	// Data from a newer, incompatible version is refused.
+	var rd resumeData
+	require.NoError(t, bencode.Unmarshal(data, &rd))
+	rd.Version = resumeDataVersion + 1
+	cl3 := newClient()
+	defer cl3.Close()
+	_, err = cl3.AddTorrentWithResumeData(bencode.MustMarshal(rd))
+	assert.Error(t, err)
+
+	// The info is held to the Client's limits.
+	cfg := TestingConfig()
+	cfg.MaxPieces = 1
+	cl4, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl4.Close()
+	_, err = cl4.AddTorrentWithResumeData(data)
+	assert.Error(t, err)
+	assert.Empty(t, cl4.Torrents())
+	cfg = TestingConfig()
+	cfg.MaxMetadataSize = len(mi.InfoBytes) - 1
+	cl5, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl5.Close()
+	_, err = cl5.AddTorrentWithResumeData(data)
+	assert.Error(t, err)
+}
+
+func TestPeerClassifier(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.PeerClassifier = func(ip net.IP) PeerDecision {
+		switch ip.To4()[0] {
+		case 10:
+			return PeerDeny
+		case 192:
+			return PeerDeprioritize
+		}
+		return PeerAllow
+	}
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{InfoHash: testutil.GreetingMetaInfo().HashInfoBytes()})
+	require.NoError(t, err)
+	// Keep the peers rather than dialing them.
+	tt.SetMaxEstablishedConns(0)
+	added := tt.AddPeers([]Peer{
+		{Addr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1}},
+		{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}},
+		{Addr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}},
+		{Addr: &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1}},
+	})
+	assert.Equal(t, 3, added)
+	cl.lock()
+	var ascending []string
+	tt.peers.Each(func(p Peer) {
+		ascending = append(ascending, addrIpOrNil(p.Addr).String())
+	})
+	cl.unlock()
+	require.Len(t, ascending, 3)
+	// The deprioritized peer is dialed last.
+	assert.Equal(t, "192.168.0.1", ascending[0])
+	assert.Equal(t, map[PeerDecision]int64{PeerAllow: 2, PeerDeny: 1, PeerDeprioritize: 1}, cl.Stats().PeerDecisions)
+}
+
+func TestPeerReputation(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.PersistPeerReputation = true
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	good, bad, flaky := net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), net.IPv4(9, 9, 9, 9)
+	cl.lock()
+	cl.adjustPeerReputation(good, reputationGoodPiece, reputationMin)
+	for i := 0; i < 3; i++ {
+		cl.adjustPeerReputation(bad, reputationBadPiece, reputationMin)
+	}
+	for i := 0; i < 20; i++ {
+		cl.adjustPeerReputation(flaky, reputationShortConn, reputationBehaviourFloor)
+	}
+	// Poor behaviour alone doesn't get connections refused, corrupt data does.
+	assert.False(t, cl.rejectPeerReputation(flaky))
+	assert.True(t, cl.rejectPeerReputation(bad))
+	cl.unlock()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{InfoHash: testutil.GreetingMetaInfo().HashInfoBytes()})
+	require.NoError(t, err)
+	// Keep the peers rather than dialing them.
+	tt.SetMaxEstablishedConns(0)
+	tt.AddPeers([]Peer{
+		{Addr: &net.TCPAddr{IP: good, Port: 1}},
+		{Addr: &net.TCPAddr{IP: net.IPv4(2, 3, 4, 5), Port: 1}},
+		{Addr: &net.TCPAddr{IP: bad, Port: 1}},
+	})
+	cl.lock()
+	var ascending []string
+	tt.peers.Each(func(p Peer) {
+		ascending = append(ascending, addrIpOrNil(p.Addr).String())
+	})
+	cl.unlock()
+	assert.Equal(t, []string{bad.String(), "2.3.4.5", good.String()}, ascending)
+	stats := cl.Stats()
+	assert.Equal(t, []PeerReputation{{good.String(), 1}}, stats.TopPeers)
+	assert.Equal(t, []PeerReputation{{bad.String(), -30}, {flaky.String(), -10}}, stats.BottomPeers)
+	// Reputation persists in the data directory if configured.
+	cl.Close()
+	cl, err = NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	assert.Equal(t, stats.TopPeers, cl.Stats().TopPeers)
+	cfg.PersistPeerReputation = false
+	unpersisted, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer unpersisted.Close()
+	assert.Empty(t, unpersisted.Stats().TopPeers)
+}
+
+func TestPeerReputationDecay(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	ip := net.IPv4(5, 6, 7, 8)
+	for i := 0; i < 3; i++ {
+		cl.adjustPeerReputation(ip, reputationBadPiece, reputationMin)
+	}
+	assert.True(t, cl.rejectPeerReputation(ip))
+	age := func(intervals int) {
+		pr := cl.reputations[ip.String()]
+		pr.Updated -= int64(time.Duration(intervals) * reputationDecayInterval / time.Second)
+		cl.reputations[ip.String()] = pr
+	}
+	// Age the reputation so it has decayed past the rejection threshold.
+	age(15)
+	assert.Equal(t, -15, cl.peerReputation(ip))
+	assert.False(t, cl.rejectPeerReputation(ip))
+	// Further changes apply to the decayed score.
+	cl.adjustPeerReputation(ip, reputationGoodPiece, reputationMin)
+	assert.Equal(t, -14, cl.peerReputation(ip))
+	// The least recently scored are forgotten once there are too many.
+	age(1)
+	for i := 0; i < maxPeerReputations; i++ {
+		cl.adjustPeerReputation(net.IPv4(10, 0, byte(i>>8), byte(i)), reputationGoodPiece, reputationMin)
+	}
+	assert.Len(t, cl.reputations, maxPeerReputations)
+	assert.Zero(t, cl.peerReputation(ip))
+}
+
+func TestBadPieceReputation(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	newConn := func(ip net.IP) *PeerConn {
+		return &PeerConn{remoteAddr: &net.TCPAddr{IP: ip, Port: 1}}
+	}
+	a, b := newConn(net.IPv4(1, 2, 3, 4)), newConn(net.IPv4(5, 6, 7, 8))
+	// Peers that shared a bad piece aren't blamed for it.
+	cl.onBadPieceReputation(map[*PeerConn]struct{}{a: {}, b: {}})
+	assert.Empty(t, cl.reputations)
+	cl.onBadPieceReputation(map[*PeerConn]struct{}{a: {}})
+	assert.Equal(t, reputationBadPiece, cl.peerReputation(a.remoteIp()))
+	assert.Zero(t, cl.peerReputation(b.remoteIp()))
+}
+
+func TestPipeStorage(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, _ := seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	seederTorrent.VerifyData()
+	leecher, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer leecher.Close()
+	r, w := io.Pipe()
+	defer r.Close()
+	spec := TorrentSpecFromMetaInfo(mi)
+	spec.Storage = storage.NewPipe(w, 1)
+	leecherTorrent, _, err := leecher.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	b := make([]byte, len(testutil.GreetingFileContents))
+	_, err = io.ReadFull(r, b)
+	require.NoError(t, err)
+	assert.Equal(t, testutil.GreetingFileContents, string(b))
+	require.True(t, leecher.WaitAll())
+}
+
+func TestTorrentStorageInfo(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.DataDir = greetingDir
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	allocated, total, err := tt.StorageInfo()
+	require.NoError(t, err)
+	assert.EqualValues(t, len(testutil.GreetingFileContents), total)
+	assert.Equal(t, total, allocated)
+
+	info, err := mi.UnmarshalInfo()
+	require.NoError(t, err)
+	info.Name = "other"
+	tt, _, err = cl.AddTorrentSpec(&TorrentSpec{
+		InfoBytes: bencode.MustMarshal(info),
+		InfoHash:  metainfo.HashBytes(bencode.MustMarshal(info)),
+		Storage:   badStorage{},
+	})
+	require.NoError(t, err)
+	_, total, err = tt.StorageInfo()
+	assert.Equal(t, ErrStorageAllocationUnknown, err)
+	assert.EqualValues(t, len(testutil.GreetingFileContents), total)
+}
+
+func TestSeedFromMappedPaths(t *testing.T) {
+	contents := map[string]string{
+		"album/a":     "hello, ",
+		"album/sub/b": "world\n",
+	}
+	info := metainfo.Info{
+		Name:        "album",
+		PieceLength: 5,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: int64(len(contents["album/a"]))},
+			{Path: []string{"sub", "b"}, Length: int64(len(contents["album/sub/b"]))},
+		},
+	}
+	require.NoError(t, info.GeneratePieces(func(fi metainfo.FileInfo) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(contents["album/"+strings.Join(fi.Path, "/")])), nil
+	}))
+	infoBytes := bencode.MustMarshal(info)
+	// The data is in a differently named directory, with a flat layout.
+	seederDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(seederDir)
+	diskPaths := map[string]string{
+		"album/a":     "renamed/first",
+		"album/sub/b": "renamed/second",
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(seederDir, "renamed"), 0755))
+	for tp, dp := range diskPaths {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(seederDir, dp), []byte(contents[tp]), 0644))
+	}
+	cfg := TestingConfig()
+	cfg.Seed = true
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, err := seeder.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  metainfo.HashBytes(infoBytes),
+		InfoBytes: infoBytes,
+		Storage: storage.NewFileWithPathMapping(seederDir, storage.NewMapPieceCompletion(), func(torrentPath string) string {
+			return diskPaths[torrentPath]
+		}),
+	})
+	require.NoError(t, err)
+	seederTorrent.VerifyData()
+	require.True(t, seederTorrent.Seeding())
+
+	leecher, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherTorrent, _, err := leecher.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  metainfo.HashBytes(infoBytes),
+		InfoBytes: infoBytes,
+	})
+	require.NoError(t, err)
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	r := leecherTorrent.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world\n", string(b))
+}
+
+func TestInvalidatePiece(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, _ := seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	seederTorrent.VerifyData()
+	cfg = TestingConfig()
+	cfg.Seed = true
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherTorrent, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	assert.Error(t, leecherTorrent.InvalidatePiece(leecherTorrent.NumPieces()))
+	require.NoError(t, leecherTorrent.InvalidatePiece(1))
+	assert.False(t, leecherTorrent.Piece(1).State().Complete)
+	assert.NotZero(t, leecherTorrent.BytesMissing())
+	// The piece is downloaded and verified again.
+	require.True(t, leecher.WaitAll())
+	r := leecherTorrent.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, testutil.GreetingFileContents, string(b))
+}
+
+func TestSeedInitialHaves(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	firstMessage := func(disableHaveAll bool) pp.Message {
+		cfg := TestingConfig()
+		cfg.Seed = true
+		cfg.DataDir = greetingDir
+		cfg.DisableHaveAllForSeeds = disableHaveAll
+		cl, err := NewClient(cfg)
+		require.NoError(t, err)
+		defer cl.Close()
+		tt, _, err := cl.AddTorrent(mi)
+		require.NoError(t, err)
+		tt.VerifyData()
+		require.True(t, tt.Seeding())
+		nc, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", cl.LocalPort()))
+		require.NoError(t, err)
+		defer nc.Close()
+		var pex PeerExtensionBits
+		pex.SetBit(pp.ExtensionBitFast)
+		ih := mi.HashInfoBytes()
+		_, err = pp.Handshake(nc, &ih, [20]byte{}, pex)
+		require.NoError(t, err)
+		nc.SetReadDeadline(time.Now().Add(10 * time.Second))
+		d := pp.Decoder{R: bufio.NewReader(nc), MaxLength: 1 << 20}
+		for {
+			var msg pp.Message
+			require.NoError(t, d.Decode(&msg))
+			if !msg.Keepalive {
+				return msg
+			}
+		}
+	}
+	assert.Equal(t, pp.HaveAll, firstMessage(false).Type)
+	msg := firstMessage(true)
+	assert.Equal(t, pp.Bitfield, msg.Type)
+	assert.Equal(t, []bool{true, true, true}, msg.Bitfield[:3])
+}
+
+func TestMaxPeerMessageLength(t *testing.T) {
+	cl := Client{config: &ClientConfig{}}
+	assert.EqualValues(t, defaultMaxPeerMessageLength, cl.maxPeerMessageLength())
+	// The bitfield of a torrent with the most pieces allowed by default, and its type byte.
+	bitfield := pp.Message{Type: pp.Bitfield, Bitfield: make([]bool, defaultMaxPieces)}
+	b, err := bitfield.MarshalBinary()
+	require.NoError(t, err)
+	assert.EqualValues(t, len(b)-4, cl.maxPeerMessageLength())
+	cfg := TestingConfig()
+	cfg.MaxPeerMessageLength = -1
+	_, err = NewClient(cfg)
+	assert.Error(t, err)
+}
+
+func TestPeerMessageTooLong(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	cfg.MaxPeerMessageLength = 1 << 10
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	tt.VerifyData()
+	nc, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", cl.LocalPort()))
+	require.NoError(t, err)
+	defer nc.Close()
+	ih := mi.HashInfoBytes()
+	_, err = pp.Handshake(nc, &ih, [20]byte{}, PeerExtensionBits{})
+	require.NoError(t, err)
+	// Declare a message far longer than the limit, without sending its contents.
+	_, err = nc.Write([]byte{0x7f, 0xff, 0xff, 0xff, byte(pp.Bitfield)})
+	require.NoError(t, err)
+	nc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// The connection ends with an EOF or a reset, depending on whether we've read what the client
+	// sent first.
+	_, err = io.Copy(ioutil.Discard, nc)
+	if ne, ok := err.(net.Error); ok {
+		require.False(t, ne.Timeout())
+	}
+	assert.Eventually(t, func() bool {
+		cl.lock()
+		defer cl.unlock()
+		return tt.connChurn.drops[ConnDropMessageTooLong] == 1
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestMessageCallbacks(t *testing.T) {
+	seederDataDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(seederDataDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = seederDataDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, _ := seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	seederTorrent.VerifyData()
+	leecherDataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDataDir)
+	cfg = TestingConfig()
+	cfg.DataDir = leecherDataDir
+	// These are called with the Client lock held, which guards the counts.
+	incoming := make(map[pp.MessageType]int)
+	outgoing := make(map[pp.MessageType]int)
+	cfg.Callbacks.IncomingMessage = func(c *PeerConn, msg pp.Message) bool {
+		if !msg.Keepalive {
+			incoming[msg.Type]++
+		}
+		return true
+	}
+	cfg.Callbacks.OutgoingMessage = func(c *PeerConn, msg pp.Message) bool {
+		if !msg.Keepalive {
+			outgoing[msg.Type]++
+		}
+		return true
+	}
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherTorrent, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	leecher.lock()
+	defer leecher.unlock()
+	// There may be more than one connection to the seeder.
+	assert.True(t, incoming[pp.Piece] >= 3)
+	assert.True(t, outgoing[pp.Request] >= incoming[pp.Piece])
+	assert.NotZero(t, outgoing[pp.Interested])
+}
+
+func TestPeerOutOfRangePieces(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	ih := mi.HashInfoBytes()
+	// A magnet, so the number of pieces isn't known.
+	tt, _ := cl.AddTorrentInfoHash(ih)
+	dial := func(id byte, msgs ...pp.Message) net.Conn {
+		nc, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", cl.LocalPort()))
+		require.NoError(t, err)
+		_, err = pp.Handshake(nc, &ih, [20]byte{id}, PeerExtensionBits{})
+		require.NoError(t, err)
+		for _, msg := range msgs {
+			_, err = nc.Write(msg.MustMarshalBinary())
+			require.NoError(t, err)
+		}
+		return nc
+	}
+	waitClosed := func(nc net.Conn) {
+		nc.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err := io.Copy(ioutil.Discard, nc)
+		if ne, ok := err.(net.Error); ok {
+			assert.False(t, ne.Timeout())
+		}
+	}
+	bad := dial(1, pp.Message{Type: pp.Have, Index: 100})
+	defer bad.Close()
+	good := dial(2, pp.Message{Type: pp.Have, Index: 2})
+	defer good.Close()
+	// The Haves are kept until the info is known.
+	require.Eventually(t, func() bool {
+		cl.lock()
+		defer cl.unlock()
+		var mins []pieceIndex
+		for c := range tt.conns {
+			mins = append(mins, c.peerMinPieces)
+		}
+		return len(mins) == 2 && mins[0]+mins[1] == 104
+	}, 10*time.Second, time.Millisecond)
+	require.NoError(t, tt.SetInfoBytes(mi.InfoBytes))
+	waitClosed(bad)
+	// Once the info is known, bad indices are rejected as they're received.
+	for i, msg := range []pp.Message{
+		{Type: pp.Have, Index: 3},
+		{Type: pp.Bitfield, Bitfield: []bool{true, true, true, true}},
+	} {
+		nc := dial(byte(3+i), msg)
+		waitClosed(nc)
+		nc.Close()
+	}
+	cl.lock()
+	defer cl.unlock()
+	assert.Len(t, tt.conns, 1)
+	for c := range tt.conns {
+		assert.True(t, c.peerHasPiece(2))
+	}
+	assert.EqualValues(t, 3, tt.connChurn.dropsMap()[ConnDropError])
+}
+
+func TestPeerConnRequestStats(t *testing.T) {
+	seederDataDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(seederDataDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = seederDataDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, _ := seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	seederTorrent.VerifyData()
+	cfg = TestingConfig()
+	cfg.DataDir, err = ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(cfg.DataDir)
+	cfg.LogLevels = map[string]log.Level{LogSubsystemRequests: log.Debug}
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherTorrent, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	var total RequestStats
+	for _, c := range leecherTorrent.PeerConns() {
+		s := c.RequestStats()
+		total.Requested += s.Requested
+		total.Delivered += s.Delivered
+		total.Cancelled += s.Cancelled
+		total.Rejected += s.Rejected
+		total.Dropped += s.Dropped
+		if s.Delivered != 0 {
+			assert.NotZero(t, s.MaxDeliveryTime)
+			assert.True(t, s.MeanDeliveryTime() <= s.MaxDeliveryTime)
+		}
+	}
+	// Each piece of the greeting is a single chunk, requested once from the only peer.
+	assert.EqualValues(t, leecherTorrent.NumPieces(), total.Delivered)
+	assert.Equal(t, total.Delivered, total.Requested)
+	assert.Zero(t, total.Cancelled)
+	assert.Zero(t, total.Rejected)
+	assert.Zero(t, total.Dropped)
+}
+
+func TestAddHybridTorrentByV2Infohash(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	info, err := mi.UnmarshalInfo()
+	require.NoError(t, err)
+	info.MetaVersion = 2
+	require.NoError(t, mi.SetInfo(&info))
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	v2Magnet := metainfo.Magnet{InfoHashV2: mi.HashInfoBytesV2()}.String()
+	v2Spec, err := TorrentSpecFromMagnetURI(v2Magnet)
+	require.NoError(t, err)
+	// The v2 infohash isn't known to be of any torrent yet.
+	_, _, err = cl.AddTorrentSpec(v2Spec)
+	assert.Error(t, err)
+	// Added by the v1 infohash, the info reveals the v2 infohash.
+	v1Spec := TorrentSpecFromMetaInfo(mi)
+	v1Spec.InfoHashV2 = [32]byte{}
+	tt, new, err := cl.AddTorrentSpec(v1Spec)
+	require.NoError(t, err)
+	require.True(t, new)
+	merged, new, err := cl.AddTorrentSpec(v2Spec)
+	require.NoError(t, err)
+	assert.False(t, new)
+	assert.Equal(t, tt, merged)
+	assert.Len(t, cl.Torrents(), 1)
+	// A spec with both infohashes must agree on the torrent.
+	_, _, err = cl.AddTorrentSpec(&TorrentSpec{InfoHash: metainfo.Hash{1}, InfoHashV2: mi.HashInfoBytesV2()})
+	assert.Error(t, err)
+	tt.Drop()
+	_, _, err = cl.AddTorrentSpec(v2Spec)
+	assert.Error(t, err)
+}
+
+func TestPeerConnectedCallback(t *testing.T) {
+	seederDataDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(seederDataDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = seederDataDir
+	cfg.ExtendedHandshakeClientVersion = "seeder 1.0"
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, _ := seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	seederTorrent.VerifyData()
+	cfg = TestingConfig()
+	cfg.DataDir, err = ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(cfg.DataDir)
+	var mu sync.Mutex
+	connected := make(map[*PeerConn]int)
+	cfg.Callbacks.PeerConnected = func(c *PeerConn) {
+		mu.Lock()
+		defer mu.Unlock()
+		connected[c]++
+		assert.Equal(t, "seeder 1.0", c.PeerClientName)
+		assert.NotZero(t, c.PeerExtensionIDs[pp.ExtensionNameMetadata])
+		assert.NotNil(t, c.RemoteAddr())
+		assert.NotEmpty(t, c.Network())
+		assert.True(t, c.Outgoing())
+		headerEncrypted, _ := c.Encryption()
+		assert.True(t, headerEncrypted)
+		// The Client lock isn't held.
+		c.t.Stats()
+	}
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherTorrent, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, connected)
+	for _, n := range connected {
+		assert.Equal(t, 1, n)
+	}
+}
+
+func TestRegisteredExtension(t *testing.T) {
+	seederDataDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(seederDataDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = seederDataDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	require.NoError(t, seeder.RegisterExtension("test_echo", func(c *PeerConn, payload []byte) {
+		assert.NoError(t, c.SendExtension("test_echo", append(payload, '!')))
+	}))
+	assert.Error(t, seeder.RegisterExtension("test_echo", nil))
+	assert.Error(t, seeder.RegisterExtension(pp.ExtensionNameMetadata, nil))
+	seederTorrent, _, _ := seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	seederTorrent.VerifyData()
+
+	cfg = TestingConfig()
+	cfg.DataDir, err = ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(cfg.DataDir)
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	echoes := make(chan string, 1)
+	require.NoError(t, leecher.RegisterExtension("test_echo", func(c *PeerConn, payload []byte) {
+		echoes <- string(payload)
+	}))
+	leecherTorrent, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	// Connections are only made while there's data wanted.
+	leecherTorrent.DownloadAll()
+	leecherTorrent.AddClientPeer(seeder)
+	var pc *PeerConn
+	// The peer's support is known once its extended handshake is received.
+	require.Eventually(t, func() bool {
+		for _, c := range leecherTorrent.PeerConns() {
+			if c.SendExtension("test_echo", []byte("hello")) == nil {
+				pc = c
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, time.Millisecond)
+	select {
+	case e := <-echoes:
+		assert.Equal(t, "hello!", e)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for echo")
+	}
+	assert.Equal(t, ErrExtensionNotSupported, pc.SendExtension("test_other", nil))
+}
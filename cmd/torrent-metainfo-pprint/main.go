@@ -46,6 +46,7 @@ func processReader(r io.Reader) error {
 		"Announce":     metainfo.Announce,
 		"AnnounceList": metainfo.AnnounceList,
 		"UrlList":      metainfo.UrlList,
+		"HttpSeeds":    metainfo.HttpSeeds,
 	}
 	if flags.Files {
 		d["Files"] = info.UpvertedFiles()
@@ -147,7 +147,7 @@ func main() {
 				if err != nil {
 					log.Fatal(err)
 				}
-				t, err := client.AddTorrent(metaInfo)
+				t, _, err := client.AddTorrent(metaInfo)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -82,7 +82,7 @@ func addTorrents(client *torrent.Client) error {
 				if err != nil {
 					return nil, xerrors.Errorf("error loading torrent file %q: %s\n", arg, err)
 				}
-				t, err := client.AddTorrent(metaInfo)
+				t, _, err := client.AddTorrent(metaInfo)
 				if err != nil {
 					return nil, xerrors.Errorf("adding torrent: %w", err)
 				}
@@ -95,7 +95,7 @@ func addTorrents(client *torrent.Client) error {
 				if err != nil {
 					return nil, xerrors.Errorf("error loading torrent file %q: %s\n", arg, err)
 				}
-				t, err := client.AddTorrent(metaInfo)
+				t, _, err := client.AddTorrent(metaInfo)
 				if err != nil {
 					return nil, xerrors.Errorf("adding torrent: %w", err)
 				}
@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/url"
@@ -32,18 +33,154 @@ type ClientConfig struct {
 	UpnpID                  string
 	// Don't announce to trackers. This only leaves DHT to discover peers.
 	DisableTrackers bool `long:"disable-trackers"`
-	DisablePEX      bool `long:"disable-pex"`
+	// The most redirects followed for HTTP tracker announces. If zero,
+	// tracker.DefaultMaxRedirects is used. If negative, redirects fail the announce.
+	TrackerMaxRedirects int
+	// Allow HTTP tracker announces to be redirected from https to http.
+	TrackerAllowRedirectDowngrade bool
+	// Report the bytes received that failed hash checks to HTTP trackers, with the "corrupt" key.
+	// The count is since the last "started" announce to each tracker.
+	TrackerReportCorrupt bool
+	// If TrackerNumWantMax is set, announces made while the torrent wants peers ask for between
+	// TrackerNumWantMin and TrackerNumWantMax of them, falling from the max as established
+	// connections approach the torrent's target, which is lower when seeding per
+	// SeedingEstablishedConnsPerTorrent. Otherwise the tracker's default is asked for.
+	TrackerNumWantMin int
+	TrackerNumWantMax int
+	// When an HTTP tracker permanently redirects announces, announce to the new URL from then on.
+	TrackerPersistRedirects bool
+	// Announces from different torrents to the same UDP tracker that are due within this long of
+	// the first are sent together, over one socket and connection ID, which saves round trips and
+	// sockets when many torrents share a tracker. Announces the batch doesn't get answers for,
+	// such as when the tracker only handles one request at a time, are retried on their own.
+	// Torrents with a TorrentSpec.TrackerDialContext aren't batched. Zero disables batching.
+	TrackerAnnounceBatchDelay time.Duration
+	// Trackers are disabled after this many consecutive failed announces, or successful announces
+	// that asked for peers and got none, respectively. Announces made while seeding or otherwise not
+	// wanting peers don't count as empty. Zero doesn't disable trackers for that reason. Disabled
+	// trackers are announced to again every TrackerAutoDisableRetestInterval, which defaults to an
+	// hour, and re-enabled once an announce returns peers. See Torrent.TrackerStatuses.
+	TrackerAutoDisableErrors         int
+	TrackerAutoDisableEmpty          int
+	TrackerAutoDisableRetestInterval time.Duration
+	// Returns the TLS config for HTTPS announces to the tracker, such as to trust a private
+	// tracker's CA, or present a client certificate. If it's nil or returns nil, trackers'
+	// certificates aren't verified. The server name defaults to the tracker URL's host.
+	TrackerTLSConfig func(trackerUrl *url.URL) *tls.Config
+	// Which IP version to announce over when a tracker's hostname resolves to addresses of both.
+	// Trackers with a udp4 or udp6 scheme always use that version.
+	TrackerIpPreference IpPreference
+	// Hold off the started announce to trackers while a torrent wants no data and has none to
+	// seed, such as when all its files are deselected.
+	DelayIdleTrackerAnnounces bool
+	DisablePEX                bool `long:"disable-pex"`
+	// Don't use the network at all, such as for tests that only exercise torrents, storage and
+	// piece handling. No sockets are listened on, so there's no incoming connections, DHT or uTP.
+	// Trackers aren't announced to, there's no Local Service Discovery or port forwarding, and
+	// IPBlocklistURL isn't fetched, nor are web seeds. Peers can't be dialed unless a Dialer is
+	// added with Client.AddDialer, and connections can be injected with Client.AddListener.
+	DisableNetwork bool
+
+	// Announce torrents and discover peers on the local network using BEP 14 Local Service
+	// Discovery. Private torrents are never announced.
+	LocalServiceDiscovery bool `long:"lsd"`
+
+	// The largest metadata (info dict) size a peer may advertise for a torrent we're fetching the
+	// info for. Peers advertising more aren't asked for metadata.
+	MaxMetadataSize int
+	// Torrents with infos having more pieces, or more data, are refused before any state is
+	// allocated for them, as protection against crafted metainfo. Zero uses the defaults.
+	MaxPieces      int
+	MaxTorrentSize int64
 
 	// Don't create a DHT.
 	NoDHT            bool `long:"disable-dht"`
 	DhtStartingNodes func(network string) dht.StartingNodesGetter
+	// If non-nil, host:port addresses of DHT bootstrap nodes that replace those from
+	// DhtStartingNodes, unless DhtBootstrapIncludeDefaults is set. An empty, non-nil slice disables
+	// bootstrapping from the defaults entirely, such as for private DHTs. Addresses are resolved
+	// when the DHT servers are created, and any that fail are logged.
+	DhtBootstrapNodes           []string
+	DhtBootstrapIncludeDefaults bool
+	// If positive, nodes we learn of, such as from peers' PORT messages and AddDHTNodes, aren't
+	// added to DHT servers with at least this many nodes in their routing tables. This bounds the
+	// routing table growth we cause, but not that from the servers' own lookups.
+	DhtMaxNodes int
+	// The minimum time between the starts of a torrent's announces to each DHT server, with up to a
+	// tenth added at random so torrents drift apart. If zero, a torrent announces again as soon as
+	// the previous announce ends.
+	DhtAnnounceInterval time.Duration
+	// Rate limits DHT announces across all torrents, so they don't all happen together. Each token
+	// is one announce. The first announce of a torrent that needs data isn't limited, so new
+	// torrents find peers promptly.
+	DhtAnnounceRateLimiter *rate.Limiter
+	// Rate limits "started" tracker announces across all torrents, so that the burst when many
+	// torrents start together is spread out, such as to stay under per-IP limits on shared
+	// trackers. Each token is one announce, so a limit of n per second spreads the announces of m
+	// torrent trackers over m/n seconds. Regular announces aren't limited.
+	TrackerStartedAnnounceRateLimiter *rate.Limiter
+	// How long a torrent's trackers wait after it's added before the first "started" announce, so
+	// that torrents dropped within it never announce. Zero announces at once.
+	TrackerStartedAnnounceDelay time.Duration
+	// The range that the announce intervals trackers give are clamped into, so that a hostile or
+	// buggy tracker can't have us announce to it excessively often, or stop announcing. The
+	// minimum defaults to a minute. Zero for the maximum accepts any interval. The minimum takes
+	// precedence if it's greater. Torrents that want peers announce again after a minute, or the
+	// minimum if that's longer, even when the tracker's interval is longer.
+	TrackerMinAnnounceInterval time.Duration
+	TrackerMaxAnnounceInterval time.Duration
+	// If positive, caps the tracker and DHT announces in progress at once over all torrents.
+	// Torrents wanting peers to download from go first, then those wanting peers to seed to. A DHT
+	// announce takes its slot for as long as it runs.
+	MaxConcurrentDiscovery int
+	// Persists priorities set on pieces and files, and restores them when a torrent's info is
+	// obtained. The piece completion implementations in the storage package can be used here.
+	PiecePriorityStore storage.PiecePriorityStore
+	// Records pieces before they're written to, until their completion is stored. Recorded pieces
+	// are verified when a torrent's info is obtained, so data written before a crash isn't lost.
+	// This should be the same store used for piece completion.
+	PieceWriteJournal storage.PieceWriteJournal
+	// Decides whether to deny or deprioritize peers by IP. Applies to peers from all sources, and to
+	// incoming connections. Nil allows all peers.
+	PeerClassifier PeerClassifier
+	// Decides the order that peers known for a torrent are dialed in. Nil uses
+	// DefaultPeerDialOrder.
+	PeerDialOrder PeerDialOrder
+	// Verify pieces that Client.AddTorrentWithResumeData marks complete, in the background. They
+	// remain readable until a check fails.
+	ResumeDataRecheck bool
+	// If positive, torrents that have all the data they want re-verify a complete piece this often
+	// while no data is being transferred or verified, cycling through the pieces. This detects data
+	// that has changed on disk. Pieces that fail are marked incomplete, so they're downloaded again.
+	ScrubInterval time.Duration
+	// Reading a piece's data to verify it is retried this many times if the read fails with an
+	// error other than the data being missing, such as from a network filesystem. The delay
+	// before each retry starts at PieceHashReadRetryDelay, or 100ms if that's zero, and doubles up
+	// to 10s. Hash mismatches aren't retried, and closing the torrent stops the retries.
+	PieceHashReadRetries    int
+	PieceHashReadRetryDelay time.Duration
 	// Never send chunks to peers.
 	NoUpload bool `long:"no-upload"`
 	// Disable uploading even when it isn't fair.
 	DisableAggressiveUpload bool `long:"disable-aggressive-upload"`
+	// When we have all of a torrent, tell peers that support the fast extension with a full
+	// bitfield, rather than a HaveAll message.
+	DisableHaveAllForSeeds bool
 	// Upload even after there's nothing in it for us. By default uploading is
 	// not altruistic, we'll only upload to encourage the peer to reciprocate.
 	Seed bool `long:"seed"`
+	// If positive, a complete torrent only uploads to this many peers at a time, and the peers are
+	// reassigned periodically.
+	SeedingUploadSlots int
+	// The fraction of SeedingUploadSlots reserved for newcomers, peers with few pieces. Newcomers
+	// take turns in the reserved slots, so they can get pieces to trade with others. Reserved slots
+	// that no newcomer is using go to other peers until the slots are next reassigned.
+	SeedingNewcomerSlotShare float64
+	// Bounds for how often seeding upload slots are reassigned. The interval grows from the minimum
+	// with no peers to the maximum with EstablishedConnsPerTorrent peers, as rechoking large swarms
+	// often is wasteful. A non-positive maximum, the default, uses a fixed 10 seconds.
+	RechokeIntervalMin time.Duration
+	RechokeIntervalMax time.Duration
 	// Only applies to chunks uploaded to peers, to maintain responsiveness
 	// communicating local Client state to peers. Each limiter token
 	// represents one byte. The Limiter's burst must be large enough to fit a
@@ -56,6 +193,22 @@ type ClientConfig struct {
 	// (~4096), and the requested chunk size (~16KiB, see
 	// TorrentSpec.ChunkSize).
 	DownloadRateLimiter *rate.Limiter
+	// The chunk size to use for outbound requests when TorrentSpec.ChunkSize isn't set. It's
+	// clamped to between 1KiB and 128KiB. Larger chunks reduce request overhead, but many peers only
+	// accept 16KiB, which is the default. Peers are told we accept requests up to the larger of
+	// this and 16KiB, and ones that request more are dropped.
+	ChunkSize int
+	// Pieces that have received some chunks, and have no more than this many left, are moved to the
+	// front of each connection's request order among pieces of the same priority, so they're
+	// finished and verified before new pieces are started. This limits how many pieces are in
+	// progress at once. Zero disables it.
+	NearCompletePieceChunks int
+	// The most requests we queue from a peer. Requests beyond this are rejected if the peer
+	// supports the fast extension, and otherwise ignored. Defaults to 250 if not set.
+	MaxPeerRequests int
+	// Peers are disconnected after sending this many requests beyond MaxPeerRequests, as peers that
+	// respect the limit we advertise don't exceed it. Non-positive values mean no limit.
+	MaxPeerRequestOverflows int
 
 	// User-provided Client peer ID. If not present, one is generated automatically.
 	PeerID string
@@ -63,30 +216,86 @@ type ClientConfig struct {
 	DisableUTP bool
 	// For the bittorrent protocol.
 	DisableTCP bool `long:"disable-tcp"`
+	// Dial outgoing TCP connections from the port we listen on, by setting SO_REUSEADDR and
+	// SO_REUSEPORT on the listening and dialing sockets. This makes our connections come from the
+	// port we advertise, which helps with some NATs and firewall rules. uTP connections always come
+	// from the listen port. Listening fails if the platform doesn't support it, and another process
+	// may then share the port, so it's off by default.
+	DialFromListenPort bool
+	// Socket buffer sizes in bytes for TCP connections, and for the UDP socket uTP runs over. Zero
+	// leaves the OS default. Larger buffers allow more data in flight on links with a high
+	// bandwidth-delay product. Listening fails if the OS caps a size below what's asked for, such
+	// as by net.core.rmem_max and net.core.wmem_max on Linux. Sizes aren't applied to
+	// TorrentSpec.Dialers, and uTP sizes require the pure Go uTP implementation (the
+	// disable_libutp build tag, or building without cgo). They aren't supported on Windows.
+	TcpSendBufferSize    int
+	TcpReceiveBufferSize int
+	UtpSendBufferSize    int
+	UtpReceiveBufferSize int
+	// The Differentiated Services Code Point, from 0 to 63, set in the IPv4 type of service or
+	// IPv6 traffic class of packets on peer and tracker connections, so networks can prioritize
+	// other traffic over BitTorrent's. For example 8 (CS1) marks it as low priority bulk traffic.
+	// Zero leaves the OS default. Listening fails if the OS doesn't apply it. It's supported on
+	// Linux, the BSDs and macOS, but not Windows. Like the buffer sizes above, it's not applied to
+	// TorrentSpec.Dialers or TorrentSpec.TrackerDialContext, and uTP requires the pure Go uTP
+	// implementation.
+	SocketDscp int
 	// Called to instantiate storage for each added torrent. Builtin backends
 	// are in the storage package. If not set, the "file" implementation is
 	// used (and Closed when the Client is Closed).
 	DefaultStorage storage.ClientImpl
 
 	HeaderObfuscationPolicy HeaderObfuscationPolicy
+	// If set, outgoing connections make these attempts in order until one succeeds, instead of
+	// racing all the dialers with the HeaderObfuscationPolicy preference and then its fallback.
+	// See TcpThenUtpObfuscated.
+	DialEscalation []DialAttempt
 	// The crypto methods to offer when initiating connections with header obfuscation.
 	CryptoProvides mse.CryptoMethod
 	// Chooses the crypto method to use when receiving connections with header obfuscation.
 	CryptoSelector mse.CryptoSelector
 
-	IPBlocklist      iplist.Ranger
+	IPBlocklist iplist.Ranger
+	// If set, a blocklist is fetched from this URL when the Client starts, and then every
+	// IPBlocklistUpdateInterval if it's non-zero, replacing IPBlocklist. Lists in the P2P plaintext
+	// or CIDR formats, optionally gzipped, are supported. If an update fails, the previous list is
+	// kept, and the update is retried sooner.
+	IPBlocklistURL            string
+	IPBlocklistUpdateInterval time.Duration
+	// If set, a list of tracker URLs, one per line, is fetched from this URL when the Client
+	// starts, and then every TrackerListUpdateInterval if it's non-zero. The trackers are added to
+	// the torrents that don't have them, once their info is known, except private torrents and
+	// those TrackerListFilter returns false for. If an update fails, the trackers already added are
+	// kept, and the update is retried sooner.
+	TrackerListURL            string
+	TrackerListUpdateInterval time.Duration
+	// Returns whether the torrent gets the trackers from TrackerListURL. It's called without the
+	// Client lock held.
+	TrackerListFilter func(t *Torrent) bool
+
 	DisableIPv6      bool `long:"disable-ipv6"`
 	DisableIPv4      bool
 	DisableIPv4Peers bool
+	// If not nil, only these of "tcp4", "tcp6", "udp4" and "udp6" are listened on, and used to
+	// connect to peers. The UDP networks carry uTP and DHT. Peers with addresses in an IP family
+	// that isn't listed aren't connected to, and our public IP for it isn't announced.
+	ListenNetworks []string
 	// Perform logging and any other behaviour that will help debug.
 	Debug  bool `help:"enable debugging"`
 	Logger log.Logger
+	// Minimum levels of messages logged by subsystems, overriding the Info level used unless Debug
+	// is set. Keys are the LogSubsystem constants: "tracker", "dht", "peer-conn", "storage",
+	// "piece" and "requests". For example, {"tracker": log.Debug} shows each tracker announce.
+	LogLevels map[string]log.Level
 
 	// Defines proxy for HTTP requests, such as for trackers. It's commonly set from the result of
 	// "net/http".ProxyURL(HTTPProxy).
 	HTTPProxy func(*http.Request) (*url.URL, error)
 	// HTTPUserAgent changes default UserAgent for HTTP requests
 	HTTPUserAgent string
+	// Resolves the hostnames of trackers and DHT bootstrap nodes. net.DefaultResolver is used if
+	// nil.
+	Resolver *net.Resolver
 	// Updated occasionally to when there's been some changes to client
 	// behaviour in case other clients are assuming anything of us. See also
 	// `bep20`.
@@ -102,25 +311,78 @@ type ClientConfig struct {
 	MinDialTimeout             time.Duration
 	EstablishedConnsPerTorrent int
 	HalfOpenConnsPerTorrent    int
+	// If positive, new connections are warming up until the peer has sent what it has (a bitfield,
+	// have all or none, or a have), or this long has passed. Connections warming up don't count
+	// toward EstablishedConnsPerTorrent, and are limited together with half-open dials by
+	// HalfOpenConnsPerTorrent, so peers that never get going don't block dialing others. Zero
+	// counts connections as established as soon as the handshake completes.
+	ConnWarmUpTimeout time.Duration
 	// Maximum number of peer addresses in reserve.
 	TorrentPeersHighWater int
 	// Minumum number of peers before effort is made to obtain more peers.
 	TorrentPeersLowWater int
 
+	// Connection limits for torrents that are seeding and want no data. Fewer connections are
+	// kept, and if either limit is set, only half are dialed, leaving the rest for peers that
+	// connect to us. Zero uses the limits for downloading above. Torrent.SetMaxEstablishedConns
+	// still caps the established connections.
+	SeedingEstablishedConnsPerTorrent int
+	SeedingHalfOpenConnsPerTorrent    int
+	// If positive, the share of a torrent's established connections that we dial when it's
+	// downloading, and when it's seeding and wants no data. The remaining slots are for peers that
+	// connect to us. Connections beyond the slots for their direction aren't dialed or accepted.
+	// Use a small share to keep nearly all of a seeding torrent's connections for uploading to peers
+	// that find us. Zero leaves the connections unsplit.
+	DownloadingOutgoingConnsShare float64
+	SeedingOutgoingConnsShare     float64
+
 	// Limit how long handshake can take. This is to reduce the lingering
 	// impact of a few bad apples. 4s loses 1% of successful handshakes that
 	// are obtained with 60s timeout, and 5% of unsuccessful handshakes.
 	HandshakesTimeout time.Duration
+	// Limits the total time to establish a peer connection, from when it's opened until all the
+	// handshakes are complete, including receiving the peer's extended handshake if both sides
+	// support it. Unlike PeerIdleTimeout, this only applies during connection establishment. Zero
+	// disables it.
+	ConnEstablishmentTimeout time.Duration
+	// How long to wait without writing to a peer before sending a keep-alive. Zero uses the default
+	// of a minute, comfortably within the two minutes BEP 3 suggests.
+	KeepAliveInterval time.Duration
+	// Connections that haven't received anything from the peer in this long are closed, freeing
+	// the slot for another peer. Peers are expected to send keep-alives, so this should exceed the
+	// keep-alive interval they're likely to use. Zero uses the default of 150s, and a negative
+	// value disables the timeout.
+	PeerIdleTimeout time.Duration
+	// Connections to peers that keep us choked for this long while we're interested are closed,
+	// freeing the slot for another peer, and the peer's reputation is lowered so it's dialed after
+	// others. Zero disables the timeout.
+	PeerChokedTimeout time.Duration
+	// Peers that declare a longer wire protocol message than this are disconnected before it's
+	// read, so they can't have us allocate for it. Zero uses the default, which fits the bitfield
+	// of a torrent with MaxPieces at its default. Negative values are rejected by NewClient.
+	MaxPeerMessageLength int
 
 	// The IP addresses as our peers should see them. May differ from the
 	// local interfaces due to NAT or other network configurations.
 	PublicIp4 net.IP
 	PublicIp6 net.IP
+	// Trackers (BEP 24) and peers (BEP 10) may report the IP they see us at. Where PublicIp4 or
+	// PublicIp6 is unset, that IP is announced to trackers, and peers at it on our port are
+	// ignored. It's used once two trackers or ten peers agree on it, or as soon as any tracker
+	// reports it if this is set. Peers reporting addresses that can't be public are ignored.
+	TrustTrackerExternalIp bool
 
 	DisableAcceptRateLimiting bool
 	// Don't add connections that have the same peer ID as an existing
 	// connection for a given Torrent.
 	DropDuplicatePeerIds bool
+	// Adding a torrent that's already present returns it unchanged, except that a missing Info is
+	// set. By default, trackers, web seeds and other sources from the new spec are merged in.
+	DisableTorrentMerging bool
+	// Keep peer reputations in DataDir between sessions. Reputation decides the order peers are
+	// dialed in, and connections from peers that sent corrupt data are refused. Reputations decay
+	// back to neutral over time either way.
+	PersistPeerReputation bool
 
 	ConnTracker *conntrack.Instance
 
@@ -128,6 +390,45 @@ type ClientConfig struct {
 	DHTOnQuery func(query *krpc.Msg, source net.Addr) (propagate bool)
 
 	DefaultRequestStrategy RequestStrategyMaker
+	// The largest fraction of a torrent's outstanding requests that a single connection may hold
+	// while other connections could take more. This spreads requests across peers, so that a fast
+	// peer choking or dropping doesn't stall progress. Values outside (0, 1) disable the limit.
+	MaxConnRequestShare float64
+	// Pieces with deadlines are requested before others. Once a piece's deadline is this close, its
+	// chunks are requested from every peer that has it, as in end game. Zero disables this.
+	PieceDeadlineEscalation time.Duration
+
+	// When pieces are verified after all their chunks are received.
+	PieceVerification PieceVerification
+	// With PieceVerificationDeferred, received pieces are verified once this many are waiting, or
+	// PieceVerificationDelay after the first of them was received.
+	PieceVerificationBatchSize int
+	PieceVerificationDelay     time.Duration
+	// The most pieces of a torrent that are hashed at once, such as when checking the existing data
+	// of a torrent that's added. More hashers read more of the storage at once, which speeds up
+	// verification on storage that handles parallel reads well. Zero uses the default of 2.
+	PieceHashersPerTorrent int
+
+	// Determines how the uploaded, downloaded and left values are reported in tracker announces.
+	AnnounceBytesReporting AnnounceBytesReporting
+	// Computes the values reported when AnnounceBytesReporting is AnnounceBytesReportingCustom. It's
+	// given the actual values, and is called with the Client lock held.
+	AnnounceBytesReporter func(ih InfoHash, actual AnnounceBytes) AnnounceBytes
+
+	Callbacks Callbacks
+	// If positive, a torrent doesn't request data until it has this many peer connections, or until
+	// MinPeersBeforeRequestingTimeout after its first, so that its first pieces are chosen knowing
+	// more peers' availability. The timeout defaults to 10 seconds. By default requests start at
+	// once.
+	MinPeersBeforeRequesting        int
+	MinPeersBeforeRequestingTimeout time.Duration
+	// How long a torrent goes without connected peers or successful announces before
+	// Callbacks.OnTorrentStalled is called. Time paused doesn't count. Zero uses a default of 10
+	// minutes.
+	TorrentStallTimeout time.Duration
+	// How often torrents sample their transfer rates and completion for Torrent.RateHistory. Zero
+	// disables sampling.
+	RateHistoryInterval time.Duration
 }
 
 func (cfg *ClientConfig) SetListenAddr(addr string) *ClientConfig {
@@ -151,12 +452,22 @@ func NewDefaultClientConfig() *ClientConfig {
 		TorrentPeersHighWater:          500,
 		TorrentPeersLowWater:           50,
 		HandshakesTimeout:              4 * time.Second,
+		ConnEstablishmentTimeout:       20 * time.Second,
+		IPBlocklistUpdateInterval:      24 * time.Hour,
+		MaxMetadataSize:                defaultMaxMetadataSize,
+		MaxPieces:                      defaultMaxPieces,
+		MaxTorrentSize:                 defaultMaxTorrentSize,
+		ChunkSize:                      defaultChunkSize,
+		MaxPeerRequests:                maxRequests,
+		MaxPeerRequestOverflows:        maxRequests,
+		MaxPeerMessageLength:           defaultMaxPeerMessageLength,
 		DhtStartingNodes: func(network string) dht.StartingNodesGetter {
 			return func() ([]dht.Addr, error) { return dht.GlobalBootstrapAddrs(network) }
 		},
 		ListenHost:                func(string) string { return "" },
 		UploadRateLimiter:         unlimited,
 		DownloadRateLimiter:       unlimited,
+		DhtAnnounceRateLimiter:    unlimited,
 		ConnTracker:               conntrack.NewInstance(),
 		DisableAcceptRateLimiting: true,
 		HeaderObfuscationPolicy: HeaderObfuscationPolicy{
@@ -168,7 +479,13 @@ func NewDefaultClientConfig() *ClientConfig {
 		ListenPort:     42069,
 		Logger:         log.Default,
 
-		DefaultRequestStrategy: RequestStrategyDuplicateRequestTimeout(5 * time.Second),
+		DefaultRequestStrategy:     RequestStrategyDuplicateRequestTimeout(5 * time.Second),
+		SeedingNewcomerSlotShare:   0.25,
+		PieceVerificationBatchSize: 16,
+		PieceVerificationDelay:     time.Second,
+		PieceDeadlineEscalation:    2 * time.Second,
+
+		TrackerStartedAnnounceRateLimiter: unlimited,
 	}
 	//cc.ConnTracker.SetNoMaxEntries()
 	//cc.ConnTracker.Timeout = func(conntrack.Entry) time.Duration { return 0 }
@@ -179,3 +496,41 @@ type HeaderObfuscationPolicy struct {
 	RequirePreferred bool // Whether the value of Preferred is a strict requirement.
 	Preferred        bool // Whether header obfuscation is preferred.
 }
+
+type AnnounceBytesReporting int
+
+const (
+	// Report the actual bytes transferred and left. This is the default.
+	AnnounceBytesReportingActual AnnounceBytesReporting = iota
+	// Report zero uploaded and downloaded. Left is still reported accurately so that trackers can
+	// determine whether we're seeding.
+	AnnounceBytesReportingZeroed
+	// Report the values returned from ClientConfig.AnnounceBytesReporter.
+	AnnounceBytesReportingCustom
+)
+
+type PieceVerification int
+
+const (
+	// Verify pieces as soon as all their chunks are received. This is the default.
+	PieceVerificationImmediate PieceVerification = iota
+	// Collect received pieces and verify them in batches, trading latency for fewer, larger runs of
+	// disk reads.
+	PieceVerificationDeferred
+)
+
+type IpPreference int
+
+const (
+	// Use the first acceptable address resolved. This is the default.
+	IpPreferenceNone IpPreference = iota
+	IpPreferenceV4
+	IpPreferenceV6
+)
+
+// The byte counts given in a tracker announce.
+type AnnounceBytes struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+// Why an established peer connection ended.
+type ConnDropReason int
+
+const (
+	ConnDropUnknown ConnDropReason = iota
+	// The peer closed the connection.
+	ConnDropPeerClosed
+	// Nothing was received from the peer within ClientConfig.PeerIdleTimeout.
+	ConnDropIdle
+	// The peer didn't send its extended handshake within ClientConfig.ConnEstablishmentTimeout.
+	ConnDropHandshakeTimeout
+	// Reading from or writing to the connection failed, or the peer broke the protocol.
+	ConnDropError
+	// The connection made way for a better one, as the torrent was at its connection limit.
+	ConnDropOverLimit
+	// Another connection had the same peer ID. See ClientConfig.DropDuplicatePeerIds.
+	ConnDropDuplicate
+	// The peer was banned for sending data that failed verification.
+	ConnDropBadData
+	// The torrent was paused or closed.
+	ConnDropLocal
+	// The peer declared a message longer than ClientConfig.MaxPeerMessageLength.
+	ConnDropMessageTooLong
+	// The peer kept us choked for ClientConfig.PeerChokedTimeout while we were interested.
+	ConnDropSnubbed
+	numConnDropReasons
+)
+
+func (r ConnDropReason) String() string {
+	switch r {
+	case ConnDropPeerClosed:
+		return "peer closed"
+	case ConnDropIdle:
+		return "idle"
+	case ConnDropHandshakeTimeout:
+		return "handshake timeout"
+	case ConnDropError:
+		return "error"
+	case ConnDropOverLimit:
+		return "over limit"
+	case ConnDropDuplicate:
+		return "duplicate"
+	case ConnDropBadData:
+		return "bad data"
+	case ConnDropLocal:
+		return "local"
+	case ConnDropMessageTooLong:
+		return "message too long"
+	case ConnDropSnubbed:
+		return "snubbed"
+	default:
+		return "unknown"
+	}
+}
+
+// Counts of established connections and their drops, for a Torrent or the Client.
+type connChurn struct {
+	established int
+	drops       [numConnDropReasons]int
+}
+
+// Returns the drops that occurred by reason.
+func (me *connChurn) dropsMap() (ret map[ConnDropReason]int) {
+	for r, n := range me.drops {
+		if n == 0 {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[ConnDropReason]int)
+		}
+		ret[ConnDropReason(r)] = n
+	}
+	return
+}
+
+// Categorizes the error that ended the connection's main read loop.
+func connDropReasonForReadErr(err error) ConnDropReason {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return ConnDropUnknown
+	case errors.Is(err, pp.ErrMessageTooLong):
+		return ConnDropMessageTooLong
+	case errors.Is(err, io.EOF):
+		return ConnDropPeerClosed
+	case errors.As(err, &ne) && ne.Timeout():
+		return ConnDropIdle
+	default:
+		return ConnDropError
+	}
+}
+
+// Records why the connection is being dropped, if a reason isn't already known. The first reason
+// given is the cause, as closing the connection will cause its reader and writer to fail too.
+func (c *PeerConn) setDropReason(r ConnDropReason) {
+	if c.dropReason == ConnDropUnknown && !c.closed.IsSet() {
+		c.dropReason = r
+	}
+}
+
+func (c *PeerConn) closeWithReason(r ConnDropReason) {
+	c.setDropReason(r)
+	c.close()
+}
+
+func (t *Torrent) dropConnectionWithReason(c *PeerConn, r ConnDropReason) {
+	c.setDropReason(r)
+	t.dropConnection(c)
+}
+
+func (t *Torrent) onConnEstablished() {
+	t.connChurn.established++
+	t.cl.connChurn.established++
+}
+
+func (t *Torrent) onConnDropped(c *PeerConn) {
+	t.connChurn.drops[c.dropReason]++
+	t.cl.connChurn.drops[c.dropReason]++
+}
@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Why an outgoing connection attempt to a peer failed.
+type ConnFailureReason int
+
+const (
+	ConnFailureUnknown ConnFailureReason = iota
+	// The peer's address was rejected when it came to be dialed, such as by the IP blocklist, or
+	// because it's known to be our own. Peers rejected when they're added aren't counted.
+	ConnFailureBlocked
+	// The peer actively refused the connection.
+	ConnFailureRefused
+	// Dialing or a handshake took too long.
+	ConnFailureTimeout
+	// The header obfuscation (encryption) handshake failed, typically because the peer doesn't
+	// support it or requires it.
+	ConnFailureHeaderObfuscation
+	// The BitTorrent protocol handshake failed, or was for another torrent.
+	ConnFailureHandshake
+)
+
+func (r ConnFailureReason) String() string {
+	switch r {
+	case ConnFailureBlocked:
+		return "blocked"
+	case ConnFailureRefused:
+		return "refused"
+	case ConnFailureTimeout:
+		return "timeout"
+	case ConnFailureHeaderObfuscation:
+		return "header obfuscation"
+	case ConnFailureHandshake:
+		return "handshake"
+	default:
+		return "unknown"
+	}
+}
+
+// Describes a failed outgoing connection attempt. See Torrent.SetOnConnFailure.
+type ConnFailure struct {
+	Addr net.Addr
+	// The transport that was last tried, if any was.
+	Network string
+	Reason  ConnFailureReason
+	Err     error
+}
+
+var errBadPeerAddr = errors.New("bad peer address")
+
+// Attaches a ConnFailureReason to an error from a stage of establishing a connection.
+type connFailureError struct {
+	reason ConnFailureReason
+	err    error
+}
+
+func (me connFailureError) Error() string {
+	return me.err.Error()
+}
+
+func (me connFailureError) Unwrap() error {
+	return me.err
+}
+
+func connFailureReason(err error) ConnFailureReason {
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return ConnFailureTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ConnFailureRefused
+	}
+	var cfe connFailureError
+	if errors.As(err, &cfe) {
+		return cfe.reason
+	}
+	return ConnFailureUnknown
+}
+
+func (t *Torrent) onConnFailure(f ConnFailure) {
+	if t.connFailures == nil {
+		t.connFailures = make(map[ConnFailureReason]int)
+	}
+	t.connFailures[f.Reason]++
+	if t.userOnConnFailure != nil {
+		go t.userOnConnFailure(f)
+	}
+}
+
+// Sets a function to be called with the details of each failed outgoing connection attempt for
+// the torrent.
+func (t *Torrent) SetOnConnFailure(f func(ConnFailure)) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.userOnConnFailure = f
+}
@@ -0,0 +1,32 @@
+package torrent
+
+import "math"
+
+// The established connection slots for connections we dial, and for those peers make to us. ok is
+// false if the torrent's connections aren't split by direction. See
+// ClientConfig.DownloadingOutgoingConnsShare.
+func (t *Torrent) connSlots() (outgoing, incoming int, ok bool) {
+	share := t.cl.config.DownloadingOutgoingConnsShare
+	if t.seedingConservatively() {
+		share = t.cl.config.SeedingOutgoingConnsShare
+	}
+	if share <= 0 {
+		return
+	}
+	target := t.targetConns()
+	outgoing = int(math.Round(math.Min(share, 1) * float64(target)))
+	return outgoing, target - outgoing, true
+}
+
+// Whether there's a free slot for a connection in the given direction.
+func (t *Torrent) haveConnSlot(incoming bool) bool {
+	outgoing, maxIncoming, ok := t.connSlots()
+	if !ok {
+		return true
+	}
+	received := t.numReceivedConns()
+	if incoming {
+		return received < maxIncoming
+	}
+	return len(t.conns)-received < outgoing
+}
@@ -23,6 +23,10 @@ type ConnStats struct {
 	BytesRead           Count
 	BytesReadData       Count
 	BytesReadUsefulData Count
+	// Data that was wasted: chunks we already had, and, at the Torrent level and above, pieces that
+	// failed verification. The latter are also counted in BytesReadUsefulData, as they weren't
+	// known to be bad when received.
+	BytesReadWastedData Count
 
 	ChunksWritten Count
 
@@ -37,6 +41,11 @@ type ConnStats struct {
 	// Number of pieces data was written to, that subsequently failed verification. Note that a
 	// connection may not have been the sole dirtier of a piece.
 	PiecesDirtiedBad Count
+
+	// Requests from the peer that we rejected, with the fast extension.
+	RequestsRejected Count
+	// Requests from the peer beyond ClientConfig.MaxPeerRequests.
+	RequestsOverflowed Count
 }
 
 func (me *ConnStats) Copy() (ret ConnStats) {
@@ -69,6 +78,10 @@ func (me *Count) MarshalJSON() ([]byte, error) {
 	return json.Marshal(me.n)
 }
 
+func (me *Count) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &me.n)
+}
+
 func (cs *ConnStats) wroteMsg(msg *pp.Message) {
 	// TODO: Track messages and not just chunks.
 	switch msg.Type {
@@ -0,0 +1,60 @@
+package torrent
+
+import (
+	"time"
+)
+
+// Starts the warm-up of a connection being added to the torrent. See
+// ClientConfig.ConnWarmUpTimeout.
+func (t *Torrent) startConnWarmUp(c *PeerConn) {
+	timeout := t.cl.config.ConnWarmUpTimeout
+	if timeout <= 0 {
+		return
+	}
+	c.warmingUp = true
+	t.numWarmingUpConns++
+	c.warmUpTimer = time.AfterFunc(timeout, func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if c.closed.IsSet() {
+			return
+		}
+		c.warmedUp()
+	})
+}
+
+// Ends a connection's warm-up without applying the established connection limit, such as when
+// it's deleted. Returns false if it wasn't warming up.
+func (t *Torrent) endConnWarmUp(c *PeerConn) bool {
+	if !c.warmingUp {
+		return false
+	}
+	c.warmingUp = false
+	t.numWarmingUpConns--
+	c.warmUpTimer.Stop()
+	return true
+}
+
+// Connections that have finished warming up.
+func (t *Torrent) numWarmConns() int {
+	return len(t.conns) - t.numWarmingUpConns
+}
+
+// Called when the peer has told us what it has, or its warm-up timed out. The connection now
+// counts toward the established connection limit, and it or a bad connection is dropped if that's
+// exceeded.
+func (cn *PeerConn) warmedUp() {
+	t := cn.t
+	if !t.endConnWarmUp(cn) {
+		return
+	}
+	if t.numWarmConns() <= t.targetConns() {
+		return
+	}
+	drop := t.worstBadConn()
+	if drop == nil || drop.warmingUp {
+		drop = cn
+	}
+	drop.closeWithReason(ConnDropOverLimit)
+	t.deleteConnection(drop)
+}
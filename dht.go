@@ -49,3 +49,43 @@ func (me anacrolixDhtServerWrapper) Ping(addr *net.UDPAddr) {
 }
 
 var _ DhtServer = anacrolixDhtServerWrapper{}
+
+// Whether the server's routing table is at ClientConfig.DhtMaxNodes, so nodes we learn of shouldn't
+// be added to it.
+func (cl *Client) dhtServerFull(s DhtServer) bool {
+	if cl.config.DhtMaxNodes <= 0 {
+		return false
+	}
+	ss, ok := s.Stats().(dht.ServerStats)
+	return ok && ss.Nodes >= cl.config.DhtMaxNodes
+}
+
+// Returns the nodes in the routing tables of the Client's DHT servers, for passing to
+// Client.ImportDHTNodes when the Client is restarted. Servers that don't expose their routing table
+// are skipped.
+func (cl *Client) ExportDHTNodes() (ret []krpc.NodeInfo) {
+	seen := make(map[string]struct{})
+	cl.eachDhtServer(func(s DhtServer) {
+		ns, ok := s.(interface{ Nodes() []krpc.NodeInfo })
+		if !ok {
+			return
+		}
+		for _, ni := range ns.Nodes() {
+			k := ni.Addr.String()
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			ret = append(ret, ni)
+		}
+	})
+	return
+}
+
+// Adds nodes, such as those from Client.ExportDHTNodes, to the routing tables of the Client's DHT
+// servers. Nodes with IDs are added directly, the rest are pinged first.
+func (cl *Client) ImportDHTNodes(nodes []krpc.NodeInfo) {
+	for _, ni := range nodes {
+		cl.addDhtNodeInfo(ni)
+	}
+}
@@ -0,0 +1,68 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// A step in ClientConfig.DialEscalation.
+type DialAttempt struct {
+	// Only dialers with a network containing this are used, such as "tcp", or "udp" for uTP. If
+	// empty, all the torrent's dialers race.
+	Network string
+	// Whether to obfuscate the header with MSE. Attempts that conflict with a required
+	// HeaderObfuscationPolicy are skipped.
+	ObfuscateHeader bool
+	// How long to wait for the dial. If zero, the torrent's dial timeout is used.
+	Timeout time.Duration
+}
+
+// A DialEscalation that tries plain TCP first, and then uTP with header obfuscation.
+var TcpThenUtpObfuscated = []DialAttempt{
+	{Network: "tcp"},
+	{Network: "udp", ObfuscateHeader: true},
+}
+
+// Returns the dialers for the attempt, in the order given.
+func dialAttemptDialers(dialers []Dialer, a DialAttempt) (ret []Dialer) {
+	for _, d := range dialers {
+		if strings.Contains(d.LocalAddr().Network(), a.Network) {
+			ret = append(ret, d)
+		}
+	}
+	return
+}
+
+func (a DialAttempt) allowed(policy HeaderObfuscationPolicy) bool {
+	return !policy.RequirePreferred || a.ObfuscateHeader == policy.Preferred
+}
+
+// Makes each attempt in ClientConfig.DialEscalation in turn, until one succeeds. Returns the last
+// attempt's network and error if none does.
+func (cl *Client) establishOutgoingConnEscalating(t *Torrent, addr net.Addr) (c *PeerConn, network string, err error) {
+	cl.rLock()
+	dialers := t.peerDialers()
+	cl.rUnlock()
+	err = errors.New("no dial attempts apply")
+	for i, a := range cl.config.DialEscalation {
+		if !a.allowed(cl.config.HeaderObfuscationPolicy) {
+			continue
+		}
+		ds := dialAttemptDialers(dialers, a)
+		if len(ds) == 0 {
+			continue
+		}
+		c, network, err = cl.establishOutgoingConnEx(t, addr, a.ObfuscateHeader, ds, a.Timeout)
+		if err == nil {
+			torrent.Add(fmt.Sprintf("initiated conn on dial attempt %d", i+1), 1)
+			if c != nil {
+				c.dialAttempt = i + 1
+			}
+			return
+		}
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 
 	"github.com/anacrolix/missinggo/perf"
+	"golang.org/x/xerrors"
 )
 
 type Dialer interface {
@@ -43,3 +44,27 @@ func (me netDialerLocalAddr) String() string {
 	}
 	return me.addr.String()
 }
+
+// Returns a TCP dialer from the local IP, with the Client's socket options. See
+// TorrentSpec.PeerLocalIp.
+func (cl *Client) localIpDialer(ip net.IP) (Dialer, error) {
+	network := "tcp4"
+	if ip.To4() == nil {
+		network = "tcp6"
+	}
+	// Binding a listener is the portable way to check the IP is one of ours.
+	l, err := net.Listen(network, net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, xerrors.Errorf("local ip %v not assignable: %w", ip, err)
+	}
+	l.Close()
+	opts := cl.socketOpts()
+	opts.dialFromListenPort = false
+	return NetDialer{
+		Network: network,
+		Dialer: net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: ip},
+			Control:   opts.tcpControl(),
+		},
+	}, nil
+}
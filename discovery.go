@@ -0,0 +1,71 @@
+package torrent
+
+// How much a torrent needs peer discovery, which orders tracker and DHT announces when
+// ClientConfig.MaxConcurrentDiscovery is reached.
+type DiscoveryPriority int
+
+const (
+	// The torrent doesn't want peers, such as when it has plenty, or nothing to download or seed.
+	// Its tracker announces are less frequent while MaxConcurrentDiscovery is set.
+	DiscoveryPriorityLow DiscoveryPriority = iota
+	// The torrent wants peers to seed to.
+	DiscoveryPriorityNormal
+	// The torrent wants peers to download from.
+	DiscoveryPriorityHigh
+
+	numDiscoveryPriorities = iota
+)
+
+func (t *Torrent) discoveryPriority() DiscoveryPriority {
+	if !t.wantPeers() {
+		return DiscoveryPriorityLow
+	}
+	if t.needData() {
+		return DiscoveryPriorityHigh
+	}
+	return DiscoveryPriorityNormal
+}
+
+// Blocks until the torrent can start a discovery operation, per ClientConfig.MaxConcurrentDiscovery.
+// Returns false if the torrent or Client is closed. The slot must be released with
+// releaseDiscoverySlot.
+func (cl *Client) acquireDiscoverySlot(t *Torrent) bool {
+	prio := t.discoveryPriority()
+	cl.discoveryWaiting[prio]++
+	defer func() {
+		cl.discoveryWaiting[prio]--
+	}()
+	for !cl.discoverySlotAvailable(prio) {
+		if t.closed.IsSet() || cl.closed.IsSet() {
+			return false
+		}
+		cl.event.Wait()
+		// The priority may have changed while waiting.
+		cl.discoveryWaiting[prio]--
+		prio = t.discoveryPriority()
+		cl.discoveryWaiting[prio]++
+	}
+	cl.activeDiscovery++
+	return true
+}
+
+func (cl *Client) discoverySlotAvailable(prio DiscoveryPriority) bool {
+	max := cl.config.MaxConcurrentDiscovery
+	if max <= 0 {
+		return true
+	}
+	if cl.activeDiscovery >= max {
+		return false
+	}
+	for higher := prio + 1; higher < numDiscoveryPriorities; higher++ {
+		if cl.discoveryWaiting[higher] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (cl *Client) releaseDiscoverySlot() {
+	cl.activeDiscovery--
+	cl.event.Broadcast()
+}
@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func TestDiscoverySlotsByPriority(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Seed = true
+	cl.config.MaxConcurrentDiscovery = 1
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	mi := testutil.GreetingMetaInfo()
+	downloading := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	seeding := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, seeding.setInfoBytes(mi.InfoBytes))
+	idle := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, idle.setInfoBytes(mi.InfoBytes))
+	idle.paused.Set()
+	assert.Equal(t, DiscoveryPriorityHigh, downloading.DiscoveryPriority())
+	assert.Equal(t, DiscoveryPriorityNormal, seeding.DiscoveryPriority())
+	assert.Equal(t, DiscoveryPriorityLow, idle.DiscoveryPriority())
+
+	acquired := make(chan *Torrent)
+	acquire := func(tt *Torrent, prio DiscoveryPriority) {
+		go func() {
+			cl.lock()
+			defer cl.unlock()
+			if cl.acquireDiscoverySlot(tt) {
+				acquired <- tt
+			}
+		}()
+		// Wait for it to queue.
+		for {
+			cl.lock()
+			waiting := cl.discoveryWaiting[prio]
+			cl.unlock()
+			if waiting != 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cl.lock()
+	require.True(t, cl.acquireDiscoverySlot(seeding))
+	cl.unlock()
+	acquire(idle, DiscoveryPriorityLow)
+	acquire(downloading, DiscoveryPriorityHigh)
+	release := func() {
+		cl.lock()
+		cl.releaseDiscoverySlot()
+		cl.unlock()
+	}
+	// The torrent wanting data goes ahead of the idle one that queued first.
+	release()
+	assert.Equal(t, downloading, <-acquired)
+	release()
+	assert.Equal(t, idle, <-acquired)
+	// Closed torrents give up waiting.
+	cl.lock()
+	downloading.close()
+	assert.False(t, cl.acquireDiscoverySlot(downloading))
+	cl.unlock()
+}
@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+
+	"github.com/anacrolix/missinggo/v2/bitmap"
+)
+
+// A byte range of a Torrent's data that's downloaded at high priority. Ranges may span files, and
+// overlap other ranges. Created with Torrent.DownloadRange.
+type DownloadRange struct {
+	t      *Torrent
+	off    int64
+	length int64
+	// The pieces that cover the range.
+	begin, end pieceIndex
+}
+
+// Downloads the pieces covering the bytes [off, off+length) of the torrent at high priority, until
+// the returned DownloadRange is closed. The range is clamped to the torrent's length. The info must
+// be available.
+func (t *Torrent) DownloadRange(off, length int64) *DownloadRange {
+	t.cl.lock()
+	defer t.cl.unlock()
+	r := &DownloadRange{
+		t:      t,
+		off:    off,
+		length: length,
+	}
+	r.begin, r.end = t.byteRegionPieces(off, length)
+	if t.downloadRanges == nil {
+		t.downloadRanges = make(map[*DownloadRange]struct{})
+	}
+	t.downloadRanges[r] = struct{}{}
+	t.downloadRangesChanged(r.begin, r.end)
+	return r
+}
+
+func (t *Torrent) downloadRangesChanged(begin, end pieceIndex) {
+	t._downloadRangePieces.Clear()
+	for r := range t.downloadRanges {
+		t._downloadRangePieces.AddRange(bitmap.BitIndex(r.begin), bitmap.BitIndex(r.end))
+	}
+	t.updatePiecePriorities(begin, end)
+}
+
+// The offset and length of the range that was requested.
+func (r *DownloadRange) Range() (off, length int64) {
+	return r.off, r.length
+}
+
+// The pieces [begin, end) that cover the range.
+func (r *DownloadRange) Pieces() (begin, end pieceIndex) {
+	return r.begin, r.end
+}
+
+// Returns whether all the pieces covering the range are complete.
+func (r *DownloadRange) Complete() bool {
+	r.t.cl.rLock()
+	defer r.t.cl.rUnlock()
+	return r.complete()
+}
+
+func (r *DownloadRange) complete() bool {
+	for i := r.begin; i < r.end; i++ {
+		if !r.t.pieceComplete(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Waits until all the pieces covering the range are complete, the Torrent is closed, or the
+// context is done.
+func (r *DownloadRange) Wait(ctx context.Context) error {
+	// This is set under the Client lock if the Context is done.
+	var ctxErr error
+	if ctx.Done() != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			<-ctx.Done()
+			r.t.cl.lock()
+			ctxErr = ctx.Err()
+			r.t.cl.event.Broadcast()
+			r.t.cl.unlock()
+		}()
+	}
+	r.t.cl.lock()
+	defer r.t.cl.unlock()
+	for !r.complete() {
+		if ctxErr != nil {
+			return ctxErr
+		}
+		if r.t.closed.IsSet() {
+			return errors.New("torrent closed")
+		}
+		r.t.cl.event.Wait()
+	}
+	return nil
+}
+
+// Stops prioritizing the range. Pieces that are wanted for other reasons, such as overlapping
+// ranges, are unaffected.
+func (r *DownloadRange) Close() {
+	r.t.cl.lock()
+	defer r.t.cl.unlock()
+	if _, ok := r.t.downloadRanges[r]; !ok {
+		return
+	}
+	delete(r.t.downloadRanges, r)
+	r.t.downloadRangesChanged(r.begin, r.end)
+}
@@ -0,0 +1,81 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func TestDownloadRange(t *testing.T) {
+	// The greeting is 13 bytes, in pieces of 5 bytes.
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt._completedPieces.Clear()
+	tt.updateAllPiecePriorities()
+	prios := func() (ret []piecePriority) {
+		cl.lock()
+		defer cl.unlock()
+		for i := 0; i < tt.numPieces(); i++ {
+			ret = append(ret, tt.piecePriority(i))
+		}
+		return
+	}
+	assert.EqualValues(t, []piecePriority{0, 0, 0}, prios())
+
+	// Ends mid-piece, so covers the piece it ends in too.
+	r1 := tt.DownloadRange(3, 4)
+	begin, end := r1.Pieces()
+	assert.EqualValues(t, 0, begin)
+	assert.EqualValues(t, 2, end)
+	// Ends on a piece boundary.
+	r2 := tt.DownloadRange(0, 5)
+	begin, end = r2.Pieces()
+	assert.EqualValues(t, 0, begin)
+	assert.EqualValues(t, 1, end)
+	// Runs past the end of the torrent.
+	r3 := tt.DownloadRange(9, 100)
+	begin, end = r3.Pieces()
+	assert.EqualValues(t, 1, begin)
+	assert.EqualValues(t, 3, end)
+	// Empty.
+	r4 := tt.DownloadRange(7, 0)
+	begin, end = r4.Pieces()
+	assert.Equal(t, begin, end)
+	assert.True(t, r4.Complete())
+	assert.NoError(t, r4.Wait(context.Background()))
+	r4.Close()
+	assert.EqualValues(t, []piecePriority{PiecePriorityHigh, PiecePriorityHigh, PiecePriorityHigh}, prios())
+
+	// Overlapping ranges keep the pieces they share wanted.
+	r1.Close()
+	r1.Close()
+	assert.EqualValues(t, []piecePriority{PiecePriorityHigh, PiecePriorityHigh, PiecePriorityHigh}, prios())
+	r2.Close()
+	assert.EqualValues(t, []piecePriority{PiecePriorityNone, PiecePriorityHigh, PiecePriorityHigh}, prios())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, r3.Wait(ctx))
+	assert.False(t, r3.Complete())
+	go func() {
+		cl.lock()
+		defer cl.unlock()
+		tt._completedPieces.AddRange(1, 3)
+		tt.pieceCompletionChanged(1)
+		tt.pieceCompletionChanged(2)
+	}()
+	require.NoError(t, r3.Wait(context.Background()))
+	assert.True(t, r3.Complete())
+	r3.Close()
+	assert.EqualValues(t, []piecePriority{0, 0, 0}, prios())
+}
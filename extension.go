@@ -0,0 +1,90 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+// Extended message IDs for extensions registered with Client.RegisterExtension are assigned from
+// here.
+const firstRegisteredExtendedId = settingsExtendedId + 1
+
+// Returned by PeerConn.SendExtension when the peer didn't advertise the extension in its extended
+// handshake.
+var ErrExtensionNotSupported = errors.New("peer doesn't support extension")
+
+// A BEP 10 extension added by Client.RegisterExtension.
+type registeredExtension struct {
+	name    pp.ExtensionName
+	id      pp.ExtensionNumber
+	handler func(c *PeerConn, payload []byte)
+}
+
+func builtinExtension(name pp.ExtensionName) bool {
+	switch name {
+	case pp.ExtensionNameMetadata, pp.ExtensionNamePex, pp.ExtensionNameDontHave,
+		pp.ExtensionNameUtHolepunch, pp.ExtensionNameSettings:
+		return true
+	}
+	return false
+}
+
+// Advertises the named extension in the extended handshakes of connections established from now
+// on, and passes the payloads of messages peers send for it to handler. The handler is called
+// from the connection's reader goroutine without the Client lock held, so messages from a peer
+// are handled in order, and the next isn't read until handler returns.
+func (cl *Client) RegisterExtension(name string, handler func(c *PeerConn, payload []byte)) error {
+	cl.lock()
+	defer cl.unlock()
+	en := pp.ExtensionName(name)
+	if name == "" || builtinExtension(en) {
+		return fmt.Errorf("can't register extension %q", name)
+	}
+	if _, ok := cl.extensions[en]; ok {
+		return fmt.Errorf("extension %q already registered", name)
+	}
+	id := firstRegisteredExtendedId + len(cl.extensions)
+	if id > 255 {
+		return errors.New("too many extensions registered")
+	}
+	if cl.extensions == nil {
+		cl.extensions = make(map[pp.ExtensionName]*registeredExtension)
+		cl.extensionsById = make(map[pp.ExtensionNumber]*registeredExtension)
+	}
+	re := &registeredExtension{en, pp.ExtensionNumber(id), handler}
+	cl.extensions[en] = re
+	cl.extensionsById[re.id] = re
+	return nil
+}
+
+// Sends a message for an extension registered with Client.RegisterExtension, using the ID the peer
+// gave for it. Returns ErrExtensionNotSupported if the peer doesn't support it, which is known once
+// its extended handshake is received.
+func (c *PeerConn) SendExtension(name string, payload []byte) error {
+	c.locker().Lock()
+	defer c.locker().Unlock()
+	if c.closed.IsSet() {
+		return errors.New("connection closed")
+	}
+	id := c.PeerExtensionIDs[pp.ExtensionName(name)]
+	if id == 0 {
+		return ErrExtensionNotSupported
+	}
+	c.post(pp.Message{
+		Type:            pp.Extended,
+		ExtendedID:      id,
+		ExtendedPayload: payload,
+	})
+	return nil
+}
+
+// Passes a message for a registered extension to its handler. The lock is released while the
+// handler runs.
+func (c *PeerConn) onRegisteredExtensionMsg(re *registeredExtension, payload []byte) {
+	cl := c.t.cl
+	cl.unlock()
+	defer cl.lock()
+	re.handler(c, payload)
+}
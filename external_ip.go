@@ -0,0 +1,156 @@
+package torrent
+
+import (
+	"net"
+
+	"github.com/anacrolix/torrent/tracker"
+)
+
+const (
+	// The number of trackers that must report the same external IP before it's used, unless
+	// ClientConfig.TrustTrackerExternalIp is set.
+	externalIpAgreement = 2
+	// The number of peers that must report the same external IP before it's used. Peers are cheap
+	// to run and can be behind the same NAT as us, so many more must agree than trackers.
+	externalIpPeerAgreement = 10
+	// The most sources remembered per IP family. Peers come and go, so old reports are forgotten.
+	maxExternalIpSources = 100
+)
+
+// Address ranges that can't be our external IP.
+var nonPublicNets = func() (ret []*net.IPNet) {
+	for _, s := range []string{"10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, n)
+	}
+	return
+}()
+
+func ipIsPublic(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the IP of the peer a tracker returned at our listen port on a public address, which is
+// probably us. Other peers can use the same port, so there's no answer if several do.
+func (cl *Client) trackerSelfEntry(peers []tracker.Peer) (ret net.IP) {
+	port := cl.incomingPeerPort()
+	if port == 0 {
+		return nil
+	}
+	for _, p := range peers {
+		if p.Port != port || !ipIsPublic(p.IP) {
+			continue
+		}
+		if ret != nil && !ret.Equal(p.IP) {
+			return nil
+		}
+		ret = p.IP
+	}
+	return
+}
+
+// The external IPs reported by trackers and peers for one IP family. Trackers and peers are kept
+// apart, so that reports from peers, which are many and cheap, never push out those of trackers.
+type externalIpVotes struct {
+	// Keyed by the tracker's hostname.
+	trackers externalIpSources
+	// Keyed by the peer's IP, so each host counts once.
+	peers externalIpSources
+	// The IP that's been agreed on, nil until there's agreement.
+	ip net.IP
+	// Whether ip was agreed on by trackers. Peers don't override trackers.
+	trackersAgreed bool
+}
+
+// Reported external IPs by source.
+type externalIpSources map[string]net.IP
+
+func (me *externalIpSources) add(source string, ip net.IP) {
+	if *me == nil {
+		*me = make(externalIpSources)
+	}
+	if _, ok := (*me)[source]; !ok && len(*me) >= maxExternalIpSources {
+		for k := range *me {
+			delete(*me, k)
+			break
+		}
+	}
+	(*me)[source] = ip
+}
+
+// The number of sources reporting the IP.
+func (me externalIpSources) votes(ip net.IP) (ret int) {
+	for _, v := range me {
+		if v.Equal(ip) {
+			ret++
+		}
+	}
+	return
+}
+
+func (me *externalIpVotes) add(source string, ip net.IP, peer bool, trust bool) {
+	if peer {
+		me.peers.add(source, ip)
+		if !me.trackersAgreed && me.peers.votes(ip) >= externalIpPeerAgreement {
+			me.ip = ip
+		}
+		return
+	}
+	me.trackers.add(source, ip)
+	if trust || me.trackers.votes(ip) >= externalIpAgreement {
+		me.ip = ip
+		me.trackersAgreed = true
+	}
+}
+
+// The number of sources reporting the IP.
+func (me *externalIpVotes) agreement(ip net.IP) int {
+	return me.trackers.votes(ip) + me.peers.votes(ip)
+}
+
+// Records our external IP as reported by a tracker. trust is whether the tracker alone is enough
+// to use the IP.
+func (cl *Client) onExternalIpReported(source string, ip net.IP, trust bool) {
+	cl.addExternalIpVote(source, ip, false, trust)
+}
+
+// Records our external IP as reported by a peer in its extended handshake. Addresses that can't
+// be public are ignored.
+func (cl *Client) onPeerReportedExternalIp(peer net.IP, ip net.IP) {
+	if !ipIsPublic(ip) {
+		return
+	}
+	cl.addExternalIpVote(peer.String(), ip, true, false)
+}
+
+func (cl *Client) addExternalIpVote(source string, ip net.IP, peer bool, trust bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		cl.externalIp4.add(source, ip4, peer, trust)
+	} else if len(ip) == net.IPv6len {
+		cl.externalIp6.add(source, ip, peer, trust)
+	}
+}
+
+// Whether the address is our own, per the external IPs reported to us.
+func (cl *Client) isExternalAddr(ip net.IP, port int) bool {
+	if port != cl.incomingPeerPort() {
+		return false
+	}
+	for _, ext := range []net.IP{cl.externalIp4.ip, cl.externalIp6.ip} {
+		if ext != nil && ext.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
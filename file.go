@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/anacrolix/missinggo/v2/bitmap"
@@ -42,8 +43,8 @@ func (f *File) Length() int64 {
 	return f.length
 }
 
-// Number of bytes of the entire file we have completed. This is the sum of
-// completed pieces, and dirtied chunks of incomplete pieces.
+// Number of bytes of the entire file we have completed. Like
+// Torrent.BytesCompleted, only verified pieces are counted.
 func (f *File) BytesCompleted() int64 {
 	f.t.cl.rLock()
 	defer f.t.cl.rUnlock()
@@ -101,14 +102,21 @@ func (f *File) DisplayPath() string {
 
 // The download status of a piece that comprises part of a File.
 type FilePieceState struct {
-	Bytes int64 // Bytes within the piece that are part of this File.
+	Index pieceIndex
+	// The range of the File that the piece covers, relative to the start of the File. Pieces
+	// shared with adjacent files only include the part within this File.
+	Offset int64
+	Bytes  int64
 	PieceState
 }
 
-// Returns the state of pieces in this file.
+// Returns a snapshot of the state of the pieces that overlap this file, in order.
 func (f *File) State() (ret []FilePieceState) {
 	f.t.cl.rLock()
 	defer f.t.cl.rUnlock()
+	if f.length == 0 {
+		return
+	}
 	pieceSize := int64(f.t.usualPieceSize())
 	off := f.offset % pieceSize
 	remaining := f.length
@@ -120,8 +128,12 @@ func (f *File) State() (ret []FilePieceState) {
 		if len1 > remaining {
 			len1 = remaining
 		}
-		ps := f.t.pieceState(i)
-		ret = append(ret, FilePieceState{len1, ps})
+		ret = append(ret, FilePieceState{
+			Index:      i,
+			Offset:     f.length - remaining,
+			Bytes:      len1,
+			PieceState: f.t.pieceState(i),
+		})
 		off = 0
 		remaining -= len1
 	}
@@ -139,9 +151,32 @@ func byteRegionExclusivePieces(off, size, pieceSize int64) (begin, end int) {
 	return
 }
 
-// Deprecated: Use File.SetPriority.
+// Stops downloading the file, and cancels outstanding requests for its pieces that are no longer
+// wanted. Pieces that other files, readers or piece priorities still want are unaffected.
 func (f *File) Cancel() {
 	f.SetPriority(PiecePriorityNone)
+	f.t.cl.lock()
+	defer f.t.cl.unlock()
+	f.t.cancelUnwantedRequests(f.firstPieceIndex(), f.endPieceIndex())
+}
+
+// Cancels the file per File.Cancel, and releases the storage held by its pieces that are no longer
+// wanted. Discarded pieces must be downloaded again if the file is wanted later. Storage that
+// doesn't implement storage.PieceDiscarder keeps the data.
+func (f *File) CancelAndDiscard() error {
+	f.Cancel()
+	f.t.cl.lock()
+	defer f.t.cl.unlock()
+	// Work backwards, so storage can truncate data at the end of files.
+	for i := f.endPieceIndex() - 1; i >= f.firstPieceIndex(); i-- {
+		if f.t.piece(i).requestedPriority() != PiecePriorityNone {
+			continue
+		}
+		if err := f.t.discardPiece(i); err != nil {
+			return fmt.Errorf("discarding piece %v: %w", i, err)
+		}
+	}
+	return nil
 }
 
 func (f *File) NewReader() Reader {
@@ -165,6 +200,7 @@ func (f *File) SetPriority(prio piecePriority) {
 	}
 	f.prio = prio
 	f.t.updatePiecePriorities(f.firstPieceIndex(), f.endPieceIndex())
+	f.t.savePiecePriorities()
 }
 
 // Returns the priority per File.SetPriority.
@@ -182,10 +218,11 @@ func (f *File) firstPieceIndex() pieceIndex {
 	return pieceIndex(f.offset / int64(f.t.usualPieceSize()))
 }
 
-// Returns the index of the piece after the last one containing data for the file.
+// Returns the index of the piece after the last one containing data for the file. Zero-length
+// files have no pieces.
 func (f *File) endPieceIndex() pieceIndex {
-	if f.t.usualPieceSize() == 0 {
-		return 0
+	if f.t.usualPieceSize() == 0 || f.length == 0 {
+		return f.firstPieceIndex()
 	}
 	return pieceIndex((f.offset + f.length + int64(f.t.usualPieceSize()) - 1) / int64(f.t.usualPieceSize()))
 }
@@ -1,10 +1,18 @@
 package torrent
 
 import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/anacrolix/missinggo/v2/bitmap"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
 )
 
 func TestFileExclusivePieces(t *testing.T) {
@@ -115,3 +123,154 @@ func TestFileBytesLeft(t *testing.T) {
 		name: "ThreePiecesCompletedAll",
 	}.Run(t)
 }
+
+func TestFileCancelAndDiscardKeepsSharedPieces(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.Seed = true
+	dir := filepath.Join(cfg.DataDir, "multi")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	// With 16 KiB pieces, b shares piece 1 with a and piece 4 with c, and has pieces 2 and 3 to
+	// itself.
+	fileData := map[string][]byte{}
+	for name, size := range map[string]int{"a": 20000, "b": 50000, "c": 20000} {
+		b := make([]byte, size)
+		rand.Read(b)
+		fileData[name] = b
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), b, 0644))
+	}
+	info := metainfo.Info{PieceLength: 16 << 10}
+	require.NoError(t, info.BuildFromFilePath(dir))
+	var mi metainfo.MetaInfo
+	var err error
+	mi.InfoBytes, err = bencode.Marshal(info)
+	require.NoError(t, err)
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(&mi)
+	require.NoError(t, err)
+	tt.VerifyData()
+	require.True(t, tt.Seeding())
+	for _, f := range tt.Files() {
+		f.Download()
+	}
+	b := tt.Files()[1]
+	require.EqualValues(t, "b", b.DisplayPath())
+	require.NoError(t, b.CancelAndDiscard())
+	assert.EqualValues(t, PiecePriorityNone, b.Priority())
+	complete := func() (ret []bool) {
+		for i := 0; i < tt.NumPieces(); i++ {
+			ret = append(ret, tt.PieceState(i).Complete)
+		}
+		return
+	}
+	assert.EqualValues(t, []bool{true, true, false, false, true, true}, complete())
+	for _, name := range []string{"a", "c"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, fileData[name], data)
+	}
+	// The shared pieces still pass a hash check.
+	tt.VerifyData()
+	for _, i := range []int{0, 1, 4, 5} {
+		assert.True(t, tt.PieceState(i).Complete, i)
+	}
+}
+
+func TestFileState(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	info := metainfo.Info{
+		Name:        "multi",
+		PieceLength: 16 << 10,
+		Pieces:      make([]byte, 6*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 20000},
+			{Path: []string{"b"}, Length: 50000},
+			{Path: []string{"c"}, Length: 20000},
+		},
+	}
+	infoBytes := bencode.MustMarshal(info)
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	// b shares piece 1 with a and piece 4 with c.
+	states := tt.Files()[1].State()
+	type span struct {
+		index         pieceIndex
+		offset, bytes int64
+	}
+	var spans []span
+	for _, s := range states {
+		spans = append(spans, span{s.Index, s.Offset, s.Bytes})
+		assert.True(t, s.Complete)
+	}
+	assert.Equal(t, []span{
+		{1, 0, 12768},
+		{2, 12768, 16384},
+		{3, 29152, 16384},
+		{4, 45536, 4464},
+	}, spans)
+}
+
+func TestZeroLengthFiles(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.Seed = true
+	dir := filepath.Join(cfg.DataDir, "multi")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "empty"), 0755))
+	// With 16 KiB pieces, c and d are within piece 1, and f is at the end of the torrent.
+	fileData := map[string][]byte{}
+	for name, size := range map[string]int{"a": 0, "b": 20000, "c": 0, "d": 0, "e": 30000, "empty/f": 0} {
+		b := make([]byte, size)
+		rand.Read(b)
+		fileData[name] = b
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), b, 0644))
+	}
+	info := metainfo.Info{PieceLength: 16 << 10}
+	require.NoError(t, info.BuildFromFilePath(dir))
+	require.Len(t, info.Files, 6)
+	var mi metainfo.MetaInfo
+	var err error
+	mi.InfoBytes, err = bencode.Marshal(info)
+	require.NoError(t, err)
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, err := seeder.AddTorrent(&mi)
+	require.NoError(t, err)
+	seederTorrent.VerifyData()
+	require.True(t, seederTorrent.Seeding())
+
+	cfg = TestingConfig()
+	cfg.DataDir = filepath.Join(cfg.DataDir, "leecher")
+	leecher, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	tt, _, err := leecher.AddTorrent(&mi)
+	require.NoError(t, err)
+	for _, f := range tt.Files() {
+		if f.Length() != 0 {
+			continue
+		}
+		assert.EqualValues(t, 0, f.BytesCompleted(), f.Path())
+		assert.Empty(t, f.State(), f.Path())
+		assert.Equal(t, f.firstPieceIndex(), f.endPieceIndex(), f.Path())
+		fi, err := os.Stat(filepath.Join(cfg.DataDir, f.Path()))
+		require.NoError(t, err)
+		assert.EqualValues(t, 0, fi.Size())
+		// There's nothing to download.
+		f.Download()
+	}
+	tt.cl.lock()
+	assert.Len(t, tt.pieces[1].files, 2)
+	assert.True(t, tt._pendingPieces.IsEmpty())
+	tt.cl.unlock()
+	tt.DownloadAll()
+	tt.AddClientPeer(seeder)
+	require.True(t, leecher.WaitAll())
+	for name, b := range fileData {
+		data, err := ioutil.ReadFile(filepath.Join(cfg.DataDir, "multi", name))
+		require.NoError(t, err)
+		assert.Equal(t, b, data, name)
+	}
+}
@@ -97,7 +97,7 @@ func TestUnmountWedged(t *testing.T) {
 	client, err := torrent.NewClient(cfg)
 	require.NoError(t, err)
 	defer client.Close()
-	tt, err := client.AddTorrent(layout.Metainfo)
+	tt, _, err := client.AddTorrent(layout.Metainfo)
 	require.NoError(t, err)
 	fs := New(client)
 	fuseConn, err := fuse.Mount(layout.MountDir)
@@ -196,7 +196,7 @@ func TestDownloadOnDemand(t *testing.T) {
 	require.NoError(t, err)
 	testutil.ExportStatusWriter(leecher, "l")()
 	defer leecher.Close()
-	leecherTorrent, err := leecher.AddTorrent(layout.Metainfo)
+	leecherTorrent, _, err := leecher.AddTorrent(layout.Metainfo)
 	require.NoError(t, err)
 	leecherTorrent.AddClientPeer(seeder)
 	fs := New(leecher)
@@ -3,14 +3,51 @@ package torrent
 import (
 	"crypto"
 	"expvar"
+	"time"
 
 	pp "github.com/anacrolix/torrent/peer_protocol"
 )
 
 const (
 	pieceHash        = crypto.SHA1
-	maxRequests      = 250    // Maximum pending requests we allow peers to send us.
+	maxRequests      = 250    // Default maximum pending requests we allow peers to send us.
 	defaultChunkSize = 0x4000 // 16KiB
+	// Bounds for ClientConfig.ChunkSize. BEP 3 notes that implementations close connections that
+	// request more than 128KiB.
+	minChunkSize = 1 << 10
+	maxChunkSize = 1 << 17
+	// The smallest block size from the "sett" extension we split requests to.
+	minPeerBlockSize = 1 << 10
+	// The default for ClientConfig.MaxMetadataSize.
+	defaultMaxMetadataSize = 10 << 20
+	// The defaults for ClientConfig.MaxPieces and ClientConfig.MaxTorrentSize.
+	defaultMaxPieces      = 1 << 21
+	defaultMaxTorrentSize = 1 << 44
+	// The default for ClientConfig.MaxPeerMessageLength. Fits the bitfield of a torrent with
+	// defaultMaxPieces, and chunks up to maxChunkSize.
+	defaultMaxPeerMessageLength = defaultMaxPieces/8 + 1
+	// The default for ClientConfig.PieceHashReadRetryDelay.
+	defaultPieceHashReadRetryDelay = 100 * time.Millisecond
+	// The most the delay between retries of a piece's hash read doubles to.
+	maxPieceHashReadRetryDelay = 10 * time.Second
+	// The default for ClientConfig.PieceHashersPerTorrent.
+	defaultPieceHashersPerTorrent = 2
+	// The default for ClientConfig.TrackerAutoDisableRetestInterval.
+	defaultTrackerAutoDisableRetestInterval = time.Hour
+	// The default for ClientConfig.TrackerMinAnnounceInterval.
+	defaultTrackerMinAnnounceInterval = time.Minute
+	// How soon we announce again to a tracker when the torrent wants peers, if the tracker's
+	// interval is longer. It's never less than ClientConfig.TrackerMinAnnounceInterval.
+	wantPeersAnnounceInterval = time.Minute
+	// The default for ClientConfig.TorrentStallTimeout.
+	defaultTorrentStallTimeout = 10 * time.Minute
+	// The default for ClientConfig.KeepAliveInterval.
+	defaultKeepAliveInterval = time.Minute
+	// The default for ClientConfig.PeerIdleTimeout. Keep-alives should be received every 2 mins,
+	// this gives a bit of grace time.
+	defaultPeerIdleTimeout = 150 * time.Second
+	// The default for ClientConfig.MinPeersBeforeRequestingTimeout.
+	defaultMinPeersBeforeRequestingTimeout = 10 * time.Second
 )
 
 // These are our extended message IDs. Peers will use these values to
@@ -18,6 +55,9 @@ const (
 const (
 	metadataExtendedId = iota + 1 // 0 is reserved for deleting keys
 	pexExtendedId
+	dontHaveExtendedId
+	utHolepunchExtendedId
+	settingsExtendedId
 )
 
 func defaultPeerExtensionBytes() PeerExtensionBits {
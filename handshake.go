@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -16,17 +17,27 @@ import (
 type deadlineReader struct {
 	nc net.Conn
 	r  io.Reader
+	// How long a Read may wait for data. Zero means there's no deadline.
+	timeout time.Duration
 }
 
 func (r deadlineReader) Read(b []byte) (int, error) {
-	// Keep-alives should be received every 2 mins. Give a bit of gracetime.
-	err := r.nc.SetReadDeadline(time.Now().Add(150 * time.Second))
+	var deadline time.Time
+	if r.timeout != 0 {
+		deadline = time.Now().Add(r.timeout)
+	}
+	err := r.nc.SetReadDeadline(deadline)
 	if err != nil {
 		return 0, fmt.Errorf("error setting read deadline: %s", err)
 	}
 	return r.r.Read(b)
 }
 
+var errPlaintextRejected = errors.New("plaintext handshake received and header obfuscation required")
+
+// Determines whether an incoming connection uses header obfuscation, and completes the MSE
+// handshake if it does. The connection is rejected if that doesn't satisfy the policy. Nothing is
+// written to the connection before the initiator has been determined to be obfuscating its header.
 func handleEncryption(
 	rw io.ReadWriter,
 	skeys mse.SecretKeyIter,
@@ -38,27 +49,31 @@ func handleEncryption(
 	cryptoMethod mse.CryptoMethod,
 	err error,
 ) {
-	if !policy.RequirePreferred || !policy.Preferred {
-		var protocol [len(pp.Protocol)]byte
-		_, err = io.ReadFull(rw, protocol[:])
-		if err != nil {
-			return
-		}
-		rw = struct {
-			io.Reader
-			io.Writer
-		}{
-			io.MultiReader(bytes.NewReader(protocol[:]), rw),
-			rw,
-		}
-		if string(protocol[:]) == pp.Protocol {
-			ret = rw
-			return
-		}
-		if policy.RequirePreferred {
-			err = fmt.Errorf("unexpected protocol string %q and header obfuscation disabled", protocol)
+	// An obfuscated header starts with the initiator's public key, which is longer than the
+	// protocol string, so it's safe to read that far before responding.
+	var protocol [len(pp.Protocol)]byte
+	_, err = io.ReadFull(rw, protocol[:])
+	if err != nil {
+		return
+	}
+	rw = struct {
+		io.Reader
+		io.Writer
+	}{
+		io.MultiReader(bytes.NewReader(protocol[:]), rw),
+		rw,
+	}
+	if string(protocol[:]) == pp.Protocol {
+		if policy.RequirePreferred && policy.Preferred {
+			err = errPlaintextRejected
 			return
 		}
+		ret = rw
+		return
+	}
+	if policy.RequirePreferred && !policy.Preferred {
+		err = fmt.Errorf("unexpected protocol string %q and header obfuscation disabled", protocol)
+		return
 	}
 	headerEncrypted = true
 	ret, cryptoMethod, err = mse.ReceiveHandshake(rw, skeys, selector)
@@ -0,0 +1,64 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Returns the infohash of the torrent the spec is for. A spec with a v2 infohash is for the torrent
+// known to have it, such as a v2 magnet for a hybrid torrent that was added by its v1 infohash,
+// once its info is known.
+func (cl *Client) specInfoHash(spec *TorrentSpec) (metainfo.Hash, error) {
+	if spec.InfoHashV2 == ([sha256.Size]byte{}) {
+		return spec.InfoHash, nil
+	}
+	if t, ok := cl.torrentsV2[spec.InfoHashV2]; ok {
+		if spec.InfoHash != (metainfo.Hash{}) && spec.InfoHash != t.infoHash {
+			return metainfo.Hash{}, errors.New("v1 and v2 infohashes are for different torrents")
+		}
+		return t.infoHash, nil
+	}
+	if spec.InfoHash == (metainfo.Hash{}) {
+		return metainfo.Hash{}, errors.New("v2 infohash isn't of a known hybrid torrent, and there's no v1 infohash")
+	}
+	return spec.InfoHash, nil
+}
+
+// Records the torrent's v2 infohash, so that later adds by it resolve to the torrent.
+func (t *Torrent) setInfoHashV2(h [sha256.Size]byte) {
+	cl := t.cl
+	if t.infoHashV2 == h {
+		return
+	}
+	t.deleteInfoHashV2()
+	if other, ok := cl.torrentsV2[h]; ok {
+		t.logger.Printf("v2 infohash %x already belongs to %v", h, other)
+		return
+	}
+	t.infoHashV2 = h
+	if cl.torrentsV2 == nil {
+		cl.torrentsV2 = make(map[[sha256.Size]byte]*Torrent)
+	}
+	cl.torrentsV2[h] = t
+}
+
+func (t *Torrent) deleteInfoHashV2() {
+	if t.cl.torrentsV2[t.infoHashV2] == t {
+		delete(t.cl.torrentsV2, t.infoHashV2)
+	}
+	t.infoHashV2 = [sha256.Size]byte{}
+}
+
+// Hybrid torrents' info determines their v2 infohash, whatever they were added by.
+func (t *Torrent) updateInfoHashV2() {
+	if t.info.MetaVersion != 2 {
+		return
+	}
+	h := sha256.Sum256(t.metadataBytes)
+	if t.infoHashV2 != ([sha256.Size]byte{}) && t.infoHashV2 != h {
+		t.logger.Printf("info has v2 infohash %x, not %x as given", h, t.infoHashV2)
+	}
+	t.setInfoHashV2(h)
+}
@@ -0,0 +1,49 @@
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/log"
+)
+
+// Subsystem names for ClientConfig.LogLevels.
+const (
+	// Tracker announces.
+	LogSubsystemTracker = "tracker"
+	// DHT servers, and torrent announces to them.
+	LogSubsystemDht = "dht"
+	// Peer connections, including handshakes and the messages exchanged.
+	LogSubsystemPeerConn = "peer-conn"
+	// Errors from torrent storage, and the piece priorities and journal kept in it.
+	LogSubsystemStorage = "storage"
+	// Piece hashing and completion.
+	LogSubsystemPiece = "piece"
+	// Each of our chunk requests to peers as it's sent, delivered, cancelled or rejected, at debug
+	// level. Unlike the others, it's only logged if it has a level. See PeerConn.RequestStats.
+	LogSubsystemRequests = "requests"
+)
+
+// Returns the logger for the subsystem. Subsystems without a level in ClientConfig.LogLevels use the
+// Client's logger.
+func (cl *Client) subsystemLogger(subsystem string) log.Logger {
+	level, ok := cl.config.LogLevels[subsystem]
+	if !ok {
+		return cl.logger
+	}
+	return cl.config.Logger.WithValues(cl).FilterLevel(level)
+}
+
+// Returns the logger for the subsystem, for messages about the torrent.
+func (t *Torrent) subsystemLogger(subsystem string) log.Logger {
+	if _, ok := t.cl.config.LogLevels[subsystem]; !ok {
+		return t.logger
+	}
+	return t.wrapLogger(t.cl.subsystemLogger(subsystem))
+}
+
+// Prefixes messages with the torrent.
+func (t *Torrent) wrapLogger(l log.Logger) log.Logger {
+	return l.WithValues(t).WithText(func(m log.Msg) string {
+		return fmt.Sprintf("%v: %s", t, m.Text())
+	})
+}
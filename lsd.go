@@ -0,0 +1,199 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// BEP 14 Local Service Discovery.
+
+const (
+	lsdPort = 6771
+	// How often each torrent is announced. BEP 14 limits announces to one per minute per torrent.
+	lsdAnnounceInterval = 5 * time.Minute
+	// How often to check for torrents due to be announced, such as those newly added.
+	lsdCheckInterval = time.Minute
+)
+
+var (
+	lsdIpv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: lsdPort}
+	lsdIpv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: lsdPort}
+)
+
+type lsdConn struct {
+	cl    *Client
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	// Included in our announces so we can ignore them when they're looped back to us.
+	cookie string
+	// Guarded by the Client lock.
+	lastAnnounced map[metainfo.Hash]time.Time
+}
+
+func newLsdCookie() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (cl *Client) startLsd() {
+	for _, g := range []struct {
+		network string
+		group   *net.UDPAddr
+		enabled bool
+	}{
+		{"udp4", lsdIpv4Group, ipv4Enabled(cl.config)},
+		{"udp6", lsdIpv6Group, ipv6Enabled(cl.config)},
+	} {
+		if !g.enabled {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP(g.network, nil, g.group)
+		if err != nil {
+			cl.logger.Printf("error listening for local service discovery on %v: %v", g.group, err)
+			continue
+		}
+		lc := &lsdConn{
+			cl:            cl,
+			conn:          conn,
+			group:         g.group,
+			cookie:        newLsdCookie(),
+			lastAnnounced: make(map[metainfo.Hash]time.Time),
+		}
+		cl.onClose = append(cl.onClose, func() { conn.Close() })
+		go lc.receive()
+		go lc.announcer()
+	}
+}
+
+func lsdAnnounceMessage(group *net.UDPAddr, port int, ih metainfo.Hash, cookie string) []byte {
+	return []byte(fmt.Sprintf(
+		"BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\nInfohash: %s\r\ncookie: %s\r\n\r\n\r\n",
+		group, port, ih.HexString(), cookie))
+}
+
+type lsdAnnounce struct {
+	port       int
+	infoHashes []metainfo.Hash
+	cookie     string
+}
+
+func parseLsdAnnounce(b []byte) (ret lsdAnnounce, err error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return
+	}
+	if req.Method != "BT-SEARCH" {
+		err = fmt.Errorf("unexpected method %q", req.Method)
+		return
+	}
+	ret.port, err = strconv.Atoi(req.Header.Get("Port"))
+	if err != nil {
+		err = fmt.Errorf("parsing port: %w", err)
+		return
+	}
+	for _, s := range req.Header["Infohash"] {
+		var ih metainfo.Hash
+		if err = ih.FromHexString(strings.TrimSpace(s)); err != nil {
+			err = fmt.Errorf("parsing infohash: %w", err)
+			return
+		}
+		ret.infoHashes = append(ret.infoHashes, ih)
+	}
+	ret.cookie = req.Header.Get("Cookie")
+	return
+}
+
+func (me *lsdConn) receive() {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := me.conn.ReadFromUDP(b)
+		if me.cl.closed.IsSet() {
+			return
+		}
+		if err != nil {
+			me.cl.logger.Printf("error reading local service discovery announce: %v", err)
+			return
+		}
+		ann, err := parseLsdAnnounce(b[:n])
+		if err != nil {
+			me.cl.logger.Printf("error parsing local service discovery announce from %v: %v", addr, err)
+			continue
+		}
+		if ann.cookie == me.cookie {
+			continue
+		}
+		me.cl.onLsdAnnounce(addr.IP, ann)
+	}
+}
+
+func (cl *Client) onLsdAnnounce(ip net.IP, ann lsdAnnounce) {
+	cl.lock()
+	defer cl.unlock()
+	for _, ih := range ann.infoHashes {
+		t := cl.torrent(ih)
+		if t == nil || t.private() {
+			continue
+		}
+		t.addPeers([]Peer{{
+			Addr:   ipPortAddr{ip, ann.port},
+			Source: PeerSourceLsd,
+		}})
+	}
+}
+
+// Returns the torrents that should be announced now.
+func (me *lsdConn) dueAnnounces(now time.Time) (ret []metainfo.Hash) {
+	cl := me.cl
+	for ih, t := range cl.torrents {
+		if t.private() || !t.wantPeers() {
+			continue
+		}
+		if now.Sub(me.lastAnnounced[ih]) < lsdAnnounceInterval {
+			continue
+		}
+		me.lastAnnounced[ih] = now
+		ret = append(ret, ih)
+	}
+	for ih := range me.lastAnnounced {
+		if _, ok := cl.torrents[ih]; !ok {
+			delete(me.lastAnnounced, ih)
+		}
+	}
+	return
+}
+
+func (me *lsdConn) announcer() {
+	cl := me.cl
+	for {
+		var ihs []metainfo.Hash
+		cl.lock()
+		port := cl.incomingPeerPort()
+		if port != 0 {
+			ihs = me.dueAnnounces(time.Now())
+		}
+		cl.unlock()
+		for _, ih := range ihs {
+			_, err := me.conn.WriteToUDP(lsdAnnounceMessage(me.group, port, ih, me.cookie), me.group)
+			if err != nil {
+				cl.logger.Printf("error sending local service discovery announce to %v: %v", me.group, err)
+				break
+			}
+		}
+		select {
+		case <-cl.closed.LockedChan(cl.locker()):
+			return
+		case <-time.After(lsdCheckInterval):
+		}
+	}
+}
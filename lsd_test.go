@@ -0,0 +1,60 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestLsdAnnounceMessageRoundTrip(t *testing.T) {
+	ih := metainfo.Hash{1, 2, 3}
+	for _, group := range []*net.UDPAddr{lsdIpv4Group, lsdIpv6Group} {
+		ann, err := parseLsdAnnounce(lsdAnnounceMessage(group, 4242, ih, "cookie"))
+		require.NoError(t, err)
+		assert.Equal(t, lsdAnnounce{
+			port:       4242,
+			infoHashes: []metainfo.Hash{ih},
+			cookie:     "cookie",
+		}, ann)
+	}
+	_, err := parseLsdAnnounce([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.Error(t, err)
+}
+
+func TestLsdAnnounceAddsPeers(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	public, _ := cl.AddTorrentInfoHash(metainfo.Hash{1})
+	private := true
+	ib, err := bencode.Marshal(metainfo.Info{
+		Name:        "private",
+		PieceLength: 1,
+		Length:      1,
+		Pieces:      make([]byte, metainfo.HashSize),
+		Private:     &private,
+	})
+	require.NoError(t, err)
+	privateTorrent, _, err := cl.AddTorrent(&metainfo.MetaInfo{InfoBytes: ib})
+	require.NoError(t, err)
+	cl.onLsdAnnounce(net.IPv4(192, 168, 1, 2), lsdAnnounce{
+		port:       4242,
+		infoHashes: []metainfo.Hash{public.InfoHash(), privateTorrent.InfoHash()},
+	})
+	cl.lock()
+	defer cl.unlock()
+	// The peer may be dialed immediately, so look at the half-open connections too.
+	assert.EqualValues(t, 1, public.peers.Len()+len(public.halfOpen))
+	assert.EqualValues(t, 0, privateTorrent.peers.Len()+len(privateTorrent.halfOpen))
+	lc := lsdConn{cl: cl, lastAnnounced: make(map[metainfo.Hash]time.Time)}
+	now := time.Now()
+	assert.Equal(t, []metainfo.Hash{public.InfoHash()}, lc.dueAnnounces(now))
+	assert.Empty(t, lc.dueAnnounces(now.Add(lsdCheckInterval)))
+	assert.Equal(t, []metainfo.Hash{public.InfoHash()}, lc.dueAnnounces(now.Add(lsdAnnounceInterval)))
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/anacrolix/torrent/bencode"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+const (
+	// Each peer can request a metadata piece per interval, after a burst allowing it to fetch the
+	// whole metadata a couple of times. Requests beyond that are rejected.
+	metadataUploadInterval    = time.Second
+	metadataUploadBurstPasses = 2
+)
+
+// Returns the ut_metadata data message payload for the piece. Once the info is known, the
+// payloads are encoded once, and shared by all requesters.
+func (t *Torrent) metadataPiecePayload(piece int) []byte {
+	if !t.haveInfo() {
+		return t.encodeMetadataPiecePayload(piece)
+	}
+	if t.metadataPayloads == nil {
+		t.metadataPayloads = make([][]byte, t.metadataPieceCount())
+		for i := range t.metadataPayloads {
+			t.metadataPayloads[i] = t.encodeMetadataPiecePayload(i)
+		}
+	}
+	return t.metadataPayloads[piece]
+}
+
+func (t *Torrent) encodeMetadataPiecePayload(piece int) []byte {
+	start := (1 << 14) * piece
+	p := bencode.MustMarshal(map[string]int{
+		"msg_type":   pp.DataMetadataExtensionMsgType,
+		"piece":      piece,
+		"total_size": len(t.metadataBytes),
+	})
+	return append(p, t.metadataBytes[start:start+t.metadataPieceSize(piece)]...)
+}
+
+// Whether the peer may be sent another metadata piece now.
+func (c *PeerConn) allowMetadataUpload() bool {
+	if c.metadataUploadLimiter == nil {
+		c.metadataUploadLimiter = rate.NewLimiter(
+			rate.Every(metadataUploadInterval),
+			metadataUploadBurstPasses*c.t.metadataPieceCount())
+	}
+	return c.metadataUploadLimiter.Allow()
+}
+
+// Responds to a ut_metadata request.
+func (c *PeerConn) serveMetadataPiece(piece int) {
+	t := c.t
+	if piece < 0 || !t.haveMetadataPiece(piece) {
+		c.post(t.newMetadataExtensionMessage(c, pp.RejectMetadataExtensionMsgType, piece, nil))
+		return
+	}
+	if !c.allowMetadataUpload() {
+		torrent.Add("metadata requests rate limited", 1)
+		c.post(t.newMetadataExtensionMessage(c, pp.RejectMetadataExtensionMsgType, piece, nil))
+		return
+	}
+	c.logger.Printf("sending metadata piece %d", piece)
+	c.post(pp.Message{
+		Type:            pp.Extended,
+		ExtendedID:      c.PeerExtensionIDs[pp.ExtensionNameMetadata],
+		ExtendedPayload: t.metadataPiecePayload(piece),
+	})
+}
@@ -0,0 +1,83 @@
+package metainfo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+const (
+	minPieceLength = 16 << 10
+	maxPieceLength = 16 << 20
+	// Piece lengths are chosen to give about this many pieces.
+	targetNumPieces = 1500
+)
+
+// Returns a power of two piece length that gives a reasonable number of pieces for a torrent of
+// the given total length.
+func ChoosePieceLength(totalLength int64) (pieceLength int64) {
+	pieceLength = minPieceLength
+	for pieceLength < maxPieceLength && totalLength/pieceLength > targetNumPieces {
+		pieceLength *= 2
+	}
+	return
+}
+
+// Options for CreateFromPath that affect the info dict, and so the infohash.
+type CreateOptions struct {
+	// Sets the private flag, which disables DHT and PEX in conforming clients.
+	Private bool
+	// Sets the source field. Private trackers use this to give the same data a distinct infohash
+	// for each tracker.
+	Source string
+}
+
+// Creates a MetaInfo for the file or directory at root, hashing all the data. The piece length is
+// chosen with ChoosePieceLength if it's zero. Fields outside the info, such as UrlList for web
+// seeds and Comment, can be set on the result before it's written.
+func CreateFromPath(root string, pieceLength int64, trackers [][]string, opts CreateOptions) (mi *MetaInfo, err error) {
+	if pieceLength == 0 {
+		var totalLength int64
+		err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				totalLength += fi.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		pieceLength = ChoosePieceLength(totalLength)
+	}
+	info := Info{
+		PieceLength: pieceLength,
+		Source:      opts.Source,
+	}
+	if opts.Private {
+		private := true
+		info.Private = &private
+	}
+	err = info.BuildFromFilePath(root)
+	if err != nil {
+		return
+	}
+	mi = &MetaInfo{
+		AnnounceList: trackers,
+		CreatedBy:    "github.com/anacrolix/torrent",
+		CreationDate: time.Now().Unix(),
+	}
+	if len(trackers) != 0 && len(trackers[0]) != 0 {
+		mi.Announce = trackers[0][0]
+	}
+	mi.InfoBytes, err = bencode.Marshal(info)
+	if err != nil {
+		err = fmt.Errorf("marshalling info: %w", err)
+	}
+	return
+}
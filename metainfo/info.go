@@ -7,9 +7,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/anacrolix/missinggo/slices"
+	"github.com/bradfitz/iter"
 )
 
 // The info dictionary.
@@ -22,6 +25,8 @@ type Info struct {
 	// TODO: Document this field.
 	Source string     `bencode:"source,omitempty"`
 	Files  []FileInfo `bencode:"files,omitempty"`
+	// 2 for BEP 52 v2 torrents. Hybrid torrents also have the v1 fields, and are in both swarms.
+	MetaVersion int64 `bencode:"meta version,omitempty"`
 }
 
 // This is a helper that sets Files and Pieces from a root path and its
@@ -77,6 +82,9 @@ func (info *Info) writeFiles(w io.Writer, open func(fi FileInfo) (io.ReadCloser,
 		wn, err := io.CopyN(w, r, fi.Length)
 		r.Close()
 		if wn != fi.Length {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
 			return fmt.Errorf("error copying %v: %s", fi, err)
 		}
 	}
@@ -84,7 +92,7 @@ func (info *Info) writeFiles(w io.Writer, open func(fi FileInfo) (io.ReadCloser,
 }
 
 // Sets Pieces (the block of piece hashes in the Info) by using the passed
-// function to get at the torrent data.
+// function to get at the torrent data. Pieces are hashed in parallel.
 func (info *Info) GeneratePieces(open func(fi FileInfo) (io.ReadCloser, error)) error {
 	if info.PieceLength == 0 {
 		return errors.New("piece length must be non-zero")
@@ -95,23 +103,66 @@ func (info *Info) GeneratePieces(open func(fi FileInfo) (io.ReadCloser, error))
 		pw.CloseWithError(err)
 	}()
 	defer pr.Close()
-	var pieces []byte
-	for {
-		hasher := sha1.New()
-		wn, err := io.CopyN(hasher, pr, info.PieceLength)
-		if err == io.EOF {
-			err = nil
-		}
-		if err != nil {
-			return err
-		}
-		if wn == 0 {
-			break
+	numPieces := (info.TotalLength() + info.PieceLength - 1) / info.PieceLength
+	pieces := make([]byte, numPieces*sha1.Size)
+	type job struct {
+		index int64
+		data  []byte
+	}
+	numWorkers := runtime.NumCPU()
+	jobs := make(chan job)
+	// Limits how much piece data is buffered.
+	free := make(chan []byte, 2*numWorkers)
+	for range iter.N(cap(free)) {
+		free <- make([]byte, info.PieceLength)
+	}
+	var wg sync.WaitGroup
+	for range iter.N(numWorkers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum := sha1.Sum(j.data)
+				copy(pieces[j.index*sha1.Size:], sum[:])
+				free <- j.data[:cap(j.data)]
+			}
+		}()
+	}
+	err := func() error {
+		// Checks that the data didn't end early, which would leave the remaining hashes unset.
+		checkLength := func(read int64) error {
+			if read != info.TotalLength() {
+				return fmt.Errorf("data ended after %d of %d bytes", read, info.TotalLength())
+			}
+			return nil
 		}
-		pieces = hasher.Sum(pieces)
-		if wn < info.PieceLength {
-			break
+		var read int64
+		for index := int64(0); ; index++ {
+			buf := <-free
+			n, err := io.ReadFull(pr, buf)
+			if err == io.EOF {
+				return checkLength(read)
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if index >= numPieces {
+				return errors.New("more data than expected")
+			}
+			read += int64(n)
+			jobs <- job{index, buf[:n]}
+			if err == io.ErrUnexpectedEOF {
+				return checkLength(read)
+			}
 		}
+	}()
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if numPieces == 0 {
+		pieces = nil
 	}
 	info.Pieces = pieces
 	return nil
@@ -154,3 +205,9 @@ func (info *Info) UpvertedFiles() []FileInfo {
 func (info *Info) Piece(index int) Piece {
 	return Piece{info, pieceIndex(index)}
 }
+
+// Whether the torrent is private per BEP 27. Peers for private torrents should only be obtained
+// from the torrent's trackers.
+func (info *Info) IsPrivate() bool {
+	return info.Private != nil && *info.Private
+}
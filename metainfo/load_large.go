@@ -0,0 +1,114 @@
+package metainfo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// Files at least this large are loaded by loadLarge.
+const largeMetaInfoSize = 1 << 20
+
+// Loads a metainfo that's entirely in b. The info dict, which holds the pieces string and makes up
+// almost all of a large metainfo, isn't decoded or copied: InfoBytes is a slice of b. Only the
+// remaining fields are decoded. Loading through a Decoder buffers the info as it's read, and then
+// copies it, so the peak memory use is several times the file size.
+func loadLarge(b []byte) (*MetaInfo, error) {
+	if len(b) == 0 || b[0] != 'd' {
+		return nil, errors.New("metainfo isn't a dict")
+	}
+	infoStart, infoEnd := -1, -1
+	off := 1
+	for {
+		if off >= len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if b[off] == 'e' {
+			break
+		}
+		keyEnd, err := bencodeValueEnd(b, off)
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		if err := bencode.Unmarshal(b[off:keyEnd], &key); err != nil {
+			return nil, fmt.Errorf("decoding key at offset %d: %w", off, err)
+		}
+		valueEnd, err := bencodeValueEnd(b, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			infoStart, infoEnd = keyEnd, valueEnd
+		}
+		off = valueEnd
+	}
+	// Trailing data is ignored, as it is by Load.
+	b = b[:off+1]
+	var mi MetaInfo
+	if infoStart == -1 {
+		return &mi, bencode.Unmarshal(b, &mi)
+	}
+	// Decode the other fields, with an empty info in place of the real one.
+	rest := make([]byte, 0, len(b)-(infoEnd-infoStart)+2)
+	rest = append(rest, b[:infoStart]...)
+	rest = append(rest, "de"...)
+	rest = append(rest, b[infoEnd:]...)
+	if err := bencode.Unmarshal(rest, &mi); err != nil {
+		return nil, err
+	}
+	mi.InfoBytes = b[infoStart:infoEnd:infoEnd]
+	return &mi, nil
+}
+
+// Returns the offset after the bencoded value starting at b[off]. Values are only delimited, not
+// validated. Nesting is tracked without recursion, so deeply nested input can't exhaust the stack.
+func bencodeValueEnd(b []byte, off int) (int, error) {
+	depth := 0
+	for {
+		if off >= len(b) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		switch c := b[off]; {
+		case c == 'i':
+			e := bytes.IndexByte(b[off:], 'e')
+			if e == -1 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			off += e + 1
+		case c == 'l' || c == 'd':
+			depth++
+			off++
+			continue
+		case c == 'e':
+			if depth == 0 {
+				return 0, fmt.Errorf("unexpected 'e' at offset %d", off)
+			}
+			depth--
+			off++
+		case c >= '0' && c <= '9':
+			colon := bytes.IndexByte(b[off:], ':')
+			if colon == -1 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			n, err := strconv.ParseUint(string(b[off:off+colon]), 10, 63)
+			if err != nil {
+				return 0, fmt.Errorf("string length at offset %d: %w", off, err)
+			}
+			off += colon + 1
+			if n > uint64(len(b)-off) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			off += int(n)
+		default:
+			return 0, fmt.Errorf("unexpected %q at offset %d", c, off)
+		}
+		if depth == 0 {
+			return off, nil
+		}
+	}
+}
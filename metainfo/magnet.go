@@ -1,6 +1,7 @@
 package metainfo
 
 import (
+	"crypto/sha256"
 	"encoding/base32"
 	"encoding/hex"
 	"errors"
@@ -11,13 +12,21 @@ import (
 
 // Magnet link components.
 type Magnet struct {
-	InfoHash    Hash       // Expected in this implementation
+	InfoHash Hash // "xt" urn:btih value. Zero for magnets with only a v2 infohash.
+	// The BEP 52 v2 infohash from the "xt" urn:btmh value, as given by MetaInfo.HashInfoBytesV2.
+	// Zero if the magnet doesn't have one.
+	InfoHashV2  [sha256.Size]byte
 	Trackers    []string   // "tr" values
 	DisplayName string     // "dn" value, if not empty
 	Params      url.Values // All other values, such as "x.pe", "as", "xs" etc.
 }
 
-const xtPrefix = "urn:btih:"
+const (
+	xtPrefix   = "urn:btih:"
+	xtPrefixV2 = "urn:btmh:"
+	// The multihash prefix of a SHA-256 digest: the sha2-256 code and the digest length.
+	sha256MultihashPrefix = "1220"
+)
 
 func (m Magnet) String() string {
 	// Deep-copy m.Params
@@ -36,9 +45,16 @@ func (m Magnet) String() string {
 	// Transmission and Deluge both expect "urn:btih:" to be unescaped. Deluge wants it to be at the
 	// start of the magnet link. The InfoHash field is expected to be BitTorrent in this
 	// implementation.
+	var xts []string
+	if m.InfoHash != (Hash{}) || m.InfoHashV2 == [sha256.Size]byte{} {
+		xts = append(xts, "xt="+xtPrefix+m.InfoHash.HexString())
+	}
+	if m.InfoHashV2 != [sha256.Size]byte{} {
+		xts = append(xts, "xt="+xtPrefixV2+sha256MultihashPrefix+hex.EncodeToString(m.InfoHashV2[:]))
+	}
 	u := url.URL{
 		Scheme:   "magnet",
-		RawQuery: "xt=" + xtPrefix + m.InfoHash.HexString(),
+		RawQuery: strings.Join(xts, "&"),
 	}
 	if len(vs) != 0 {
 		u.RawQuery += "&" + vs.Encode()
@@ -58,13 +74,36 @@ func ParseMagnetURI(uri string) (m Magnet, err error) {
 		return
 	}
 	q := u.Query()
-	xt := q.Get("xt")
-	m.InfoHash, err = parseInfohash(q.Get("xt"))
-	if err != nil {
+	// The first v1 and v2 infohashes are taken. Any other xt values are left in Params.
+	var haveV1, haveV2 bool
+	var otherXts []string
+	for _, xt := range q["xt"] {
+		switch {
+		case !haveV1 && strings.HasPrefix(xt, xtPrefix):
+			m.InfoHash, err = parseInfohash(xt)
+			haveV1 = true
+		case !haveV2 && strings.HasPrefix(xt, xtPrefixV2):
+			m.InfoHashV2, err = parseInfohashV2(xt)
+			haveV2 = true
+		default:
+			otherXts = append(otherXts, xt)
+		}
+		if err != nil {
+			err = fmt.Errorf("error parsing infohash %q: %w", xt, err)
+			return
+		}
+	}
+	if !haveV1 && !haveV2 {
+		xt := q.Get("xt")
+		_, err = parseInfohash(xt)
 		err = fmt.Errorf("error parsing infohash %q: %w", xt, err)
 		return
 	}
-	dropFirst(q, "xt")
+	if len(otherXts) == 0 {
+		q.Del("xt")
+	} else {
+		q["xt"] = otherXts
+	}
 	m.DisplayName = q.Get("dn")
 	dropFirst(q, "dn")
 	m.Trackers = q["tr"]
@@ -106,6 +145,25 @@ func parseInfohash(xt string) (ih Hash, err error) {
 	return
 }
 
+// Parses a v2 infohash, which is hex encoded as a SHA-256 multihash.
+func parseInfohashV2(xt string) (ih [sha256.Size]byte, err error) {
+	encoded := strings.TrimPrefix(xt, xtPrefixV2)
+	if !strings.HasPrefix(encoded, sha256MultihashPrefix) {
+		err = errors.New("unhandled multihash type")
+		return
+	}
+	encoded = encoded[len(sha256MultihashPrefix):]
+	if hex.DecodedLen(len(encoded)) != sha256.Size {
+		err = fmt.Errorf("unhandled xt parameter encoding (encoded length %d)", len(encoded))
+		return
+	}
+	_, err = hex.Decode(ih[:], []byte(encoded))
+	if err != nil {
+		err = fmt.Errorf("error decoding xt: %w", err)
+	}
+	return
+}
+
 func dropFirst(vs url.Values, key string) {
 	sl := vs[key]
 	switch len(sl) {
@@ -70,6 +70,26 @@ func TestParseMagnetURI(t *testing.T) {
 
 }
 
+func TestParseMagnetURIV2(t *testing.T) {
+	const v2 = "urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	m, err := ParseMagnetURI("magnet:?xt=" + v2 + "&dn=foo")
+	require.NoError(t, err)
+	assert.Zero(t, m.InfoHash)
+	assert.Equal(t, "caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e", hex.EncodeToString(m.InfoHashV2[:]))
+	assert.Nil(t, m.Params)
+	m2, err := ParseMagnetURI(m.String())
+	require.NoError(t, err)
+	assert.Equal(t, m, m2)
+	// A hybrid magnet has both, and other xt values are kept.
+	m, err = ParseMagnetURI(exampleMagnetURI + "&xt=" + v2 + "&xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C")
+	require.NoError(t, err)
+	assert.Equal(t, exampleMagnet.InfoHash, m.InfoHash)
+	assert.Equal(t, m2.InfoHashV2, m.InfoHashV2)
+	assert.Equal(t, []string{"urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C"}, m.Params["xt"])
+	_, err = ParseMagnetURI("magnet:?xt=urn:btmh:1114caf1e1c30e81cb361b9ee167c4aa64228a7f")
+	assert.Error(t, err)
+}
+
 func TestMagnetize(t *testing.T) {
 	mi, err := LoadFromFile("../testdata/bootstrap.dat.torrent")
 	require.NoError(t, err)
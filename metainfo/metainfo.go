@@ -1,6 +1,7 @@
 package metainfo
 
 import (
+	"crypto/sha256"
 	"io"
 	"os"
 	"time"
@@ -18,6 +19,8 @@ type MetaInfo struct {
 	CreatedBy    string        `bencode:"created by,omitempty"`
 	Encoding     string        `bencode:"encoding,omitempty"`
 	UrlList      UrlList       `bencode:"url-list,omitempty"`
+	// BEP 17 HTTP seeds, which serve pieces by index rather than files by byte range.
+	HttpSeeds UrlList `bencode:"httpseeds,omitempty"`
 }
 
 // Load a MetaInfo from an io.Reader. Returns a non-nil error in case of
@@ -32,14 +35,27 @@ func Load(r io.Reader) (*MetaInfo, error) {
 	return &mi, nil
 }
 
-// Convenience function for loading a MetaInfo from a file.
+// Convenience function for loading a MetaInfo from a file. Large files are read whole, and the
+// InfoBytes of the result refers to the file's data rather than being copied from it, which
+// keeps memory use to about the file size.
 func LoadFromFile(filename string) (*MetaInfo, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return Load(f)
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < largeMetaInfoSize {
+		return Load(f)
+	}
+	b := make([]byte, fi.Size())
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+	return loadLarge(b)
 }
 
 func (mi MetaInfo) UnmarshalInfo() (info Info, err error) {
@@ -47,10 +63,35 @@ func (mi MetaInfo) UnmarshalInfo() (info Info, err error) {
 	return
 }
 
+// Returns the v1 infohash, the SHA-1 of the info bytes as they are. They aren't reencoded, as the
+// swarm identifies the torrent by the bytes its creator produced, canonical or not.
 func (mi MetaInfo) HashInfoBytes() (infoHash Hash) {
 	return HashBytes(mi.InfoBytes)
 }
 
+// Returns the BEP 52 v2 infohash, the SHA-256 of the info bytes. It's only meaningful for v2 and
+// hybrid torrents, whose info has v2 fields that this package doesn't otherwise handle. Hybrid
+// torrents are also in the swarm of their v1 infohash.
+func (mi MetaInfo) HashInfoBytesV2() [sha256.Size]byte {
+	return sha256.Sum256(mi.InfoBytes)
+}
+
+// Sets the info bytes to the canonical bencoding of info, such as after editing it. The
+// resulting infohash is then given by HashInfoBytes.
+func (mi *MetaInfo) SetInfo(info *Info) (err error) {
+	mi.InfoBytes, err = bencode.Marshal(info)
+	return
+}
+
+// Returns the creation date as a time, or the zero time if it's missing or isn't a positive Unix
+// timestamp. Dates that aren't integers are dropped when decoding.
+func (mi MetaInfo) CreationTime() time.Time {
+	if mi.CreationDate <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(mi.CreationDate, 0)
+}
+
 // Encode to bencoded form.
 func (mi MetaInfo) Write(w io.Writer) error {
 	return bencode.NewEncoder(w).Encode(mi)
@@ -1,12 +1,16 @@
 package metainfo
 
 import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/anacrolix/missinggo"
 	"github.com/stretchr/testify/assert"
@@ -73,6 +77,19 @@ func TestNumPieces(t *testing.T) {
 	}
 }
 
+func TestGeneratePiecesShortData(t *testing.T) {
+	info := Info{
+		Files:       []FileInfo{{Length: 4}, {Length: 12}},
+		PieceLength: 5,
+	}
+	err := info.GeneratePieces(func(fi FileInfo) (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.LimitReader(missinggo.ZeroReader, fi.Length-1)), nil
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), io.ErrUnexpectedEOF.Error())
+	assert.Nil(t, info.Pieces)
+}
+
 func touchFile(path string) (err error) {
 	f, err := os.Create(path)
 	if err != nil {
@@ -123,6 +140,15 @@ func TestMetainfoWithListURLList(t *testing.T) {
 	assert.Len(t, mi.UrlList, 3)
 }
 
+func TestMetainfoHttpSeeds(t *testing.T) {
+	var mi MetaInfo
+	require.NoError(t, bencode.Unmarshal([]byte("d9:httpseedsl21:http://a.example/seed21:http://b.example/seede4:infodee"), &mi))
+	assert.EqualValues(t, UrlList{"http://a.example/seed", "http://b.example/seed"}, mi.HttpSeeds)
+	b, err := bencode.Marshal(mi)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "9:httpseedsl21:http://a.example/seed")
+}
+
 func TestMetainfoWithStringURLList(t *testing.T) {
 	mi, err := LoadFromFile("testdata/flat-url-list.torrent")
 	require.NoError(t, err)
@@ -137,3 +163,204 @@ func TestStringCreationDate(t *testing.T) {
 	var mi MetaInfo
 	assert.NoError(t, bencode.Unmarshal([]byte("d13:creation date23:29.03.2018 22:18:14 UTC4:infodee"), &mi))
 }
+
+func TestCreationMetadata(t *testing.T) {
+	var mi MetaInfo
+	require.NoError(t, bencode.Unmarshal([]byte("d7:comment5:hello10:created by10:go.torrent13:creation datei1522361894e8:encoding5:UTF-84:infodee"), &mi))
+	assert.EqualValues(t, "hello", mi.Comment)
+	assert.EqualValues(t, "go.torrent", mi.CreatedBy)
+	assert.EqualValues(t, "UTF-8", mi.Encoding)
+	assert.True(t, mi.CreationTime().Equal(time.Unix(1522361894, 0)))
+
+	mi = MetaInfo{}
+	require.NoError(t, bencode.Unmarshal([]byte("d4:infodee"), &mi))
+	assert.Empty(t, mi.Comment)
+	assert.Empty(t, mi.CreatedBy)
+	assert.Empty(t, mi.Encoding)
+	assert.True(t, mi.CreationTime().IsZero())
+
+	mi = MetaInfo{}
+	require.NoError(t, bencode.Unmarshal([]byte("d13:creation date23:29.03.2018 22:18:14 UTC4:infodee"), &mi))
+	assert.True(t, mi.CreationTime().IsZero())
+	mi.CreationDate = -1
+	assert.True(t, mi.CreationTime().IsZero())
+}
+
+func TestMetaInfoHashes(t *testing.T) {
+	mi, err := LoadFromFile("testdata/23516C72685E8DB0C8F15553382A927F185C4F01.torrent")
+	require.NoError(t, err)
+	assert.Equal(t, "23516c72685e8db0c8f15553382a927f185c4f01", mi.HashInfoBytes().HexString())
+	assert.Equal(t, sha256.Sum256(mi.InfoBytes), mi.HashInfoBytesV2())
+	info, err := mi.UnmarshalInfo()
+	require.NoError(t, err)
+	// Reencoding an unmodified info gives the same infohash.
+	require.NoError(t, mi.SetInfo(&info))
+	assert.Equal(t, "23516c72685e8db0c8f15553382a927f185c4f01", mi.HashInfoBytes().HexString())
+	private := true
+	info.Private = &private
+	require.NoError(t, mi.SetInfo(&info))
+	assert.NotEqual(t, "23516c72685e8db0c8f15553382a927f185c4f01", mi.HashInfoBytes().HexString())
+	info2, err := mi.UnmarshalInfo()
+	require.NoError(t, err)
+	assert.True(t, info2.IsPrivate())
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	assert.EqualValues(t, 16<<10, ChoosePieceLength(0))
+	assert.EqualValues(t, 16<<10, ChoosePieceLength(1<<20))
+	assert.EqualValues(t, 1<<20, ChoosePieceLength(1<<30))
+	assert.EqualValues(t, 16<<20, ChoosePieceLength(1<<40))
+}
+
+func TestCreateFromPathRoundTrip(t *testing.T) {
+	td, err := ioutil.TempDir("", "anacrolix")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	root := filepath.Join(td, "data")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0750))
+	contents := map[string]string{
+		"a":                           "hello, world\n",
+		filepath.Join("sub", "b.txt"): string(make([]byte, 100000)),
+	}
+	for name, data := range contents {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0640))
+	}
+	mi, err := CreateFromPath(root, 0, [][]string{{"http://a/announce"}, {"udp://b:1337"}}, CreateOptions{})
+	require.NoError(t, err)
+	mi.UrlList = []string{"http://webseed/"}
+	mi.Comment = "test"
+	tf := filepath.Join(td, "data.torrent")
+	f, err := os.Create(tf)
+	require.NoError(t, err)
+	require.NoError(t, mi.Write(f))
+	require.NoError(t, f.Close())
+
+	mi2, err := LoadFromFile(tf)
+	require.NoError(t, err)
+	assert.EqualValues(t, "http://a/announce", mi2.Announce)
+	assert.EqualValues(t, [][]string{{"http://a/announce"}, {"udp://b:1337"}}, mi2.AnnounceList)
+	assert.EqualValues(t, UrlList{"http://webseed/"}, mi2.UrlList)
+	assert.EqualValues(t, "test", mi2.Comment)
+	assert.EqualValues(t, mi.HashInfoBytes(), mi2.HashInfoBytes())
+	info, err := mi2.UnmarshalInfo()
+	require.NoError(t, err)
+	assert.EqualValues(t, "data", info.Name)
+	assert.EqualValues(t, 16<<10, info.PieceLength)
+	assert.EqualValues(t, 100013, info.TotalLength())
+	assert.Len(t, info.Files, 2)
+
+	// Check the piece hashes against the data on disk.
+	var all []byte
+	for _, fi := range info.Files {
+		b, err := ioutil.ReadFile(filepath.Join(append([]string{root}, fi.Path...)...))
+		require.NoError(t, err)
+		all = append(all, b...)
+	}
+	require.EqualValues(t, 7, info.NumPieces())
+	for i := 0; i < info.NumPieces(); i++ {
+		p := info.Piece(i)
+		h := sha1.Sum(all[p.Offset() : p.Offset()+p.Length()])
+		assert.EqualValues(t, p.Hash(), Hash(h), i)
+	}
+}
+
+func TestCreateFromPathPrivateAndSource(t *testing.T) {
+	td, err := ioutil.TempDir("", "anacrolix")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	root := filepath.Join(td, "data")
+	require.NoError(t, ioutil.WriteFile(root, []byte("hello, world\n"), 0640))
+	create := func(opts CreateOptions) (*MetaInfo, Info) {
+		mi, err := CreateFromPath(root, 0, nil, opts)
+		require.NoError(t, err)
+		info, err := mi.UnmarshalInfo()
+		require.NoError(t, err)
+		return mi, info
+	}
+	plain, plainInfo := create(CreateOptions{})
+	assert.False(t, plainInfo.IsPrivate())
+	assert.Empty(t, plainInfo.Source)
+	sourced, sourcedInfo := create(CreateOptions{Private: true, Source: "TRACKER"})
+	assert.True(t, sourcedInfo.IsPrivate())
+	assert.EqualValues(t, "TRACKER", sourcedInfo.Source)
+	assert.NotEqual(t, plain.HashInfoBytes(), sourced.HashInfoBytes())
+	other, _ := create(CreateOptions{Private: true, Source: "OTHER"})
+	assert.NotEqual(t, sourced.HashInfoBytes(), other.HashInfoBytes())
+}
+
+// Writes a metainfo with a pieces string of n hashes, to exercise loading large files.
+func writeLargeMetaInfo(t testing.TB, dir string, n int) (string, *MetaInfo) {
+	info := Info{
+		Name:        "large",
+		PieceLength: 1 << 18,
+		Length:      int64(n) << 18,
+		Pieces:      make([]byte, n*HashSize),
+	}
+	for i := range info.Pieces {
+		info.Pieces[i] = byte(i)
+	}
+	mi := &MetaInfo{
+		Announce:     "http://tracker.example/announce",
+		AnnounceList: [][]string{{"http://tracker.example/announce"}},
+		Comment:      "large",
+		UrlList:      []string{"http://webseed.example/"},
+	}
+	var err error
+	mi.InfoBytes, err = bencode.Marshal(info)
+	require.NoError(t, err)
+	name := filepath.Join(dir, "large.torrent")
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, mi.Write(f))
+	return name, mi
+}
+
+func TestLoadFromFileLarge(t *testing.T) {
+	td, err := ioutil.TempDir("", "anacrolix")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	name, expected := writeLargeMetaInfo(t, td, largeMetaInfoSize/HashSize+1)
+	mi, err := LoadFromFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, expected, mi)
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	decoded, err := Load(f)
+	require.NoError(t, err)
+	assert.Equal(t, decoded, mi)
+	// Truncated files are an error.
+	b, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	_, err = loadLarge(b[:len(b)-1])
+	assert.Error(t, err)
+	_, err = loadLarge(b[:len(b)/2])
+	assert.Error(t, err)
+	_, err = loadLarge(append([]byte("l"), b...))
+	assert.Error(t, err)
+}
+
+func BenchmarkLoadFromFileLarge(b *testing.B) {
+	td, err := ioutil.TempDir("", "anacrolix")
+	require.NoError(b, err)
+	defer os.RemoveAll(td)
+	name, _ := writeLargeMetaInfo(b, td, 1<<20)
+	b.Run("LoadFromFile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := LoadFromFile(name)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("Load", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(name)
+			require.NoError(b, err)
+			_, err = Load(bufio.NewReader(f))
+			f.Close()
+			require.NoError(b, err)
+		}
+	})
+}
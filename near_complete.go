@@ -0,0 +1,37 @@
+package torrent
+
+import pp "github.com/anacrolix/torrent/peer_protocol"
+
+// How much is subtracted from the connection piece priority of nearly complete pieces. Within a
+// torrent piece priority, piece inclinations, availability and the request strategy's adjustment by
+// piece index span less than twice the number of pieces, so this puts them first. See
+// ClientConfig.NearCompletePieceChunks.
+func (t *Torrent) nearCompletePieceBoost() int {
+	return 2 * t.numPieces()
+}
+
+func (t *Torrent) boostNearCompletePieces() bool {
+	return t.cl.config.NearCompletePieceChunks > 0
+}
+
+// Whether the piece has started downloading and has few enough chunks left to be finished first.
+func (t *Torrent) pieceNearComplete(piece pieceIndex) bool {
+	if !t.boostNearCompletePieces() {
+		return false
+	}
+	p := &t.pieces[piece]
+	return p.hasDirtyChunks() && p.numChunks()-p.numDirtyChunks() <= pp.Integer(t.cl.config.NearCompletePieceChunks)
+}
+
+// Updates the connections' request orders if the piece changed from being nearly complete, as given
+// by was.
+func (t *Torrent) onPieceNearCompleteChanged(piece pieceIndex, was bool) {
+	if t.pieceNearComplete(piece) == was {
+		return
+	}
+	for c := range t.conns {
+		if c.updatePiecePriority(piece) {
+			c.updateRequests()
+		}
+	}
+}
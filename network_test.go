@@ -1,7 +1,10 @@
 package torrent
 
 import (
+	"context"
 	"net"
+	"runtime"
+	"syscall"
 	"testing"
 
 	"github.com/anacrolix/missinggo"
@@ -72,3 +75,100 @@ func TestListenLocalhostNetwork(t *testing.T) {
 
 	testAcceptedConnAddr(t, "tcp", false, dialClosure(net.Dial, "tcp"), listenClosure(net.Listen, "tcp6", ":0"))
 }
+
+func TestDialFromListenPort(t *testing.T) {
+	s, err := listenTcp("tcp4", "127.0.0.1:0", socketOpts{dialFromListenPort: true})
+	if err != nil {
+		t.Skipf("can't listen with port reuse: %v", err)
+	}
+	defer s.Close()
+	// Dial more than one peer from the same port.
+	for range "ab" {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, _ := l.Accept()
+			accepted <- c
+		}()
+		c, err := s.Dial(context.Background(), l.Addr().String())
+		require.NoError(t, err)
+		ac := <-accepted
+		require.NotNil(t, ac)
+		assert.Equal(t, missinggo.AddrPort(s.Addr()), missinggo.AddrPort(ac.RemoteAddr()))
+		ac.Close()
+		c.Close()
+	}
+	// The listener still accepts while we dial from its port.
+	go func() {
+		c, err := net.Dial("tcp4", s.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := s.Accept()
+	require.NoError(t, err)
+	c.Close()
+}
+
+func TestSocketBufferSizes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket buffer sizes aren't supported")
+	}
+	bufs := socketBufferSizes{send: 1 << 16, receive: 1 << 16}
+	s, err := listenTcp("tcp4", "127.0.0.1:0", socketOpts{tcpBuffers: bufs})
+	require.NoError(t, err)
+	defer s.Close()
+	go func() {
+		c, err := s.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := s.Dial(context.Background(), s.Addr().String())
+	require.NoError(t, err)
+	c.Close()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	require.NoError(t, setUdpSocketBuffers(pc, bufs))
+	// Far beyond any default OS maximum.
+	_, err = listenTcp("tcp4", "127.0.0.1:0", socketOpts{tcpBuffers: socketBufferSizes{receive: 1 << 30}})
+	assert.Error(t, err)
+	assert.Error(t, socketBufferSizes{send: -1}.validate())
+}
+
+func TestSocketDscp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket DSCP isn't supported")
+	}
+	dscp := func(c syscall.Conn, ipv6 bool) (ret int) {
+		rc, err := c.SyscallConn()
+		require.NoError(t, err)
+		require.NoError(t, rc.Control(func(fd uintptr) {
+			ret, err = socketDscp(fd, ipv6)
+		}))
+		require.NoError(t, err)
+		return
+	}
+	s, err := listenTcp("tcp4", "127.0.0.1:0", socketOpts{dscp: 8})
+	require.NoError(t, err)
+	defer s.Close()
+	go func() {
+		c, err := s.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := s.Dial(context.Background(), s.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	assert.EqualValues(t, 8, dscp(c.(*net.TCPConn), false))
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	require.NoError(t, setUdpSocketDscp(pc, 10))
+	assert.EqualValues(t, 10, dscp(pc.(*net.UDPConn), false))
+	assert.Error(t, validateDscp(64))
+}
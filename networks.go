@@ -47,11 +47,46 @@ func peerNetworkEnabled(n network, cfg *ClientConfig) bool {
 	if cfg.DisableTCP && n.Tcp {
 		return false
 	}
-	if cfg.DisableIPv6 && n.Ipv6 {
+	if !ipv6Enabled(cfg) && n.Ipv6 {
 		return false
 	}
-	if cfg.DisableIPv4 && n.Ipv4 {
+	if !ipv4Enabled(cfg) && n.Ipv4 {
 		return false
 	}
-	return true
+	return listenNetworksAllow(n, cfg)
+}
+
+// Whether ClientConfig.ListenNetworks permits the network. A network without an IP family, such as
+// that of an address from a dual-stack socket, is permitted if its transport is listed for any family.
+func listenNetworksAllow(n network, cfg *ClientConfig) bool {
+	return listenNetworksAny(cfg, func(l network) bool {
+		if l.Tcp != n.Tcp || l.Udp != n.Udp {
+			return false
+		}
+		if !n.Ipv4 && !n.Ipv6 {
+			return true
+		}
+		return l.Ipv4 == n.Ipv4 && l.Ipv6 == n.Ipv6
+	})
+}
+
+// Whether any of the networks permitted by ClientConfig.ListenNetworks match.
+func listenNetworksAny(cfg *ClientConfig, match func(network) bool) bool {
+	if cfg.ListenNetworks == nil {
+		return true
+	}
+	for _, s := range cfg.ListenNetworks {
+		if match(parseNetworkString(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipv4Enabled(cfg *ClientConfig) bool {
+	return !cfg.DisableIPv4 && listenNetworksAny(cfg, func(n network) bool { return n.Ipv4 })
+}
+
+func ipv6Enabled(cfg *ClientConfig) bool {
+	return !cfg.DisableIPv6 && listenNetworksAny(cfg, func(n network) bool { return n.Ipv6 })
 }
@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+)
+
+// What to do with a peer per ClientConfig.PeerClassifier.
+type PeerDecision int
+
+const (
+	// Connect to the peer as usual.
+	PeerAllow PeerDecision = iota
+	// Don't dial the peer, or accept connections from it.
+	PeerDeny
+	// Dial the peer only after the others known for the torrent. Connections from the peer are
+	// still accepted.
+	PeerDeprioritize
+	numPeerDecisions
+)
+
+func (d PeerDecision) String() string {
+	switch d {
+	case PeerAllow:
+		return "allow"
+	case PeerDeny:
+		return "deny"
+	case PeerDeprioritize:
+		return "deprioritize"
+	default:
+		return "unknown"
+	}
+}
+
+// Decides how to treat peers by IP, such as with the user's own GeoIP or ASN database. It's called
+// with the Client lock held, so it should be fast, and must not call into the Client.
+type PeerClassifier func(net.IP) PeerDecision
+
+// A PeerClassifier that allows every peer. It's used if ClientConfig.PeerClassifier is nil.
+func AllowAllPeers(net.IP) PeerDecision {
+	return PeerAllow
+}
+
+var errPeerDenied = errors.New("peer denied by classifier")
+
+func (cl *Client) peerClassifier() PeerClassifier {
+	if cl.config.PeerClassifier != nil {
+		return cl.config.PeerClassifier
+	}
+	return AllowAllPeers
+}
+
+// Classifies the peer IP, counting the decision for ClientStats.PeerDecisions. Unknown decisions
+// are treated as PeerAllow.
+func (cl *Client) classifyPeer(ip net.IP) PeerDecision {
+	d := cl.peerClassifier()(ip)
+	if d < 0 || d >= numPeerDecisions {
+		d = PeerAllow
+	}
+	cl.peerDecisions[d].Add(1)
+	return d
+}
+
+// Whether the peer should be dialed after others. This doesn't count toward the stats, as it's
+// consulted whenever the peer's priority is determined.
+func (cl *Client) peerDeprioritized(addr net.Addr) bool {
+	ip := addrIpOrNil(addr)
+	return ip != nil && cl.peerClassifier()(ip) == PeerDeprioritize
+}
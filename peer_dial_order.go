@@ -0,0 +1,60 @@
+package torrent
+
+import "math"
+
+// What's known about a peer when deciding when to dial it, for PeerDialOrder.
+type PeerDialCandidate struct {
+	Peer
+	// The BEP 40 canonical priority of the peer relative to our public address. Zero if it can't
+	// be determined.
+	Bep40Priority uint32
+	// The peer's reputation by IP. Positive for peers that have sent us verified data, and
+	// negative for those that sent bad data or were poor connections.
+	Reputation int
+	// ClientConfig.PeerClassifier returned PeerDeprioritize for the peer.
+	Deprioritized bool
+	// A PEX source recently reported the peer as dropped.
+	PexDropped bool
+}
+
+// Returns the priority for dialing a peer known for a torrent. Peers with higher priorities are
+// dialed first, and trusted peers before all others, with ties broken arbitrarily but consistently.
+// When a torrent has too many peers, those with the lowest priorities are discarded. The priority
+// is fixed when the peer is added. It's called with the Client lock held, so it should be fast,
+// and must not call into the Client.
+type PeerDialOrder func(PeerDialCandidate) uint32
+
+// The PeerDialOrder used if ClientConfig.PeerDialOrder is nil. Deprioritized and PEX dropped peers
+// are dialed last, then peers by reputation, and the rest in BEP 40 order.
+func DefaultPeerDialOrder(c PeerDialCandidate) uint32 {
+	if c.Deprioritized || c.PexDropped {
+		return 0
+	}
+	switch {
+	case c.Reputation > 0:
+		return math.MaxUint32
+	case c.Reputation < 0:
+		return 0
+	default:
+		return c.Bep40Priority
+	}
+}
+
+func (cl *Client) peerDialOrder() PeerDialOrder {
+	if cl.config.PeerDialOrder != nil {
+		return cl.config.PeerDialOrder
+	}
+	return DefaultPeerDialOrder
+}
+
+func (t *Torrent) peerDialPriority(p Peer) peerPriority {
+	cl := t.cl
+	ip := addrIpOrNil(p.Addr)
+	return cl.peerDialOrder()(PeerDialCandidate{
+		Peer:          p,
+		Bep40Priority: bep40PriorityIgnoreError(cl.publicAddr(ip), p.addr()),
+		Reputation:    cl.peerReputation(ip),
+		Deprioritized: cl.peerDeprioritized(p.Addr),
+		PexDropped:    t.pexDroppedRecently(p.Addr),
+	})
+}
@@ -0,0 +1,91 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// A line of Torrent.DumpPeers output.
+type peerDumpLine struct {
+	Addr   string
+	Source PeerSource
+	// Whether there's an established connection to the peer. The remaining fields are only set for
+	// connected peers, except Reputation.
+	Connected bool
+	Network   string `json:",omitempty"`
+	Outgoing  bool   `json:",omitempty"`
+	// Hex encoded.
+	PeerID         string `json:",omitempty"`
+	ClientName     string `json:",omitempty"`
+	Encrypted      bool   `json:",omitempty"`
+	PeerPieces     int    `json:",omitempty"`
+	Interested     bool   `json:",omitempty"`
+	Choking        bool   `json:",omitempty"`
+	PeerInterested bool   `json:",omitempty"`
+	PeerChoking    bool   `json:",omitempty"`
+	// Seconds since the handshake completed.
+	ConnectedFor float64 `json:",omitempty"`
+	// Average useful bytes per second in each direction over the connection's lifetime.
+	DownloadRate float64    `json:",omitempty"`
+	UploadRate   float64    `json:",omitempty"`
+	Stats        *ConnStats `json:",omitempty"`
+	Reputation   int
+}
+
+// Writes the torrent's connected and known peers to w as JSON lines, for debugging and attaching to
+// issues. The peers are gathered under the Client lock, which is released before anything is
+// written.
+func (t *Torrent) DumpPeers(w io.Writer) error {
+	lines := t.peerDumpLines()
+	enc := json.NewEncoder(w)
+	for _, l := range lines {
+		if err := enc.Encode(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Torrent) peerDumpLines() (ret []peerDumpLine) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	for c := range t.conns {
+		l := peerDumpLine{
+			Addr:           c.remoteAddr.String(),
+			Source:         c.Discovery,
+			Connected:      true,
+			Network:        c.network,
+			Outgoing:       c.outgoing,
+			PeerID:         hex.EncodeToString(c.PeerID[:]),
+			ClientName:     c.PeerClientName,
+			Encrypted:      c.headerEncrypted,
+			PeerPieces:     c.peerNumPieces(),
+			Interested:     c.interested,
+			Choking:        c.choking,
+			PeerInterested: c.peerInterested,
+			PeerChoking:    c.peerChoking,
+			Reputation:     t.cl.peerReputation(c.remoteIp()),
+		}
+		stats := c._stats.Copy()
+		l.Stats = &stats
+		if !c.completedHandshake.IsZero() {
+			d := time.Since(c.completedHandshake).Seconds()
+			l.ConnectedFor = d
+			if d > 0 {
+				l.DownloadRate = float64(stats.BytesReadUsefulData.Int64()) / d
+				l.UploadRate = float64(stats.BytesWrittenData.Int64()) / d
+			}
+		}
+		ret = append(ret, l)
+	}
+	t.peers.Each(func(p Peer) {
+		ret = append(ret, peerDumpLine{
+			Addr:       p.Addr.String(),
+			Source:     p.Source,
+			Reputation: t.cl.peerReputation(addrIpOrNil(p.Addr)),
+		})
+	})
+	return
+}
@@ -11,6 +11,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Returned by Decoder.Decode when a message's length exceeds MaxLength. Nothing of the message
+// past the length is read.
+var ErrMessageTooLong = errors.New("message too long")
+
 type Decoder struct {
 	R         *bufio.Reader
 	Pool      *sync.Pool
@@ -29,7 +33,7 @@ func (d *Decoder) Decode(msg *Message) (err error) {
 		return
 	}
 	if length > d.MaxLength {
-		return errors.New("message too long")
+		return ErrMessageTooLong
 	}
 	if length == 0 {
 		msg.Keepalive = true
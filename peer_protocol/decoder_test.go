@@ -2,6 +2,7 @@ package peer_protocol
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"sync"
 	"testing"
@@ -91,3 +92,12 @@ func TestDecodeOverlongPiece(t *testing.T) {
 	var m Message
 	require.Error(t, d.Decode(&m))
 }
+
+func TestDecodeMessageTooLong(t *testing.T) {
+	d := Decoder{
+		R:         bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, byte(Bitfield)})),
+		MaxLength: 1 << 18,
+	}
+	var msg Message
+	assert.Equal(t, ErrMessageTooLong, d.Decode(&msg))
+}
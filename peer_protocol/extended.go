@@ -17,6 +17,16 @@ type (
 		YourIp CompactIp `bencode:"yourip,omitempty"`
 		Ipv4   CompactIp `bencode:"ipv4,omitempty"`
 		Ipv6   net.IP    `bencode:"ipv6,omitempty"`
+		// Only meaningful if the sender includes ExtensionNameSettings in M.
+		Settings *ExtendedHandshakeSettings `bencode:"sett,omitempty"`
+	}
+
+	// Connection preferences for the "sett" extension. Zero values are unspecified.
+	ExtendedHandshakeSettings struct {
+		// The longest request the sender will serve.
+		BlockSize int `bencode:"block_size,omitempty"`
+		// The most requests the sender will queue. This narrows Reqq if both are given.
+		MaxRequests int `bencode:"max_requests,omitempty"`
 	}
 
 	ExtensionName   string
@@ -29,4 +39,12 @@ const (
 	// http://bittorrent.org/beps/bep_0009.html. Note that there's an
 	// LT_metadata, but I've never implemented it.
 	ExtensionNameMetadata = "ut_metadata"
+	// libtorrent's extension to retract a previously advertised piece. The payload is the 4 byte
+	// big-endian piece index.
+	ExtensionNameDontHave = "lt_donthave"
+	// http://www.bittorrent.org/beps/bep_0055.html
+	ExtensionNameUtHolepunch = "ut_holepunch"
+	// Peers exchange connection preferences in the extended handshake. No messages are sent with
+	// this extension's ID.
+	ExtensionNameSettings = "sett"
 )
@@ -3,10 +3,14 @@ package peer_protocol
 import (
 	"bufio"
 	"bytes"
+	"net"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
 )
 
 func TestBinaryReadSliceOfPointers(t *testing.T) {
@@ -152,3 +156,30 @@ func TestUnmarshalPortMsg(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestExtendedHandshakeYourIp(t *testing.T) {
+	for _, ip := range []string{"203.0.113.1", "2001:db8::1"} {
+		b, err := bencode.Marshal(ExtendedHandshakeMessage{YourIp: CompactIp(net.ParseIP(ip))})
+		require.NoError(t, err)
+		var d ExtendedHandshakeMessage
+		require.NoError(t, bencode.Unmarshal(b, &d))
+		assert.Equal(t, ip, net.IP(d.YourIp).String())
+	}
+	b, err := bencode.Marshal(ExtendedHandshakeMessage{YourIp: CompactIp(net.ParseIP("203.0.113.1"))})
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "6:yourip4:")
+}
+
+func TestExtendedHandshakeSettings(t *testing.T) {
+	b, err := bencode.Marshal(ExtendedHandshakeMessage{})
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "sett")
+	b, err = bencode.Marshal(ExtendedHandshakeMessage{
+		Settings: &ExtendedHandshakeSettings{BlockSize: 16384, MaxRequests: 250},
+	})
+	require.NoError(t, err)
+	var d ExtendedHandshakeMessage
+	require.NoError(t, bencode.Unmarshal(b, &d))
+	require.NotNil(t, d.Settings)
+	assert.Equal(t, ExtendedHandshakeSettings{BlockSize: 16384, MaxRequests: 250}, *d.Settings)
+}
@@ -0,0 +1,95 @@
+package peer_protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/anacrolix/dht/v2/krpc"
+)
+
+// http://www.bittorrent.org/beps/bep_0055.html
+type (
+	UtHolepunchMsg struct {
+		MsgType  UtHolepunchMsgType
+		AddrPort krpc.NodeAddr
+		// Only sent in UtHolepunchError messages.
+		ErrCode UtHolepunchErrCode
+	}
+	UtHolepunchMsgType byte
+	UtHolepunchErrCode uint32
+)
+
+const (
+	// Sent to a relay, asking it to have us and the target connect to each other.
+	UtHolepunchRendezvous UtHolepunchMsgType = iota
+	// Sent by a relay to both ends, with the address of the other end.
+	UtHolepunchConnect
+	// Sent by a relay when it can't handle a rendezvous.
+	UtHolepunchError
+)
+
+const (
+	// The target endpoint is invalid.
+	UtHolepunchNoSuchPeer UtHolepunchErrCode = iota + 1
+	// The relay isn't connected to the target.
+	UtHolepunchNotConnected
+	// The target doesn't support the holepunch extension.
+	UtHolepunchNoSupport
+	// The target is the sender of the rendezvous.
+	UtHolepunchNoSelf
+)
+
+const (
+	utHolepunchIpv4 = 0
+	utHolepunchIpv6 = 1
+)
+
+func (m UtHolepunchMsg) MarshalBinary() ([]byte, error) {
+	b := []byte{byte(m.MsgType)}
+	if ip := m.AddrPort.IP.To4(); ip != nil {
+		b = append(b, utHolepunchIpv4)
+		b = append(b, ip...)
+	} else if ip := m.AddrPort.IP.To16(); ip != nil {
+		b = append(b, utHolepunchIpv6)
+		b = append(b, ip...)
+	} else {
+		return nil, fmt.Errorf("bad ip: %v", m.AddrPort.IP)
+	}
+	b = append(b, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(m.AddrPort.Port))
+	if m.MsgType == UtHolepunchError {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(m.ErrCode))
+	}
+	return b, nil
+}
+
+func (m *UtHolepunchMsg) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 {
+		return errors.New("too short")
+	}
+	m.MsgType = UtHolepunchMsgType(b[0])
+	var ipLen int
+	switch b[1] {
+	case utHolepunchIpv4:
+		ipLen = net.IPv4len
+	case utHolepunchIpv6:
+		ipLen = net.IPv6len
+	default:
+		return fmt.Errorf("unknown addr type: %v", b[1])
+	}
+	b = b[2:]
+	if len(b) < ipLen+2 {
+		return errors.New("addr too short")
+	}
+	m.AddrPort.IP = append(net.IP(nil), b[:ipLen]...)
+	m.AddrPort.Port = int(binary.BigEndian.Uint16(b[ipLen:]))
+	b = b[ipLen+2:]
+	// Some implementations send the error code in every message.
+	if len(b) >= 4 {
+		m.ErrCode = UtHolepunchErrCode(binary.BigEndian.Uint32(b))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package peer_protocol
+
+import (
+	"net"
+	"testing"
+
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUtHolepunchMsgRoundTrip(t *testing.T) {
+	for _, m := range []UtHolepunchMsg{
+		{MsgType: UtHolepunchRendezvous, AddrPort: krpc.NodeAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 6881}},
+		{MsgType: UtHolepunchConnect, AddrPort: krpc.NodeAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}},
+		{MsgType: UtHolepunchError, AddrPort: krpc.NodeAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 2}, ErrCode: UtHolepunchNoSelf},
+	} {
+		b, err := m.MarshalBinary()
+		require.NoError(t, err)
+		var m2 UtHolepunchMsg
+		require.NoError(t, m2.UnmarshalBinary(b))
+		assert.Equal(t, m, m2)
+	}
+}
+
+func TestUtHolepunchMsgWireFormat(t *testing.T) {
+	b, err := UtHolepunchMsg{
+		MsgType:  UtHolepunchError,
+		AddrPort: krpc.NodeAddr{IP: net.IPv4(1, 2, 3, 4), Port: 0x1a2b},
+		ErrCode:  UtHolepunchNotConnected,
+	}.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{2, 0, 1, 2, 3, 4, 0x1a, 0x2b, 0, 0, 0, 2}, b)
+	var m UtHolepunchMsg
+	assert.Error(t, m.UnmarshalBinary([]byte{0, 1, 1, 2}))
+	assert.Error(t, m.UnmarshalBinary([]byte{0, 2}))
+}
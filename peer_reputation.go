@@ -0,0 +1,218 @@
+package torrent
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+const (
+	// Reputation changes. Peers are scored by IP, as reconnecting peers usually come from another
+	// port.
+	reputationGoodPiece    = 1
+	reputationBadPiece     = -10
+	reputationShortConn    = -1
+	reputationChokedConn   = -1
+	reputationSnubbedConn  = -3
+	reputationMin          = -100
+	reputationMax          = 100
+	reputationStatsEntries = 10
+	// Peer conns closed within this long of the handshake count as short.
+	reputationShortConnDuration = time.Minute
+	// Short and choked connections don't lower reputation below this, so only corrupt data gets
+	// connections refused.
+	reputationBehaviourFloor = -10
+	// Connections from peers below this are refused.
+	reputationRejectBelow = -20
+	// Reputations move one point back toward zero this often, so peers aren't judged forever on
+	// old behaviour, and IPs that change hands recover.
+	reputationDecayInterval = time.Hour
+	// The most IPs reputation is kept for. The least recently scored are forgotten first.
+	maxPeerReputations = 4096
+	// The file in ClientConfig.DataDir that reputation is persisted to.
+	reputationFileName = ".torrent.reputation"
+)
+
+// A peer IP and its reputation, for ClientStats.
+type PeerReputation struct {
+	IP    string
+	Score int
+}
+
+var errPeerReputation = errors.New("peer has poor reputation")
+
+// A peer IP's reputation as of when it last changed.
+type peerReputation struct {
+	Score int `bencode:"s"`
+	// Unix seconds.
+	Updated int64 `bencode:"t"`
+}
+
+// Returns the score once decayed toward zero up to now.
+func (me peerReputation) score(now time.Time) int {
+	steps := int64(now.Sub(time.Unix(me.Updated, 0)) / reputationDecayInterval)
+	if steps <= 0 {
+		return me.Score
+	}
+	if me.Score > 0 {
+		return int(max(0, int64(me.Score)-steps))
+	}
+	return int(min(0, int64(me.Score)+steps))
+}
+
+func (cl *Client) peerReputation(ip net.IP) int {
+	if ip == nil {
+		return 0
+	}
+	return cl.reputations[ip.String()].score(time.Now())
+}
+
+// Adjusts the reputation of the IP by delta, within floor and reputationMax.
+func (cl *Client) adjustPeerReputation(ip net.IP, delta, floor int) {
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+	now := time.Now()
+	pr, ok := cl.reputations[key]
+	score := pr.score(now)
+	if delta < 0 && score <= floor {
+		return
+	}
+	score = int(clamp(int64(floor), int64(score+delta), reputationMax))
+	if score == 0 {
+		delete(cl.reputations, key)
+		return
+	}
+	if cl.reputations == nil {
+		cl.reputations = make(map[string]peerReputation)
+	}
+	if !ok {
+		cl.makeRoomForPeerReputation(now)
+	}
+	cl.reputations[key] = peerReputation{Score: score, Updated: now.Unix()}
+}
+
+// Forgets reputations that have decayed away, and then the least recently scored, until there's
+// room for another.
+func (cl *Client) makeRoomForPeerReputation(now time.Time) {
+	if len(cl.reputations) < maxPeerReputations {
+		return
+	}
+	var oldest string
+	for k, pr := range cl.reputations {
+		if pr.score(now) == 0 {
+			delete(cl.reputations, k)
+			continue
+		}
+		if oldest == "" || pr.Updated < cl.reputations[oldest].Updated {
+			oldest = k
+		}
+	}
+	if len(cl.reputations) >= maxPeerReputations {
+		delete(cl.reputations, oldest)
+	}
+}
+
+// Lowers the reputation of the peer that sent a piece that failed its hash check, if it was the
+// only one that contributed to it. Others that shared the piece may have been unlucky to be mixed
+// up with a bad peer.
+func (cl *Client) onBadPieceReputation(dirtiers map[*PeerConn]struct{}) {
+	if len(dirtiers) != 1 {
+		return
+	}
+	for c := range dirtiers {
+		cl.adjustPeerReputation(c.remoteIp(), reputationBadPiece, reputationMin)
+	}
+}
+
+// Scores the peer after its connection is closed.
+func (cl *Client) onPeerConnClosedReputation(c *PeerConn) {
+	if c.completedHandshake.IsZero() {
+		return
+	}
+	ip := c.remoteIp()
+	if time.Since(c.completedHandshake) < reputationShortConnDuration {
+		cl.adjustPeerReputation(ip, reputationShortConn, reputationBehaviourFloor)
+	}
+	// We wanted data for a while and got none.
+	if c.cumInterest() >= reputationShortConnDuration && c.lastUsefulChunkReceived.IsZero() {
+		cl.adjustPeerReputation(ip, reputationChokedConn, reputationBehaviourFloor)
+	}
+}
+
+func (cl *Client) rejectPeerReputation(ip net.IP) bool {
+	return cl.peerReputation(ip) < reputationRejectBelow
+}
+
+// Returns the peers with the highest and lowest reputations.
+func (cl *Client) reputationStats() (top, bottom []PeerReputation) {
+	all := make([]PeerReputation, 0, len(cl.reputations))
+	now := time.Now()
+	for ip, pr := range cl.reputations {
+		all = append(all, PeerReputation{ip, pr.score(now)})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Score != all[j].Score {
+			return all[i].Score > all[j].Score
+		}
+		return all[i].IP < all[j].IP
+	})
+	for _, pr := range all {
+		if pr.Score <= 0 || len(top) == reputationStatsEntries {
+			break
+		}
+		top = append(top, pr)
+	}
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Score >= 0 || len(bottom) == reputationStatsEntries {
+			break
+		}
+		bottom = append(bottom, all[i])
+	}
+	return
+}
+
+func (cl *Client) reputationFilePath() string {
+	if !cl.config.PersistPeerReputation || cl.config.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(cl.config.DataDir, reputationFileName)
+}
+
+func (cl *Client) loadPeerReputations() {
+	path := cl.reputationFilePath()
+	if path == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = bencode.Unmarshal(b, &cl.reputations)
+	}
+	if err != nil {
+		cl.logger.Printf("error loading peer reputations: %v", err)
+	}
+}
+
+func (cl *Client) savePeerReputations() {
+	path := cl.reputationFilePath()
+	if path == "" {
+		return
+	}
+	b, err := bencode.Marshal(cl.reputations)
+	if err == nil {
+		err = ioutil.WriteFile(path, b, 0640)
+	}
+	if err != nil {
+		cl.logger.Printf("error saving peer reputations: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math/rand"
@@ -19,6 +20,7 @@ import (
 	"github.com/anacrolix/missinggo/v2/prioritybitmap"
 	"github.com/anacrolix/multiless"
 	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/mse"
@@ -33,6 +35,8 @@ const (
 	PeerSourceDhtGetPeers     = "Hg" // Peers we found by searching a DHT.
 	PeerSourceDhtAnnouncePeer = "Ha" // Peers that were announced to us by a DHT.
 	PeerSourcePex             = "X"
+	PeerSourceLsd             = "L" // Peers found on the local network by BEP 14 discovery.
+	PeerSourceUtHolepunch     = "C" // Peers we were told to connect to by a BEP 55 holepunch relay.
 )
 
 // Maintains the state of a connection with a peer.
@@ -57,10 +61,17 @@ type PeerConn struct {
 	Discovery       PeerSource
 	trusted         bool
 	closed          missinggo.Event
+	// Whether Callbacks.PeerConnected has been called for the connection.
+	connectedCallbackCalled bool
+	// Whether the connection doesn't count toward the torrent's established connection limit yet.
+	// See ClientConfig.ConnWarmUpTimeout.
+	warmingUp   bool
+	warmUpTimer *time.Timer
 	// Set true after we've added our ConnStats generated during handshake to
 	// other ConnStat instances as determined when the *Torrent became known.
 	reconciledHandshakeStats bool
 
+	opened                  time.Time
 	lastMessageReceived     time.Time
 	completedHandshake      time.Time
 	lastUsefulChunkReceived time.Time
@@ -70,14 +81,20 @@ type PeerConn struct {
 	interested           bool
 	lastBecameInterested time.Time
 	priorInterest        time.Duration
+	// When the peer last started choking us while we're interested, and the timer for
+	// ClientConfig.PeerChokedTimeout.
+	chokedWhileInterestedSince time.Time
+	snubTimer                  *time.Timer
 
 	lastStartedExpectingToReceiveChunks time.Time
 	cumulativeExpectedToReceiveChunks   time.Duration
 	_chunksReceivedWhileExpecting       int64
 
-	choking          bool
-	requests         map[request]struct{}
+	choking bool
+	// Outstanding requests to the peer, and when they were sent.
+	requests         map[request]time.Time
 	requestsLowWater int
+	requestStats     RequestStats
 	// Chunks that we might reasonably expect to receive from the peer. Due to
 	// latency, buffering, and implementation differences, we may receive
 	// chunks that are no longer in the set of requests actually want.
@@ -85,8 +102,36 @@ type PeerConn struct {
 	// Indexed by metadata piece, set to true if posted and pending a
 	// response.
 	metadataRequests []bool
-	sentHaves        bitmap.Bitmap
-	pex              pexConnState
+	// The peer advertised a metadata size we won't accept, so we don't fetch metadata from it.
+	metadataSizeRejected bool
+	// Limits the metadata pieces we send the peer.
+	metadataUploadLimiter *rate.Limiter
+	// The peer rejected a request larger than 16KiB while not choking us, so we request larger
+	// chunks from it in 16KiB pieces.
+	largeRequestsRejected bool
+	// Chunks requested in pieces, by the chunk's request, and the chunk request for each of the
+	// pieces we're still expecting.
+	splitChunks   map[request]*splitChunk
+	splitRequests map[request]request
+	sentHaves     bitmap.Bitmap
+	pex           pexConnState
+	// Whether the peer has a seeding upload slot, and whether it's one reserved for newcomers. See
+	// ClientConfig.SeedingUploadSlots.
+	uploadSlot             bool
+	newcomerUploadSlot     bool
+	lastNewcomerUploadSlot time.Time
+	// BytesWrittenData when upload slots were last reassigned.
+	rechokeBytesWritten int64
+	// Set by SetChoked, and takes precedence over the automatic choking.
+	chokeOverride chokeOverride
+	// The outgoing connection attempt that succeeded, from 1. Zero for incoming connections.
+	dialAttempt int
+	// Why the connection was closed, once it is.
+	dropReason ConnDropReason
+	// Per-connection caps set by SetDownloadLimit and SetUploadLimit, applied within the
+	// ClientConfig limiters.
+	downloadLimiter *rate.Limiter
+	uploadLimiter   *rate.Limiter
 
 	// Stuff controlled by the remote peer.
 	PeerID                PeerID
@@ -101,6 +146,8 @@ type PeerConn struct {
 	// The peer has everything. This can occur due to a special message, when
 	// we may not even know the number of pieces in the torrent yet.
 	peerSentHaveAll bool
+	// Whether the peer's pieces are counted in the availability of the Torrent's pieces.
+	availabilityCounted bool
 	// The highest possible number of pieces the torrent could have based on
 	// communication with the peer. Generally only useful until we have the
 	// torrent info.
@@ -112,6 +159,8 @@ type PeerConn struct {
 	PeerMaxRequests  int // Maximum pending requests the peer allows.
 	PeerExtensionIDs map[pp.ExtensionName]pp.ExtensionNumber
 	PeerClientName   string
+	// The longest request the peer will serve, per the "sett" extension. Zero if unknown.
+	peerBlockSize pp.Integer
 
 	pieceInclination   []int
 	_pieceRequestOrder prioritybitmap.PriorityBitmap
@@ -134,6 +183,7 @@ func (cn *PeerConn) updateExpectingChunks() {
 			cn.lastStartedExpectingToReceiveChunks = time.Time{}
 		}
 	}
+	cn.updateChokedWhileInterested()
 }
 
 func (cn *PeerConn) expectingChunks() bool {
@@ -205,19 +255,29 @@ func (cn *PeerConn) bestPeerNumPieces() pieceIndex {
 	return cn.peerMinPieces
 }
 
-func (cn *PeerConn) completedString() string {
-	have := pieceIndex(cn._peerPieces.Len())
+// The number of pieces the peer has claimed to have.
+func (cn *PeerConn) peerNumPieces() pieceIndex {
 	if cn.peerSentHaveAll {
-		have = cn.bestPeerNumPieces()
+		return cn.bestPeerNumPieces()
 	}
-	return fmt.Sprintf("%d/%d", have, cn.bestPeerNumPieces())
+	return pieceIndex(cn._peerPieces.Len())
+}
+
+func (cn *PeerConn) completedString() string {
+	return fmt.Sprintf("%d/%d", cn.peerNumPieces(), cn.bestPeerNumPieces())
 }
 
 // Correct the PeerPieces slice length. Return false if the existing slice is
 // invalid, such as by receiving badly sized BITFIELD, or invalid HAVE
 // messages.
+// Called when the info becomes known. Peers that claimed pieces beyond the end of the torrent
+// before then broke the protocol.
 func (cn *PeerConn) setNumPieces(num pieceIndex) error {
+	if cn.peerMinPieces > num {
+		return fmt.Errorf("peer claimed piece %d of %d", cn.peerMinPieces-1, num)
+	}
 	cn._peerPieces.RemoveRange(bitmap.BitIndex(num), bitmap.ToEnd)
+	cn.setAvailabilityCounted(true)
 	cn.peerPiecesChanged()
 	return nil
 }
@@ -326,8 +386,12 @@ func (cn *PeerConn) close() {
 		cn.pex.Close()
 	}
 	cn.tickleWriter()
+	if cn.t != nil {
+		cn.t.cl.leaveUploadQueue(cn)
+	}
 	cn.discardPieceInclination()
 	cn._pieceRequestOrder.Clear()
+	cn.updateChokedWhileInterested()
 	if cn.conn != nil {
 		go cn.conn.Close()
 	}
@@ -343,7 +407,7 @@ func (cn *PeerConn) post(msg pp.Message) {
 	// We don't need to track bytes here because a connection.w Writer wrapper
 	// takes care of that (although there's some delay between us recording
 	// the message, and the connection writer flushing it out.).
-	cn.writeBuffer.Write(msg.MustMarshalBinary())
+	cn.bufferMessage(msg)
 	// Last I checked only Piece messages affect stats, and we don't post
 	// those.
 	cn.wroteMsg(&msg)
@@ -392,6 +456,41 @@ func (cn *PeerConn) nominalMaxRequests() (ret int) {
 	))
 }
 
+// Returns the most requests the connection should have outstanding to leave work for other
+// connections whose peers are unchoking us, per ClientConfig.MaxConnRequestShare. ok is false if
+// there's no such limit.
+func (cn *PeerConn) requestShareLimit() (limit int, ok bool) {
+	share := cn.t.cl.config.MaxConnRequestShare
+	if share <= 0 || share >= 1 {
+		return
+	}
+	unchoking := cn.t.numUnchokingConns
+	if _, counted := cn.t.conns[cn]; counted && !cn.peerChoking {
+		unchoking--
+	}
+	if unchoking <= 0 {
+		return
+	}
+	others := cn.t.numRequests - len(cn.requests)
+	// Holding limit requests leaves us exactly share of the total.
+	return int(max(2, int64(share*float64(others)/(1-share)))), true
+}
+
+func (c *PeerConn) setPeerChoking(choking bool) {
+	if c.peerChoking == choking {
+		return
+	}
+	c.updateAvailability(func() { c.peerChoking = choking })
+	if _, ok := c.t.conns[c]; !ok {
+		return
+	}
+	if choking {
+		c.t.numUnchokingConns--
+	} else {
+		c.t.numUnchokingConns++
+	}
+}
+
 func (cn *PeerConn) totalExpectingTime() (ret time.Duration) {
 	ret = cn.cumulativeExpectedToReceiveChunks
 	if !cn.lastStartedExpectingToReceiveChunks.IsZero() {
@@ -497,16 +596,22 @@ func (cn *PeerConn) request(r request, mw messageWriter) bool {
 		panic("piece is queued for hash")
 	}
 	if cn.requests == nil {
-		cn.requests = make(map[request]struct{})
+		cn.requests = make(map[request]time.Time)
 	}
-	cn.requests[r] = struct{}{}
+	cn.requests[r] = time.Now()
+	cn.onRequestSent(r)
 	if cn.validReceiveChunks == nil {
 		cn.validReceiveChunks = make(map[request]struct{})
 	}
 	cn.validReceiveChunks[r] = struct{}{}
 	cn.t.pendingRequests[r]++
+	cn.t.numRequests++
+	cn.t.piece(pieceIndex(r.Index)).numPeerRequests++
 	cn.t.requestStrategy.hooks().sentRequest(r)
 	cn.updateExpectingChunks()
+	if l := cn.maxRequestLength(); l != 0 && r.Length > l {
+		return cn.requestSplit(r, l, mw)
+	}
 	return mw(pp.Message{
 		Type:   pp.Request,
 		Index:  r.Index,
@@ -515,29 +620,153 @@ func (cn *PeerConn) request(r request, mw messageWriter) bool {
 	})
 }
 
+// The longest request we make to the peer, or zero if requests aren't split. Chunks are requested
+// in pieces from peers that reject large requests, or that gave a smaller block size.
+func (cn *PeerConn) maxRequestLength() (ret pp.Integer) {
+	if cn.largeRequestsRejected {
+		ret = defaultChunkSize
+	}
+	if cn.peerBlockSize != 0 && (ret == 0 || cn.peerBlockSize < ret) {
+		ret = cn.peerBlockSize
+	}
+	return
+}
+
+// A chunk we're receiving in pieces. See PeerConn.maxRequestLength.
+type splitChunk struct {
+	data    []byte
+	pending map[request]struct{}
+}
+
+// Requests the chunk in pieces no longer than l. Chunk state is tracked in units of the torrent's
+// chunk size, so the pieces are put back together before the chunk is received.
+func (cn *PeerConn) requestSplit(r request, l pp.Integer, mw messageWriter) bool {
+	sc := &splitChunk{
+		data:    make([]byte, r.Length),
+		pending: make(map[request]struct{}),
+	}
+	if cn.splitChunks == nil {
+		cn.splitChunks = make(map[request]*splitChunk)
+		cn.splitRequests = make(map[request]request)
+	}
+	cn.splitChunks[r] = sc
+	more := true
+	for begin := r.Begin; begin < r.Begin+r.Length; begin += l {
+		sr := newRequest(r.Index, begin, pp.Integer(min(int64(l), int64(r.Begin+r.Length-begin))))
+		sc.pending[sr] = struct{}{}
+		cn.splitRequests[sr] = r
+		// The message is buffered even if the writer wants no more.
+		more = mw(pp.Message{
+			Type:   pp.Request,
+			Index:  sr.Index,
+			Begin:  sr.Begin,
+			Length: sr.Length,
+		}) && more
+	}
+	return more
+}
+
+// Returns the cancel messages for a request, which for a split chunk are for its pieces that
+// haven't arrived.
+func (cn *PeerConn) cancelMessages(r request) (ret []pp.Message) {
+	sc, ok := cn.splitChunks[r]
+	if !ok {
+		return []pp.Message{makeCancelMessage(r)}
+	}
+	for sr := range sc.pending {
+		ret = append(ret, makeCancelMessage(sr))
+	}
+	return
+}
+
+// Forgets the pieces of a split chunk, if the request was split.
+func (c *PeerConn) deleteSplitChunk(r request) {
+	sc, ok := c.splitChunks[r]
+	if !ok {
+		return
+	}
+	for sr := range sc.pending {
+		delete(c.splitRequests, sr)
+	}
+	delete(c.splitChunks, r)
+}
+
+// Whether the chunk received could be a piece of a split chunk that was deleted before the pieces
+// were put back together, such as by a reject, cancel or choke. The peer may still send such
+// pieces, and they're discarded.
+func (c *PeerConn) strayChunkPiece(sr request) bool {
+	l := c.maxRequestLength()
+	if l == 0 || sr.Length > l {
+		return false
+	}
+	r := request{sr.Index, chunkIndexSpec(
+		pp.Integer(chunkIndex(sr.chunkSpec, c.t.chunkSize)),
+		c.t.pieceLength(pieceIndex(sr.Index)),
+		c.t.chunkSize,
+	)}
+	return r != sr && (sr.Begin-r.Begin)%l == 0 && sr.Begin+sr.Length <= r.Begin+r.Length
+}
+
+// Adds a received piece of a split chunk. Returns the whole chunk once all of its pieces have
+// arrived.
+func (c *PeerConn) receiveSplitChunk(sr request, msg *pp.Message) (_ *pp.Message, ok bool) {
+	r := c.splitRequests[sr]
+	delete(c.splitRequests, sr)
+	sc, ok := c.splitChunks[r]
+	if !ok {
+		// The chunk was rejected.
+		return nil, false
+	}
+	if _, ok := sc.pending[sr]; !ok {
+		return nil, false
+	}
+	delete(sc.pending, sr)
+	copy(sc.data[sr.Begin-r.Begin:], msg.Piece)
+	if len(sc.pending) != 0 {
+		return nil, false
+	}
+	delete(c.splitChunks, r)
+	return &pp.Message{
+		Type:  pp.Piece,
+		Index: r.Index,
+		Begin: r.Begin,
+		Piece: sc.data,
+	}, true
+}
+
 func (cn *PeerConn) fillWriteBuffer(msg func(pp.Message) bool) {
-	if !cn.t.networkingEnabled || cn.t.dataDownloadDisallowed {
+	if !cn.t.networkingEnabled || cn.t.dataDownloadDisallowed || cn.t.seedOnly || cn.t.holdingRequests() {
 		if !cn.setInterested(false, msg) {
 			return
 		}
 		if len(cn.requests) != 0 {
 			for r := range cn.requests {
+				cms := cn.cancelMessages(r)
 				cn.deleteRequest(r)
+				cn.onRequestCancelled(r)
 				// log.Printf("%p: cancelling request: %v", cn, r)
-				if !msg(makeCancelMessage(r)) {
+				more := true
+				for _, cm := range cms {
+					more = msg(cm) && more
+				}
+				if !more {
 					return
 				}
 			}
 		}
 	} else if len(cn.requests) <= cn.requestsLowWater {
 		filledBuffer := false
+		maxRequests := cn.nominalMaxRequests()
+		if share, ok := cn.requestShareLimit(); ok && share < maxRequests {
+			maxRequests = share
+		}
 		cn.iterPendingPieces(func(pieceIndex pieceIndex) bool {
 			cn.iterPendingRequests(pieceIndex, func(r request) bool {
 				if !cn.setInterested(true, msg) {
 					filledBuffer = true
 					return false
 				}
-				if len(cn.requests) >= cn.nominalMaxRequests() {
+				if len(cn.requests) >= maxRequests {
 					return false
 				}
 				// Choking is looked at here because our interest is dependent
@@ -589,7 +818,7 @@ func (cn *PeerConn) writer(keepAliveTimeout time.Duration) {
 	})
 	cn.locker().Lock()
 	defer cn.locker().Unlock()
-	defer cn.close()
+	defer cn.closeWithReason(ConnDropError)
 	defer keepAliveTimer.Stop()
 	frontBuf := new(bytes.Buffer)
 	for {
@@ -599,13 +828,13 @@ func (cn *PeerConn) writer(keepAliveTimeout time.Duration) {
 		if cn.writeBuffer.Len() == 0 {
 			cn.fillWriteBuffer(func(msg pp.Message) bool {
 				cn.wroteMsg(&msg)
-				cn.writeBuffer.Write(msg.MustMarshalBinary())
+				cn.bufferMessage(msg)
 				torrent.Add(fmt.Sprintf("messages filled of type %s", msg.Type.String()), 1)
 				return cn.writeBuffer.Len() < 1<<16 // 64KiB
 			})
 		}
 		if cn.writeBuffer.Len() == 0 && time.Since(lastWrite) >= keepAliveTimeout {
-			cn.writeBuffer.Write(pp.Message{Keepalive: true}.MustMarshalBinary())
+			cn.bufferMessage(pp.Message{Keepalive: true})
 			postedKeepalives.Add(1)
 		}
 		if cn.writeBuffer.Len() == 0 {
@@ -693,6 +922,10 @@ func iterUnbiasedPieceRequestOrder(cn requestStrategyConnection, f func(piece pi
 		iterBitmapsDistinct(&skip, now, readahead),
 		// We have to iterate _pendingPieces separately because it isn't a Bitmap.
 		func(cb iter.Callback) {
+			if cn.torrent().inShareMode() || cn.torrent().boostNearCompletePieces() {
+				iterPendingPiecesSorted(cn.torrent(), &skip, cb)
+				return
+			}
 			cn.torrent().pendingPieces().IterTyped(func(piece int) bool {
 				if skip.Contains(piece) {
 					return true
@@ -719,14 +952,33 @@ func (cn *PeerConn) iterPendingPieces(f func(pieceIndex) bool) bool {
 	if !cn.t.haveInfo() {
 		return false
 	}
-	return cn.t.requestStrategy.iterPendingPieces(cn, f)
+	// Pieces with deadlines come first, soonest first.
+	var deadlined bitmap.Bitmap
+	if !cn.t.iterDeadlinePieces(func(piece pieceIndex) bool {
+		if !cn.peerHasPiece(piece) || !cn.t.wantPieceIndex(piece) || cn.t.piecePriority(piece) == PiecePriorityNone {
+			return true
+		}
+		deadlined.Add(bitmap.BitIndex(piece))
+		return f(piece)
+	}) {
+		return false
+	}
+	return cn.t.requestStrategy.iterPendingPieces(cn, func(piece pieceIndex) bool {
+		// Pieces a web seed is fetching are left to it, unless they have a deadline.
+		return deadlined.Contains(bitmap.BitIndex(piece)) || cn.t.piece(piece).webSeedFetching || f(piece)
+	})
 }
 func (cn *PeerConn) iterPendingPiecesUntyped(f iter.Callback) {
 	cn.iterPendingPieces(func(i pieceIndex) bool { return f(i) })
 }
 
 func (cn *PeerConn) iterPendingRequests(piece pieceIndex, f func(request) bool) bool {
-	return cn.t.requestStrategy.iterUndirtiedChunks(
+	iterUndirtiedChunks := cn.t.requestStrategy.iterUndirtiedChunks
+	if cn.t.pieceDeadlineNear(piece) {
+		// Request the chunks even if other connections have, so as to meet the deadline.
+		iterUndirtiedChunks = requestStrategyDefaults{}.iterUndirtiedChunks
+	}
+	return iterUndirtiedChunks(
 		cn.t.piece(piece).requestStrategyPiece(),
 		func(cs chunkSpec) bool {
 			return f(request{pp.Integer(piece), cs})
@@ -752,7 +1004,15 @@ func (cn *PeerConn) updatePiecePriority(piece pieceIndex) bool {
 		return cn.stopRequestingPiece(piece)
 	}
 	prio := cn.getPieceInclination()[piece]
+	if cn.t.shareMode {
+		// Favour rarer pieces, as more peers are likely to want them from us.
+		prio = int(min(int64(cn.t.pieceAvailability(piece)), int64(cn.t.numPieces()-1)))
+	}
 	prio = cn.t.requestStrategy.piecePriority(cn, piece, tpp, prio)
+	if cn.t.pieceNearComplete(piece) {
+		// This comes after the strategy's adjustment, which can add to the priority by piece index.
+		prio -= cn.t.nearCompletePieceBoost()
+	}
 	return cn._pieceRequestOrder.Set(bitmap.BitIndex(piece), prio) || cn.shouldRequestWithoutBias()
 }
 
@@ -782,7 +1042,42 @@ func (cn *PeerConn) peerPiecesChanged() {
 		if prioritiesChanged {
 			cn.updateRequests()
 		}
+		cn.t.allPieceAvailabilityChanged()
+	}
+}
+
+// Includes or excludes the peer's pieces from the availability of the Torrent's pieces.
+func (cn *PeerConn) setAvailabilityCounted(counted bool) {
+	if counted == cn.availabilityCounted || counted && !cn.t.haveInfo() {
+		return
+	}
+	cn.availabilityCounted = counted
+	delta := 1
+	if !counted {
+		delta = -1
+	}
+	if cn.peerSentHaveAll {
+		for i := range cn.t.pieces {
+			cn.t.pieces[i].addAvailability(delta, !cn.peerChoking)
+		}
+		return
 	}
+	cn._peerPieces.IterTyped(func(i int) bool {
+		if i >= len(cn.t.pieces) {
+			return false
+		}
+		cn.t.pieces[i].addAvailability(delta, !cn.peerChoking)
+		return true
+	})
+}
+
+// Applies a change to the peer's pieces or choke state, keeping the availability of the Torrent's
+// pieces up to date.
+func (cn *PeerConn) updateAvailability(f func()) {
+	counted := cn.availabilityCounted
+	cn.setAvailabilityCounted(false)
+	f()
+	cn.setAvailabilityCounted(counted)
 }
 
 func (cn *PeerConn) raisePeerMinPieces(newMin pieceIndex) {
@@ -800,45 +1095,91 @@ func (cn *PeerConn) peerSentHave(piece pieceIndex) error {
 	}
 	cn.raisePeerMinPieces(piece + 1)
 	cn._peerPieces.Set(bitmap.BitIndex(piece), true)
+	if cn.availabilityCounted {
+		cn.t.piece(piece).addAvailability(1, !cn.peerChoking)
+	}
 	if cn.updatePiecePriority(piece) {
 		cn.updateRequests()
 	}
+	cn.t.pieceAvailabilityChanged(piece)
+	cn.warmedUp()
+	return nil
+}
+
+// The peer has retracted a piece it previously claimed to have.
+func (cn *PeerConn) peerSentDontHave(piece pieceIndex) error {
+	if cn.t.haveInfo() && piece >= cn.t.numPieces() || piece < 0 {
+		return errors.New("invalid piece")
+	}
+	if !cn.peerHasPiece(piece) {
+		return nil
+	}
+	if cn.peerSentHaveAll {
+		if !cn.t.haveInfo() {
+			// We can't represent all but one piece until we know how many there are.
+			return nil
+		}
+		cn.peerSentHaveAll = false
+		cn._peerPieces.AddRange(0, bitmap.BitIndex(cn.t.numPieces()))
+	}
+	cn._peerPieces.Remove(bitmap.BitIndex(piece))
+	if cn.availabilityCounted {
+		cn.t.piece(piece).addAvailability(-1, !cn.peerChoking)
+	}
+	if cn.updatePiecePriority(piece) {
+		cn.updateRequests()
+	}
+	cn.t.pieceAvailabilityChanged(piece)
 	return nil
 }
 
 func (cn *PeerConn) peerSentBitfield(bf []bool) error {
-	cn.peerSentHaveAll = false
 	if len(bf)%8 != 0 {
 		panic("expected bitfield length divisible by 8")
 	}
-	// We know that the last byte means that at most the last 7 bits are
-	// wasted.
-	cn.raisePeerMinPieces(pieceIndex(len(bf) - 7))
 	if cn.t.haveInfo() && len(bf) > int(cn.t.numPieces()) {
-		// Ignore known excess pieces.
+		// The spare bits must be clear.
+		for _, have := range bf[cn.t.numPieces():] {
+			if have {
+				return errors.New("bitfield has pieces beyond the end of the torrent")
+			}
+		}
 		bf = bf[:cn.t.numPieces()]
 	}
-	for i, have := range bf {
-		if have {
-			cn.raisePeerMinPieces(pieceIndex(i) + 1)
+	cn.updateAvailability(func() {
+		cn.peerSentHaveAll = false
+		// We know that the last byte means that at most the last 7 bits are
+		// wasted.
+		cn.raisePeerMinPieces(pieceIndex(len(bf) - 7))
+		for i, have := range bf {
+			if have {
+				cn.raisePeerMinPieces(pieceIndex(i) + 1)
+			}
+			cn._peerPieces.Set(i, have)
 		}
-		cn._peerPieces.Set(i, have)
-	}
+	})
 	cn.peerPiecesChanged()
+	cn.warmedUp()
 	return nil
 }
 
 func (cn *PeerConn) onPeerSentHaveAll() error {
-	cn.peerSentHaveAll = true
-	cn._peerPieces.Clear()
+	cn.updateAvailability(func() {
+		cn.peerSentHaveAll = true
+		cn._peerPieces.Clear()
+	})
 	cn.peerPiecesChanged()
+	cn.warmedUp()
 	return nil
 }
 
 func (cn *PeerConn) peerSentHaveNone() error {
-	cn._peerPieces.Clear()
-	cn.peerSentHaveAll = false
+	cn.updateAvailability(func() {
+		cn._peerPieces.Clear()
+		cn.peerSentHaveAll = false
+	})
 	cn.peerPiecesChanged()
+	cn.warmedUp()
 	return nil
 }
 
@@ -850,6 +1191,9 @@ func (c *PeerConn) requestPendingMetadata() {
 		// Peer doesn't support this.
 		return
 	}
+	if c.metadataSizeRejected {
+		return
+	}
 	// Request metadata pieces that we don't have in a random order.
 	var pending []int
 	for index := 0; index < c.t.metadataPieceCount(); index++ {
@@ -943,6 +1287,7 @@ func (c *PeerConn) reject(r request) {
 	}
 	c.post(r.ToMsg(pp.Reject))
 	delete(c.peerRequests, r)
+	c.allStats(add(1, func(cs *ConnStats) *Count { return &cs.RequestsRejected }))
 }
 
 func (c *PeerConn) onReadRequest(r request) error {
@@ -959,8 +1304,13 @@ func (c *PeerConn) onReadRequest(r request) error {
 		}
 		return nil
 	}
-	if len(c.peerRequests) >= maxRequests {
+	if len(c.peerRequests) >= c.t.cl.maxPeerRequests() {
 		torrent.Add("requests received while queue full", 1)
+		c.allStats(add(1, func(cs *ConnStats) *Count { return &cs.RequestsOverflowed }))
+		if limit := c.t.cl.config.MaxPeerRequestOverflows; limit > 0 && c._stats.RequestsOverflowed.Int64() > int64(limit) {
+			torrent.Add("connections dropped for request floods", 1)
+			return errors.New("peer exceeded request queue limit too many times")
+		}
 		if c.fastEnabled() {
 			c.reject(r)
 		}
@@ -975,18 +1325,48 @@ func (c *PeerConn) onReadRequest(r request) error {
 		return fmt.Errorf("peer requested piece we don't have: %v", r.Index.Int())
 	}
 	// Check this after we know we have the piece, so that the piece length will be known.
-	if r.Begin+r.Length > c.t.pieceLength(pieceIndex(r.Index)) {
+	if r.Begin+r.Length > c.t.pieceLength(pieceIndex(r.Index)) || r.Length > c.t.cl.maxPeerRequestLength() {
 		torrent.Add("bad requests received", 1)
 		return errors.New("bad request")
 	}
 	if c.peerRequests == nil {
-		c.peerRequests = make(map[request]struct{}, maxRequests)
+		c.peerRequests = make(map[request]struct{}, c.t.cl.maxPeerRequests())
 	}
 	c.peerRequests[r] = struct{}{}
 	c.tickleWriter()
 	return nil
 }
 
+// Adapts to the preferences the peer gave for the "sett" extension.
+func (c *PeerConn) applyPeerSettings(s pp.ExtendedHandshakeSettings) {
+	if s.BlockSize > 0 {
+		// Smaller block sizes would have us send a request for every few bytes.
+		c.peerBlockSize = pp.Integer(max(int64(s.BlockSize), minPeerBlockSize))
+	}
+	if s.MaxRequests > 0 && s.MaxRequests < c.PeerMaxRequests {
+		c.PeerMaxRequests = s.MaxRequests
+	}
+	c.updateRequests()
+}
+
+func (c *PeerConn) remoteRejectedRequest(r request) {
+	if cr, ok := c.splitRequests[r]; ok {
+		// Without this piece the chunk can't be completed, so the chunk is rejected. Its other
+		// pieces are discarded if they arrive.
+		r = cr
+	}
+	if c.deleteRequest(r) {
+		c.onRequestRejected(r)
+	}
+	delete(c.validReceiveChunks, r)
+	if r.Length > defaultChunkSize && !c.peerChoking && !c.largeRequestsRejected {
+		// Since the peer isn't choking us, it may not accept requests this large.
+		torrent.Add("peers rejecting large requests", 1)
+		c.largeRequestsRejected = true
+		c.updateRequests()
+	}
+}
+
 // Processes incoming BitTorrent wire-protocol messages. The client lock is held upon entry and
 // exit. Returning will end the connection.
 func (c *PeerConn) mainReadLoop() (err error) {
@@ -1002,7 +1382,7 @@ func (c *PeerConn) mainReadLoop() (err error) {
 
 	decoder := pp.Decoder{
 		R:         bufio.NewReaderSize(c.r, 1<<17),
-		MaxLength: 256 * 1024,
+		MaxLength: cl.maxPeerMessageLength(),
 		Pool:      t.chunkPool,
 	}
 	for {
@@ -1018,6 +1398,12 @@ func (c *PeerConn) mainReadLoop() (err error) {
 		if err != nil {
 			return err
 		}
+		if !c.allowIncomingMessage(msg) {
+			if msg.Type == pp.Piece {
+				t.putChunkBuffer(msg.Piece)
+			}
+			continue
+		}
 		c.readMsg(&msg)
 		c.lastMessageReceived = time.Now()
 		if msg.Keepalive {
@@ -1030,17 +1416,19 @@ func (c *PeerConn) mainReadLoop() (err error) {
 		}
 		switch msg.Type {
 		case pp.Choke:
-			c.peerChoking = true
+			c.setPeerChoking(true)
 			c.deleteAllRequests()
 			// We can then reset our interest.
 			c.updateRequests()
 			c.updateExpectingChunks()
+			c.t.tickleWebSeeds()
 		case pp.Unchoke:
-			c.peerChoking = false
+			c.setPeerChoking(false)
 			c.tickleWriter()
 			c.updateExpectingChunks()
 		case pp.Interested:
 			c.peerInterested = true
+			c.t.fillFreeUploadSlot(c)
 			c.tickleWriter()
 		case pp.NotInterested:
 			c.peerInterested = false
@@ -1056,9 +1444,7 @@ func (c *PeerConn) mainReadLoop() (err error) {
 			err = c.onReadRequest(r)
 		case pp.Piece:
 			err = c.receiveChunk(&msg)
-			if len(msg.Piece) == int(t.chunkSize) {
-				t.chunkPool.Put(&msg.Piece)
-			}
+			t.putChunkBuffer(msg.Piece)
 			if err != nil {
 				err = fmt.Errorf("receiving chunk: %s", err)
 			}
@@ -1078,6 +1464,10 @@ func (c *PeerConn) mainReadLoop() (err error) {
 				pingAddr.Port = int(msg.Port)
 			}
 			cl.eachDhtServer(func(s DhtServer) {
+				if cl.dhtServerFull(s) {
+					torrent.Add("dht nodes not added over limit", 1)
+					return
+				}
 				go s.Ping(&pingAddr)
 			})
 		case pp.Suggest:
@@ -1089,8 +1479,7 @@ func (c *PeerConn) mainReadLoop() (err error) {
 		case pp.HaveNone:
 			err = c.peerSentHaveNone()
 		case pp.Reject:
-			c.deleteRequest(newRequestFromMessage(&msg))
-			delete(c.validReceiveChunks, newRequestFromMessage(&msg))
+			c.remoteRejectedRequest(newRequestFromMessage(&msg))
 		case pp.AllowedFast:
 			torrent.Add("allowed fasts received", 1)
 			log.Fmsg("peer allowed fast: %d", msg.Index).AddValues(c).SetLevel(log.Debug).Log(c.t.logger)
@@ -1136,15 +1525,24 @@ func (c *PeerConn) onReadExtendedMsg(id pp.ExtensionNumber, payload []byte) (err
 		}
 		c.PeerListenPort = d.Port
 		c.PeerPrefersEncryption = d.Encryption
+		if ip := c.remoteIp(); ip != nil && d.YourIp != nil {
+			cl.onPeerReportedExternalIp(ip, net.IP(d.YourIp))
+		}
 		for name, id := range d.M {
 			if _, ok := c.PeerExtensionIDs[name]; !ok {
 				torrent.Add(fmt.Sprintf("peers supporting extension %q", name), 1)
 			}
 			c.PeerExtensionIDs[name] = id
 		}
+		if d.Settings != nil && c.supportsExtension(pp.ExtensionNameSettings) {
+			c.applyPeerSettings(*d.Settings)
+		}
 		if d.MetadataSize != 0 {
-			if err = t.setMetadataSize(d.MetadataSize); err != nil {
-				return errors.Wrapf(err, "setting metadata size to %d", d.MetadataSize)
+			if err := t.setMetadataSize(d.MetadataSize); err != nil {
+				// The peer may still be useful once we get the metadata elsewhere.
+				torrent.Add("peers advertising bad metadata size", 1)
+				c.logger.Printf("not fetching metadata from peer: setting metadata size to %d: %v", d.MetadataSize, err)
+				c.metadataSizeRejected = true
 			}
 		}
 		c.requestPendingMetadata()
@@ -1152,6 +1550,7 @@ func (c *PeerConn) onReadExtendedMsg(id pp.ExtensionNumber, payload []byte) (err
 			t.pex.Add(c) // we learnt enough now
 			c.pex.Init(c)
 		}
+		c.onConnected()
 		return nil
 	case metadataExtendedId:
 		err := cl.gotMetadataExtensionMsg(payload, t, c)
@@ -1164,7 +1563,22 @@ func (c *PeerConn) onReadExtendedMsg(id pp.ExtensionNumber, payload []byte) (err
 			return nil // or hang-up maybe?
 		}
 		return c.pex.Recv(payload)
+	case dontHaveExtendedId:
+		if len(payload) != 4 {
+			return fmt.Errorf("unexpected lt_donthave payload length: %v", len(payload))
+		}
+		return c.peerSentDontHave(pieceIndex(binary.BigEndian.Uint32(payload)))
+	case utHolepunchExtendedId:
+		var msg pp.UtHolepunchMsg
+		if err := msg.UnmarshalBinary(payload); err != nil {
+			return fmt.Errorf("unmarshalling ut_holepunch message: %w", err)
+		}
+		return t.handleReceivedUtHolepunchMsg(msg, c)
 	default:
+		if re, ok := cl.extensionsById[id]; ok {
+			c.onRegisteredExtensionMsg(re, payload)
+			return nil
+		}
 		return fmt.Errorf("unexpected extended message ID: %v", id)
 	}
 }
@@ -1195,7 +1609,20 @@ func (c *PeerConn) receiveChunk(msg *pp.Message) error {
 		torrent.Add("chunks received while choking", 1)
 	}
 
+	if _, ok := c.splitRequests[req]; ok {
+		var whole bool
+		msg, whole = c.receiveSplitChunk(req, msg)
+		if !whole {
+			return nil
+		}
+		req = newRequestFromMessage(msg)
+	}
+
 	if _, ok := c.validReceiveChunks[req]; !ok {
+		if c.strayChunkPiece(req) {
+			torrent.Add("split chunk pieces discarded", 1)
+			return nil
+		}
 		torrent.Add("chunks received unexpected", 1)
 		return errors.New("received unexpected chunk")
 	}
@@ -1206,7 +1633,9 @@ func (c *PeerConn) receiveChunk(msg *pp.Message) error {
 	}
 
 	// Request has been satisfied.
+	sent := c.requests[req]
 	if c.deleteRequest(req) {
+		c.onRequestDelivered(req, sent)
 		if c.expectingChunks() {
 			c._chunksReceivedWhileExpecting++
 		}
@@ -1218,6 +1647,7 @@ func (c *PeerConn) receiveChunk(msg *pp.Message) error {
 	if t.haveChunk(req) {
 		torrent.Add("chunks received wasted", 1)
 		c.allStats(add(1, func(cs *ConnStats) *Count { return &cs.ChunksReadWasted }))
+		c.allStats(add(int64(len(msg.Piece)), func(cs *ConnStats) *Count { return &cs.BytesReadWastedData }))
 		return nil
 	}
 
@@ -1243,6 +1673,7 @@ func (c *PeerConn) receiveChunk(msg *pp.Message) error {
 		c.postCancel(req)
 	}
 
+	t.journalPieceWritten(pieceIndex(req.Index))
 	err := func() error {
 		cl.unlock()
 		defer cl.lock()
@@ -1269,7 +1700,7 @@ func (c *PeerConn) receiveChunk(msg *pp.Message) error {
 	c.onDirtiedPiece(pieceIndex(req.Index))
 
 	if t.pieceAllDirty(pieceIndex(req.Index)) {
-		t.queuePieceCheck(pieceIndex(req.Index))
+		t.queueReceivedPieceCheck(pieceIndex(req.Index))
 		// We don't pend all chunks here anymore because we don't want code dependent on the dirty
 		// chunk status (such as the haveChunk call above) to have to check all the various other
 		// piece states like queued for hash, hashing etc. This does mean that we need to be sure
@@ -1299,9 +1730,15 @@ func (c *PeerConn) uploadAllowed() bool {
 	if c.t.cl.config.NoUpload {
 		return false
 	}
-	if c.t.seeding() {
+	switch c.chokeOverride {
+	case chokeForced:
+		return false
+	case unchokeForced:
 		return true
 	}
+	if c.t.seeding() {
+		return !c.t.uploadSlotsLimited() || c.uploadSlot
+	}
 	if !c.peerHasWantedPieces() {
 		return false
 	}
@@ -1331,18 +1768,17 @@ another:
 			return false
 		}
 		for r := range c.peerRequests {
-			res := c.t.cl.config.UploadRateLimiter.ReserveN(time.Now(), int(r.Length))
-			if !res.OK() {
-				panic(fmt.Sprintf("upload rate limiter burst size < %d", r.Length))
+			if !c.t.cl.uploadTurn(c) {
+				// We'll be woken when it's our turn.
+				return true
 			}
-			delay := res.Delay()
-			if delay > 0 {
-				res.Cancel()
+			if delay := c.reserveUpload(int(r.Length)); delay > 0 {
 				c.setRetryUploadTimer(delay)
 				// Hard to say what to return here.
 				return true
 			}
 			more, err := c.sendChunk(r, msg)
+			c.t.cl.uploadServed(c, int(r.Length))
 			if err != nil {
 				i := pieceIndex(r.Index)
 				if c.t.pieceComplete(i) {
@@ -1361,16 +1797,39 @@ another:
 				break another
 			}
 			delete(c.peerRequests, r)
-			if !more {
+			c.t.checkSeedingGoals()
+			if !more || c.closed.IsSet() {
 				return false
 			}
 			goto another
 		}
+		c.t.cl.leaveUploadQueue(c)
 		return true
 	}
+	c.t.cl.leaveUploadQueue(c)
 	return c.choke(msg)
 }
 
+// Reserves the bytes from the Client and connection upload limiters. If either can't supply them
+// now, neither reservation is kept, and the wait for both is returned.
+func (c *PeerConn) reserveUpload(n int) time.Duration {
+	now := time.Now()
+	res := c.t.cl.config.UploadRateLimiter.ReserveN(now, n)
+	if !res.OK() {
+		panic(fmt.Sprintf("upload rate limiter burst size < %d", n))
+	}
+	connRes := c.uploadLimiter.ReserveN(now, n)
+	delay := res.DelayFrom(now)
+	if d := connRes.DelayFrom(now); d > delay {
+		delay = d
+	}
+	if delay > 0 {
+		res.CancelAt(now)
+		connRes.CancelAt(now)
+	}
+	return delay
+}
+
 func (cn *PeerConn) drop() {
 	cn.t.dropConnection(cn)
 }
@@ -1392,8 +1851,11 @@ func (c *PeerConn) deleteRequest(r request) bool {
 		return false
 	}
 	delete(c.requests, r)
+	c.deleteSplitChunk(r)
 	c.updateExpectingChunks()
 	c.t.requestStrategy.hooks().deletedRequest(r)
+	c.t.numRequests--
+	c.t.piece(pieceIndex(r.Index)).numPeerRequests--
 	pr := c.t.pendingRequests
 	pr[r]--
 	n := pr[r]
@@ -1415,6 +1877,7 @@ func (c *PeerConn) deleteRequest(r request) bool {
 func (c *PeerConn) deleteAllRequests() {
 	for r := range c.requests {
 		c.deleteRequest(r)
+		c.onRequestDropped(r)
 	}
 	if len(c.requests) != 0 {
 		panic(len(c.requests))
@@ -1429,10 +1892,14 @@ func (c *PeerConn) tickleWriter() {
 }
 
 func (c *PeerConn) postCancel(r request) bool {
+	cms := c.cancelMessages(r)
 	if !c.deleteRequest(r) {
 		return false
 	}
-	c.post(makeCancelMessage(r))
+	c.onRequestCancelled(r)
+	for _, cm := range cms {
+		c.post(cm)
+	}
 	return true
 }
 
@@ -1492,6 +1959,9 @@ func (c *PeerConn) pexPeerFlags() pp.PexPeerFlags {
 	if c.remoteAddr != nil && strings.Contains(c.remoteAddr.Network(), "udp") {
 		f |= pp.PexSupportsUtp
 	}
+	if c.supportsExtension(pp.ExtensionNameUtHolepunch) {
+		f |= pp.PexHolepunchSupport
+	}
 	return f
 }
 
@@ -1557,6 +2027,125 @@ func (cn *PeerConn) PeerPieces() bitmap.Bitmap {
 	return cn.peerPieces()
 }
 
+// Returns a copy of the connection's stats. BytesWrittenData is the data we've served to the peer.
+func (cn *PeerConn) Stats() ConnStats {
+	return cn._stats.Copy()
+}
+
+// Returns which attempt established an outgoing connection, counting from 1, and the network
+// used. The attempt is the step of ClientConfig.DialEscalation if it's set, and otherwise whether
+// the preferred or fallback header obfuscation was used. The attempt is zero for incoming
+// connections.
+func (cn *PeerConn) DialAttempt() (attempt int, network string) {
+	cn.locker().RLock()
+	defer cn.locker().RUnlock()
+	return cn.dialAttempt, cn.network
+}
+
+// The peer's address.
+func (cn *PeerConn) RemoteAddr() net.Addr {
+	return cn.remoteAddr
+}
+
+// The network the connection is over, such as "tcp4", or "udp6" for uTP.
+func (cn *PeerConn) Network() string {
+	return cn.network
+}
+
+// Whether we dialed the peer.
+func (cn *PeerConn) Outgoing() bool {
+	return cn.outgoing
+}
+
+// Whether the connection is obfuscated with MSE, and the crypto method negotiated for the data
+// after the handshake. RC4 encrypts it, while plaintext only obfuscated the handshake.
+func (cn *PeerConn) Encryption() (headerEncrypted bool, method mse.CryptoMethod) {
+	return cn.headerEncrypted, cn.cryptoMethod
+}
+
+// Returns a copy of the pieces the peer has told us it has, by bitfield, have, and the fast
+// extension's have all and have none messages. If the peer has all the pieces before the info is
+// known, it's empty until then.
+func (cn *PeerConn) PieceBitfield() bitmap.Bitmap {
+	cn.locker().RLock()
+	defer cn.locker().RUnlock()
+	return cn.peerPieces()
+}
+
+// Whether we're interested in the peer.
+func (cn *PeerConn) AmInterested() bool {
+	cn.locker().RLock()
+	defer cn.locker().RUnlock()
+	return cn.interested
+}
+
+// Whether we're choking the peer.
+func (cn *PeerConn) AmChoking() bool {
+	cn.locker().RLock()
+	defer cn.locker().RUnlock()
+	return cn.choking
+}
+
+// Whether the peer is interested in us.
+func (cn *PeerConn) PeerInterested() bool {
+	cn.locker().RLock()
+	defer cn.locker().RUnlock()
+	return cn.peerInterested
+}
+
+// Whether the peer is choking us.
+func (cn *PeerConn) PeerChoking() bool {
+	cn.locker().RLock()
+	defer cn.locker().RUnlock()
+	return cn.peerChoking
+}
+
+type chokeOverride int
+
+const (
+	chokeAutomatic chokeOverride = iota
+	chokeForced
+	unchokeForced
+)
+
+// Chokes or unchokes the peer, overriding the automatic choking until ReleaseChoke is called. A
+// manual choke always applies. A manual unchoke takes precedence over seeding upload slots and
+// upload fairness, but not ClientConfig.NoUpload, and chunks are still sent subject to
+// ClientConfig.UploadRateLimiter. The override ends with the connection.
+func (cn *PeerConn) SetChoked(choked bool) {
+	cn.locker().Lock()
+	defer cn.locker().Unlock()
+	if choked {
+		cn.chokeOverride = chokeForced
+	} else {
+		cn.chokeOverride = unchokeForced
+	}
+	cn.tickleWriter()
+}
+
+// Caps the rate data is read from the peer, in bytes per second. The Client's
+// ClientConfig.DownloadRateLimiter still applies. rate.Inf removes the cap.
+func (cn *PeerConn) SetDownloadLimit(l rate.Limit) {
+	cn.downloadLimiter.SetLimit(l)
+}
+
+// Caps the rate chunks are uploaded to the peer, in bytes per second. The Client's
+// ClientConfig.UploadRateLimiter still applies. rate.Inf removes the cap.
+func (cn *PeerConn) SetUploadLimit(l rate.Limit) {
+	cn.locker().Lock()
+	defer cn.locker().Unlock()
+	cn.uploadLimiter.SetLimit(l)
+	cn.tickleWriter()
+}
+
+// Returns choking of the peer to the automatic choking.
+func (cn *PeerConn) ReleaseChoke() {
+	cn.locker().Lock()
+	defer cn.locker().Unlock()
+	cn.chokeOverride = chokeAutomatic
+	cn.tickleWriter()
+}
+
 func (cn *PeerConn) peerPieces() bitmap.Bitmap {
 	ret := cn._peerPieces.Copy()
 	if cn.peerSentHaveAll {
@@ -1,16 +1,25 @@
 package torrent
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/anacrolix/missinggo/pubsub"
 	"github.com/bradfitz/iter"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/internal/testutil"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
 	"github.com/anacrolix/torrent/storage"
@@ -206,3 +215,936 @@ func TestConnPexEvent(t *testing.T) {
 		require.EqualValues(t, tc.e, e, i)
 	}
 }
+
+// Check that the writer sends keep-alives when there's nothing else to write.
+func TestConnWriterKeepAlive(t *testing.T) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.setTorrent(cl.newTorrent(metainfo.Hash{}, nil))
+	r, w := io.Pipe()
+	c.r = r
+	c.w = w
+	defer r.Close()
+	go c.writer(10 * time.Millisecond)
+	defer func() {
+		c.locker().Lock()
+		c.close()
+		c.locker().Unlock()
+	}()
+	b := make([]byte, 8)
+	_, err := io.ReadFull(r, b)
+	require.NoError(t, err)
+	require.EqualValues(t, "\x00\x00\x00\x00\x00\x00\x00\x00", string(b))
+}
+
+func TestDeadlineReaderTimeout(t *testing.T) {
+	l, r := net.Pipe()
+	defer l.Close()
+	defer r.Close()
+	dr := deadlineReader{l, l, 10 * time.Millisecond}
+	_, err := dr.Read(make([]byte, 1))
+	require.Error(t, err)
+	ne, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, ne.Timeout())
+}
+
+func TestPeerSentDontHave(t *testing.T) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.setTorrent(cl.newTorrent(metainfo.Hash{}, nil))
+	require.NoError(t, c.t.setInfo(&metainfo.Info{
+		Pieces: make([]byte, metainfo.HashSize*3),
+	}))
+	cl.lock()
+	defer cl.unlock()
+	require.NoError(t, c.onPeerSentHaveAll())
+	require.NoError(t, c.onReadExtendedMsg(dontHaveExtendedId, []byte{0, 0, 0, 1}))
+	require.True(t, c.peerHasPiece(0))
+	require.False(t, c.peerHasPiece(1))
+	require.True(t, c.peerHasPiece(2))
+	require.NoError(t, c.onReadExtendedMsg(dontHaveExtendedId, []byte{0, 0, 0, 0}))
+	require.False(t, c.peerHasPiece(0))
+	require.EqualValues(t, 1, c.peerPieces().Len())
+	require.Error(t, c.onReadExtendedMsg(dontHaveExtendedId, []byte{0, 0, 0, 3}))
+	require.Error(t, c.onReadExtendedMsg(dontHaveExtendedId, []byte{0}))
+}
+
+func testRequestShare(t *testing.T, share float64) (fast int, total int) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.MaxConnRequestShare = share
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	tt.setChunkSize(1)
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt._completedPieces.Clear()
+	tt.DownloadAll()
+	cl.lock()
+	defer cl.unlock()
+	newConn := func() *PeerConn {
+		c := cl.newConnection(nil, false, nil, "", "")
+		c.setTorrent(tt)
+		c.peerChoking = false
+		require.NoError(t, tt.addConnection(c))
+		require.NoError(t, c.onPeerSentHaveAll())
+		return c
+	}
+	fastConn := newConn()
+	// Make the fast connection look like it has received plenty while expecting chunks.
+	fastConn._chunksReceivedWhileExpecting = 1000
+	fastConn.cumulativeExpectedToReceiveChunks = time.Second
+	slowConns := []*PeerConn{newConn(), newConn(), newConn()}
+	msg := func(pp.Message) bool { return true }
+	fastConn.fillWriteBuffer(msg)
+	for _, c := range slowConns {
+		c.fillWriteBuffer(msg)
+	}
+	fast = len(fastConn.requests)
+	total = fast
+	for _, c := range slowConns {
+		total += len(c.requests)
+	}
+	return
+}
+
+func TestMaxConnRequestShare(t *testing.T) {
+	// Without a limit the fast connection takes every chunk.
+	fast, total := testRequestShare(t, 0)
+	require.EqualValues(t, 13, total)
+	require.EqualValues(t, total, fast)
+	fast, total = testRequestShare(t, 0.75)
+	assert.NotZero(t, fast)
+	assert.Less(t, fast, total)
+}
+
+func TestMinPeersBeforeRequesting(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.MinPeersBeforeRequesting = 3
+	cl.config.MinPeersBeforeRequestingTimeout = 50 * time.Millisecond
+	cl.initLogger()
+	newTorrent := func() *Torrent {
+		tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+		require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+		tt._completedPieces.Clear()
+		tt.DownloadAll()
+		return tt
+	}
+	msg := func(pp.Message) bool { return true }
+	newConn := func(tt *Torrent) *PeerConn {
+		c := cl.newConnection(nil, false, nil, "", "")
+		c.setTorrent(tt)
+		c.peerChoking = false
+		require.NoError(t, tt.addConnection(c))
+		require.NoError(t, c.onPeerSentHaveAll())
+		c.fillWriteBuffer(msg)
+		return c
+	}
+
+	// Requests start when the threshold is reached.
+	tt := newTorrent()
+	cl.lock()
+	a, b := newConn(tt), newConn(tt)
+	assert.Empty(t, a.requests)
+	assert.Empty(t, b.requests)
+	c := newConn(tt)
+	a.fillWriteBuffer(msg)
+	assert.NotEmpty(t, a.requests)
+	assert.NotEmpty(t, c.requests)
+	cl.unlock()
+
+	// Or after the timeout.
+	tt = newTorrent()
+	cl.lock()
+	a = newConn(tt)
+	assert.Empty(t, a.requests)
+	cl.unlock()
+	time.Sleep(100 * time.Millisecond)
+	cl.lock()
+	a.fillWriteBuffer(msg)
+	assert.NotEmpty(t, a.requests)
+	cl.unlock()
+}
+
+func TestUploadQueueRoundRobin(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	// Without a rate limit, everyone may upload whenever.
+	a, b, c := &PeerConn{t: tt}, &PeerConn{t: tt}, &PeerConn{t: tt}
+	assert.True(t, cl.uploadTurn(a))
+	assert.True(t, cl.uploadTurn(b))
+	assert.Empty(t, cl.uploadQueue)
+	cl.config.UploadRateLimiter = rate.NewLimiter(1, 1<<20)
+	assert.True(t, cl.uploadTurn(a))
+	assert.False(t, cl.uploadTurn(b))
+	assert.False(t, cl.uploadTurn(c))
+	// a keeps the turn until it's served.
+	assert.True(t, cl.uploadTurn(a))
+	assert.False(t, cl.uploadTurn(b))
+	cl.leaveUploadQueue(a)
+	// a goes to the back after b and c.
+	assert.False(t, cl.uploadTurn(a))
+	assert.True(t, cl.uploadTurn(b))
+	cl.leaveUploadQueue(c)
+	cl.leaveUploadQueue(b)
+	assert.True(t, cl.uploadTurn(a))
+	cl.leaveUploadQueue(a)
+	assert.Empty(t, cl.uploadQueue)
+}
+
+func TestUploadQueuePriority(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.UploadRateLimiter = rate.NewLimiter(1, 1<<20)
+	cl.config.SeedingUploadSlots = 4
+	cl.initLogger()
+	cl.torrents = make(map[metainfo.Hash]*Torrent)
+	hi := cl.newTorrent(metainfo.Hash{1}, nil)
+	lo := cl.newTorrent(metainfo.Hash{2}, nil)
+	hi.SetUploadPriority(2)
+	cl.torrents[hi.infoHash] = hi
+	cl.torrents[lo.infoHash] = lo
+	var conns []*PeerConn
+	for _, tt := range []*Torrent{hi, lo} {
+		for i := 0; i < 2; i++ {
+			c := &PeerConn{t: tt, peerRequests: map[request]struct{}{{}: {}}}
+			tt.conns[c] = struct{}{}
+			conns = append(conns, c)
+		}
+	}
+	assert.InDelta(t, 0.8, hi.uploadShare(), 1e-9)
+	assert.InDelta(t, 0.2, lo.uploadShare(), 1e-9)
+	assert.Equal(t, 16, hi.seedingUploadSlots())
+	assert.Equal(t, 4, lo.seedingUploadSlots())
+	// The scaling of upload slots is capped.
+	hi.SetUploadPriority(maxUploadPriority)
+	assert.Equal(t, 16, hi.seedingUploadSlots())
+	hi.SetUploadPriority(minUploadPriority)
+	assert.Equal(t, 1, hi.seedingUploadSlots())
+	hi.SetUploadPriority(2)
+	served := make(map[*Torrent]int)
+	for i := 0; i < 100; i++ {
+		var turn *PeerConn
+		for _, c := range conns {
+			if cl.uploadTurn(c) {
+				require.Nil(t, turn)
+				turn = c
+			}
+		}
+		require.NotNil(t, turn)
+		served[turn.t]++
+		cl.uploadServed(turn, maxChunkSize)
+	}
+	// The higher priority torrent gets four times the turns.
+	assert.Equal(t, 80, served[hi])
+	assert.Equal(t, 20, served[lo])
+	// A torrent that starts uploading doesn't make up for the turns it didn't want.
+	late := cl.newTorrent(metainfo.Hash{3}, nil)
+	lc := &PeerConn{t: late}
+	served = make(map[*Torrent]int)
+	for i := 0; i < 60; i++ {
+		var turn *PeerConn
+		for _, c := range append(conns, lc) {
+			if cl.uploadTurn(c) {
+				turn = c
+			}
+		}
+		served[turn.t]++
+		cl.uploadServed(turn, maxChunkSize)
+	}
+	assert.InDelta(t, 40, served[hi], 1)
+	assert.InDelta(t, 10, served[lo], 1)
+	assert.InDelta(t, 10, served[late], 1)
+	// There's no budget to share without a rate limit.
+	cl.config.UploadRateLimiter = rate.NewLimiter(rate.Inf, 0)
+	assert.Zero(t, hi.uploadShare())
+}
+
+// A storage backend that has run out of space.
+type fullStorage struct {
+	torrentStorage
+}
+
+func (me *fullStorage) Piece(mp metainfo.Piece) storage.PieceImpl {
+	return me
+}
+
+func (me *fullStorage) WriteAt(b []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}
+}
+
+func TestReceiveChunkStorageFull(t *testing.T) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	require.NoError(t, tt.setInfo(&metainfo.Info{
+		Pieces:      make([]byte, metainfo.HashSize),
+		Length:      2 * defaultChunkSize,
+		PieceLength: 2 * defaultChunkSize,
+	}))
+	tt.storage = &storage.Torrent{TorrentImpl: &fullStorage{}}
+	storageFull := make(chan error, 1)
+	tt.SetOnStorageFull(func(err error) { storageFull <- err })
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.setTorrent(tt)
+	msg := pp.Message{
+		Type:  pp.Piece,
+		Index: 0,
+		Piece: make([]byte, defaultChunkSize),
+	}
+	req := newRequestFromMessage(&msg)
+	cl.lock()
+	c.validReceiveChunks = map[request]struct{}{req: {}}
+	require.NoError(t, c.receiveChunk(&msg))
+	// The chunk must be requested again, but not until download is allowed again.
+	assert.False(t, tt.haveChunk(req))
+	assert.True(t, tt.dataDownloadDisallowed)
+	cl.unlock()
+	assert.True(t, errors.Is(<-storageFull, syscall.ENOSPC))
+	tt.AllowDataDownload()
+	cl.lock()
+	assert.False(t, tt.dataDownloadDisallowed)
+	cl.unlock()
+	// Downloads the user disallowed still report the storage being full.
+	tt.DisallowDataDownload()
+	cl.lock()
+	c.validReceiveChunks = map[request]struct{}{req: {}}
+	require.NoError(t, c.receiveChunk(&msg))
+	cl.unlock()
+	assert.True(t, errors.Is(<-storageFull, syscall.ENOSPC))
+}
+
+func TestPeerAdvertisingExcessiveMetadataSize(t *testing.T) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.config.MaxMetadataSize = 1 << 20
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	handshake := func(metadataSize int) []byte {
+		return bencode.MustMarshal(pp.ExtendedHandshakeMessage{
+			M: map[pp.ExtensionName]pp.ExtensionNumber{
+				pp.ExtensionNameMetadata: 1,
+			},
+			MetadataSize: metadataSize,
+		})
+	}
+	cl.lock()
+	defer cl.unlock()
+	bad := cl.newConnection(nil, false, nil, "", "")
+	bad.setTorrent(tt)
+	require.NoError(t, bad.onReadExtendedMsg(pp.HandshakeExtendedID, handshake(1<<40)))
+	assert.True(t, bad.metadataSizeRejected)
+	assert.Nil(t, tt.metadataBytes)
+	assert.Empty(t, bad.metadataRequests)
+	good := cl.newConnection(nil, false, nil, "", "")
+	good.setTorrent(tt)
+	require.NoError(t, good.onReadExtendedMsg(pp.HandshakeExtendedID, handshake(20000)))
+	assert.False(t, good.metadataSizeRejected)
+	assert.Len(t, tt.metadataBytes, 20000)
+	assert.True(t, good.requestedMetadataPiece(0))
+	assert.True(t, good.requestedMetadataPiece(1))
+	bad.requestPendingMetadata()
+	assert.Empty(t, bad.metadataRequests)
+}
+
+func TestMetadataRejectedOnHashMismatch(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	rejected := make(chan MetadataRejection, 1)
+	tt.SetOnMetadataRejected(func(mr MetadataRejection) { rejected <- mr })
+	cl.lock()
+	defer cl.unlock()
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}
+	c := cl.newConnection(nil, false, addr, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, c.onReadExtendedMsg(pp.HandshakeExtendedID, bencode.MustMarshal(pp.ExtendedHandshakeMessage{
+		M: map[pp.ExtensionName]pp.ExtensionNumber{
+			pp.ExtensionNameMetadata: 1,
+		},
+		MetadataSize: len(mi.InfoBytes),
+	})))
+	sendMetadata := func(b []byte) error {
+		return cl.gotMetadataExtensionMsg(append(bencode.MustMarshal(map[string]int{
+			"msg_type":   pp.DataMetadataExtensionMsgType,
+			"piece":      0,
+			"total_size": len(b),
+		}), b...), tt, c)
+	}
+	corrupt := append([]byte(nil), mi.InfoBytes...)
+	corrupt[len(corrupt)-2] ^= 1
+	require.True(t, c.requestedMetadataPiece(0))
+	assert.Error(t, sendMetadata(corrupt))
+	assert.False(t, tt.haveInfo())
+	cl.unlock()
+	assert.Equal(t, MetadataRejection{Peers: []net.Addr{addr}}, <-rejected)
+	cl.lock()
+	assert.EqualValues(t, 1, tt.statsLocked().MetadataHashMismatches)
+	c.requestPendingMetadata()
+	require.True(t, c.requestedMetadataPiece(0))
+	require.NoError(t, sendMetadata(mi.InfoBytes))
+	assert.True(t, tt.haveInfo())
+}
+
+func TestConfiguredChunkSize(t *testing.T) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.config.ChunkSize = 1 << 20
+	assert.EqualValues(t, maxChunkSize, cl.chunkSize())
+	cl.config.ChunkSize = 32 << 10
+	cl.initLogger()
+	infoBytes := bencode.MustMarshal(metainfo.Info{
+		Name:        "a",
+		Pieces:      make([]byte, metainfo.HashSize),
+		Length:      128 << 10,
+		PieceLength: 128 << 10,
+	})
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	tt._completedPieces.Clear()
+	tt.DownloadAll()
+	cl.lock()
+	defer cl.unlock()
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.setTorrent(tt)
+	c.peerChoking = false
+	require.NoError(t, tt.addConnection(c))
+	require.NoError(t, c.onPeerSentHaveAll())
+	var sent []pp.Message
+	c.fillWriteBuffer(func(msg pp.Message) bool {
+		if msg.Type == pp.Request {
+			sent = append(sent, msg)
+		}
+		return true
+	})
+	require.NotEmpty(t, sent)
+	for _, msg := range sent {
+		assert.EqualValues(t, 32<<10, msg.Length)
+	}
+	// Once the peer rejects a large request, we request chunks from it in 16KiB pieces.
+	rejected := newRequestFromMessage(&sent[0])
+	c.remoteRejectedRequest(rejected)
+	assert.True(t, c.largeRequestsRejected)
+	sent = nil
+	c.requestsLowWater = len(c.requests)
+	c.fillWriteBuffer(func(msg pp.Message) bool {
+		if msg.Type == pp.Request {
+			sent = append(sent, msg)
+		}
+		return true
+	})
+	require.Len(t, sent, 2)
+	for i, msg := range sent {
+		assert.EqualValues(t, rejected.Index, msg.Index)
+		assert.EqualValues(t, rejected.Begin+pp.Integer(i)*defaultChunkSize, msg.Begin)
+		assert.EqualValues(t, defaultChunkSize, msg.Length)
+	}
+	assert.Contains(t, c.requests, rejected)
+	// The chunk is received once both pieces arrive.
+	for i, msg := range sent {
+		require.NoError(t, c.receiveChunk(&pp.Message{
+			Type:  pp.Piece,
+			Index: msg.Index,
+			Begin: msg.Begin,
+			Piece: make([]byte, msg.Length),
+		}))
+		_, ok := c.requests[rejected]
+		assert.Equal(t, i == 0, ok)
+	}
+	assert.Empty(t, c.splitChunks)
+	assert.Empty(t, c.splitRequests)
+	// Deleting the requests, as for a choke, forgets the pieces, which are discarded if they arrive.
+	c.deleteAllRequests()
+	sent = nil
+	c.request(rejected, func(msg pp.Message) bool {
+		sent = append(sent, msg)
+		return true
+	})
+	require.Len(t, sent, 2)
+	assert.NotEmpty(t, c.splitChunks)
+	c.deleteAllRequests()
+	assert.Empty(t, c.splitChunks)
+	assert.Empty(t, c.splitRequests)
+	require.NoError(t, c.receiveChunk(&pp.Message{
+		Type:  pp.Piece,
+		Index: sent[0].Index,
+		Begin: sent[0].Begin,
+		Piece: make([]byte, sent[0].Length),
+	}))
+	assert.Empty(t, c.splitChunks)
+	// Every request sent is accounted for, including those dropped above.
+	s := c.requestStats
+	assert.NotZero(t, s.Dropped)
+	assert.Equal(t, s.Requested, s.Delivered+s.Cancelled+s.Rejected+s.Dropped)
+}
+
+func TestPeerConnSetChoked(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	mi := testutil.GreetingMetaInfo()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	require.NoError(t, c.peerSentHaveNone())
+	c.peerInterested = true
+	upload := func() (ret []pp.MessageType) {
+		c.upload(func(msg pp.Message) bool {
+			ret = append(ret, msg.Type)
+			return true
+		})
+		return
+	}
+	// We're not seeding, and the peer has nothing we want, so it isn't unchoked automatically.
+	assert.Empty(t, upload())
+	assert.True(t, c.AmChoking())
+	assert.True(t, c.PeerInterested())
+	assert.True(t, c.PeerChoking())
+	assert.False(t, c.AmInterested())
+	c.SetChoked(false)
+	assert.Equal(t, []pp.MessageType{pp.Unchoke}, upload())
+	assert.False(t, c.AmChoking())
+	c.SetChoked(true)
+	assert.Equal(t, []pp.MessageType{pp.Choke}, upload())
+	// NoUpload takes precedence over a manual unchoke.
+	cl.config.NoUpload = true
+	c.SetChoked(false)
+	assert.Empty(t, upload())
+	cl.config.NoUpload = false
+	assert.Equal(t, []pp.MessageType{pp.Unchoke}, upload())
+	// Released, the automatic choking applies again.
+	c.ReleaseChoke()
+	assert.Equal(t, []pp.MessageType{pp.Choke}, upload())
+}
+
+func TestPeerRequestFlood(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.MaxPeerRequests = 10
+	cl.config.MaxPeerRequestOverflows = 20
+	cl.extensionBytes = defaultPeerExtensionBytes()
+	cl.initLogger()
+	infoBytes := bencode.MustMarshal(metainfo.Info{
+		Name:        "a",
+		Pieces:      make([]byte, metainfo.HashSize),
+		Length:      1 << 20,
+		PieceLength: 1 << 20,
+	})
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	c.PeerExtensionBytes.SetBit(pp.ExtensionBitFast)
+	c.choking = false
+	var err error
+	var sent int
+	for sent = 0; sent < 100 && err == nil; sent++ {
+		err = c.onReadRequest(newRequest(0, pp.Integer(sent*16), 16))
+	}
+	// The queue limit is reached, and then the peer is tolerated for a while.
+	require.Error(t, err)
+	assert.Equal(t, 10+20+1, sent)
+	assert.Len(t, c.peerRequests, 10)
+	assert.EqualValues(t, 21, c._stats.RequestsOverflowed.Int64())
+	assert.EqualValues(t, 20, c._stats.RequestsRejected.Int64())
+	assert.EqualValues(t, 20, tt.stats.RequestsRejected.Int64())
+}
+
+func TestWastedBytes(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	infoBytes := bencode.MustMarshal(metainfo.Info{
+		Name:        "a",
+		Pieces:      make([]byte, metainfo.HashSize),
+		Length:      2 * defaultChunkSize,
+		PieceLength: 2 * defaultChunkSize,
+	})
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	c.trusted = true
+	// A chunk of a piece we already have.
+	req := newRequest(0, 0, defaultChunkSize)
+	c.validReceiveChunks = map[request]struct{}{req: {}}
+	require.NoError(t, c.receiveChunk(&pp.Message{
+		Type:  pp.Piece,
+		Index: req.Index,
+		Begin: req.Begin,
+		Piece: make([]byte, req.Length),
+	}))
+	assert.EqualValues(t, defaultChunkSize, c._stats.BytesReadWastedData.Int64())
+	assert.EqualValues(t, defaultChunkSize, tt.stats.BytesReadWastedData.Int64())
+	assert.EqualValues(t, defaultChunkSize, cl.stats.BytesReadWastedData.Int64())
+	// A piece the connection wrote that then failed verification.
+	p := tt.piece(0)
+	p._dirtyChunks.AddRange(0, 2)
+	c.onDirtiedPiece(0)
+	tt.pieceHashed(0, false, nil)
+	assert.EqualValues(t, defaultChunkSize, c._stats.BytesReadWastedData.Int64())
+	assert.EqualValues(t, 3*defaultChunkSize, tt.stats.BytesReadWastedData.Int64())
+	assert.EqualValues(t, 3*defaultChunkSize, cl.stats.BytesReadWastedData.Int64())
+}
+
+func TestPieceDeadlineEscalation(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.event.L = cl.locker()
+	cl.initLogger()
+	infoBytes := bencode.MustMarshal(metainfo.Info{
+		Name:        "a",
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Length:      4 * defaultChunkSize,
+		PieceLength: 2 * defaultChunkSize,
+	})
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), storage.NewFileWithCompletion(cl.config.DataDir, storage.NewMapPieceCompletion()))
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	tt.VerifyData()
+	tt.DownloadAll()
+	c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	c.peerSentHaveAll = true
+	pendingPieces := func() (ret []pieceIndex) {
+		c.iterPendingPieces(func(piece pieceIndex) bool {
+			ret = append(ret, piece)
+			return true
+		})
+		return
+	}
+	pendingRequests := func(piece pieceIndex) (ret int) {
+		c.iterPendingRequests(piece, func(request) bool {
+			ret++
+			return true
+		})
+		return
+	}
+	assert.Equal(t, []pieceIndex{0, 1}, pendingPieces())
+	// Another connection has requested all of piece 1.
+	for _, r := range []request{newRequest(1, 0, defaultChunkSize), newRequest(1, defaultChunkSize, defaultChunkSize)} {
+		tt.requestStrategy.hooks().sentRequest(r)
+		defer tt.requestStrategy.hooks().deletedRequest(r)
+	}
+	assert.Equal(t, 0, pendingRequests(1))
+	// A distant deadline orders the piece first, but doesn't duplicate requests.
+	tt.piece(1).SetDeadline(time.Now().Add(time.Hour))
+	assert.Equal(t, []pieceIndex{1, 0}, pendingPieces())
+	assert.Equal(t, 0, pendingRequests(1))
+	// A near deadline has every connection request what's outstanding.
+	tt.piece(1).SetDeadline(time.Now().Add(cl.config.PieceDeadlineEscalation / 2))
+	assert.Equal(t, 2, pendingRequests(1))
+	assert.Equal(t, 2, pendingRequests(0))
+	tt.piece(1).SetDeadline(time.Time{})
+	assert.Equal(t, 0, pendingRequests(1))
+}
+
+func TestPeerSettingsExtension(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, badStorage{})
+	handshake := func(d pp.ExtendedHandshakeMessage) *PeerConn {
+		c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, c.onReadExtendedMsg(pp.HandshakeExtendedID, bencode.MustMarshal(d)))
+		return c
+	}
+	settings := &pp.ExtendedHandshakeSettings{BlockSize: 8 << 10, MaxRequests: 20}
+	// Settings aren't trusted unless the peer advertises the extension.
+	c := handshake(pp.ExtendedHandshakeMessage{Reqq: 100, Settings: settings})
+	assert.EqualValues(t, 0, c.peerBlockSize)
+	assert.Equal(t, 100, c.PeerMaxRequests)
+	c = handshake(pp.ExtendedHandshakeMessage{
+		M:        map[pp.ExtensionName]pp.ExtensionNumber{pp.ExtensionNameSettings: 1},
+		Reqq:     100,
+		Settings: settings,
+	})
+	assert.EqualValues(t, 8<<10, c.peerBlockSize)
+	assert.Equal(t, 20, c.PeerMaxRequests)
+	// The settings only narrow reqq.
+	c = handshake(pp.ExtendedHandshakeMessage{
+		M:        map[pp.ExtensionName]pp.ExtensionNumber{pp.ExtensionNameSettings: 1},
+		Reqq:     10,
+		Settings: settings,
+	})
+	assert.Equal(t, 10, c.PeerMaxRequests)
+	// Tiny block sizes aren't honoured.
+	c = handshake(pp.ExtendedHandshakeMessage{
+		M:        map[pp.ExtensionName]pp.ExtensionNumber{pp.ExtensionNameSettings: 1},
+		Settings: &pp.ExtendedHandshakeSettings{BlockSize: 1},
+	})
+	assert.EqualValues(t, minPeerBlockSize, c.peerBlockSize)
+}
+
+func TestPeerBlockSizeSplitsRequests(t *testing.T) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	infoBytes := bencode.MustMarshal(metainfo.Info{
+		Name:        "a",
+		Pieces:      make([]byte, metainfo.HashSize),
+		Length:      64 << 10,
+		PieceLength: 64 << 10,
+	})
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	tt._completedPieces.Clear()
+	tt.DownloadAll()
+	cl.lock()
+	defer cl.unlock()
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.setTorrent(tt)
+	c.peerChoking = false
+	c.peerBlockSize = 8 << 10
+	require.NoError(t, tt.addConnection(c))
+	require.NoError(t, c.onPeerSentHaveAll())
+	var sent []pp.Message
+	c.fillWriteBuffer(func(msg pp.Message) bool {
+		if msg.Type == pp.Request {
+			sent = append(sent, msg)
+		}
+		return true
+	})
+	// The chunks are requested in pieces no longer than the peer's block size.
+	require.NotEmpty(t, c.requests)
+	require.Len(t, sent, 2*len(c.requests))
+	for _, msg := range sent {
+		assert.EqualValues(t, 8<<10, msg.Length)
+	}
+}
+
+func TestPeerConnRateLimits(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.UploadRateLimiter = rate.NewLimiter(maxChunkSize/4, maxChunkSize)
+	cl.initLogger()
+	r, w := net.Pipe()
+	defer w.Close()
+	c := cl.newConnection(r, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "", "")
+	defer r.Close()
+	c.setTorrent(cl.newTorrent(metainfo.Hash{}, badStorage{}))
+
+	c.SetDownloadLimit(4 * maxChunkSize)
+	go w.Write(make([]byte, 3*maxChunkSize))
+	started := time.Now()
+	_, err := io.ReadFull(c.r, make([]byte, 3*maxChunkSize))
+	require.NoError(t, err)
+	elapsed := time.Since(started)
+	assert.True(t, elapsed > 600*time.Millisecond && elapsed < 2*time.Second, elapsed)
+
+	// The connection cap is lower than the Client's, which has a chunk to spare.
+	c.SetUploadLimit(maxChunkSize)
+	delay := c.reserveUpload(maxChunkSize)
+	assert.True(t, delay > 900*time.Millisecond && delay <= time.Second, delay)
+	// Neither reservation was kept.
+	c.SetUploadLimit(rate.Inf)
+	assert.Zero(t, c.reserveUpload(maxChunkSize))
+	// Now the Client's limit is lower.
+	delay = c.reserveUpload(maxChunkSize)
+	assert.True(t, delay > 3900*time.Millisecond && delay <= 4*time.Second, delay)
+}
+
+func newMetadataServingConn(cl *Client, tt *Torrent) *PeerConn {
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.setTorrent(tt)
+	c.PeerExtensionIDs = map[pp.ExtensionName]pp.ExtensionNumber{pp.ExtensionNameMetadata: 1}
+	return c
+}
+
+func requestMetadataPiece(tb testing.TB, cl *Client, tt *Torrent, c *PeerConn, piece int) {
+	require.NoError(tb, cl.gotMetadataExtensionMsg(bencode.MustMarshal(map[string]int{
+		"msg_type": pp.RequestMetadataExtensionMsgType,
+		"piece":    piece,
+	}), tt, c))
+}
+
+func TestMetadataUploadRateLimited(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	cl.lock()
+	defer cl.unlock()
+	c := newMetadataServingConn(&cl, tt)
+	for range iter.N(metadataUploadBurstPasses + 1) {
+		requestMetadataPiece(t, &cl, tt, c, 0)
+	}
+	requestMetadataPiece(t, &cl, tt, c, -1)
+	var msgTypes []int
+	d := pp.Decoder{R: bufio.NewReader(c.writeBuffer), MaxLength: 1 << 20}
+	for {
+		var msg pp.Message
+		if d.Decode(&msg) != nil {
+			break
+		}
+		var m map[string]int
+		err := bencode.Unmarshal(msg.ExtendedPayload, &m)
+		if _, ok := err.(bencode.ErrUnusedTrailingBytes); !ok {
+			require.NoError(t, err)
+		}
+		msgTypes = append(msgTypes, m["msg_type"])
+		if m["msg_type"] == pp.DataMetadataExtensionMsgType {
+			assert.True(t, bytes.HasSuffix(msg.ExtendedPayload, mi.InfoBytes))
+		}
+	}
+	assert.Equal(t, []int{
+		pp.DataMetadataExtensionMsgType,
+		pp.DataMetadataExtensionMsgType,
+		pp.RejectMetadataExtensionMsgType,
+		pp.RejectMetadataExtensionMsgType,
+	}, msgTypes)
+}
+
+func BenchmarkServeMetadataConcurrentRequesters(b *testing.B) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	info := metainfo.Info{
+		Name:        "big",
+		PieceLength: 1 << 14,
+		Length:      1 << 30,
+		Pieces:      make([]byte, metainfo.HashSize<<16),
+	}
+	ib, err := bencode.Marshal(info)
+	require.NoError(b, err)
+	tt := cl.newTorrent(metainfo.HashBytes(ib), badStorage{})
+	require.NoError(b, tt.setInfoBytes(ib))
+	numPieces := tt.metadataPieceCount()
+	b.SetBytes(int64(len(ib)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		cl.lock()
+		c := newMetadataServingConn(&cl, tt)
+		c.metadataUploadLimiter = rate.NewLimiter(rate.Inf, 0)
+		cl.unlock()
+		for pb.Next() {
+			cl.lock()
+			for i := range iter.N(numPieces) {
+				requestMetadataPiece(b, &cl, tt, c, i)
+			}
+			c.writeBuffer.Reset()
+			cl.unlock()
+		}
+	})
+}
+
+func TestPeerConnPieceBitfield(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := Client{
+		config: TestingConfig(),
+	}
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	c := cl.newConnection(nil, false, nil, "", "")
+	cl.lock()
+	c.setTorrent(tt)
+	require.NoError(t, c.peerSentHave(1))
+	cl.unlock()
+	bf := c.PieceBitfield()
+	assert.Equal(t, []int{1}, bf.ToSortedSlice())
+	// It's a copy.
+	bf.Add(0)
+	assert.Equal(t, 1, c.PieceBitfield().Len())
+	cl.lock()
+	require.NoError(t, c.onPeerSentHaveAll())
+	cl.unlock()
+	assert.Equal(t, []int{0, 1, 2}, c.PieceBitfield().ToSortedSlice())
+	cl.lock()
+	require.NoError(t, c.peerSentHaveNone())
+	cl.unlock()
+	assert.Zero(t, c.PieceBitfield().Len())
+}
+
+func TestNearCompletePiecesRequestedFirst(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	infoBytes := bencode.MustMarshal(metainfo.Info{
+		Name:        "a",
+		Pieces:      make([]byte, 4*metainfo.HashSize),
+		Length:      4 * 4 * defaultChunkSize,
+		PieceLength: 4 * defaultChunkSize,
+	})
+	// Returns the first request made when the last piece has the given number of chunks.
+	firstRequest := func(haveChunks int) request {
+		tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+		require.NoError(t, tt.setInfoBytes(infoBytes))
+		tt._completedPieces.Clear()
+		tt.DownloadAll()
+		cl.lock()
+		defer cl.unlock()
+		for i := 0; i < haveChunks; i++ {
+			tt.pieces[3].unpendChunkIndex(i)
+		}
+		c := cl.newConnection(nil, false, nil, "", "")
+		c.setTorrent(tt)
+		c.peerChoking = false
+		require.NoError(t, tt.addConnection(c))
+		require.NoError(t, c.onPeerSentHaveAll())
+		var sent []pp.Message
+		c.fillWriteBuffer(func(msg pp.Message) bool {
+			if msg.Type == pp.Request {
+				sent = append(sent, msg)
+			}
+			return true
+		})
+		require.NotEmpty(t, sent)
+		return newRequestFromMessage(&sent[0])
+	}
+	assert.EqualValues(t, 0, firstRequest(3).Index)
+	cl.config.NearCompletePieceChunks = 1
+	assert.EqualValues(t, request{3, chunkSpec{3 * defaultChunkSize, defaultChunkSize}}, firstRequest(3))
+	// The piece has too many chunks left to be boosted.
+	assert.EqualValues(t, 0, firstRequest(2).Index)
+	// The boost also applies to the connection's own piece order.
+	cl.config.DefaultRequestStrategy = RequestStrategyFastest()
+	assert.EqualValues(t, 3, firstRequest(3).Index)
+	// Including when the strategy adjusts priorities by piece. Piece inclinations are random, so
+	// try a few.
+	cl.config.DefaultRequestStrategy = RequestStrategyFuzzing()
+	for i := 0; i < 20; i++ {
+		assert.EqualValues(t, 3, firstRequest(3).Index)
+	}
+}
+
+func TestPeerKeepAliveDefaults(t *testing.T) {
+	cl := Client{config: &ClientConfig{}}
+	assert.Equal(t, defaultKeepAliveInterval, cl.keepAliveInterval())
+	assert.Equal(t, defaultPeerIdleTimeout, cl.peerIdleTimeout())
+	cl.config.PeerIdleTimeout = -1
+	assert.Zero(t, cl.peerIdleTimeout())
+	cl.config.KeepAliveInterval = time.Second
+	cl.config.PeerIdleTimeout = time.Minute
+	assert.Equal(t, time.Second, cl.keepAliveInterval())
+	assert.Equal(t, time.Minute, cl.peerIdleTimeout())
+}
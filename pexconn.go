@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/anacrolix/log"
@@ -12,6 +13,10 @@ import (
 const (
 	pexRetryDelay = 10 * time.Second
 	pexInterval   = 1 * time.Minute
+	// How long after PEX reports a peer dropped it's dialed after others, unless PEX adds it again.
+	pexDroppedPeerWindow = 10 * time.Minute
+	// The most peers remembered as dropped at a time, per torrent.
+	maxPexDropped = 1000
 )
 
 // per-connection PEX state
@@ -26,6 +31,14 @@ type pexConnState struct {
 	Listed  bool
 	info    log.Logger
 	dbg     log.Logger
+	// Addresses the peer has told us it's connected to, keyed per holepunchAddrKey.
+	remoteLiveConns map[string]struct{}
+}
+
+// Whether the peer has told us it's connected to the address.
+func (s *pexConnState) remotePeerConnected(key string) bool {
+	_, ok := s.remoteLiveConns[key]
+	return ok
 }
 
 func (s *pexConnState) IsEnabled() bool {
@@ -35,7 +48,7 @@ func (s *pexConnState) IsEnabled() bool {
 // Init is called from the reader goroutine upon the extended handshake completion
 func (s *pexConnState) Init(c *PeerConn) {
 	xid, ok := c.PeerExtensionIDs[pp.ExtensionNamePex]
-	if !ok || xid == 0 || c.t.cl.config.DisablePEX {
+	if !ok || xid == 0 || c.t.cl.config.DisablePEX || c.t.private() {
 		return
 	}
 	s.xid = xid
@@ -99,13 +112,34 @@ func (s *pexConnState) Recv(payload []byte) error {
 	var peers Peers
 	peers.AppendFromPex(rx.Added6, rx.Added6Flags)
 	peers.AppendFromPex(rx.Added, rx.AddedFlags)
+	if s.remoteLiveConns == nil {
+		s.remoteLiveConns = make(map[string]struct{})
+	}
+	for _, p := range peers {
+		if key, ok := holepunchAddrKey(p.Addr); ok {
+			s.remoteLiveConns[key] = struct{}{}
+		}
+	}
+	s.torrent.prunePexDropped()
+	for _, na := range append(rx.Dropped.NodeAddrs(), rx.Dropped6.NodeAddrs()...) {
+		addr := ipPortAddr{na.IP, na.Port}
+		// Only the peer that added an address can drop it, so peers can't have us forget
+		// addresses from other sources.
+		if !s.remotePeerConnected(addr.String()) {
+			continue
+		}
+		delete(s.remoteLiveConns, addr.String())
+		s.torrent.onPexDropped(addr)
+	}
+	for _, p := range peers {
+		delete(s.torrent.pexDropped, p.Addr.String())
+	}
 	s.dbg.Printf("adding %d peers from PEX", len(peers))
 	s.torrent.addPeers(peers)
 	// s.dbg.Print("known swarm now:", s.torrent.KnownSwarm())
 
 	// one day we may also want to:
 	// - check if the peer is not flooding us with PEX updates
-	// - handle drops somehow
 	// - detect malicious peers
 
 	return nil
@@ -115,4 +149,36 @@ func (s *pexConnState) Close() {
 	if s.timer != nil {
 		s.timer.Stop()
 	}
+	s.enabled = false
+}
+
+// Forgets a peer that PEX says has left the swarm, and dials it after others if it's added again
+// from another source within pexDroppedPeerWindow. Up to maxPexDropped peers are remembered.
+func (t *Torrent) onPexDropped(addr ipPortAddr) {
+	// Removed before it's marked, so that its priority matches its entry.
+	if t.peers.Delete(Peer{Addr: addr}) {
+		torrent.Add("pex dropped peers forgotten", 1)
+	}
+	if _, ok := t.pexDropped[addr.String()]; !ok && len(t.pexDropped) >= maxPexDropped {
+		return
+	}
+	if t.pexDropped == nil {
+		t.pexDropped = make(map[string]time.Time)
+	}
+	t.pexDropped[addr.String()] = time.Now()
+}
+
+// Forgets dropped peers once pexDroppedPeerWindow has passed.
+func (t *Torrent) prunePexDropped() {
+	now := time.Now()
+	for k, when := range t.pexDropped {
+		if now.Sub(when) >= pexDroppedPeerWindow {
+			delete(t.pexDropped, k)
+		}
+	}
+}
+
+func (t *Torrent) pexDroppedRecently(addr net.Addr) bool {
+	when, ok := t.pexDropped[addr.String()]
+	return ok && time.Since(when) < pexDroppedPeerWindow
 }
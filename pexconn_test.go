@@ -5,8 +5,10 @@ import (
 	"testing"
 
 	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
 )
@@ -54,3 +56,39 @@ func TestPexConnState(t *testing.T) {
 	}
 	require.EqualValues(t, targx, x)
 }
+
+func TestPexDroppedPeerNotRedialed(t *testing.T) {
+	cl := Client{
+		config: TestingConfig(),
+	}
+	// Other peers need a nonzero priority.
+	cl.config.PublicIp4 = net.IPv4(9, 9, 9, 9)
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	s := pexConnState{torrent: tt, dbg: cl.logger}
+	dropped := ipPortAddr{net.IPv4(1, 2, 3, 4).To4(), 6881}
+	other := ipPortAddr{net.IPv4(5, 6, 7, 8).To4(), 6881}
+	recv := func(m pp.PexMsg) {
+		require.NoError(t, s.Recv(bencode.MustMarshal(m)))
+	}
+	cl.lock()
+	defer cl.unlock()
+	recv(pp.PexMsg{Added: krpc.CompactIPv4NodeAddrs{nodeAddr(dropped)}, AddedFlags: []pp.PexPeerFlags{0}})
+	tt.addPeers([]Peer{{Addr: other, Source: PeerSourceTracker}})
+	require.EqualValues(t, 2, tt.peers.Len())
+	// Peers can't drop addresses they didn't add.
+	recv(pp.PexMsg{Dropped: krpc.CompactIPv4NodeAddrs{nodeAddr(other)}})
+	require.EqualValues(t, 2, tt.peers.Len())
+	assert.False(t, tt.pexDroppedRecently(other))
+	recv(pp.PexMsg{Dropped: krpc.CompactIPv4NodeAddrs{nodeAddr(dropped)}})
+	// The dropped peer won't be dialed.
+	require.EqualValues(t, 1, tt.peers.Len())
+	assert.True(t, tt.pexDroppedRecently(dropped))
+	// Added again from elsewhere, it's dialed after others.
+	tt.addPeers([]Peer{{Addr: dropped, Source: PeerSourceTracker}})
+	require.EqualValues(t, 2, tt.peers.Len())
+	assert.Equal(t, other.String(), tt.peers.PopMax().Addr.String())
+	// PEX adding it again clears the mark.
+	recv(pp.PexMsg{Added: krpc.CompactIPv4NodeAddrs{nodeAddr(dropped)}, AddedFlags: []pp.PexPeerFlags{0}})
+	assert.False(t, tt.pexDroppedRecently(dropped))
+}
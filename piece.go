@@ -3,6 +3,7 @@ package torrent
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/anacrolix/missinggo/v2/bitmap"
 
@@ -51,6 +52,8 @@ type Piece struct {
 	hashing             bool
 	numVerifies         int64
 	storageCompletionOk bool
+	// Whether the piece is recorded in ClientConfig.PieceWriteJournal.
+	journalled bool
 
 	publicPieceState PieceState
 	priority         piecePriority
@@ -62,6 +65,30 @@ type Piece struct {
 	// Connections that have written data to this piece since its last check.
 	// This can include connections that have closed.
 	dirtiers map[*PeerConn]struct{}
+	// Whether a web seed is fetching the piece, and the web seed that wrote it since its last
+	// check.
+	webSeedFetching bool
+	webSeedWritten  *webSeed
+	// How many connected peers have the piece, and how many of those are unchoking us. See
+	// PeerConn.setAvailabilityCounted.
+	availability          int
+	unchokingAvailability int
+	// Outstanding requests for the piece's chunks, over all connections.
+	numPeerRequests int
+
+	// When the piece should arrive by, from Piece.SetDeadline and from readers. Zero if unset.
+	deadline       time.Time
+	readerDeadline time.Time
+}
+
+func (p *Piece) addAvailability(delta int, unchoking bool) {
+	p.availability += delta
+	if unchoking {
+		p.unchokingAvailability += delta
+	}
+	if p.availability < 0 || p.unchokingAvailability < 0 {
+		panic(p.availability)
+	}
 }
 
 func (p *Piece) String() string {
@@ -93,12 +120,16 @@ func (p *Piece) numDirtyChunks() pp.Integer {
 }
 
 func (p *Piece) unpendChunkIndex(i int) {
+	near := p.t.pieceNearComplete(p.index)
 	p._dirtyChunks.Add(i)
+	p.t.onPieceNearCompleteChanged(p.index, near)
 	p.t.tickleReaders()
 }
 
 func (p *Piece) pendChunkIndex(i int) {
+	near := p.t.pieceNearComplete(p.index)
 	p._dirtyChunks.Remove(i)
+	p.t.onPieceNearCompleteChanged(p.index, near)
 }
 
 func (p *Piece) numChunks() pp.Integer {
@@ -201,7 +232,7 @@ func (p *Piece) VerifyData() {
 }
 
 func (p *Piece) queuedForHash() bool {
-	return p.t.piecesQueuedForHash.Get(bitmap.BitIndex(p.index))
+	return p.t.piecesQueuedForHash.Get(bitmap.BitIndex(p.index)) || p.t.deferredPieceChecks.Get(bitmap.BitIndex(p.index))
 }
 
 func (p *Piece) torrentBeginOffset() int64 {
@@ -217,15 +248,44 @@ func (p *Piece) SetPriority(prio piecePriority) {
 	defer p.t.cl.unlock()
 	p.priority = prio
 	p.t.updatePiecePriority(p.index)
+	p.t.savePiecePriorities()
+}
+
+// Sets a soft deadline for the piece to arrive by, such as when it's needed for playback. Pieces
+// with deadlines are requested before others, most urgent first. The zero value clears the
+// deadline. Deadlines are cleared when the piece completes.
+func (p *Piece) SetDeadline(deadline time.Time) {
+	p.t.cl.lock()
+	defer p.t.cl.unlock()
+	p.deadline = deadline
+	p.t.pieceDeadlinesChanged()
 }
 
 func (p *Piece) uncachedPriority() (ret piecePriority) {
 	if p.t.pieceComplete(p.index) || p.t.pieceQueuedForHash(p.index) || p.t.hashingPiece(p.index) {
 		return PiecePriorityNone
 	}
+	if w := p.t.storageWindow; p.t.hasStorageWindow && (p.index < w.begin || p.index >= w.end) {
+		// The storage can't hold it yet.
+		return PiecePriorityNone
+	}
+	ret = p.requestedPriority()
+	if p.t.shareMode && ret < PiecePriorityReadahead && p.t.pieceUbiquitous(p.index) {
+		// There's nobody to upload it to.
+		return PiecePriorityNone
+	}
+	return
+}
+
+// The priority given to the piece by its files, readers and explicit priority, regardless of
+// whether we have it.
+func (p *Piece) requestedPriority() (ret piecePriority) {
 	for _, f := range p.files {
 		ret.Raise(f.prio)
 	}
+	if p.t._downloadRangePieces.Contains(int(p.index)) {
+		ret.Raise(PiecePriorityHigh)
+	}
 	if p.t.readerNowPieces().Contains(int(p.index)) {
 		ret.Raise(PiecePriorityNow)
 	}
@@ -266,3 +326,18 @@ func (p *Piece) dirtyChunks() bitmap.Bitmap {
 func (p *Piece) State() PieceState {
 	return p.t.PieceState(p.index)
 }
+
+// Returns a snapshot of which chunks of the piece have been received, and not yet discarded by a
+// failed hash check.
+func (p *Piece) ReceivedChunks() (ret []bool) {
+	p.t.cl.rLock()
+	defer p.t.cl.rUnlock()
+	ret = make([]bool, p.numChunks())
+	p._dirtyChunks.IterTyped(func(i int) bool {
+		if i < len(ret) {
+			ret[i] = true
+		}
+		return true
+	})
+	return
+}
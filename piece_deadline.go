@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"sort"
+	"time"
+)
+
+// The earliest of the piece's deadlines, or zero if it has none.
+func (p *Piece) effectiveDeadline() time.Time {
+	if p.readerDeadline.IsZero() || !p.deadline.IsZero() && p.deadline.Before(p.readerDeadline) {
+		return p.deadline
+	}
+	return p.readerDeadline
+}
+
+// Whether the piece's deadline is within ClientConfig.PieceDeadlineEscalation, and its requests
+// should be duplicated across peers.
+func (t *Torrent) pieceDeadlineNear(piece pieceIndex) bool {
+	window := t.cl.config.PieceDeadlineEscalation
+	if window <= 0 || !t.deadlinePieces.Contains(piece) {
+		return false
+	}
+	return time.Until(t.pieces[piece].effectiveDeadline()) < window
+}
+
+// Calls f with the pieces that have deadlines, soonest first.
+func (t *Torrent) iterDeadlinePieces(f func(pieceIndex) bool) bool {
+	if t.deadlinePieces.IsEmpty() {
+		return true
+	}
+	pieces := make([]pieceIndex, 0, t.deadlinePieces.Len())
+	t.deadlinePieces.IterTyped(func(piece int) bool {
+		pieces = append(pieces, piece)
+		return true
+	})
+	sort.Slice(pieces, func(i, j int) bool {
+		return t.pieces[pieces[i]].effectiveDeadline().Before(t.pieces[pieces[j]].effectiveDeadline())
+	})
+	for _, piece := range pieces {
+		if !f(piece) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets deadlines for the pieces in each reader's window, from when the reader is expected to reach
+// them at its current read rate.
+func (t *Torrent) updateReaderDeadlines() {
+	if !t.haveInfo() {
+		return
+	}
+	for i := range t.pieces {
+		t.pieces[i].readerDeadline = time.Time{}
+	}
+	now := time.Now()
+	for r := range t.readers {
+		if r.readRate <= 0 {
+			continue
+		}
+		pos := r.torrentOffset(r.pos)
+		for piece := r.pieces.begin; piece < r.pieces.end; piece++ {
+			deadline := now
+			if off := int64(piece) * t.info.PieceLength; off > pos {
+				deadline = now.Add(time.Duration(float64(off-pos) / r.readRate * float64(time.Second)))
+			}
+			p := &t.pieces[piece]
+			if p.readerDeadline.IsZero() || deadline.Before(p.readerDeadline) {
+				p.readerDeadline = deadline
+			}
+		}
+	}
+	t.pieceDeadlinesChanged()
+}
+
+func (t *Torrent) pieceDeadlinesChanged() {
+	t.deadlinePieces.Clear()
+	for i := range t.pieces {
+		if !t.pieces[i].effectiveDeadline().IsZero() {
+			t.deadlinePieces.Add(i)
+		}
+	}
+	t.escalateDeadlinePieces()
+	t.updateDeadlineTimer()
+}
+
+func (t *Torrent) clearPieceDeadlines(piece pieceIndex) {
+	p := &t.pieces[piece]
+	p.deadline = time.Time{}
+	p.readerDeadline = time.Time{}
+	t.deadlinePieces.Remove(piece)
+}
+
+// Has connections top up their requests for pieces with near deadlines, without waiting for
+// their requests to drain.
+func (t *Torrent) escalateDeadlinePieces() {
+	t.deadlinePieces.IterTyped(func(piece int) bool {
+		if !t.pieceDeadlineNear(piece) || !t.wantPieceIndex(piece) {
+			return true
+		}
+		for c := range t.conns {
+			if c.peerHasPiece(piece) {
+				c.requestsLowWater = len(c.requests)
+				c.updateRequests()
+			}
+		}
+		return true
+	})
+}
+
+// Schedules escalation for when the next deadline comes within
+// ClientConfig.PieceDeadlineEscalation.
+func (t *Torrent) updateDeadlineTimer() {
+	window := t.cl.config.PieceDeadlineEscalation
+	var next time.Time
+	if window > 0 {
+		t.deadlinePieces.IterTyped(func(piece int) bool {
+			e := t.pieces[piece].effectiveDeadline().Add(-window)
+			if time.Until(e) > 0 && (next.IsZero() || e.Before(next)) {
+				next = e
+			}
+			return true
+		})
+	}
+	if next.IsZero() {
+		if t.deadlineTimer != nil {
+			t.deadlineTimer.Stop()
+		}
+		return
+	}
+	if t.deadlineTimer == nil {
+		t.deadlineTimer = time.AfterFunc(time.Until(next), t.onDeadlineTimer)
+	} else {
+		t.deadlineTimer.Reset(time.Until(next))
+	}
+}
+
+func (t *Torrent) onDeadlineTimer() {
+	t.cl.lock()
+	defer t.cl.unlock()
+	if t.closed.IsSet() {
+		return
+	}
+	t.escalateDeadlinePieces()
+	t.updateDeadlineTimer()
+}
@@ -0,0 +1,60 @@
+package torrent
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Whether an error reading piece data for hashing might succeed if tried again. Missing data, as
+// for pieces that haven't been written, won't.
+func pieceHashReadErrTransient(err error) bool {
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+		return false
+	}
+	return !os.IsNotExist(err)
+}
+
+// Hashes the piece, retrying transient read errors per ClientConfig.PieceHashReadRetries. The
+// caller holds storageLock for reading, which is released while waiting to retry, so the torrent
+// can be closed. Closing the torrent stops the retries.
+func (t *Torrent) hashPieceRetrying(piece pieceIndex) (sum metainfo.Hash, err error) {
+	delay := t.cl.config.PieceHashReadRetryDelay
+	if delay <= 0 {
+		delay = defaultPieceHashReadRetryDelay
+	}
+	for retries := t.cl.config.PieceHashReadRetries; ; retries-- {
+		sum, err = t.hashPiece(piece)
+		if retries <= 0 || !pieceHashReadErrTransient(err) {
+			return
+		}
+		t.logger.Printf("retrying read of piece %d for hashing in %v: %v", piece, delay, err)
+		if !t.waitPieceHashRetry(delay) {
+			return
+		}
+		delay *= 2
+		if delay > maxPieceHashReadRetryDelay {
+			delay = maxPieceHashReadRetryDelay
+		}
+	}
+}
+
+// Waits to retry hashing without holding storageLock. Returns false if the torrent was closed.
+func (t *Torrent) waitPieceHashRetry(delay time.Duration) bool {
+	t.storageLock.RUnlock()
+	defer t.storageLock.RLock()
+	t.cl.lock()
+	closed := t.closed.C()
+	t.cl.unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-closed:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
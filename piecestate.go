@@ -12,6 +12,10 @@ type PieceState struct {
 	Checking bool
 	// Some of the piece has been obtained.
 	Partial bool
+	// For partial pieces, the number of chunks in the piece, and how many of them have been
+	// received. These are zero for other pieces so that runs of pieces compress well.
+	NumChunks         int
+	NumChunksReceived int
 }
 
 // Represents a series of consecutive pieces with the same state.
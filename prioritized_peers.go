@@ -7,8 +7,9 @@ import (
 	"github.com/google/btree"
 )
 
-// Peers are stored with their priority at insertion. Their priority may
-// change if our apparent IP changes, we don't currently handle that.
+// Peers are stored with their priority at insertion. The inputs to the priority, such as our
+// apparent IP or the peer's reputation, may change while the peer is stored, so stored items are
+// found by address rather than by recomputing their priority.
 type prioritizedPeersItem struct {
 	prio peerPriority
 	p    Peer
@@ -35,6 +36,41 @@ func (me prioritizedPeersItem) Less(than btree.Item) bool {
 type prioritizedPeers struct {
 	om      *btree.BTree
 	getPrio func(Peer) peerPriority
+	// The items in om by address and trust.
+	byKey map[prioritizedPeersKey]prioritizedPeersItem
+}
+
+type prioritizedPeersKey struct {
+	addr    string
+	trusted bool
+}
+
+func (me prioritizedPeersItem) key() prioritizedPeersKey {
+	return prioritizedPeersKey{me.p.Addr.String(), me.p.Trusted}
+}
+
+func (me *prioritizedPeers) insert(item prioritizedPeersItem) (replaced prioritizedPeersItem, ok bool) {
+	if me.byKey == nil {
+		me.byKey = make(map[prioritizedPeersKey]prioritizedPeersItem)
+	}
+	k := item.key()
+	replaced, ok = me.byKey[k]
+	if ok {
+		me.om.Delete(replaced)
+	}
+	me.byKey[k] = item
+	me.om.ReplaceOrInsert(item)
+	return
+}
+
+func (me *prioritizedPeers) forget(i btree.Item) (ret prioritizedPeersItem, ok bool) {
+	if i == nil {
+		return
+	}
+	ret = i.(prioritizedPeersItem)
+	delete(me.byKey, ret.key())
+	ok = true
+	return
 }
 
 func (me *prioritizedPeers) Each(f func(Peer)) {
@@ -50,30 +86,36 @@ func (me *prioritizedPeers) Len() int {
 
 // Returns true if a peer is replaced.
 func (me *prioritizedPeers) Add(p Peer) bool {
-	return me.om.ReplaceOrInsert(prioritizedPeersItem{me.getPrio(p), p}) != nil
+	_, ok := me.insert(prioritizedPeersItem{me.getPrio(p), p})
+	return ok
 }
 
 // Returns true if a peer is replaced.
 func (me *prioritizedPeers) AddReturningReplacedPeer(p Peer) (ret Peer, ok bool) {
-	item := me.om.ReplaceOrInsert(prioritizedPeersItem{me.getPrio(p), p})
-	if item == nil {
-		return
+	item, ok := me.insert(prioritizedPeersItem{me.getPrio(p), p})
+	return item.p, ok
+}
+
+// Removes the peer with the address, whether or not it's trusted. Returns whether it was present.
+func (me *prioritizedPeers) Delete(p Peer) bool {
+	for _, trusted := range []bool{false, true} {
+		p.Trusted = trusted
+		if item, ok := me.byKey[prioritizedPeersItem{p: p}.key()]; ok {
+			me.forget(me.om.Delete(item))
+			return true
+		}
 	}
-	ret = item.(prioritizedPeersItem).p
-	ok = true
-	return
+	return false
 }
 
 func (me *prioritizedPeers) DeleteMin() (ret prioritizedPeersItem, ok bool) {
-	i := me.om.DeleteMin()
-	if i == nil {
-		return
-	}
-	ret = i.(prioritizedPeersItem)
-	ok = true
-	return
+	return me.forget(me.om.DeleteMin())
 }
 
 func (me *prioritizedPeers) PopMax() Peer {
-	return me.om.DeleteMax().(prioritizedPeersItem).p
+	ret, ok := me.forget(me.om.DeleteMax())
+	if !ok {
+		panic("no peers")
+	}
+	return ret.p
 }
@@ -1,11 +1,15 @@
 package torrent
 
 import (
+	"math"
 	"net"
 	"testing"
 
 	"github.com/google/btree"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/metainfo"
 )
 
 func TestPrioritizedPeers(t *testing.T) {
@@ -53,3 +57,63 @@ func TestPrioritizedPeers(t *testing.T) {
 	min(nil)
 	pop(nil)
 }
+
+func TestPrioritizedPeersPriorityChanged(t *testing.T) {
+	var prio peerPriority = 1
+	pp := prioritizedPeers{
+		om:      btree.New(3),
+		getPrio: func(Peer) peerPriority { return prio },
+	}
+	a := Peer{Addr: ipPortAddr{IP: net.ParseIP("1.2.3.4"), Port: 1}}
+	b := Peer{Addr: ipPortAddr{IP: net.ParseIP("1.2.3.4"), Port: 2}}
+	assert.False(t, pp.Add(a))
+	assert.False(t, pp.Add(b))
+	// The inputs to the priority change while the peers are stored.
+	prio = 2
+	assert.True(t, pp.Add(a))
+	assert.Equal(t, 2, pp.Len())
+	assert.Equal(t, a, pp.PopMax())
+	assert.True(t, pp.Delete(b))
+	assert.False(t, pp.Delete(b))
+	assert.Zero(t, pp.Len())
+	assert.Empty(t, pp.byKey)
+}
+
+func TestPeerDialOrder(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.PeerClassifier = func(ip net.IP) PeerDecision {
+		if ip.Equal(net.IPv4(1, 2, 3, 3)) {
+			return PeerDeprioritize
+		}
+		return PeerAllow
+	}
+	var candidates []PeerDialCandidate
+	// Dial peers on higher ports first.
+	cl.config.PeerDialOrder = func(c PeerDialCandidate) uint32 {
+		candidates = append(candidates, c)
+		return uint32(c.Addr.(ipPortAddr).Port)
+	}
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	cl.lock()
+	defer cl.unlock()
+	// There are no dialers, so the peers stay queued.
+	for i, port := range []int{2, 3, 1} {
+		tt.addPeer(Peer{Addr: ipPortAddr{IP: net.IPv4(1, 2, 3, byte(i+1)), Port: port}})
+	}
+	require.Len(t, candidates, 3)
+	assert.False(t, candidates[0].Deprioritized)
+	assert.True(t, candidates[2].Deprioritized)
+	var ports []int
+	for tt.peers.Len() != 0 {
+		ports = append(ports, tt.peers.PopMax().Addr.(ipPortAddr).Port)
+	}
+	assert.Equal(t, []int{3, 2, 1}, ports)
+	// The default reproduces the built-in ordering.
+	assert.EqualValues(t, 0, DefaultPeerDialOrder(PeerDialCandidate{Bep40Priority: 5, Deprioritized: true}))
+	assert.EqualValues(t, 0, DefaultPeerDialOrder(PeerDialCandidate{Bep40Priority: 5, PexDropped: true}))
+	assert.EqualValues(t, 0, DefaultPeerDialOrder(PeerDialCandidate{Bep40Priority: 5, Reputation: -1}))
+	assert.EqualValues(t, math.MaxUint32, DefaultPeerDialOrder(PeerDialCandidate{Bep40Priority: 5, Reputation: 1}))
+	assert.EqualValues(t, 5, DefaultPeerDialOrder(PeerDialCandidate{Bep40Priority: 5}))
+}
@@ -0,0 +1,88 @@
+package torrent
+
+import "time"
+
+// The number of samples Torrent.RateHistory retains.
+const rateHistoryLength = 60
+
+// A sample of a torrent's transfer rates and progress. See ClientConfig.RateHistoryInterval.
+type RateSample struct {
+	Time time.Time
+	// Average bytes per second of useful data downloaded, and data uploaded, since the previous
+	// sample.
+	DownloadRate   float64
+	UploadRate     float64
+	BytesCompleted int64
+	// The completed fraction of the torrent. Zero until the info is known.
+	Completion float64
+}
+
+// A ring buffer of the latest samples.
+type rateHistory struct {
+	timer   *time.Timer
+	samples [rateHistoryLength]RateSample
+	// The index of the oldest sample, and the number of samples.
+	start, len int
+	// Counters at the last sample.
+	lastRead, lastWritten int64
+}
+
+func (me *rateHistory) add(s RateSample) {
+	if me.len < len(me.samples) {
+		me.samples[(me.start+me.len)%len(me.samples)] = s
+		me.len++
+		return
+	}
+	me.samples[me.start] = s
+	me.start = (me.start + 1) % len(me.samples)
+}
+
+// Returns the samples, oldest first.
+func (me *rateHistory) get() (ret []RateSample) {
+	ret = make([]RateSample, 0, me.len)
+	for i := 0; i < me.len; i++ {
+		ret = append(ret, me.samples[(me.start+i)%len(me.samples)])
+	}
+	return
+}
+
+// Starts sampling if ClientConfig.RateHistoryInterval is set.
+func (t *Torrent) startRateHistory() {
+	interval := t.cl.config.RateHistoryInterval
+	if interval <= 0 {
+		return
+	}
+	t.rateHistory.lastRead = t.stats.BytesReadUsefulData.Int64()
+	t.rateHistory.lastWritten = t.stats.BytesWrittenData.Int64()
+	last := time.Now()
+	t.rateHistory.timer = time.AfterFunc(interval, func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if t.closed.IsSet() {
+			return
+		}
+		now := time.Now()
+		t.sampleRates(now, now.Sub(last))
+		last = now
+		t.rateHistory.timer.Reset(interval)
+	})
+}
+
+func (t *Torrent) sampleRates(now time.Time, dt time.Duration) {
+	h := &t.rateHistory
+	read := t.stats.BytesReadUsefulData.Int64()
+	written := t.stats.BytesWrittenData.Int64()
+	s := RateSample{Time: now}
+	if secs := dt.Seconds(); secs > 0 {
+		s.DownloadRate = float64(read-h.lastRead) / secs
+		s.UploadRate = float64(written-h.lastWritten) / secs
+	}
+	h.lastRead, h.lastWritten = read, written
+	if t.haveInfo() {
+		s.BytesCompleted = t.bytesCompleted()
+		if l := t.info.TotalLength(); l != 0 {
+			s.Completion = float64(s.BytesCompleted) / float64(l)
+		}
+	}
+	h.add(s)
+}
@@ -9,6 +9,12 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// Returns an unlimited limiter for a single connection. The burst is the longest chunk that may be
+// uploaded, so that only the limit needs changing.
+func newConnLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Inf, maxChunkSize)
+}
+
 type rateLimitedReader struct {
 	l *rate.Limiter
 	r io.Reader
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo"
@@ -45,6 +46,10 @@ type reader struct {
 	// corresponds to nothing. We cache this so that changes can be detected,
 	// and bubbled up to the Torrent only as required.
 	pieces pieceRange
+	// Smoothed bytes read per second, and when the last read completed. Used to set deadlines for
+	// the pieces ahead of the reader.
+	readRate float64
+	lastRead time.Time
 }
 
 var _ io.ReadCloser = &reader{}
@@ -168,6 +173,7 @@ func (r *reader) ReadContext(ctx context.Context, b []byte) (n int, err error) {
 		n += n1
 		r.mu.Lock()
 		r.pos += int64(n1)
+		r.updateReadRate(n1)
 		r.posChanged()
 		r.mu.Unlock()
 	}
@@ -240,6 +246,21 @@ func (r *reader) Close() error {
 	return nil
 }
 
+func (r *reader) updateReadRate(n int) {
+	now := time.Now()
+	if !r.lastRead.IsZero() {
+		if elapsed := now.Sub(r.lastRead).Seconds(); elapsed > 0 {
+			rate := float64(n) / elapsed
+			if r.readRate == 0 {
+				r.readRate = rate
+			} else {
+				r.readRate = 0.8*r.readRate + 0.2*rate
+			}
+		}
+	}
+	r.lastRead = now
+}
+
 func (r *reader) posChanged() {
 	to := r.piecesUncached()
 	from := r.pieces
@@ -14,7 +14,7 @@ func TestReaderReadContext(t *testing.T) {
 	cl, err := NewClient(TestingConfig())
 	require.NoError(t, err)
 	defer cl.Close()
-	tt, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	tt, _, err := cl.AddTorrent(testutil.GreetingMetaInfo())
 	require.NoError(t, err)
 	defer tt.Drop()
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Millisecond))
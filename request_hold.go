@@ -0,0 +1,51 @@
+package torrent
+
+import "time"
+
+// Whether requests are held back until the torrent has ClientConfig.MinPeersBeforeRequesting
+// connections, or has waited MinPeersBeforeRequestingTimeout since its first.
+func (t *Torrent) holdingRequests() bool {
+	return t.cl.config.MinPeersBeforeRequesting > 0 && !t.requestingStarted
+}
+
+func (t *Torrent) minPeersBeforeRequestingTimeout() time.Duration {
+	if d := t.cl.config.MinPeersBeforeRequestingTimeout; d > 0 {
+		return d
+	}
+	return defaultMinPeersBeforeRequestingTimeout
+}
+
+// Called when a connection is added, to start requesting if enough peers have connected. The
+// timeout is started by the first connection.
+func (t *Torrent) checkRequestHold() {
+	if !t.holdingRequests() {
+		return
+	}
+	if len(t.conns) >= t.cl.config.MinPeersBeforeRequesting {
+		t.startRequesting()
+		return
+	}
+	if t.requestHoldTimer == nil {
+		t.requestHoldTimer = time.AfterFunc(t.minPeersBeforeRequestingTimeout(), func() {
+			t.cl.lock()
+			defer t.cl.unlock()
+			if t.closed.IsSet() {
+				return
+			}
+			t.startRequesting()
+		})
+	}
+}
+
+func (t *Torrent) startRequesting() {
+	if t.requestingStarted {
+		return
+	}
+	t.requestingStarted = true
+	if t.requestHoldTimer != nil {
+		t.requestHoldTimer.Stop()
+	}
+	for c := range t.conns {
+		c.updateRequests()
+	}
+}
@@ -0,0 +1,78 @@
+package torrent
+
+import (
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// The lifecycle of our chunk requests to a peer. See PeerConn.RequestStats.
+type RequestStats struct {
+	// Requests sent, and of those, the ones the peer delivered, the ones we cancelled, such as when
+	// another peer delivered the chunk first in end-game, the ones the peer rejected with the fast
+	// extension, and the ones dropped unanswered because the peer choked us or the connection
+	// closed. Requested is the sum of the others once no requests are outstanding.
+	Requested int64
+	Delivered int64
+	Cancelled int64
+	Rejected  int64
+	Dropped   int64
+	// The total and longest times from sending a request to receiving its chunk, over delivered
+	// requests.
+	TotalDeliveryTime time.Duration
+	MaxDeliveryTime   time.Duration
+}
+
+// The average time from sending a request to receiving its chunk. Zero if none were delivered.
+func (me RequestStats) MeanDeliveryTime() time.Duration {
+	if me.Delivered == 0 {
+		return 0
+	}
+	return me.TotalDeliveryTime / time.Duration(me.Delivered)
+}
+
+// Returns the lifecycle counts of our requests to the peer. Each request is logged to the
+// LogSubsystemRequests subsystem, if it has a level in ClientConfig.LogLevels.
+func (cn *PeerConn) RequestStats() RequestStats {
+	cn.locker().RLock()
+	defer cn.locker().RUnlock()
+	return cn.requestStats
+}
+
+func (cn *PeerConn) logRequest(event string, r request) {
+	if _, ok := cn.t.cl.config.LogLevels[LogSubsystemRequests]; !ok {
+		return
+	}
+	cn.t.subsystemLogger(LogSubsystemRequests).WithDefaultLevel(log.Debug).Printf("%v: %s %v", cn.remoteAddr, event, r)
+}
+
+func (cn *PeerConn) onRequestSent(r request) {
+	cn.requestStats.Requested++
+	cn.logRequest("requested", r)
+}
+
+func (cn *PeerConn) onRequestDelivered(r request, sent time.Time) {
+	d := time.Since(sent)
+	s := &cn.requestStats
+	s.Delivered++
+	s.TotalDeliveryTime += d
+	if d > s.MaxDeliveryTime {
+		s.MaxDeliveryTime = d
+	}
+	cn.logRequest("delivered after "+d.String(), r)
+}
+
+func (cn *PeerConn) onRequestCancelled(r request) {
+	cn.requestStats.Cancelled++
+	cn.logRequest("cancelled", r)
+}
+
+func (cn *PeerConn) onRequestRejected(r request) {
+	cn.requestStats.Rejected++
+	cn.logRequest("rejected", r)
+}
+
+func (cn *PeerConn) onRequestDropped(r request) {
+	cn.requestStats.Dropped++
+	cn.logRequest("dropped", r)
+}
@@ -24,6 +24,10 @@ type requestStrategyTorrent interface {
 	readerPiecePriorities() (now, readahead bitmap.Bitmap)
 	ignorePieces() bitmap.Bitmap
 	pendingPieces() *prioritybitmap.PriorityBitmap
+	inShareMode() bool
+	pieceAvailability(pieceIndex) int
+	boostNearCompletePieces() bool
+	pieceNearComplete(pieceIndex) bool
 }
 
 type requestStrategyConnection interface {
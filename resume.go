@@ -0,0 +1,161 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The version of resume data written by Torrent.ExportResumeData. Newer versions may only add
+// fields, so older data is always accepted, and unknown fields are ignored.
+const resumeDataVersion = 1
+
+// The bencoded resume data format.
+type resumeData struct {
+	Version  int    `bencode:"version"`
+	InfoHash []byte `bencode:"info_hash"`
+	// Bencoded info, if it was known.
+	InfoBytes   []byte     `bencode:"info,omitempty"`
+	DisplayName string     `bencode:"name,omitempty"`
+	Trackers    [][]string `bencode:"trackers,omitempty"`
+	// Completed pieces, packed high bit first as in the bitfield message.
+	Pieces         []byte `bencode:"pieces,omitempty"`
+	FilePriorities []int  `bencode:"file_priorities,omitempty"`
+	Uploaded       int64  `bencode:"uploaded,omitempty"`
+	Downloaded     int64  `bencode:"downloaded,omitempty"`
+	// Seconds spent seeding.
+	SeedingTime int64 `bencode:"seeding_time,omitempty"`
+}
+
+func packBitfield(bf []bool) []byte {
+	ret := make([]byte, (len(bf)+7)/8)
+	for i, have := range bf {
+		if have {
+			ret[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return ret
+}
+
+func bitfieldGet(packed []byte, i int) bool {
+	return i/8 < len(packed) && packed[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// Returns the torrent's state for Client.AddTorrentWithResumeData: its info, trackers, completed
+// pieces, file priorities and transfer totals.
+func (t *Torrent) ExportResumeData() ([]byte, error) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	rd := resumeData{
+		Version:     resumeDataVersion,
+		InfoHash:    t.infoHash[:],
+		Trackers:    t.metainfo.UpvertedAnnounceList(),
+		Uploaded:    t.stats.BytesWrittenData.Int64(),
+		Downloaded:  t.stats.BytesReadUsefulData.Int64(),
+		DisplayName: t.name(),
+	}
+	if !t.seedingSince.IsZero() {
+		rd.SeedingTime = int64(time.Since(t.seedingSince) / time.Second)
+	}
+	if t.haveInfo() {
+		rd.InfoBytes = t.metadataBytes
+		rd.Pieces = packBitfield(t.bitfield())
+		for _, f := range *t.files {
+			rd.FilePriorities = append(rd.FilePriorities, int(f.prio))
+		}
+	}
+	return bencode.Marshal(rd)
+}
+
+// Adds a torrent from data returned by Torrent.ExportResumeData. Pieces recorded as complete are
+// marked complete in the storage without being verified, unless ClientConfig.ResumeDataRecheck
+// is set. If the torrent is already in the Client, it's returned unchanged.
+func (cl *Client) AddTorrentWithResumeData(data []byte) (t *Torrent, err error) {
+	var rd resumeData
+	if err = bencode.Unmarshal(data, &rd); err != nil {
+		return nil, fmt.Errorf("decoding resume data: %w", err)
+	}
+	if rd.Version < 1 || rd.Version > resumeDataVersion {
+		return nil, fmt.Errorf("unsupported resume data version %v", rd.Version)
+	}
+	if len(rd.InfoHash) != len(metainfo.Hash{}) {
+		return nil, errors.New("resume data has bad infohash")
+	}
+	var ih metainfo.Hash
+	copy(ih[:], rd.InfoHash)
+	var info metainfo.Info
+	if rd.InfoBytes != nil {
+		if metainfo.HashBytes(rd.InfoBytes) != ih {
+			return nil, errInfoHashMismatch
+		}
+		if err = bencode.Unmarshal(rd.InfoBytes, &info); err != nil {
+			return nil, fmt.Errorf("decoding resume data info: %w", err)
+		}
+	}
+	cl.lock()
+	defer cl.unlock()
+	t, new := cl.addTorrentInfoHashWithStorage(ih, nil)
+	if !new {
+		return t, nil
+	}
+	if rd.DisplayName != "" {
+		t.SetDisplayName(rd.DisplayName)
+	}
+	if rd.InfoBytes != nil {
+		if err = t.resumeInfo(&info, rd); err != nil {
+			cl.dropTorrent(ih)
+			return nil, err
+		}
+	}
+	// Added after the info, so that pieces completing from the resume data don't look like a
+	// finished download.
+	t.stats.BytesWrittenData.Add(rd.Uploaded)
+	t.stats.BytesReadUsefulData.Add(rd.Downloaded)
+	t.addTrackers(rd.Trackers)
+	t.maybeNewConns()
+	return t, nil
+}
+
+// Sets the info, trusting the completion in the resume data. The info is held to the same limits
+// as info from elsewhere.
+func (t *Torrent) resumeInfo(info *metainfo.Info, rd resumeData) error {
+	if len(rd.InfoBytes) > t.maxMetadataSize() {
+		return fmt.Errorf("bad info: metadata size %d exceeds maximum of %d", len(rd.InfoBytes), t.maxMetadataSize())
+	}
+	if err := t.checkInfoLimits(info); err != nil {
+		return fmt.Errorf("bad info: %s", err)
+	}
+	if err := t.setInfo(info); err != nil {
+		return err
+	}
+	t.metadataBytes = rd.InfoBytes
+	for i := range t.pieces {
+		if !bitfieldGet(rd.Pieces, i) {
+			continue
+		}
+		if err := t.pieces[i].Storage().MarkComplete(); err != nil {
+			t.logger.Printf("error marking resumed piece %d complete: %v", i, err)
+		}
+	}
+	t.onSetInfo()
+	if len(rd.FilePriorities) == len(*t.files) {
+		for i, f := range *t.files {
+			f.prio = piecePriority(rd.FilePriorities[i])
+		}
+		t.updateAllPiecePriorities()
+	}
+	if t.haveAllPieces() && rd.SeedingTime > 0 {
+		t.seedingSince = time.Now().Add(-time.Duration(rd.SeedingTime) * time.Second)
+		t.updateSeedingGoalTimer()
+	}
+	if t.cl.config.ResumeDataRecheck {
+		t._completedPieces.IterTyped(func(piece int) bool {
+			t.queuePieceCheck(piece)
+			return true
+		})
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package torrent
+
+import (
+	"syscall"
+)
+
+// Sets the socket options that let outgoing TCP connections bind the port we listen on. See
+// ClientConfig.DialFromListenPort.
+func reusePortControl(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = setReusePort(fd)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
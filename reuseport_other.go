@@ -0,0 +1,12 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package torrent
+
+import (
+	"errors"
+)
+
+// SO_REUSEADDR on Windows lets other sockets steal the port, and there's no SO_REUSEPORT.
+func setReusePort(fd uintptr) error {
+	return errors.New("dialing from the listen port isn't supported on this platform")
+}
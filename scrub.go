@@ -0,0 +1,86 @@
+package torrent
+
+import "time"
+
+// Background re-verification of complete pieces. See ClientConfig.ScrubInterval.
+type scrubState struct {
+	timer *time.Timer
+	// The next piece to consider in the current pass.
+	next pieceIndex
+	// The piece queued for hash by the scrubber, if checking is set.
+	piece    pieceIndex
+	checking bool
+	// When a pass over all the pieces last finished.
+	lastPassCompleted time.Time
+	// Complete pieces that failed their scrub, and were marked incomplete.
+	failed int
+}
+
+// Starts scrubbing the torrent's pieces if ClientConfig.ScrubInterval is set.
+func (t *Torrent) startScrubTimer() {
+	if t.scrub.timer != nil || t.cl.config.ScrubInterval <= 0 {
+		return
+	}
+	t.scrub.timer = time.AfterFunc(t.cl.config.ScrubInterval, func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if t.closed.IsSet() {
+			return
+		}
+		t.scrubNextPiece()
+		t.scrub.timer.Reset(t.cl.config.ScrubInterval)
+	})
+}
+
+// Whether nothing is being transferred or verified, so scrubbing won't interfere.
+func (t *Torrent) scrubIdle() bool {
+	if !t.haveInfo() || t.needData() || t.activePieceHashes != 0 || t.piecesQueuedForHash.Len() != 0 || t.deferredPieceChecks.Len() != 0 {
+		return false
+	}
+	for c := range t.conns {
+		if len(c.peerRequests) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Queues a check of the next complete piece if the torrent is idle.
+func (t *Torrent) scrubNextPiece() {
+	if t.scrub.checking || !t.scrubIdle() {
+		return
+	}
+	for t.scrub.next < t.numPieces() {
+		i := t.scrub.next
+		t.scrub.next++
+		if !t.pieceComplete(i) {
+			continue
+		}
+		t.scrub.piece = i
+		t.scrub.checking = true
+		t.queuePieceCheck(i)
+		return
+	}
+	t.scrub.next = 0
+	t.scrub.lastPassCompleted = time.Now()
+}
+
+// Called when a piece has been hashed, to account for checks the scrubber queued.
+func (t *Torrent) onScrubPieceHashed(piece pieceIndex, passed bool) {
+	if !t.scrub.checking || piece != t.scrub.piece {
+		return
+	}
+	t.scrub.checking = false
+	if !passed {
+		t.scrub.failed++
+		t.logger.Printf("piece %d failed scrub", piece)
+	}
+}
+
+// The fraction of the current scrub pass completed.
+func (t *Torrent) scrubProgress() float64 {
+	if !t.haveInfo() || t.numPieces() == 0 {
+		return 0
+	}
+	return float64(t.scrub.next) / float64(t.numPieces())
+}
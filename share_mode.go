@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"sort"
+
+	"github.com/anacrolix/missinggo/iter"
+	"github.com/anacrolix/missinggo/v2/bitmap"
+)
+
+func (t *Torrent) inShareMode() bool {
+	return t.shareMode
+}
+
+func (t *Torrent) setShareMode(b bool) {
+	if t.shareMode == b {
+		return
+	}
+	t.shareMode = b
+	if !t.haveInfo() {
+		return
+	}
+	t.updateAllPiecePriorities()
+	for c := range t.conns {
+		c.peerPiecesChanged()
+	}
+}
+
+// Returns the number of connected peers that have the piece.
+func (t *Torrent) pieceAvailability(piece pieceIndex) int {
+	return t.piece(piece).availability
+}
+
+// Whether every connected peer has the piece, so there's nobody we could upload it to. False if
+// there are no peers yet.
+func (t *Torrent) pieceUbiquitous(piece pieceIndex) bool {
+	return len(t.conns) != 0 && t.pieceAvailability(piece) == len(t.conns)
+}
+
+// In share mode, piece priorities depend on which peers have the piece, so they're updated when
+// that changes.
+func (t *Torrent) pieceAvailabilityChanged(piece pieceIndex) {
+	if !t.shareMode || !t.haveInfo() {
+		return
+	}
+	if t.pieces[piece].uncachedPriority() != t.piecePriority(piece) {
+		t.updatePiecePriority(piece)
+		return
+	}
+	for c := range t.conns {
+		if c.updatePiecePriority(piece) {
+			c.updateRequests()
+		}
+	}
+}
+
+func (t *Torrent) allPieceAvailabilityChanged() {
+	if !t.shareMode || !t.haveInfo() {
+		return
+	}
+	for i := pieceIndex(0); i < t.numPieces(); i++ {
+		t.pieceAvailabilityChanged(i)
+	}
+}
+
+// Iterates pending pieces not in skip by priority class. Within each class, nearly complete pieces
+// come first, and then the rarest if in share mode.
+func iterPendingPiecesSorted(t requestStrategyTorrent, skip *bitmap.Bitmap, cb iter.Callback) {
+	type pendingPiece struct {
+		index        int
+		priority     int
+		nearComplete bool
+		availability int
+	}
+	var pieces []pendingPiece
+	pending := t.pendingPieces()
+	pending.IterTyped(func(piece int) bool {
+		if !skip.Contains(piece) {
+			prio, _ := pending.GetPriority(piece)
+			p := pendingPiece{index: piece, priority: prio, nearComplete: t.pieceNearComplete(piece)}
+			if t.inShareMode() {
+				p.availability = t.pieceAvailability(piece)
+			}
+			pieces = append(pieces, p)
+		}
+		return true
+	})
+	sort.SliceStable(pieces, func(i, j int) bool {
+		if pieces[i].priority != pieces[j].priority {
+			return pieces[i].priority < pieces[j].priority
+		}
+		if pieces[i].nearComplete != pieces[j].nearComplete {
+			return pieces[i].nearComplete
+		}
+		return pieces[i].availability < pieces[j].availability
+	})
+	for _, p := range pieces {
+		if !cb(p.index) {
+			return
+		}
+		skip.Add(p.index)
+	}
+}
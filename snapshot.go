@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// A consistent view of a torrent's state, taken at once by Torrent.Snapshot.
+type TorrentSnapshot struct {
+	InfoHash metainfo.Hash
+	Name     string
+	// Whether the info is known. Length, BytesCompleted and Files are zero without it.
+	HaveInfo       bool
+	Length         int64
+	BytesCompleted int64
+	Private        bool
+	Paused         bool
+	// Per Torrent.Seeding.
+	Seeding bool
+	Files   []FileSnapshot
+	// Ordered by URL.
+	Trackers []TrackerSnapshot
+	Peers    []PeerConnSnapshot
+	// Totals for the torrent, see Torrent.Stats.
+	ConnStats ConnStats
+}
+
+type FileSnapshot struct {
+	// Per File.DisplayPath.
+	Path           string
+	Length         int64
+	BytesCompleted int64
+	Priority       piecePriority
+}
+
+type TrackerSnapshot struct {
+	URL string
+	// When the last announce completed, zero if it hasn't. The other fields are from that
+	// announce. Only HTTP and UDP trackers report announce results.
+	LastAnnounce time.Time
+	Err          error
+	NumPeers     int
+	Interval     time.Duration
+}
+
+type PeerConnSnapshot struct {
+	RemoteAddr net.Addr
+	Network    string
+	Outgoing   bool
+	Discovery  PeerSource
+	PeerID     PeerID
+	ClientName string
+	// Whether the connection's headers are obfuscated.
+	Encrypted bool
+	// The number of pieces the peer has.
+	PeerPieces     int
+	Interested     bool
+	Choking        bool
+	PeerInterested bool
+	PeerChoking    bool
+	Stats          ConnStats
+}
+
+// Returns the torrent's state, taken under a single lock so the parts are consistent with each
+// other.
+func (t *Torrent) Snapshot() (ret TorrentSnapshot) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	ret.InfoHash = t.infoHash
+	ret.Name = t.name()
+	ret.HaveInfo = t.haveInfo()
+	ret.Private = t.private()
+	ret.Paused = t.paused.IsSet()
+	ret.Seeding = t.seeding()
+	ret.ConnStats = t.stats.Copy()
+	if ret.HaveInfo {
+		ret.Length = *t.length
+		ret.BytesCompleted = t.bytesCompleted()
+		ret.Files = make([]FileSnapshot, 0, len(*t.files))
+		for _, f := range *t.files {
+			ret.Files = append(ret.Files, FileSnapshot{
+				Path:           f.DisplayPath(),
+				Length:         f.length,
+				BytesCompleted: f.bytesCompleted(),
+				Priority:       f.prio,
+			})
+		}
+	}
+	ret.Trackers = make([]TrackerSnapshot, 0, len(t.trackerAnnouncers))
+	for _, ta := range t.trackerAnnouncers {
+		u := ta.URL()
+		ts := TrackerSnapshot{URL: u.String()}
+		if s, ok := ta.(*trackerScraper); ok {
+			ts.LastAnnounce = s.lastAnnounce.Completed
+			ts.Err = s.lastAnnounce.Err
+			ts.NumPeers = s.lastAnnounce.NumPeers
+			ts.Interval = s.lastAnnounce.Interval
+		}
+		ret.Trackers = append(ret.Trackers, ts)
+	}
+	sort.Slice(ret.Trackers, func(i, j int) bool {
+		return ret.Trackers[i].URL < ret.Trackers[j].URL
+	})
+	ret.Peers = make([]PeerConnSnapshot, 0, len(t.conns))
+	for c := range t.conns {
+		ret.Peers = append(ret.Peers, PeerConnSnapshot{
+			RemoteAddr:     c.remoteAddr,
+			Network:        c.network,
+			Outgoing:       c.outgoing,
+			Discovery:      c.Discovery,
+			PeerID:         c.PeerID,
+			ClientName:     c.PeerClientName,
+			Encrypted:      c.headerEncrypted,
+			PeerPieces:     c.peerNumPieces(),
+			Interested:     c.interested,
+			Choking:        c.choking,
+			PeerInterested: c.peerInterested,
+			PeerChoking:    c.peerChoking,
+			Stats:          c._stats.Copy(),
+		})
+	}
+	return
+}
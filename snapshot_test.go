@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func TestTorrentSnapshot(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	mi := testutil.GreetingMetaInfo()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	snap := tt.Snapshot()
+	assert.False(t, snap.HaveInfo)
+	assert.Empty(t, snap.Files)
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	completed := time.Now()
+	tt.trackerAnnouncers = map[string]torrentTrackerAnnouncer{
+		"udp://b": &trackerScraper{u: url.URL{Scheme: "udp", Host: "b"}, lastAnnounce: trackerAnnounceResult{
+			NumPeers:  3,
+			Interval:  time.Minute,
+			Completed: completed,
+		}},
+		"udp://a": &trackerScraper{u: url.URL{Scheme: "udp", Host: "a"}, lastAnnounce: trackerAnnounceResult{
+			Err:       errors.New("timed out"),
+			Completed: completed,
+		}},
+	}
+	cl.lock()
+	c := cl.newConnection(nil, true, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}, "tcp4", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	require.NoError(t, c.onPeerSentHaveAll())
+	c.PeerClientName = "test"
+	c._stats.BytesReadData.Add(10)
+	cl.unlock()
+	tt.Files()[0].SetPriority(PiecePriorityHigh)
+	snap = tt.Snapshot()
+	assert.Equal(t, mi.HashInfoBytes(), snap.InfoHash)
+	assert.Equal(t, testutil.GreetingFileName, snap.Name)
+	assert.True(t, snap.HaveInfo)
+	assert.EqualValues(t, len(testutil.GreetingFileContents), snap.Length)
+	assert.Equal(t, snap.Length, snap.BytesCompleted)
+	assert.False(t, snap.Private)
+	assert.False(t, snap.Paused)
+	assert.Equal(t, []FileSnapshot{{
+		Path:           testutil.GreetingFileName,
+		Length:         snap.Length,
+		BytesCompleted: snap.Length,
+		Priority:       PiecePriorityHigh,
+	}}, snap.Files)
+	require.Len(t, snap.Trackers, 2)
+	assert.Equal(t, "udp://a", snap.Trackers[0].URL)
+	assert.EqualError(t, snap.Trackers[0].Err, "timed out")
+	assert.Equal(t, TrackerSnapshot{
+		URL:          "udp://b",
+		LastAnnounce: completed,
+		NumPeers:     3,
+		Interval:     time.Minute,
+	}, snap.Trackers[1])
+	require.Len(t, snap.Peers, 1)
+	p := snap.Peers[0]
+	assert.Equal(t, "1.2.3.4:5", p.RemoteAddr.String())
+	assert.Equal(t, "tcp4", p.Network)
+	assert.True(t, p.Outgoing)
+	assert.Equal(t, "test", p.ClientName)
+	assert.Equal(t, tt.numPieces(), p.PeerPieces)
+	assert.True(t, p.Choking)
+	assert.EqualValues(t, 10, p.Stats.BytesReadData.Int64())
+}
+
+func TestTorrentDumpPeers(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	mi := testutil.GreetingMetaInfo()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	cl.lock()
+	c := cl.newConnection(nil, true, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}, "tcp4", "")
+	c.Discovery = PeerSourceTracker
+	c.PeerID = PeerID{'a'}
+	c.PeerClientName = "test"
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	require.NoError(t, c.onPeerSentHaveAll())
+	c._stats.BytesReadUsefulData.Add(10)
+	cl.adjustPeerReputation(net.IPv4(1, 2, 3, 4), 3, reputationMin)
+	tt.addPeer(Peer{Addr: &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 9}, Source: PeerSourcePex})
+	cl.unlock()
+	var buf bytes.Buffer
+	require.NoError(t, tt.DumpPeers(&buf))
+	d := json.NewDecoder(&buf)
+	var lines []peerDumpLine
+	for d.More() {
+		var l peerDumpLine
+		require.NoError(t, d.Decode(&l))
+		lines = append(lines, l)
+	}
+	require.Len(t, lines, 2)
+	connected := lines[0]
+	assert.Equal(t, "1.2.3.4:5", connected.Addr)
+	assert.True(t, connected.Connected)
+	assert.EqualValues(t, PeerSourceTracker, connected.Source)
+	assert.Equal(t, "tcp4", connected.Network)
+	assert.True(t, connected.Outgoing)
+	assert.Equal(t, "6100000000000000000000000000000000000000", connected.PeerID)
+	assert.Equal(t, "test", connected.ClientName)
+	assert.Equal(t, 3, connected.PeerPieces)
+	assert.Equal(t, 3, connected.Reputation)
+	require.NotNil(t, connected.Stats)
+	assert.EqualValues(t, 10, connected.Stats.BytesReadUsefulData.Int64())
+	assert.Equal(t, peerDumpLine{Addr: "5.6.7.8:9", Source: PeerSourcePex}, lines[1])
+}
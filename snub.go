@@ -0,0 +1,43 @@
+package torrent
+
+import (
+	"time"
+)
+
+// Tracks how long the peer has kept us choked while we're interested, and starts the timer that
+// drops the connection at ClientConfig.PeerChokedTimeout.
+func (cn *PeerConn) updateChokedWhileInterested() {
+	if cn.t == nil {
+		return
+	}
+	if cn.interested && cn.peerChoking && !cn.closed.IsSet() {
+		if !cn.chokedWhileInterestedSince.IsZero() {
+			return
+		}
+		cn.chokedWhileInterestedSince = time.Now()
+		if timeout := cn.t.cl.config.PeerChokedTimeout; timeout > 0 {
+			cn.snubTimer = time.AfterFunc(timeout, cn.onSnubTimer)
+		}
+		return
+	}
+	cn.chokedWhileInterestedSince = time.Time{}
+	if cn.snubTimer != nil {
+		cn.snubTimer.Stop()
+		cn.snubTimer = nil
+	}
+}
+
+func (cn *PeerConn) onSnubTimer() {
+	cl := cn.t.cl
+	cl.lock()
+	defer cl.unlock()
+	since := cn.chokedWhileInterestedSince
+	if cn.closed.IsSet() || since.IsZero() || time.Since(since) < cl.config.PeerChokedTimeout {
+		// The timer was stopped too late, and a newer one may be running.
+		return
+	}
+	cn.logger.Printf("dropping connection: choked us for %v while we were interested", time.Since(since))
+	cl.adjustPeerReputation(cn.remoteIp(), reputationSnubbedConn, reputationBehaviourFloor)
+	cn.closeWithReason(ConnDropSnubbed)
+	cn.t.deleteConnection(cn)
+}
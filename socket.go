@@ -19,25 +19,41 @@ type socket interface {
 	Dialer
 }
 
-func listen(n network, addr string, f firewallCallback) (socket, error) {
+func listen(n network, addr string, f firewallCallback, opts socketOpts) (socket, error) {
 	switch {
 	case n.Tcp:
-		return listenTcp(n.String(), addr)
+		return listenTcp(n.String(), addr, opts)
 	case n.Udp:
-		return listenUtp(n.String(), addr, f)
+		// uTP dials from the socket it listens on, so its source port is always the listen port.
+		return listenUtp(n.String(), addr, f, opts.utpBuffers, opts.dscp)
 	default:
 		panic(n)
 	}
 }
 
-func listenTcp(network, address string) (s socket, err error) {
-	l, err := net.Listen(network, address)
-	return tcpSocket{
+func listenTcp(network, address string, opts socketOpts) (s socket, err error) {
+	// Buffer sizes set on the listener are inherited by accepted connections, and must be set
+	// before connecting to affect the TCP window scale.
+	lc := net.ListenConfig{Control: opts.tcpControl()}
+	l, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return tcpSocket{}, err
+	}
+	ts := tcpSocket{
 		Listener: l,
 		NetDialer: NetDialer{
 			Network: network,
+			Dialer:  net.Dialer{Control: opts.tcpControl()},
 		},
-	}, err
+	}
+	if opts.dialFromListenPort {
+		la := l.Addr().(*net.TCPAddr)
+		ts.Dialer.LocalAddr = &net.TCPAddr{Port: la.Port}
+		if !la.IP.IsUnspecified() {
+			ts.Dialer.LocalAddr.(*net.TCPAddr).IP = la.IP
+		}
+	}
+	return ts, nil
 }
 
 type tcpSocket struct {
@@ -45,7 +61,7 @@ type tcpSocket struct {
 	NetDialer
 }
 
-func listenAll(networks []network, getHost func(string) string, port int, f firewallCallback) ([]socket, error) {
+func listenAll(networks []network, getHost func(string) string, port int, f firewallCallback, opts socketOpts) ([]socket, error) {
 	if len(networks) == 0 {
 		return nil, nil
 	}
@@ -54,7 +70,7 @@ func listenAll(networks []network, getHost func(string) string, port int, f fire
 		nahs = append(nahs, networkAndHost{n, getHost(n.String())})
 	}
 	for {
-		ss, retry, err := listenAllRetry(nahs, port, f)
+		ss, retry, err := listenAllRetry(nahs, port, f, opts)
 		if !retry {
 			return ss, err
 		}
@@ -66,10 +82,10 @@ type networkAndHost struct {
 	Host    string
 }
 
-func listenAllRetry(nahs []networkAndHost, port int, f firewallCallback) (ss []socket, retry bool, err error) {
+func listenAllRetry(nahs []networkAndHost, port int, f firewallCallback, opts socketOpts) (ss []socket, retry bool, err error) {
 	ss = make([]socket, 1, len(nahs))
 	portStr := strconv.FormatInt(int64(port), 10)
-	ss[0], err = listen(nahs[0].Network, net.JoinHostPort(nahs[0].Host, portStr), f)
+	ss[0], err = listen(nahs[0].Network, net.JoinHostPort(nahs[0].Host, portStr), f, opts)
 	if err != nil {
 		return nil, false, errors.Wrap(err, "first listen")
 	}
@@ -83,7 +99,7 @@ func listenAllRetry(nahs []networkAndHost, port int, f firewallCallback) (ss []s
 	}()
 	portStr = strconv.FormatInt(int64(missinggo.AddrPort(ss[0].Addr())), 10)
 	for _, nah := range nahs[1:] {
-		s, err := listen(nah.Network, net.JoinHostPort(nah.Host, portStr), f)
+		s, err := listen(nah.Network, net.JoinHostPort(nah.Host, portStr), f, opts)
 		if err != nil {
 			return ss,
 				missinggo.IsAddrInUse(err) && port == 0,
@@ -96,8 +112,8 @@ func listenAllRetry(nahs []networkAndHost, port int, f firewallCallback) (ss []s
 
 type firewallCallback func(net.Addr) bool
 
-func listenUtp(network, addr string, fc firewallCallback) (socket, error) {
-	us, err := NewUtpSocket(network, addr, fc)
+func listenUtp(network, addr string, fc firewallCallback, bufs socketBufferSizes, dscp int) (socket, error) {
+	us, err := newUtpSocket(network, addr, fc, bufs, dscp)
 	return utpSocketSocket{us, network}, err
 }
 
@@ -110,3 +126,40 @@ func (me utpSocketSocket) Dial(ctx context.Context, addr string) (conn net.Conn,
 	defer perf.ScopeTimerErr(&err)()
 	return me.utpSocket.DialContext(ctx, me.network, addr)
 }
+
+// A Dialer for uTP on its own socket. See NewUtpDialer.
+type UtpDialer struct {
+	s utpSocketSocket
+}
+
+// Returns a uTP Dialer on a new socket bound to addr, such as an address on a VPN interface, for
+// use in TorrentSpec.Dialers. Incoming connections on the socket are closed. It should be closed
+// once the torrents using it are dropped.
+func NewUtpDialer(network, addr string) (*UtpDialer, error) {
+	us, err := NewUtpSocket(network, addr, func(net.Addr) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := us.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return &UtpDialer{utpSocketSocket{us, network}}, nil
+}
+
+func (me *UtpDialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return me.s.Dial(ctx, addr)
+}
+
+func (me *UtpDialer) LocalAddr() net.Addr {
+	return me.s.LocalAddr()
+}
+
+func (me *UtpDialer) Close() error {
+	return me.s.Close()
+}
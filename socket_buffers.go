@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Socket send and receive buffer sizes in bytes. Zero leaves the OS default.
+type socketBufferSizes struct {
+	send    int
+	receive int
+}
+
+func (me socketBufferSizes) isZero() bool {
+	return me.send == 0 && me.receive == 0
+}
+
+func (me socketBufferSizes) validate() error {
+	if me.send < 0 || me.receive < 0 {
+		return errors.New("socket buffer sizes can't be negative")
+	}
+	return nil
+}
+
+// Options for the sockets the Client listens and dials on.
+type socketOpts struct {
+	dialFromListenPort bool
+	tcpBuffers         socketBufferSizes
+	utpBuffers         socketBufferSizes
+	dscp               int
+}
+
+func (cl *Client) socketOpts() socketOpts {
+	return socketOpts{
+		dialFromListenPort: cl.config.DialFromListenPort,
+		tcpBuffers:         socketBufferSizes{cl.config.TcpSendBufferSize, cl.config.TcpReceiveBufferSize},
+		utpBuffers:         socketBufferSizes{cl.config.UtpSendBufferSize, cl.config.UtpReceiveBufferSize},
+		dscp:               cl.config.SocketDscp,
+	}
+}
+
+// Returns a net.ListenConfig or net.Dialer Control function for the options, or nil if there's
+// nothing to set.
+func (me socketOpts) tcpControl() func(network, address string, c syscall.RawConn) error {
+	if !me.dialFromListenPort && me.tcpBuffers.isZero() && me.dscp == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if me.dialFromListenPort {
+			if err := reusePortControl(network, address, c); err != nil {
+				return err
+			}
+		}
+		if err := setSocketDscpRaw(c, networkIsIpv6(network), me.dscp); err != nil {
+			return err
+		}
+		return setSocketBuffersRaw(c, me.tcpBuffers)
+	}
+}
+
+func setSocketBuffersRaw(c syscall.RawConn, sizes socketBufferSizes) (err error) {
+	if sizes.isZero() {
+		return nil
+	}
+	cerr := c.Control(func(fd uintptr) {
+		err = setSocketBuffers(fd, sizes)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+// Sets the buffer sizes on a UDP socket, such as the one uTP runs over.
+func setUdpSocketBuffers(pc net.PacketConn, sizes socketBufferSizes) error {
+	if sizes.isZero() {
+		return nil
+	}
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return errors.New("socket buffer sizes can't be set on this socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setSocketBuffersRaw(rc, sizes)
+}
@@ -0,0 +1,11 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package torrent
+
+import (
+	"errors"
+)
+
+func setSocketBuffers(fd uintptr, sizes socketBufferSizes) error {
+	return errors.New("setting socket buffer sizes isn't supported on this platform")
+}
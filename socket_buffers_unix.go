@@ -0,0 +1,41 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package torrent
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets the buffer sizes, failing if the OS caps them below what's asked for.
+func setSocketBuffers(fd uintptr, sizes socketBufferSizes) error {
+	for _, o := range []struct {
+		name string
+		opt  int
+		size int
+	}{
+		{"send", unix.SO_SNDBUF, sizes.send},
+		{"receive", unix.SO_RCVBUF, sizes.receive},
+	} {
+		if o.size == 0 {
+			continue
+		}
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, o.opt, o.size); err != nil {
+			return fmt.Errorf("setting socket %s buffer size: %w", o.name, err)
+		}
+		got, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, o.opt)
+		if err != nil {
+			return fmt.Errorf("getting socket %s buffer size: %w", o.name, err)
+		}
+		if runtime.GOOS == "linux" {
+			// Linux doubles the size to allow for bookkeeping, and reports that.
+			got /= 2
+		}
+		if got < o.size {
+			return fmt.Errorf("socket %s buffer size %d exceeds the OS maximum, got %d", o.name, o.size, got)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+func validateDscp(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return errors.New("DSCP must be from 0 to 63")
+	}
+	return nil
+}
+
+// Whether a socket for the network, like one passed to a Control function, is IPv6.
+func networkIsIpv6(network string) bool {
+	return strings.HasSuffix(network, "6")
+}
+
+func setSocketDscpRaw(c syscall.RawConn, ipv6 bool, dscp int) (err error) {
+	if dscp == 0 {
+		return nil
+	}
+	cerr := c.Control(func(fd uintptr) {
+		err = setSocketDscp(fd, ipv6, dscp)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+// Sets the DSCP on a UDP socket, such as the one uTP runs over.
+func setUdpSocketDscp(pc net.PacketConn, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return errors.New("DSCP can't be set on this socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ua, _ := pc.LocalAddr().(*net.UDPAddr)
+	return setSocketDscpRaw(rc, ua != nil && ua.IP.To4() == nil, dscp)
+}
+
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return setSocketDscpRaw(c, networkIsIpv6(network), dscp)
+	}
+}
+
+// The dialer for announces to trackers. See ClientConfig.SocketDscp.
+func (t *Torrent) trackerAnnounceDialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.trackerDialContext != nil || t.cl.config.SocketDscp == 0 {
+		return t.trackerDialContext
+	}
+	return (&net.Dialer{Control: dscpControl(t.cl.config.SocketDscp)}).DialContext
+}
@@ -0,0 +1,15 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package torrent
+
+import (
+	"errors"
+)
+
+func setSocketDscp(fd uintptr, ipv6 bool, dscp int) error {
+	return errors.New("setting socket DSCP isn't supported on this platform")
+}
+
+func socketDscp(fd uintptr, ipv6 bool) (int, error) {
+	return 0, errors.New("getting socket DSCP isn't supported on this platform")
+}
@@ -0,0 +1,43 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package torrent
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets the DSCP in the IPv4 type of service or IPv6 traffic class of the socket's packets, failing
+// if the OS doesn't apply it.
+func setSocketDscp(fd uintptr, ipv6 bool, dscp int) error {
+	level, opt := unix.IPPROTO_IP, unix.IP_TOS
+	if ipv6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+		// Dual-stack sockets send IPv4 packets too. This fails for IPv6-only sockets.
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, dscp<<2)
+	}
+	if err := unix.SetsockoptInt(int(fd), level, opt, dscp<<2); err != nil {
+		return fmt.Errorf("setting socket DSCP: %w", err)
+	}
+	got, err := socketDscp(fd, ipv6)
+	if err != nil {
+		return err
+	}
+	if got != dscp {
+		return fmt.Errorf("socket DSCP %d wasn't applied, got %d", dscp, got)
+	}
+	return nil
+}
+
+func socketDscp(fd uintptr, ipv6 bool) (int, error) {
+	level, opt := unix.IPPROTO_IP, unix.IP_TOS
+	if ipv6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	}
+	tos, err := unix.GetsockoptInt(int(fd), level, opt)
+	if err != nil {
+		return 0, fmt.Errorf("getting socket DSCP: %w", err)
+	}
+	return tos >> 2, nil
+}
@@ -1,6 +1,10 @@
 package torrent
 
 import (
+	"context"
+	"crypto/sha256"
+	"net"
+
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/storage"
 )
@@ -12,12 +16,47 @@ type TorrentSpec struct {
 	Trackers  [][]string
 	InfoHash  metainfo.Hash
 	InfoBytes []byte
+	// The BEP 52 v2 infohash, if known. A spec with one is merged into the hybrid torrent known to
+	// have it, even if it has no InfoHash, such as from a v2 magnet.
+	InfoHashV2 [sha256.Size]byte
 	// The name to use if the Name field from the Info isn't available.
 	DisplayName string
 	// The chunk size to use for outbound requests. Defaults to 16KiB if not
 	// set.
 	ChunkSize int
 	Storage   storage.ClientImpl
+	// Store the torrent's data in this directory instead of ClientConfig.DataDir, using the file
+	// storage and the piece completion of the Client's default storage. Ignored if Storage is set.
+	// Requires that ClientConfig.DefaultStorage isn't set. Nothing coordinates torrents whose files
+	// resolve to the same paths: their data would overwrite each other, and since completion is
+	// tracked per infohash, neither would notice. Callers should give such torrents distinct
+	// directories.
+	DataDir string
+	// Seed existing data only. Pieces not known to be complete by the storage are verified, and
+	// no data is ever requested from peers, so the storage isn't written to.
+	SeedOnly bool
+	// If not nil, peer connections for the torrent are dialed with these instead of the Client's
+	// dialers, such as to route the torrent through a VPN interface. Use NetDialer with a LocalAddr
+	// for TCP, and NewUtpDialer for uTP. The torrent isn't announced to the DHT, as that goes
+	// through the Client's sockets. Incoming connections are still accepted on the Client's
+	// listeners.
+	Dialers []Dialer
+	// If set, peer connections for the torrent are dialed over TCP from this local IP, such as one
+	// on a VPN interface, while trackers are still announced to as usual. Unlike Dialers, the
+	// torrent is still announced to the DHT, through the Client's sockets. It can't be used with
+	// Dialers. The IP must be assignable.
+	PeerLocalIp net.IP
+	// If set, used for the torrent's tracker connections and the DNS lookups for them, instead of
+	// the defaults.
+	TrackerDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// DHT nodes as "host:port", such as from the nodes field of a trackerless torrent's metainfo.
+	// They're added to the Client's DHT servers, unless the torrent is private or has its own
+	// Dialers. Host names are resolved.
+	DhtNodes []string
+	// BEP 19 web seed URLs, such as from the url-list field of the metainfo.
+	Webseeds []string
+	// BEP 17 HTTP seed URLs.
+	HttpSeeds []string
 }
 
 func TorrentSpecFromMagnetURI(uri string) (spec *TorrentSpec, err error) {
@@ -29,6 +68,7 @@ func TorrentSpecFromMagnetURI(uri string) (spec *TorrentSpec, err error) {
 		Trackers:    [][]string{m.Trackers},
 		DisplayName: m.DisplayName,
 		InfoHash:    m.InfoHash,
+		InfoHashV2:  m.InfoHashV2,
 	}
 	return
 }
@@ -40,9 +80,17 @@ func TorrentSpecFromMetaInfo(mi *metainfo.MetaInfo) (spec *TorrentSpec) {
 		InfoBytes:   mi.InfoBytes,
 		DisplayName: info.Name,
 		InfoHash:    mi.HashInfoBytes(),
+		Webseeds:    mi.UrlList,
+		HttpSeeds:   mi.HttpSeeds,
+	}
+	if info.MetaVersion == 2 {
+		spec.InfoHashV2 = mi.HashInfoBytesV2()
 	}
 	if spec.Trackers == nil && mi.Announce != "" {
 		spec.Trackers = [][]string{{mi.Announce}}
 	}
+	for _, n := range mi.Nodes {
+		spec.DhtNodes = append(spec.DhtNodes, string(n))
+	}
 	return
 }
@@ -0,0 +1,55 @@
+package torrent
+
+import "time"
+
+// Notes that the torrent has connected peers, or has had a successful tracker or DHT announce, so
+// it isn't stalled.
+func (t *Torrent) onPeerSourceActivity() {
+	t.lastPeerSourceActivity = time.Now()
+	t.stalled = false
+}
+
+func (t *Torrent) stallTimeout() time.Duration {
+	if d := t.cl.config.TorrentStallTimeout; d > 0 {
+		return d
+	}
+	return defaultTorrentStallTimeout
+}
+
+// Starts checking for stalls if there's a Callbacks.OnTorrentStalled.
+func (t *Torrent) startStallTimer() {
+	if t.stallTimer != nil || t.callbacks.OnTorrentStalled == nil {
+		return
+	}
+	t.onPeerSourceActivity()
+	t.stallTimer = time.AfterFunc(t.stallTimeout(), func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if t.closed.IsSet() {
+			return
+		}
+		t.stallTimer.Reset(t.checkStalled())
+	})
+}
+
+// Calls Callbacks.OnTorrentStalled if the torrent has just stalled, and returns when to check
+// again.
+func (t *Torrent) checkStalled() time.Duration {
+	timeout := t.stallTimeout()
+	if len(t.conns) != 0 || t.paused.IsSet() {
+		// Time paused, or with peers, doesn't count towards a stall.
+		t.onPeerSourceActivity()
+		return timeout
+	}
+	if t.stalled {
+		return timeout
+	}
+	d := time.Since(t.lastPeerSourceActivity)
+	if d < timeout {
+		return timeout - d
+	}
+	t.stalled = true
+	t.logger.Printf("stalled: no peers or successful announces for %v", d)
+	go t.callbacks.OnTorrentStalled(t, d)
+	return timeout
+}
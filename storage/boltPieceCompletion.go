@@ -2,8 +2,12 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"time"
 
 	"go.etcd.io/bbolt"
@@ -18,20 +22,34 @@ const (
 
 var (
 	completionBucketKey = []byte("completion")
+	prioritiesBucketKey = []byte("priorities")
+	writtenBucketKey    = []byte("written")
 )
 
 type boltPieceCompletion struct {
 	db *bbolt.DB
 }
 
-var _ PieceCompletion = (*boltPieceCompletion)(nil)
+var (
+	_ PieceCompletion    = (*boltPieceCompletion)(nil)
+	_ PiecePriorityStore = (*boltPieceCompletion)(nil)
+	_ PieceWriteJournal  = (*boltPieceCompletion)(nil)
+)
 
+// Opens the piece completion db in dir. A corrupt db is moved aside with a ".corrupt" suffix and
+// replaced with an empty one, so that pieces are verified again rather than trusting bad state.
 func NewBoltPieceCompletion(dir string) (ret PieceCompletion, err error) {
 	os.MkdirAll(dir, 0770)
 	p := filepath.Join(dir, ".torrent.bolt.db")
-	db, err := bbolt.Open(p, 0660, &bbolt.Options{
-		Timeout: time.Second,
-	})
+	db, err := openCheckedBoltDb(p)
+	if errors.Is(err, errBoltDbCorrupt) {
+		log.Printf("piece completion db %q is corrupt, all pieces will be verified: %v", p, err)
+		err = os.Rename(p, p+".corrupt")
+		if err != nil {
+			return
+		}
+		db, err = openCheckedBoltDb(p)
+	}
 	if err != nil {
 		return
 	}
@@ -40,6 +58,59 @@ func NewBoltPieceCompletion(dir string) (ret PieceCompletion, err error) {
 	return
 }
 
+var errBoltDbCorrupt = errors.New("bolt db corrupt")
+
+// Opens the bolt db at the path, and reads all of it, so corruption is found now rather than when
+// it's used. bbolt can fault or panic on bad data, so that's caught and reported as
+// errBoltDbCorrupt.
+func openCheckedBoltDb(p string) (db *bbolt.DB, err error) {
+	// The db is memory mapped, so truncated files fault when read.
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if db != nil {
+			db.Close()
+			db = nil
+		}
+		err = fmt.Errorf("%w: %v", errBoltDbCorrupt, r)
+	}()
+	db, err = bbolt.Open(p, 0660, &bbolt.Options{
+		Timeout: time.Second,
+	})
+	switch err {
+	case nil:
+	case bbolt.ErrInvalid, bbolt.ErrVersionMismatch, bbolt.ErrChecksum:
+		return nil, fmt.Errorf("%w: %v", errBoltDbCorrupt, err)
+	default:
+		return
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bbolt.Bucket) error {
+			return readBoltBucket(b)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%w: %v", errBoltDbCorrupt, err)
+	}
+	return
+}
+
+func readBoltBucket(b *bbolt.Bucket) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		if nb := b.Bucket(k); nb != nil {
+			return readBoltBucket(nb)
+		}
+		return nil
+	})
+}
+
 func (me boltPieceCompletion) Get(pk metainfo.PieceKey) (cn Completion, err error) {
 	err = me.db.View(func(tx *bbolt.Tx) error {
 		cb := tx.Bucket(completionBucketKey)
@@ -88,6 +159,69 @@ func (me boltPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 	})
 }
 
+func (me boltPieceCompletion) GetPiecePriorities(ih metainfo.Hash) (ret []byte, err error) {
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		pb := tx.Bucket(prioritiesBucketKey)
+		if pb == nil {
+			return nil
+		}
+		// The value is only valid for the life of the transaction.
+		ret = append(ret, pb.Get(ih[:])...)
+		return nil
+	})
+	return
+}
+
+func (me boltPieceCompletion) SetPiecePriorities(ih metainfo.Hash, prios []byte) error {
+	return me.db.Update(func(tx *bbolt.Tx) error {
+		pb, err := tx.CreateBucketIfNotExists(prioritiesBucketKey)
+		if err != nil {
+			return err
+		}
+		if prios == nil {
+			return pb.Delete(ih[:])
+		}
+		return pb.Put(ih[:], prios)
+	})
+}
+
+func (me boltPieceCompletion) GetWrittenPieces(ih metainfo.Hash) (ret []int, err error) {
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		wb := tx.Bucket(writtenBucketKey)
+		if wb == nil {
+			return nil
+		}
+		ihb := wb.Bucket(ih[:])
+		if ihb == nil {
+			return nil
+		}
+		return ihb.ForEach(func(k, _ []byte) error {
+			ret = append(ret, int(binary.BigEndian.Uint32(k)))
+			return nil
+		})
+	})
+	return
+}
+
+func (me boltPieceCompletion) SetPieceWritten(pk metainfo.PieceKey, written bool) error {
+	return me.db.Update(func(tx *bbolt.Tx) error {
+		wb, err := tx.CreateBucketIfNotExists(writtenBucketKey)
+		if err != nil {
+			return err
+		}
+		ih, err := wb.CreateBucketIfNotExists(pk.InfoHash[:])
+		if err != nil {
+			return err
+		}
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], uint32(pk.Index))
+		if !written {
+			return ih.Delete(key[:])
+		}
+		return ih.Put(key[:], []byte{})
+	})
+}
+
 func (me *boltPieceCompletion) Close() error {
 	return me.db.Close()
 }
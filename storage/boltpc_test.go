@@ -3,6 +3,7 @@ package storage
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,3 +39,105 @@ func TestBoltPieceCompletion(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, Completion{Complete: true, Ok: true}, b)
 }
+
+func TestBoltPiecePriorities(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	pc, err := NewBoltPieceCompletion(td)
+	require.NoError(t, err)
+	defer pc.Close()
+	ps := pc.(PiecePriorityStore)
+
+	ih := metainfo.Hash{1}
+
+	b, err := ps.GetPiecePriorities(ih)
+	require.NoError(t, err)
+	assert.Nil(t, b)
+
+	require.NoError(t, ps.SetPiecePriorities(ih, []byte{0, 1, 2}))
+
+	b, err = ps.GetPiecePriorities(ih)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2}, b)
+
+	require.NoError(t, ps.SetPiecePriorities(ih, nil))
+
+	b, err = ps.GetPiecePriorities(ih)
+	require.NoError(t, err)
+	assert.Nil(t, b)
+}
+
+func TestBoltPieceWriteJournal(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	pc, err := NewBoltPieceCompletion(td)
+	require.NoError(t, err)
+	defer pc.Close()
+	j := pc.(PieceWriteJournal)
+
+	ih := metainfo.Hash{1}
+
+	w, err := j.GetWrittenPieces(ih)
+	require.NoError(t, err)
+	assert.Empty(t, w)
+
+	require.NoError(t, j.SetPieceWritten(metainfo.PieceKey{InfoHash: ih, Index: 3}, true))
+	require.NoError(t, j.SetPieceWritten(metainfo.PieceKey{InfoHash: ih, Index: 300}, true))
+	require.NoError(t, j.SetPieceWritten(metainfo.PieceKey{InfoHash: metainfo.Hash{2}, Index: 4}, true))
+
+	w, err = j.GetWrittenPieces(ih)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{3, 300}, w)
+
+	require.NoError(t, j.SetPieceWritten(metainfo.PieceKey{InfoHash: ih, Index: 3}, false))
+
+	w, err = j.GetWrittenPieces(ih)
+	require.NoError(t, err)
+	assert.Equal(t, []int{300}, w)
+}
+
+func TestBoltPieceCompletionCorrupt(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		corrupt func([]byte) []byte
+	}{
+		{"garbage", func([]byte) []byte { return []byte("not a bolt db") }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)/3] }},
+		{"scrambled", func(b []byte) []byte {
+			for i := 2 * os.Getpagesize(); i < len(b); i++ {
+				b[i] = byte(i * 7)
+			}
+			return b
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			td, err := ioutil.TempDir("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(td)
+			pc, err := NewBoltPieceCompletion(td)
+			require.NoError(t, err)
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, pc.Set(metainfo.PieceKey{Index: i}, true))
+			}
+			require.NoError(t, pc.Close())
+			p := filepath.Join(td, ".torrent.bolt.db")
+			b, err := ioutil.ReadFile(p)
+			require.NoError(t, err)
+			require.NoError(t, ioutil.WriteFile(p, tc.corrupt(b), 0660))
+
+			pc, err = NewBoltPieceCompletion(td)
+			require.NoError(t, err)
+			defer pc.Close()
+			// Nothing is trusted, so pieces get verified.
+			c, err := pc.Get(metainfo.PieceKey{Index: 1})
+			require.NoError(t, err)
+			assert.False(t, c.Ok)
+			require.NoError(t, pc.Set(metainfo.PieceKey{Index: 1}, true))
+			assert.FileExists(t, p+".corrupt")
+		})
+	}
+}
@@ -17,7 +17,9 @@ type PieceCompletion interface {
 	Close() error
 }
 
-func pieceCompletionForDir(dir string) (ret PieceCompletion) {
+// Returns the piece completion used by default for storage in the given directory, falling back to
+// an in-memory implementation if the persistent one can't be opened.
+func NewDefaultPieceCompletionForDir(dir string) (ret PieceCompletion) {
 	ret, err := NewBoltPieceCompletion(dir)
 	if err != nil {
 		log.Printf("couldn't open piece completion db in %q: %s", dir, err)
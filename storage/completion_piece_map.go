@@ -7,11 +7,17 @@ import (
 )
 
 type mapPieceCompletion struct {
-	mu sync.Mutex
-	m  map[metainfo.PieceKey]bool
+	mu         sync.Mutex
+	m          map[metainfo.PieceKey]bool
+	priorities map[metainfo.Hash][]byte
+	written    map[metainfo.PieceKey]struct{}
 }
 
-var _ PieceCompletion = (*mapPieceCompletion)(nil)
+var (
+	_ PieceCompletion    = (*mapPieceCompletion)(nil)
+	_ PiecePriorityStore = (*mapPieceCompletion)(nil)
+	_ PieceWriteJournal  = (*mapPieceCompletion)(nil)
+)
 
 func NewMapPieceCompletion() PieceCompletion {
 	return &mapPieceCompletion{m: make(map[metainfo.PieceKey]bool)}
@@ -35,3 +41,48 @@ func (me *mapPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 	me.m[pk] = b
 	return nil
 }
+
+func (me *mapPieceCompletion) GetPiecePriorities(ih metainfo.Hash) ([]byte, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return append([]byte(nil), me.priorities[ih]...), nil
+}
+
+func (me *mapPieceCompletion) SetPiecePriorities(ih metainfo.Hash, prios []byte) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if prios == nil {
+		delete(me.priorities, ih)
+		return nil
+	}
+	if me.priorities == nil {
+		me.priorities = make(map[metainfo.Hash][]byte)
+	}
+	me.priorities[ih] = append([]byte(nil), prios...)
+	return nil
+}
+
+func (me *mapPieceCompletion) GetWrittenPieces(ih metainfo.Hash) (ret []int, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for pk := range me.written {
+		if pk.InfoHash == ih {
+			ret = append(ret, pk.Index)
+		}
+	}
+	return
+}
+
+func (me *mapPieceCompletion) SetPieceWritten(pk metainfo.PieceKey, written bool) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if !written {
+		delete(me.written, pk)
+		return nil
+	}
+	if me.written == nil {
+		me.written = make(map[metainfo.PieceKey]struct{})
+	}
+	me.written[pk] = struct{}{}
+	return nil
+}
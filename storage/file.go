@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/anacrolix/missinggo"
 
@@ -16,6 +18,13 @@ type fileClientImpl struct {
 	baseDir   string
 	pathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string
 	pc        PieceCompletion
+	// Maps torrent file paths to paths on disk. See NewFileWithPathMapping.
+	mapPath func(torrentPath string) (diskPath string)
+	// If not nil, files are kept open here rather than opened for each read and write. See
+	// NewFileWithFilePool.
+	pool *FilePool
+	// See NewFileReadOnly.
+	readOnly bool
 }
 
 // The Default path maker just returns the current path
@@ -29,7 +38,7 @@ func infoHashPathMaker(baseDir string, info *metainfo.Info, infoHash metainfo.Ha
 
 // All Torrent data stored in this baseDir
 func NewFile(baseDir string) ClientImplCloser {
-	return NewFileWithCompletion(baseDir, pieceCompletionForDir(baseDir))
+	return NewFileWithCompletion(baseDir, NewDefaultPieceCompletionForDir(baseDir))
 }
 
 func NewFileWithCompletion(baseDir string, completion PieceCompletion) *fileClientImpl {
@@ -43,7 +52,35 @@ func NewFileByInfoHash(baseDir string) ClientImpl {
 
 // Allows passing a function to determine the path for storing torrent data
 func NewFileWithCustomPathMaker(baseDir string, pathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string) ClientImpl {
-	return newFileWithCustomPathMakerAndCompletion(baseDir, pathMaker, pieceCompletionForDir(baseDir))
+	return newFileWithCustomPathMakerAndCompletion(baseDir, pathMaker, NewDefaultPieceCompletionForDir(baseDir))
+}
+
+// File storage where the torrent's files are stored at the paths returned by mapPath, such as to
+// seed data that's laid out differently on disk. A torrent path is the torrent's name followed by
+// the file's path, separated by "/". Relative disk paths are relative to baseDir. Verification and
+// uploads read through the mapping, as do writes.
+func NewFileWithPathMapping(baseDir string, completion PieceCompletion, mapPath func(torrentPath string) (diskPath string)) ClientImplCloser {
+	ret := newFileWithCustomPathMakerAndCompletion(baseDir, nil, completion)
+	ret.mapPath = mapPath
+	return ret
+}
+
+// File storage that reads and writes through files kept open in pool, which can be shared with
+// other storage. This avoids reopening files for every read and write, while bounding the file
+// descriptors used no matter how many files the torrents have.
+func NewFileWithFilePool(baseDir string, completion PieceCompletion, pool *FilePool) ClientImplCloser {
+	ret := newFileWithCustomPathMakerAndCompletion(baseDir, nil, completion)
+	ret.pool = pool
+	return ret
+}
+
+// File storage that only reads the torrent data already in baseDir, such as to check it without a
+// Client. No files are created or modified, and writes return an error. Completion is kept in
+// memory.
+func NewFileReadOnly(baseDir string) ClientImplCloser {
+	ret := newFileWithCustomPathMakerAndCompletion(baseDir, nil, NewMapPieceCompletion())
+	ret.readOnly = true
+	return ret
 }
 
 func newFileWithCustomPathMakerAndCompletion(baseDir string, pathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string, completion PieceCompletion) *fileClientImpl {
@@ -63,16 +100,23 @@ func (me *fileClientImpl) Close() error {
 
 func (fs *fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
 	dir := fs.pathMaker(fs.baseDir, info, infoHash)
-	err := CreateNativeZeroLengthFiles(info, dir)
-	if err != nil {
-		return nil, err
-	}
-	return &fileTorrentImpl{
+	ret := &fileTorrentImpl{
 		dir,
 		info,
 		infoHash,
 		fs.pc,
-	}, nil
+		fs.mapPath,
+		fs.pool,
+		fs.readOnly,
+	}
+	if fs.readOnly {
+		return ret, nil
+	}
+	err := createNativeZeroLengthFiles(info, ret.fileInfoName)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 type fileTorrentImpl struct {
@@ -80,6 +124,9 @@ type fileTorrentImpl struct {
 	info       *metainfo.Info
 	infoHash   metainfo.Hash
 	completion PieceCompletion
+	mapPath    func(string) string
+	pool       *FilePool
+	readOnly   bool
 }
 
 func (fts *fileTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
@@ -95,18 +142,54 @@ func (fts *fileTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
 }
 
 func (fs *fileTorrentImpl) Close() error {
+	if fs.pool != nil {
+		for _, fi := range fs.info.UpvertedFiles() {
+			fs.pool.closeFile(fs.fileInfoName(fi))
+		}
+	}
 	return nil
 }
 
+// Sums the space allocated to each file, up to its length in the torrent. Missing files have none.
+func (fs *fileTorrentImpl) AllocatedBytes() (ret int64, err error) {
+	for _, fi := range fs.info.UpvertedFiles() {
+		var n int64
+		n, err = fileAllocatedBytes(fs.fileInfoName(fi))
+		if os.IsNotExist(err) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if n > fi.Length {
+			n = fi.Length
+		}
+		ret += n
+	}
+	return
+}
+
 // Creates natives files for any zero-length file entries in the info. This is
 // a helper for file-based storages, which don't address or write to zero-
 // length files because they have no corresponding pieces.
 func CreateNativeZeroLengthFiles(info *metainfo.Info, dir string) (err error) {
+	return createNativeZeroLengthFiles(info, func(fi metainfo.FileInfo) string {
+		return FilePath(dir, info, fi)
+	})
+}
+
+// Returns where file storage in dir, as returned by NewFile, keeps the data for the file fi of info.
+func FilePath(dir string, info *metainfo.Info, fi metainfo.FileInfo) string {
+	return filepath.Join(append([]string{dir, info.Name}, fi.Path...)...)
+}
+
+func createNativeZeroLengthFiles(info *metainfo.Info, fileName func(metainfo.FileInfo) string) (err error) {
 	for _, fi := range info.UpvertedFiles() {
 		if fi.Length != 0 {
 			continue
 		}
-		name := filepath.Join(append([]string{dir, info.Name}, fi.Path...)...)
+		name := fileName(fi)
 		os.MkdirAll(filepath.Dir(name), 0777)
 		var f io.Closer
 		f, err = os.Create(name)
@@ -118,14 +201,44 @@ func CreateNativeZeroLengthFiles(info *metainfo.Info, dir string) (err error) {
 	return
 }
 
+var errReadOnly = errors.New("file storage is read-only")
+
 // Exposes file-based storage of a torrent, as one big ReadWriterAt.
 type fileTorrentImplIO struct {
 	fts *fileTorrentImpl
 }
 
+// Opens the named file for reading, or for writing, creating it, if write is set. The returned
+// function must be called when done with the file.
+func (fts *fileTorrentImpl) openFile(name string, write bool) (f *os.File, done func(), err error) {
+	if write && fts.readOnly {
+		err = errReadOnly
+		return
+	}
+	if fts.pool != nil {
+		var pf *pooledFile
+		pf, err = fts.pool.acquire(name, write)
+		if err != nil {
+			return
+		}
+		return pf.f, func() { fts.pool.release(pf) }, nil
+	}
+	if write {
+		os.MkdirAll(filepath.Dir(name), 0777)
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
+	} else {
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return
+	}
+	// TODO: On some systems, write errors can be delayed until the Close.
+	return f, func() { f.Close() }, nil
+}
+
 // Returns EOF on short or missing file.
 func (fst *fileTorrentImplIO) readFileAt(fi metainfo.FileInfo, b []byte, off int64) (n int, err error) {
-	f, err := os.Open(fst.fts.fileInfoName(fi))
+	f, done, err := fst.fts.openFile(fst.fts.fileInfoName(fi), false)
 	if os.IsNotExist(err) {
 		// File missing is treated the same as a short file.
 		err = io.EOF
@@ -134,7 +247,7 @@ func (fst *fileTorrentImplIO) readFileAt(fi metainfo.FileInfo, b []byte, off int
 	if err != nil {
 		return
 	}
-	defer f.Close()
+	defer done()
 	// Limit the read to within the expected bounds of this file.
 	if int64(len(b)) > fi.Length-off {
 		b = b[:fi.Length-off]
@@ -187,16 +300,16 @@ func (fst fileTorrentImplIO) WriteAt(p []byte, off int64) (n int, err error) {
 		if int64(n1) > fi.Length-off {
 			n1 = int(fi.Length - off)
 		}
-		name := fst.fts.fileInfoName(fi)
-		os.MkdirAll(filepath.Dir(name), 0777)
-		var f *os.File
-		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
+		var (
+			f    *os.File
+			done func()
+		)
+		f, done, err = fst.fts.openFile(fst.fts.fileInfoName(fi), true)
 		if err != nil {
 			return
 		}
 		n1, err = f.WriteAt(p[:n1], off)
-		// TODO: On some systems, write errors can be delayed until the Close.
-		f.Close()
+		done()
 		if err != nil {
 			return
 		}
@@ -211,5 +324,12 @@ func (fst fileTorrentImplIO) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 func (fts *fileTorrentImpl) fileInfoName(fi metainfo.FileInfo) string {
-	return filepath.Join(append([]string{fts.dir, fts.info.Name}, fi.Path...)...)
+	if fts.mapPath == nil {
+		return FilePath(fts.dir, fts.info, fi)
+	}
+	name := fts.mapPath(strings.Join(append([]string{fts.info.Name}, fi.Path...), "/"))
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(fts.dir, name)
+	}
+	return name
 }
@@ -0,0 +1,22 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the space allocated to the file on disk, which is less than its size where it's sparse.
+func fileAllocatedBytes(name string) (int64, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.Size(), nil
+	}
+	// Blocks are always counted in 512 byte units.
+	return int64(st.Blocks) * 512, nil
+}
@@ -51,3 +51,58 @@ func (fs *filePieceImpl) MarkComplete() error {
 func (fs *filePieceImpl) MarkNotComplete() error {
 	return fs.completion.Set(fs.pieceKey(), false)
 }
+
+// Releases the piece's data in its files. Data that runs to the end of a file is truncated, and
+// elsewhere a hole is punched where the platform supports it.
+func (fs *filePieceImpl) Discard() error {
+	if fs.readOnly {
+		return errReadOnly
+	}
+	if err := fs.MarkNotComplete(); err != nil {
+		return err
+	}
+	off, n := fs.p.Offset(), fs.p.Length()
+	for _, fi := range fs.info.UpvertedFiles() {
+		if off >= fi.Length {
+			off -= fi.Length
+			continue
+		}
+		n1 := n
+		if off+n1 > fi.Length {
+			n1 = fi.Length - off
+		}
+		if err := discardFileRegion(fs.fileInfoName(fi), off, n1); err != nil {
+			return err
+		}
+		n -= n1
+		if n == 0 {
+			break
+		}
+		off = 0
+	}
+	return nil
+}
+
+var _ PieceDiscarder = (*filePieceImpl)(nil)
+
+func discardFileRegion(name string, off, n int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if off >= fi.Size() {
+		return nil
+	}
+	if off+n >= fi.Size() {
+		return f.Truncate(off)
+	}
+	return punchHole(f, off, n)
+}
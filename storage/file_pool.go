@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A bounded set of open files for file storage, which can be shared by any number of torrents and
+// storage Clients. Files are opened as they're read or written, and the least recently used are
+// closed once more than the maximum are open. Files are only closed when no read or write is
+// using them, so concurrent operations on different files can briefly exceed the maximum.
+type FilePool struct {
+	mu      sync.Mutex
+	maxOpen int
+	files   map[string]*pooledFile
+	// Unused files, least recently used at the back.
+	lru list.List
+}
+
+type pooledFile struct {
+	name     string
+	f        *os.File
+	writable bool
+	// Reads and writes using the file.
+	refs int
+	// No longer in the pool, and closed when refs reaches zero.
+	evicted bool
+	elem    *list.Element
+}
+
+// Returns a pool that keeps at most maxOpen files open. maxOpen is at least 1.
+func NewFilePool(maxOpen int) *FilePool {
+	if maxOpen < 1 {
+		maxOpen = 1
+	}
+	return &FilePool{
+		maxOpen: maxOpen,
+		files:   make(map[string]*pooledFile),
+	}
+}
+
+// The number of files the pool has open.
+func (me *FilePool) NumOpen() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return len(me.files)
+}
+
+// Returns the file open for reading, and writing if write is set, which creates it. Missing files
+// return an error satisfying os.IsNotExist when not writing. The file must be released.
+func (me *FilePool) acquire(name string, write bool) (*pooledFile, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if pf, ok := me.files[name]; ok {
+		if pf.writable || !write {
+			me.use(pf)
+			return pf, nil
+		}
+		// It was opened read-only.
+		me.evict(pf)
+	}
+	pf := &pooledFile{name: name}
+	var err error
+	if write {
+		os.MkdirAll(filepath.Dir(name), 0777)
+		pf.f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+		pf.writable = true
+	} else {
+		pf.f, err = os.OpenFile(name, os.O_RDWR, 0)
+		pf.writable = true
+		if os.IsPermission(err) {
+			pf.f, err = os.Open(name)
+			pf.writable = false
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	me.files[name] = pf
+	me.use(pf)
+	me.trim()
+	return pf, nil
+}
+
+func (me *FilePool) use(pf *pooledFile) {
+	if pf.elem != nil {
+		me.lru.Remove(pf.elem)
+		pf.elem = nil
+	}
+	pf.refs++
+}
+
+func (me *FilePool) release(pf *pooledFile) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	pf.refs--
+	if pf.refs != 0 {
+		return
+	}
+	if pf.evicted {
+		pf.f.Close()
+		return
+	}
+	pf.elem = me.lru.PushFront(pf)
+	me.trim()
+}
+
+// Removes the file from the pool, closing it once it's unused.
+func (me *FilePool) evict(pf *pooledFile) {
+	delete(me.files, pf.name)
+	pf.evicted = true
+	if pf.elem != nil {
+		me.lru.Remove(pf.elem)
+		pf.elem = nil
+	}
+	if pf.refs == 0 {
+		pf.f.Close()
+	}
+}
+
+// Closes unused files until there's no more than the maximum open.
+func (me *FilePool) trim() {
+	for len(me.files) > me.maxOpen {
+		e := me.lru.Back()
+		if e == nil {
+			return
+		}
+		me.evict(e.Value.(*pooledFile))
+	}
+}
+
+// Closes the named file, once it's unused, if it's open.
+func (me *FilePool) closeFile(name string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if pf, ok := me.files[name]; ok {
+		me.evict(pf)
+	}
+}
+
+// Closes all the files, each once it's unused. The pool can still be used after.
+func (me *FilePool) Close() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, pf := range me.files {
+		me.evict(pf)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -42,3 +43,122 @@ func TestShortFile(t *testing.T) {
 		t.Errorf("expected nil or EOF error from truncated piece, got %v", err)
 	}
 }
+
+func TestFileAllocatedBytes(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	info := &metainfo.Info{
+		Name:        "a",
+		PieceLength: missinggo.MiB,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"b"}, Length: missinggo.MiB},
+			{Path: []string{"c"}, Length: 1},
+		},
+	}
+	ts, err := NewFile(td).OpenTorrent(info, metainfo.Hash{})
+	require.NoError(t, err)
+	ar := ts.(AllocationReporter)
+	n, err := ar.AllocatedBytes()
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, n)
+	// Only the start of the first file is written, so the rest of it is a hole.
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt(make([]byte, 4096), 0)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(filepath.Join(td, "a", "b"), missinggo.MiB))
+	n, err = ar.AllocatedBytes()
+	require.NoError(t, err)
+	assert.True(t, n > 0 && n < missinggo.MiB, n)
+	_, err = p.WriteAt(make([]byte, missinggo.MiB), 0)
+	require.NoError(t, err)
+	_, err = ts.Piece(info.Piece(1)).WriteAt([]byte{1}, 0)
+	require.NoError(t, err)
+	n, err = ar.AllocatedBytes()
+	require.NoError(t, err)
+	assert.EqualValues(t, info.TotalLength(), n)
+}
+
+func TestFilePool(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	const numFiles = 10
+	info := &metainfo.Info{
+		Name:        "a",
+		PieceLength: 4,
+	}
+	for i := 0; i < numFiles; i++ {
+		info.Files = append(info.Files, metainfo.FileInfo{Path: []string{fmt.Sprint(i)}, Length: 3})
+	}
+	info.Pieces = make([]byte, (info.TotalLength()+3)/4*metainfo.HashSize)
+	data := make([]byte, info.TotalLength())
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// Where the platform lets us, check that descriptors aren't leaked, as well as the pool's count.
+	numFds := func() int {
+		fds, _ := ioutil.ReadDir("/proc/self/fd")
+		return len(fds)
+	}
+	fdsBefore := numFds()
+	pool := NewFilePool(3)
+	s := NewFileWithFilePool(td, NewMapPieceCompletion(), pool)
+	defer s.Close()
+	ts, err := s.OpenTorrent(info, metainfo.Hash{})
+	require.NoError(t, err)
+	for i := 0; i < info.NumPieces(); i++ {
+		p := info.Piece(i)
+		_, err := ts.Piece(p).WriteAt(data[p.Offset():p.Offset()+p.Length()], 0)
+		require.NoError(t, err)
+		assert.True(t, pool.NumOpen() <= 3)
+	}
+	for i := info.NumPieces() - 1; i >= 0; i-- {
+		p := info.Piece(i)
+		b := make([]byte, p.Length())
+		_, err := ts.Piece(p).ReadAt(b, 0)
+		require.NoError(t, err)
+		assert.Equal(t, data[p.Offset():p.Offset()+p.Length()], b)
+		assert.True(t, pool.NumOpen() <= 3)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(td, "a", "4"))
+	require.NoError(t, err)
+	assert.Equal(t, data[12:15], b)
+	assert.NotZero(t, pool.NumOpen())
+	require.NoError(t, ts.Close())
+	assert.Zero(t, pool.NumOpen())
+	assert.Equal(t, fdsBefore, numFds())
+}
+
+func TestFileReadOnly(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	info := &metainfo.Info{
+		Name:        "a",
+		PieceLength: missinggo.MiB,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"b"}, Length: 2},
+			{Path: []string{"c"}, Length: 0},
+		},
+	}
+	s := NewFileReadOnly(td)
+	defer s.Close()
+	ts, err := s.OpenTorrent(info, metainfo.Hash{})
+	require.NoError(t, err)
+	defer ts.Close()
+	_, err = os.Stat(FilePath(td, info, info.Files[1]))
+	assert.True(t, os.IsNotExist(err))
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte("hi"), 0)
+	assert.Error(t, err)
+	_, err = os.Stat(FilePath(td, info, info.Files[0]))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, os.MkdirAll(filepath.Join(td, "a"), 0777))
+	require.NoError(t, ioutil.WriteFile(FilePath(td, info, info.Files[0]), []byte("hi"), 0666))
+	b := make([]byte, 2)
+	n, err := p.ReadAt(b, 0)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "hi", string(b))
+	assert.Error(t, p.(PieceDiscarder).Discard())
+}
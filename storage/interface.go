@@ -38,6 +38,32 @@ type PieceImpl interface {
 	Completion() Completion
 }
 
+// Optionally implemented by a PieceImpl to release the storage held by the piece's data. The piece
+// is no longer complete afterwards.
+type PieceDiscarder interface {
+	Discard() error
+}
+
+// Optionally implemented by a TorrentImpl that can only hold some of the torrent's pieces at once.
+// Only pieces in [begin, end) are downloaded. The window is checked again after pieces are marked
+// complete, and when the torrent is resumed.
+type PieceWindower interface {
+	PieceWindow() (begin, end int)
+}
+
+// Optionally implemented by a PieceWindower whose window moves on its own, such as when pieces are
+// written out in the background. The callback is called when the window moves, or with the error
+// when moving it failed, without any of the storage's locks held.
+type PieceWindowNotifier interface {
+	OnPieceWindowChanged(func(error))
+}
+
+// Optionally implemented by a TorrentImpl that can report how much of the torrent's data has
+// space allocated in the backing store, such as when files are sparse or partly written.
+type AllocationReporter interface {
+	AllocatedBytes() (int64, error)
+}
+
 type Completion struct {
 	Complete bool
 	Ok       bool
@@ -20,7 +20,7 @@ type mmapClientImpl struct {
 }
 
 func NewMMap(baseDir string) ClientImplCloser {
-	return NewMMapWithCompletion(baseDir, pieceCompletionForDir(baseDir))
+	return NewMMapWithCompletion(baseDir, NewDefaultPieceCompletionForDir(baseDir))
 }
 
 func NewMMapWithCompletion(baseDir string, completion PieceCompletion) *mmapClientImpl {
@@ -0,0 +1,15 @@
+package storage
+
+import (
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Persists user-set file and piece priorities for torrents, so that selections survive restarts.
+// The priorities are opaque to the store. The piece completion
+// implementations in this package also implement this interface. It must be concurrent-safe.
+type PiecePriorityStore interface {
+	// Returns nil if no priorities are stored for the torrent.
+	GetPiecePriorities(metainfo.Hash) ([]byte, error)
+	// Nil priorities removes any stored for the torrent.
+	SetPiecePriorities(metainfo.Hash, []byte) error
+}
@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Records pieces that have been written to but not yet verified. Pieces are recorded before their
+// first write, and cleared once their completion is recorded, so after a crash only the recorded
+// pieces need verifying to recover data that was written. The piece completion implementations in
+// this package also implement this interface, and keep the journal alongside the completion. It
+// must be concurrent-safe.
+type PieceWriteJournal interface {
+	// Returns the indices of the recorded pieces for the torrent, in no particular order.
+	GetWrittenPieces(metainfo.Hash) ([]int, error)
+	SetPieceWritten(_ metainfo.PieceKey, written bool) error
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Reported to the PieceWindowNotifier callback when writing to a Pipe's sink fails. The pieces
+// remain complete, and writing is retried the next time the window is requested.
+type SinkWriteError struct {
+	Err error
+}
+
+func (me *SinkWriteError) Error() string {
+	return fmt.Sprintf("writing to pipe sink: %v", me.Err)
+}
+
+func (me *SinkWriteError) Unwrap() error {
+	return me.Err
+}
+
+var errPipePieceDiscarded = errors.New("piece data was written to the pipe sink and discarded")
+
+// Streams the verified data of a single torrent to a sink in order, without storing all of it. Only
+// a window of pieces following the last piece written to the sink is held in memory, and only
+// those pieces are downloaded. Pieces are complete once written to the sink, and can't be read
+// back, so the torrent can't be read or uploaded from once they're discarded. The sink is written
+// to by a goroutine of its own, so a slow sink doesn't hold up the caller marking pieces complete.
+type Pipe struct {
+	sink   io.Writer
+	window int
+
+	mu sync.Mutex
+	// Signalled when the writer may have something to do.
+	writerCond sync.Cond
+	opened     bool
+	closed     bool
+	pieces     []pipePiece
+	// The next piece to write to the sink. Pieces before this are discarded.
+	next int
+	// The next piece's remaining data, once writing it has begun. Pieces can't be changed then.
+	pending []byte
+	// The last error writing to the sink. It's retried when retry is set.
+	err   error
+	retry bool
+	// Told when the window moves, or writing to the sink fails.
+	onWindowChanged func(error)
+}
+
+type pipePiece struct {
+	data     []byte
+	complete bool
+}
+
+var (
+	_ ClientImpl          = (*Pipe)(nil)
+	_ PieceWindower       = (*pipeTorrent)(nil)
+	_ PieceWindowNotifier = (*pipeTorrent)(nil)
+)
+
+// Returns storage that writes a torrent's verified pieces to sink in order, holding up to window of
+// them in memory until they can be written.
+func NewPipe(sink io.Writer, window int) *Pipe {
+	if window < 1 {
+		window = 1
+	}
+	ret := &Pipe{
+		sink:   sink,
+		window: window,
+	}
+	ret.writerCond.L = &ret.mu
+	return ret
+}
+
+func (me *Pipe) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.opened {
+		return nil, errors.New("pipe storage supports a single torrent")
+	}
+	me.opened = true
+	me.pieces = make([]pipePiece, info.NumPieces())
+	go me.writer()
+	return &pipeTorrent{me}, nil
+}
+
+// Writes complete pieces following those already written, until all the pieces are written or the
+// torrent is closed.
+func (me *Pipe) writer() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for !me.closed && me.next < len(me.pieces) {
+		p := &me.pieces[me.next]
+		if !p.complete || me.err != nil && !me.retry {
+			me.writerCond.Wait()
+			continue
+		}
+		me.retry = false
+		if me.pending == nil {
+			me.pending = p.data
+		}
+		b := me.pending
+		me.mu.Unlock()
+		n, err := me.sink.Write(b)
+		me.mu.Lock()
+		me.pending = me.pending[n:]
+		if err == nil && len(me.pending) != 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			me.err = &SinkWriteError{err}
+		} else {
+			me.err = nil
+			me.pending = nil
+			p.data = nil
+			me.next++
+		}
+		if f := me.onWindowChanged; f != nil {
+			err := me.err
+			me.mu.Unlock()
+			f(err)
+			me.mu.Lock()
+		}
+	}
+}
+
+type pipeTorrent struct {
+	p *Pipe
+}
+
+func (me *pipeTorrent) Piece(p metainfo.Piece) PieceImpl {
+	return pipePieceImpl{me.p, p}
+}
+
+func (me *pipeTorrent) Close() error {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	me.p.closed = true
+	me.p.writerCond.Broadcast()
+	return nil
+}
+
+// Retries writing to the sink if it previously failed.
+func (me *pipeTorrent) PieceWindow() (begin, end int) {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	if me.p.err != nil {
+		me.p.retry = true
+		me.p.writerCond.Broadcast()
+	}
+	begin = me.p.next
+	end = begin + me.p.window
+	if end > len(me.p.pieces) {
+		end = len(me.p.pieces)
+	}
+	return
+}
+
+func (me *pipeTorrent) OnPieceWindowChanged(f func(error)) {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	me.p.onWindowChanged = f
+}
+
+type pipePieceImpl struct {
+	p  *Pipe
+	mp metainfo.Piece
+}
+
+func (me pipePieceImpl) piece() *pipePiece {
+	return &me.p.pieces[me.mp.Index()]
+}
+
+func (me pipePieceImpl) discarded() bool {
+	return me.mp.Index() < me.p.next
+}
+
+// Whether the piece has been, or is being, written to the sink.
+func (me pipePieceImpl) committed() bool {
+	return me.discarded() || me.mp.Index() == me.p.next && me.p.pending != nil
+}
+
+func (me pipePieceImpl) ReadAt(b []byte, off int64) (int, error) {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	if me.discarded() {
+		return 0, errPipePieceDiscarded
+	}
+	data := me.piece().data
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (me pipePieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	if me.committed() {
+		return 0, errPipePieceDiscarded
+	}
+	p := me.piece()
+	if p.data == nil {
+		p.data = make([]byte, me.mp.Length())
+	}
+	return copy(p.data[off:], b), nil
+}
+
+func (me pipePieceImpl) MarkComplete() error {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	if me.discarded() {
+		return nil
+	}
+	me.piece().complete = true
+	me.p.writerCond.Broadcast()
+	return nil
+}
+
+// Pieces already written to the sink stay complete.
+func (me pipePieceImpl) MarkNotComplete() error {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	if !me.committed() {
+		me.piece().complete = false
+	}
+	return nil
+}
+
+func (me pipePieceImpl) Completion() Completion {
+	me.p.mu.Lock()
+	defer me.p.mu.Unlock()
+	return Completion{
+		Complete: me.discarded() || me.piece().complete,
+		Ok:       true,
+	}
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type failingWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	err error
+}
+
+func (me *failingWriter) Write(b []byte) (int, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.err != nil {
+		return 0, me.err
+	}
+	return me.buf.Write(b)
+}
+
+func (me *failingWriter) String() string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.buf.String()
+}
+
+func (me *failingWriter) setErr(err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.err = err
+}
+
+func TestPipeWritesInOrder(t *testing.T) {
+	info := &metainfo.Info{
+		PieceLength: 2,
+		Length:      5,
+		Pieces:      make([]byte, 3*20),
+	}
+	var sink failingWriter
+	p := NewPipe(&sink, 2)
+	to, err := p.OpenTorrent(info, metainfo.Hash{})
+	require.NoError(t, err)
+	defer to.Close()
+	_, err = p.OpenTorrent(info, metainfo.Hash{})
+	assert.Error(t, err)
+	changes := make(chan error, 10)
+	to.(PieceWindowNotifier).OnPieceWindowChanged(func(err error) { changes <- err })
+	nextChange := func() error {
+		select {
+		case err := <-changes:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for window change")
+			return nil
+		}
+	}
+	piece := func(i int) PieceImpl { return to.Piece(info.Piece(i)) }
+	window := func() (begin, end int) { return to.(PieceWindower).PieceWindow() }
+	begin, end := window()
+	assert.Equal(t, []int{0, 2}, []int{begin, end})
+
+	piece(1).WriteAt([]byte("ll"), 0)
+	require.NoError(t, piece(1).MarkComplete())
+	assert.Empty(t, sink.String())
+
+	sink.setErr(errors.New("sink full"))
+	piece(0).WriteAt([]byte("he"), 0)
+	require.NoError(t, piece(0).MarkComplete())
+	err = nextChange()
+	var swe *SinkWriteError
+	require.True(t, errors.As(err, &swe))
+	assert.EqualError(t, swe.Err, "sink full")
+	begin, end = window()
+	assert.Equal(t, []int{0, 2}, []int{begin, end})
+	require.True(t, errors.As(nextChange(), &swe))
+
+	sink.setErr(nil)
+	window()
+	require.NoError(t, nextChange())
+	require.NoError(t, nextChange())
+	begin, end = window()
+	assert.Equal(t, []int{2, 3}, []int{begin, end})
+	assert.Equal(t, "hell", sink.String())
+	assert.True(t, piece(0).Completion().Complete)
+	_, err = piece(0).ReadAt(make([]byte, 2), 0)
+	assert.Error(t, err)
+
+	piece(2).WriteAt([]byte("o"), 0)
+	require.NoError(t, piece(2).MarkComplete())
+	require.NoError(t, nextChange())
+	assert.Equal(t, "hello", sink.String())
+}
+
+// The sink is written to without holding up marking pieces complete.
+func TestPipeSinkBlocking(t *testing.T) {
+	info := &metainfo.Info{
+		PieceLength: 1,
+		Length:      2,
+		Pieces:      make([]byte, 2*20),
+	}
+	r, w := io.Pipe()
+	defer r.Close()
+	p := NewPipe(w, 2)
+	to, err := p.OpenTorrent(info, metainfo.Hash{})
+	require.NoError(t, err)
+	defer to.Close()
+	for i := 0; i < 2; i++ {
+		piece := to.Piece(info.Piece(i))
+		piece.WriteAt([]byte{byte('a' + i)}, 0)
+		require.NoError(t, piece.MarkComplete())
+	}
+	begin, _ := to.(PieceWindower).PieceWindow()
+	assert.Equal(t, 0, begin)
+	b := make([]byte, 2)
+	_, err = io.ReadFull(r, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(b))
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocFlKeepSize  = 0x1
+	fallocFlPunchHole = 0x2
+)
+
+// Deallocates the region of the file without changing its size.
+func punchHole(f *os.File, off, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocFlKeepSize|fallocFlPunchHole, off, n)
+	if err == syscall.EOPNOTSUPP {
+		// The filesystem can't do it, so the data stays.
+		return nil
+	}
+	return err
+}
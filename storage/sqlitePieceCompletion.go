@@ -15,7 +15,11 @@ type sqlitePieceCompletion struct {
 	db *sql.DB
 }
 
-var _ PieceCompletion = (*sqlitePieceCompletion)(nil)
+var (
+	_ PieceCompletion    = (*sqlitePieceCompletion)(nil)
+	_ PiecePriorityStore = (*sqlitePieceCompletion)(nil)
+	_ PieceWriteJournal  = (*sqlitePieceCompletion)(nil)
+)
 
 func NewSqlitePieceCompletion(dir string) (ret *sqlitePieceCompletion, err error) {
 	p := filepath.Join(dir, ".torrent.db")
@@ -31,6 +35,16 @@ func NewSqlitePieceCompletion(dir string) (ret *sqlitePieceCompletion, err error
 		db.Close()
 		return
 	}
+	_, err = db.Exec(`create table if not exists piece_priorities(infohash primary key, priorities)`)
+	if err != nil {
+		db.Close()
+		return
+	}
+	_, err = db.Exec(`create table if not exists piece_written(infohash, "index", unique(infohash, "index"))`)
+	if err != nil {
+		db.Close()
+		return
+	}
 	ret = &sqlitePieceCompletion{db}
 	return
 }
@@ -51,6 +65,51 @@ func (me *sqlitePieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 	return err
 }
 
+func (me *sqlitePieceCompletion) GetPiecePriorities(ih metainfo.Hash) (ret []byte, err error) {
+	row := me.db.QueryRow(`select priorities from piece_priorities where infohash=?`, ih.HexString())
+	err = row.Scan(&ret)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (me *sqlitePieceCompletion) SetPiecePriorities(ih metainfo.Hash, prios []byte) (err error) {
+	if prios == nil {
+		_, err = me.db.Exec(`delete from piece_priorities where infohash=?`, ih.HexString())
+	} else {
+		_, err = me.db.Exec(`insert or replace into piece_priorities(infohash, priorities) values(?, ?)`, ih.HexString(), prios)
+	}
+	return
+}
+
+func (me *sqlitePieceCompletion) GetWrittenPieces(ih metainfo.Hash) (ret []int, err error) {
+	rows, err := me.db.Query(`select "index" from piece_written where infohash=?`, ih.HexString())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i int
+		err = rows.Scan(&i)
+		if err != nil {
+			return
+		}
+		ret = append(ret, i)
+	}
+	err = rows.Err()
+	return
+}
+
+func (me *sqlitePieceCompletion) SetPieceWritten(pk metainfo.PieceKey, written bool) (err error) {
+	if written {
+		_, err = me.db.Exec(`insert or ignore into piece_written(infohash, "index") values(?, ?)`, pk.InfoHash.HexString(), pk.Index)
+	} else {
+		_, err = me.db.Exec(`delete from piece_written where infohash=? and "index"=?`, pk.InfoHash.HexString(), pk.Index)
+	}
+	return
+}
+
 func (me *sqlitePieceCompletion) Close() error {
 	return me.db.Close()
 }
@@ -78,3 +78,12 @@ func (p Piece) ReadAt(b []byte, off int64) (n int, err error) {
 	}
 	return
 }
+
+// Releases the storage held by the piece's data if the implementation is a PieceDiscarder,
+// otherwise the piece is just marked not complete.
+func (p Piece) Discard() error {
+	if d, ok := p.PieceImpl.(PieceDiscarder); ok {
+		return d.Discard()
+	}
+	return p.MarkNotComplete()
+}
@@ -1,12 +1,20 @@
 package torrent
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/pubsub"
 
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/tracker"
 )
 
 // The Torrent's infohash. This is fixed and cannot change. It uniquely identifies a torrent.
@@ -15,19 +23,28 @@ func (t *Torrent) InfoHash() metainfo.Hash {
 }
 
 // Returns a channel that is closed when the info (.Info()) for the torrent has become available.
+// From then on, Name returns the name from the info rather than any display name.
 func (t *Torrent) GotInfo() <-chan struct{} {
 	t.cl.lock()
 	defer t.cl.unlock()
 	return t.gotMetainfo.C()
 }
 
-// Returns the metainfo info dictionary, or nil if it's not yet available.
+// Returns the metainfo info dictionary, or nil if it's not yet available. It's safe to call at any
+// time, such as while a magnet's metadata is still being fetched.
 func (t *Torrent) Info() *metainfo.Info {
 	t.cl.lock()
 	defer t.cl.unlock()
 	return t.info
 }
 
+// Returns the metainfo info dictionary, and false if it's not yet available, such as while a
+// magnet's metadata is still being fetched.
+func (t *Torrent) InfoOk() (*metainfo.Info, bool) {
+	info := t.Info()
+	return info, info != nil
+}
+
 // Returns a Reader bound to the torrent's data. All read calls block until the data requested is
 // actually available. Note that you probably want to ensure the Torrent Info is available first.
 func (t *Torrent) NewReader() Reader {
@@ -89,21 +106,107 @@ func (t *Torrent) Drop() {
 }
 
 // Number of bytes of the entire torrent we have completed. This is the sum of
-// completed pieces, and dirtied chunks of incomplete pieces. Do not use this
-// for download rate, as it can go down when pieces are lost or fail checks.
-// Sample Torrent.Stats.DataBytesRead for actual file data download rate.
+// verified pieces, and doesn't include data not yet verified, see
+// BytesPending. Do not use this for download rate, as it can go down when
+// pieces are lost or fail checks. Sample Torrent.Stats.DataBytesRead for actual
+// file data download rate.
 func (t *Torrent) BytesCompleted() int64 {
 	t.cl.rLock()
 	defer t.cl.rUnlock()
 	return t.bytesCompleted()
 }
 
+// Number of bytes downloaded into pieces that aren't yet complete, which
+// become completed when their pieces are verified, or are downloaded again if
+// the pieces fail checks.
+func (t *Torrent) BytesPending() int64 {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	return t.bytesPending()
+}
+
+// Returns the latest samples of the torrent's transfer rates and completion, oldest first, taken
+// every ClientConfig.RateHistoryInterval. Up to 60 samples are kept.
+func (t *Torrent) RateHistory() []RateSample {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	return t.rateHistory.get()
+}
+
 // The subscription emits as (int) the index of pieces as their state changes.
 // A state change is when the PieceState for a piece alters in value.
 func (t *Torrent) SubscribePieceStateChanges() *pubsub.Subscription {
 	return t.pieceStateChanges.Subscribe()
 }
 
+// The buffer size of channels returned by SubscribePieceCompleted.
+const PieceCompletedBufferSize = 1024
+
+// Returns a channel that receives the index of each piece as it's verified and is available to
+// read from storage. This includes pieces found complete in storage when the info is obtained. The
+// channel has a buffer of PieceCompletedBufferSize, and indices are dropped rather than delaying
+// the Client if it's full. The returned func unsubscribes and closes the channel, which also
+// occurs when the Torrent is closed.
+func (t *Torrent) SubscribePieceCompleted() (<-chan int, func()) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	ch := make(chan int, PieceCompletedBufferSize)
+	if t.closed.IsSet() {
+		close(ch)
+		return ch, func() {}
+	}
+	if t.pieceCompletedSubs == nil {
+		t.pieceCompletedSubs = make(map[chan int]struct{})
+	}
+	t.pieceCompletedSubs[ch] = struct{}{}
+	return ch, func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if _, ok := t.pieceCompletedSubs[ch]; ok {
+			close(ch)
+			delete(t.pieceCompletedSubs, ch)
+		}
+	}
+}
+
+// Sent by the channels from Torrent.SubscribeVerification as each piece is hashed.
+type VerificationProgress struct {
+	Piece  int
+	Passed bool
+	// Pieces queued for hashing or being hashed. Verification of the torrent's existing data is
+	// complete once this is zero.
+	Remaining int
+}
+
+// The buffer size of channels returned by SubscribeVerification.
+const VerificationProgressBufferSize = 1024
+
+// Returns a channel that receives progress as each of the torrent's pieces is hashed, such as when
+// checking the existing data of a torrent that's added, and a function to unsubscribe. Progress is
+// dropped if the channel's buffer is full. The channel is closed when unsubscribing, or the
+// torrent is closed.
+func (t *Torrent) SubscribeVerification() (<-chan VerificationProgress, func()) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	ch := make(chan VerificationProgress, VerificationProgressBufferSize)
+	if t.closed.IsSet() {
+		close(ch)
+		return ch, func() {}
+	}
+	if t.verificationSubs == nil {
+		t.verificationSubs = make(map[chan VerificationProgress]struct{})
+	}
+	t.verificationSubs[ch] = struct{}{}
+	return ch, func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if _, ok := t.verificationSubs[ch]; ok {
+			close(ch)
+			delete(t.verificationSubs, ch)
+		}
+	}
+}
+
 // Returns true if the torrent is currently being seeded. This occurs when the
 // client is willing to upload without wanting anything in return.
 func (t *Torrent) Seeding() bool {
@@ -120,7 +223,9 @@ func (t *Torrent) SetDisplayName(dn string) {
 	if t.haveInfo() {
 		return
 	}
+	old := t.displayName
 	t.displayName = dn
+	t.publishNameChange(old)
 }
 
 // The current working name for the torrent. Either the name in the info dict,
@@ -129,6 +234,37 @@ func (t *Torrent) Name() string {
 	return t.name()
 }
 
+// The buffer size of channels returned by SubscribeName.
+const NameChangesBufferSize = 16
+
+// Returns a channel that receives the torrent's name each time it changes, and a function to
+// unsubscribe. This includes a display name being set, and the name from the info replacing it
+// when the metadata arrives. Names are dropped if the channel's buffer is full. The channel is
+// closed when unsubscribing, or the torrent is closed.
+func (t *Torrent) SubscribeName() (<-chan string, func()) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	ch := make(chan string, NameChangesBufferSize)
+	if t.closed.IsSet() {
+		close(ch)
+		return ch, func() {}
+	}
+	t.nameMu.Lock()
+	defer t.nameMu.Unlock()
+	if t.nameSubs == nil {
+		t.nameSubs = make(map[chan string]struct{})
+	}
+	t.nameSubs[ch] = struct{}{}
+	return ch, func() {
+		t.nameMu.Lock()
+		defer t.nameMu.Unlock()
+		if _, ok := t.nameSubs[ch]; ok {
+			close(ch)
+			delete(t.nameSubs, ch)
+		}
+	}
+}
+
 // The completed length of all the torrent data, in all its files. This is
 // derived from the torrent info, when it is available.
 func (t *Torrent) Length() int64 {
@@ -143,6 +279,26 @@ func (t *Torrent) Metainfo() metainfo.MetaInfo {
 	return t.newMetaInfo()
 }
 
+// Returns a metainfo for the torrent that can be saved as a .torrent file, such as once a magnet
+// link's info is fetched. It has the info, and the trackers, web seeds and DHT nodes currently
+// known, including those added at run-time. The first tracker is also given as the announce URL
+// for clients that ignore the announce list. Returns an error if the info isn't known yet.
+func (t *Torrent) FullMetainfo() (*metainfo.MetaInfo, error) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	if !t.haveInfo() {
+		return nil, errors.New("torrent has no info")
+	}
+	mi := t.newMetaInfo()
+	for _, tier := range mi.AnnounceList {
+		if len(tier) != 0 {
+			mi.Announce = tier[0]
+			break
+		}
+	}
+	return &mi, nil
+}
+
 func (t *Torrent) addReader(r *reader) {
 	t.cl.lock()
 	defer t.cl.unlock()
@@ -173,6 +329,7 @@ func (t *Torrent) downloadPiecesLocked(begin, end pieceIndex) {
 			t.updatePiecePriority(i)
 		}
 	}
+	t.savePiecePriorities()
 }
 
 func (t *Torrent) CancelPieces(begin, end pieceIndex) {
@@ -190,6 +347,15 @@ func (t *Torrent) cancelPiecesLocked(begin, end pieceIndex) {
 		p.priority = PiecePriorityNone
 		t.updatePiecePriority(i)
 	}
+	t.savePiecePriorities()
+}
+
+// Returns all piece and file priorities to the default, and forgets any that were stored. Requires
+// that the info has been obtained.
+func (t *Torrent) ResetPiecePriorities() {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.resetPiecePriorities()
 }
 
 func (t *Torrent) initFiles() {
@@ -249,6 +415,56 @@ func (t *Torrent) AddTrackers(announceList [][]string) {
 	t.addTrackers(announceList)
 }
 
+// Returns the torrent's trackers, in tier order, as given to AddTrackers or in the metainfo.
+// Trackers with unparseable URLs are omitted.
+func (t *Torrent) Trackers() (ret []url.URL) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	seen := make(map[string]struct{})
+	add := func(s string) {
+		if _, ok := seen[s]; ok || s == "" {
+			return
+		}
+		seen[s] = struct{}{}
+		if u, err := url.Parse(s); err == nil {
+			ret = append(ret, *u)
+		}
+	}
+	add(t.metainfo.Announce)
+	for _, tier := range t.metainfo.AnnounceList {
+		for _, s := range tier {
+			add(s)
+		}
+	}
+	return
+}
+
+// Removes a tracker returned by Trackers, and returns whether it was present. If we joined its
+// swarm, the tracker is told we've stopped once any announce in progress completes. WebSocket
+// trackers are forgotten, but their connections aren't closed.
+func (t *Torrent) RemoveTracker(u url.URL) bool {
+	t.cl.lock()
+	defer t.cl.unlock()
+	return t.removeTracker(u.String())
+}
+
+// Adds BEP 19 web seeds, ignoring those already present. Web seeds are used for pieces that no
+// connected peer will give us. Invalid URLs are reported in the returned error, and don't prevent
+// the others being added.
+func (t *Torrent) AddWebSeeds(urls []string) error {
+	t.cl.lock()
+	defer t.cl.unlock()
+	return t.addWebSeeds(urls, false)
+}
+
+// Adds BEP 17 HTTP seeds, like AddWebSeeds. They're fetched from by piece index, under the same
+// WebSeedPolicy as BEP 19 web seeds.
+func (t *Torrent) AddHttpSeeds(urls []string) error {
+	t.cl.lock()
+	defer t.cl.unlock()
+	return t.addWebSeeds(urls, true)
+}
+
 func (t *Torrent) Piece(i pieceIndex) *Piece {
 	return t.piece(i)
 }
@@ -262,3 +478,216 @@ func (t *Torrent) PeerConns() []*PeerConn {
 	}
 	return ret
 }
+
+// Waits until at least n peer connections are established, the Torrent is closed, or the context
+// is done.
+func (t *Torrent) WaitForPeers(ctx context.Context, n int) error {
+	// This is set under the Client lock if the Context is done.
+	var ctxErr error
+	if ctx.Done() != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			<-ctx.Done()
+			t.cl.lock()
+			ctxErr = ctx.Err()
+			t.cl.event.Broadcast()
+			t.cl.unlock()
+		}()
+	}
+	t.cl.lock()
+	defer t.cl.unlock()
+	for len(t.conns) < n {
+		if ctxErr != nil {
+			return ctxErr
+		}
+		if t.closed.IsSet() {
+			return errors.New("torrent closed")
+		}
+		t.cl.event.Wait()
+	}
+	return nil
+}
+
+// Announces to each of the torrent's trackers now with the given event, outside the regular
+// interval, such as to tell a tracker that lost it that the download completed. Regular announces
+// continue afterwards, and a stopped event rejoins the swarm at the next one. Announces wait while
+// the torrent is paused.
+func (t *Torrent) AnnounceWithEvent(e tracker.AnnounceEvent) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	if e == tracker.Completed && !t.haveAllPieces() {
+		t.subsystemLogger(LogSubsystemTracker).WithDefaultLevel(log.Warning).Printf("announcing completed event for incomplete torrent")
+	}
+	for _, ta := range t.trackerAnnouncers {
+		if ts, ok := ta.(*trackerScraper); ok {
+			ts.forceAnnounce(e)
+		}
+	}
+}
+
+// Sets which pieces the torrent's web seeds fetch. The default is WebSeedPeersFirst.
+func (t *Torrent) SetWebSeedPolicy(p WebSeedPolicy) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.webSeedPolicy = p
+	t.tickleWebSeeds()
+}
+
+// Closes all peer connections, and stops seeking new ones. Trackers are told that we've stopped.
+func (t *Torrent) Pause() {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.pause()
+	// It's now paused in its own right.
+	t.pausedByClient = false
+}
+
+// Undoes Pause. A torrent paused because it reached a seeding goal will be paused again unless the
+// corresponding limit is changed.
+func (t *Torrent) Resume() {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.resume()
+}
+
+// Stops or resumes transferring data. While disabled, the torrent has no peer connections and
+// doesn't use web seeds, but unlike Pause, it keeps announcing to trackers and the DHT. The peers
+// found meanwhile are connected to when transfer is enabled again.
+func (t *Torrent) SetTransferEnabled(enabled bool) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.setTransferEnabled(enabled)
+}
+
+// Returns whether the torrent is paused, either by Pause, or by reaching a seeding goal.
+func (t *Torrent) Paused() bool {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	return t.paused.IsSet()
+}
+
+// Pauses the torrent once it's complete and the ratio of uploaded to downloaded data reaches the
+// given value. Zero or negative values remove the limit.
+func (t *Torrent) SetRatioLimit(ratio float64) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.ratioLimit = ratio
+	t.checkSeedingGoals()
+}
+
+// Pauses the torrent once it has been complete for the given duration. Zero or negative values
+// remove the limit.
+func (t *Torrent) SetSeedingTimeLimit(d time.Duration) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.seedingTimeLimit = d
+	t.updateSeedingGoalTimer()
+	t.checkSeedingGoals()
+}
+
+// Sets the torrent's priority for the Client's upload budget. Each priority above zero doubles the
+// torrent's share of ClientConfig.UploadRateLimiter relative to torrents at the priority below when
+// they're uploading at once, and its seeding upload slots (see ClientConfig.SeedingUploadSlots) up
+// to 4 times as many. Each priority below zero halves them, to no fewer than a quarter as many
+// slots. Priorities are clamped to between -16 and 16. The default is zero.
+func (t *Torrent) SetUploadPriority(p int) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.uploadPriority = int(clamp(minUploadPriority, int64(p), maxUploadPriority))
+	t.rechoke()
+}
+
+// Sets a function to be called when the torrent is paused due to reaching a seeding goal.
+func (t *Torrent) SetOnSeedingGoalReached(f func()) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.userOnSeedingGoalReached = f
+}
+
+// Sets whether the torrent is in share mode, for improving upload ratio. In share mode, pieces are
+// only downloaded if there's a connected peer without them, so they might be uploaded again, and
+// rarer pieces are favoured. Pieces wanted by Readers are still downloaded.
+func (t *Torrent) SetShareMode(b bool) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.setShareMode(b)
+}
+
+// Sets an arbitrary label on the torrent, such as for categorizing torrents. The label isn't
+// interpreted, see Client.TorrentsByLabel.
+func (t *Torrent) SetLabel(label string) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.label = label
+}
+
+// Returns the label set by SetLabel.
+func (t *Torrent) Label() string {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	return t.label
+}
+
+// Returns the earliest time the torrent is scheduled to announce to a DHT server, per
+// ClientConfig.DhtAnnounceInterval and ClientConfig.DhtAnnounceRateLimiter. It's zero if no
+// announce is scheduled, such as while announcing, or while the torrent doesn't want peers.
+func (t *Torrent) NextDhtAnnounce() (ret time.Time) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	for _, next := range t.nextDhtAnnounces {
+		if ret.IsZero() || next.Before(ret) {
+			ret = next
+		}
+	}
+	return
+}
+
+// Returns how much the torrent currently needs peer discovery. See DiscoveryPriority.
+func (t *Torrent) DiscoveryPriority() DiscoveryPriority {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	return t.discoveryPriority()
+}
+
+// Marks the piece incomplete and discards its data, so that it's downloaded and verified again, such
+// as when storage was modified externally. Requests from peers for the piece are dropped, or
+// rejected where the fast extension allows. Waits for any verification of the piece in progress.
+func (t *Torrent) InvalidatePiece(i pieceIndex) error {
+	t.cl.lock()
+	defer t.cl.unlock()
+	if !t.haveInfo() {
+		return errors.New("torrent has no info")
+	}
+	if i < 0 || i >= t.numPieces() {
+		return fmt.Errorf("piece index %v out of range", i)
+	}
+	return t.invalidatePiece(i)
+}
+
+// Returned by Torrent.StorageInfo when the storage can't report what's allocated.
+var ErrStorageAllocationUnknown = errors.New("storage doesn't report allocation")
+
+// Returns how much of the torrent's data has space allocated in its storage, and the total space
+// it requires. For file storage, the difference is what sparse and missing files still need. If the
+// storage doesn't implement storage.AllocationReporter, allocatedBytes is unknown, and
+// ErrStorageAllocationUnknown is returned with totalBytes.
+func (t *Torrent) StorageInfo() (allocatedBytes, totalBytes int64, err error) {
+	t.cl.rLock()
+	if !t.haveInfo() {
+		t.cl.rUnlock()
+		return 0, 0, errors.New("torrent has no info")
+	}
+	totalBytes = t.info.TotalLength()
+	var ar storage.AllocationReporter
+	ok := false
+	if t.storage != nil {
+		ar, ok = t.storage.TorrentImpl.(storage.AllocationReporter)
+	}
+	t.cl.rUnlock()
+	if !ok {
+		return 0, totalBytes, ErrStorageAllocationUnknown
+	}
+	allocatedBytes, err = ar.AllocatedBytes()
+	return
+}
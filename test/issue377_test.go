@@ -55,7 +55,7 @@ func TestReceiveChunkStorageFailure(t *testing.T) {
 	leecherStorage.t = leecherTorrent
 	require.NoError(t, err)
 	assert.True(t, new)
-	seederTorrent, err := seederClient.AddTorrent(metainfo)
+	seederTorrent, _, err := seederClient.AddTorrent(metainfo)
 	require.NoError(t, err)
 	// Tell the seeder to find the leecher. Is it guaranteed seeders will always try to do this?
 	seederTorrent.AddClientPeer(leecherClient)
@@ -4,18 +4,22 @@ import (
 	"container/heap"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/url"
 	"sync"
+	"syscall"
 	"text/tabwriter"
 	"time"
 	"unsafe"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/pion/datachannel"
+	"golang.org/x/time/rate"
 
 	"github.com/anacrolix/dht/v2"
 	"github.com/anacrolix/log"
@@ -43,18 +47,95 @@ type Torrent struct {
 	cl     *Client
 	logger log.Logger
 
+	// Whether the torrent has peer connections and uses web seeds. See Torrent.SetTransferEnabled.
 	networkingEnabled      bool
 	dataDownloadDisallowed bool
 	userOnWriteChunkErr    func(error)
+	userOnStorageFull      func(error)
+
+	// Only seed existing data: never request anything from peers.
+	seedOnly bool
+	// From TorrentSpec.Dialers and TorrentSpec.TrackerDialContext.
+	dialers            []Dialer
+	trackerDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// The dialer for TorrentSpec.PeerLocalIp. Unlike dialers, it doesn't keep the torrent off the
+	// DHT.
+	localIpDialer Dialer
+	// Keyed by URL.
+	webSeeds map[webSeedKey]*webSeed
+	// Which pieces web seeds fetch.
+	webSeedPolicy WebSeedPolicy
+	// Useful data written from web seeds. It's included in the ConnStats.
+	webSeedBytesRead int64
+	// Pieces with a deadline, and the timer for the next deadline to come within
+	// ClientConfig.PieceDeadlineEscalation.
+	deadlinePieces bitmap.Bitmap
+	deadlineTimer  *time.Timer
+	// The pieces the storage can hold, if it implements storage.PieceWindower.
+	storageWindow    pieceRange
+	hasStorageWindow bool
+	// Connections dropped because another had the same peer ID, per
+	// ClientConfig.DropDuplicatePeerIds.
+	duplicateConnsDropped int
+	// Counts of failed outgoing connection attempts by reason.
+	connFailures      map[ConnFailureReason]int
+	userOnConnFailure func(ConnFailure)
+	// Times metadata assembled from peers didn't match the infohash.
+	metadataHashMismatches int
+	userOnMetadataRejected func(MetadataRejection)
+	// Established peer connections and their drops.
+	connChurn connChurn
+
+	// Set while the torrent is paused. There are no peer connections, and trackers are told we've
+	// stopped.
+	paused missinggo.Event
+	// Set if the torrent was paused by Client.PauseAll, and so is resumed by Client.ResumeAll.
+	pausedByClient bool
+	// Seeding goals, after which the torrent is paused. Non-positive values mean no limit.
+	ratioLimit       float64
+	seedingTimeLimit time.Duration
+	// When we last obtained all the pieces. Zero if we haven't.
+	seedingSince             time.Time
+	seedingGoalTimer         *time.Timer
+	userOnSeedingGoalReached func()
+	// Periodically reassigns seeding upload slots.
+	rechokeTimer *time.Timer
+	// See SetUploadPriority.
+	uploadPriority int
+	// Bytes uploaded while taking turns in the Client's upload queue, divided by the upload weight.
+	// Torrents with the least take the next turn.
+	uploadQueueBytes float64
+	// Periodically re-verifies complete pieces.
+	scrub scrubState
+	// Bytes received from peers in pieces that failed their hash check.
+	corruptBytes int64
+	// When the torrent last had connected peers or a successful announce, and whether it's been
+	// reported as stalled since. See Callbacks.OnTorrentStalled.
+	lastPeerSourceActivity time.Time
+	stalled                bool
+	stallTimer             *time.Timer
+	rateHistory            rateHistory
+	// Whether requests are no longer held back for ClientConfig.MinPeersBeforeRequesting.
+	requestingStarted bool
+	requestHoldTimer  *time.Timer
+	// Set when we obtain all the pieces after downloading data this session. Trackers are sent a
+	// completed event.
+	downloadCompleted missinggo.Event
 
 	// Determines what chunks to request from peers.
 	requestStrategy requestStrategy
 
 	closed   missinggo.Event
 	infoHash metainfo.Hash
-	pieces   []Piece
+	// The BEP 52 v2 infohash, if known. Only hybrid torrents are supported, so it's an alias.
+	infoHashV2 [sha256.Size]byte
+	pieces     []Piece
 	// Values are the piece indices that changed.
 	pieceStateChanges *pubsub.PubSub
+	// Channels returned by SubscribePieceCompleted.
+	pieceCompletedSubs map[chan int]struct{}
+	// Channels returned by SubscribeVerification.
+	verificationSubs map[chan VerificationProgress]struct{}
 	// The size of chunks to request from peers over the wire. This is
 	// normally 16KiB by convention these days.
 	chunkSize pp.Integer
@@ -69,6 +150,8 @@ type Torrent struct {
 	storage *storage.Torrent
 	// Read-locked for using storage, and write-locked for Closing.
 	storageLock sync.RWMutex
+	// From ClientConfig.Callbacks.
+	callbacks Callbacks
 
 	// TODO: Only announce stuff is used?
 	metainfo metainfo.MetaInfo
@@ -83,8 +166,10 @@ type Torrent struct {
 	maxEstablishedConns int
 	// Set of addrs to which we're attempting to connect. Connections are
 	// half-open until all handshakes are completed.
-	halfOpen    map[string]Peer
-	fastestConn *PeerConn
+	halfOpen map[string]Peer
+	// Connections in conns that are warming up. See ClientConfig.ConnWarmUpTimeout.
+	numWarmingUpConns int
+	fastestConn       *PeerConn
 
 	// Reserve of peers to connect to. A peer can be both here and in the
 	// active connections if were told about the peer after connecting with
@@ -97,20 +182,30 @@ type Torrent struct {
 	trackerAnnouncers map[string]torrentTrackerAnnouncer
 	// How many times we've initiated a DHT announce. TODO: Move into stats.
 	numDHTAnnounces int
+	// When the next announce to each DHT server is scheduled, while waiting for it.
+	nextDhtAnnounces map[DhtServer]time.Time
 
 	// Name used if the info name isn't available. Should be cleared when the
 	// Info does become available.
 	nameMu      sync.RWMutex
 	displayName string
+	// Channels returned by SubscribeName. Guarded by nameMu.
+	nameSubs map[chan string]struct{}
+	// An arbitrary user-provided label. It isn't interpreted by the Client.
+	label string
 
 	// The bencoded bytes of the info dict. This is actively manipulated if
 	// the info bytes aren't initially available, and we try to fetch them
 	// from peers.
 	metadataBytes []byte
+	// The ut_metadata data message payloads for each metadata piece, once the info is known.
+	metadataPayloads [][]byte
 	// Each element corresponds to the 16KiB metadata pieces. If true, we have
 	// received that piece.
 	metadataCompletedChunks []bool
 	metadataChanged         sync.Cond
+	// The connections that supplied each of the completed metadata pieces.
+	metadataChunkSources []*PeerConn
 
 	// Set when .Info is obtained.
 	gotMetainfo missinggo.Event
@@ -118,6 +213,11 @@ type Torrent struct {
 	readers                map[*reader]struct{}
 	_readerNowPieces       bitmap.Bitmap
 	_readerReadaheadPieces bitmap.Bitmap
+	downloadRanges         map[*DownloadRange]struct{}
+	// The union of the pieces covered by downloadRanges.
+	_downloadRangePieces bitmap.Bitmap
+	// Set by SetShareMode.
+	shareMode bool
 
 	// A cache of pieces we need to get. Calculated from various piece and
 	// file priorities and completion states elsewhere.
@@ -127,6 +227,15 @@ type Torrent struct {
 	// Pieces that need to be hashed.
 	piecesQueuedForHash bitmap.Bitmap
 	activePieceHashes   int
+	// Received pieces held back from the hash queue by PieceVerificationDeferred, and the timer
+	// that will release them. They count as queued for hash.
+	deferredPieceChecks     bitmap.Bitmap
+	deferredPieceCheckTimer *time.Timer
+	// Priorities waiting to be written to ClientConfig.PiecePriorityStore, where nil removes them,
+	// and whether a goroutine is writing them.
+	prioritiesToStore []byte
+	prioritiesPending bool
+	storingPriorities bool
 
 	// A pool of piece priorities []int for assignment to new connections.
 	// These "inclinations" are used to give connections preference for
@@ -135,8 +244,14 @@ type Torrent struct {
 
 	// Count of each request across active connections.
 	pendingRequests map[request]int
+	// Requests outstanding over all connections, and connections whose peer isn't choking us. See
+	// ClientConfig.MaxConnRequestShare.
+	numRequests       int
+	numUnchokingConns int
 
 	pex pexState
+	// When peers were last reported dropped over PEX, keyed by address. See pexDroppedPeerWindow.
+	pexDropped map[string]time.Time
 }
 
 func (t *Torrent) numConns() int {
@@ -158,6 +273,7 @@ func (t *Torrent) readerReadaheadPieces() bitmap.Bitmap {
 func (t *Torrent) ignorePieces() bitmap.Bitmap {
 	ret := t._completedPieces.Copy()
 	ret.Union(t.piecesQueuedForHash)
+	ret.Union(t.deferredPieceChecks)
 	for i := 0; i < t.numPieces(); i++ {
 		if t.piece(i).hashing {
 			ret.Set(i, true)
@@ -222,6 +338,13 @@ func (t *Torrent) setChunkSize(size pp.Integer) {
 	}
 }
 
+// Returns a received chunk's buffer to the pool once it's been handled, if it came from there.
+func (t *Torrent) putChunkBuffer(b []byte) {
+	if len(b) == int(t.chunkSize) {
+		t.chunkPool.Put(&b)
+	}
+}
+
 func (t *Torrent) pieceComplete(piece pieceIndex) bool {
 	return t._completedPieces.Get(bitmap.BitIndex(piece))
 }
@@ -264,6 +387,11 @@ func (t *Torrent) addPeer(p Peer) (added bool) {
 		if cl.badPeerIPPort(ipAddr.IP, ipAddr.Port) {
 			torrent.Add("peers not added because of bad addr", 1)
 			// cl.logger.Printf("peers not added because of bad addr: %v", p)
+			// This isn't a connection failure, as the peer is never dialed.
+			return false
+		}
+		if cl.classifyPeer(ipAddr.IP) == PeerDeny {
+			torrent.Add("peers not added because denied by classifier", 1)
 			return false
 		}
 	}
@@ -289,13 +417,16 @@ func (t *Torrent) addPeer(p Peer) (added bool) {
 func (t *Torrent) invalidateMetadata() {
 	for i := range t.metadataCompletedChunks {
 		t.metadataCompletedChunks[i] = false
+		t.metadataChunkSources[i] = nil
 	}
 	t.nameMu.Lock()
+	old := t.nameLocked()
 	t.info = nil
+	t.publishNameChange(old)
 	t.nameMu.Unlock()
 }
 
-func (t *Torrent) saveMetadataPiece(index int, data []byte) {
+func (t *Torrent) saveMetadataPiece(index int, data []byte, from *PeerConn) {
 	if t.haveInfo() {
 		return
 	}
@@ -305,6 +436,7 @@ func (t *Torrent) saveMetadataPiece(index int, data []byte) {
 	}
 	copy(t.metadataBytes[(1<<14)*index:], data)
 	t.metadataCompletedChunks[index] = true
+	t.metadataChunkSources[index] = from
 }
 
 func (t *Torrent) metadataPieceCount() int {
@@ -342,8 +474,26 @@ func (t *Torrent) makePieces() {
 		files := *t.files
 		beginFile := pieceFirstFileIndex(piece.torrentBeginOffset(), files)
 		endFile := pieceEndFileIndex(piece.torrentEndOffset(), files)
-		piece.files = files[beginFile:endFile]
+		piece.files = nonEmptyFiles(files[beginFile:endFile])
+	}
+}
+
+// Returns the files that have data. Zero-length files between the files of a piece have no part in
+// it, and mustn't affect its priority.
+func nonEmptyFiles(files []*File) []*File {
+	for i, f := range files {
+		if f.length != 0 {
+			continue
+		}
+		ret := append([]*File(nil), files[:i]...)
+		for _, f := range files[i+1:] {
+			if f.length != 0 {
+				ret = append(ret, f)
+			}
+		}
+		return ret
 	}
+	return files
 }
 
 // Returns the index of the first file containing the piece. files must be
@@ -388,9 +538,11 @@ func (t *Torrent) setInfo(info *metainfo.Info) error {
 		}
 	}
 	t.nameMu.Lock()
+	old := t.nameLocked()
 	t.info = info
-	t.nameMu.Unlock()
 	t.displayName = "" // Save a few bytes lol.
+	t.publishNameChange(old)
+	t.nameMu.Unlock()
 	t.initFiles()
 	t.cacheLength()
 	t.makePieces()
@@ -398,16 +550,26 @@ func (t *Torrent) setInfo(info *metainfo.Info) error {
 }
 
 func (t *Torrent) onSetInfo() {
+	t.updateInfoHashV2()
+	if t.storage != nil {
+		if n, ok := t.storage.TorrentImpl.(storage.PieceWindowNotifier); ok {
+			n.OnPieceWindowChanged(t.onStorageWindowChanged)
+		}
+	}
+	t.updateStorageWindow()
 	for conn := range t.conns {
 		if err := conn.setNumPieces(t.numPieces()); err != nil {
 			t.logger.Printf("closing connection: %s", err)
-			conn.close()
+			conn.closeWithReason(ConnDropError)
+		}
+		if t.private() {
+			conn.pex.Close()
 		}
 	}
 	for i := range t.pieces {
 		t.updatePieceCompletion(pieceIndex(i))
 		p := &t.pieces[i]
-		if !p.storageCompletionOk {
+		if !p.storageCompletionOk || t.seedOnly && !t.pieceComplete(pieceIndex(i)) {
 			// t.logger.Printf("piece %s completion unknown, queueing check", p)
 			t.queuePieceCheck(pieceIndex(i))
 		}
@@ -416,27 +578,46 @@ func (t *Torrent) onSetInfo() {
 	t.gotMetainfo.Set()
 	t.updateWantPeersEvent()
 	t.pendingRequests = make(map[request]int)
+	t.restorePiecePriorities()
+	t.restorePieceJournal()
 	t.tryCreateMorePieceHashers()
+	t.tickleWebSeeds()
+	t.startScrubTimer()
+	if urls := t.cl.trackerList; len(urls) != 0 {
+		go t.addListedTrackers(urls)
+	}
 }
 
+var errInfoHashMismatch = errors.New("info bytes have wrong hash")
+
 // Called when metadata for a torrent becomes available.
 func (t *Torrent) setInfoBytes(b []byte) error {
 	if metainfo.HashBytes(b) != t.infoHash {
-		return errors.New("info bytes have wrong hash")
+		return errInfoHashMismatch
 	}
 	var info metainfo.Info
 	if err := bencode.Unmarshal(b, &info); err != nil {
 		return fmt.Errorf("error unmarshalling info bytes: %s", err)
 	}
+	if err := t.checkInfoLimits(&info); err != nil {
+		return fmt.Errorf("bad info: %s", err)
+	}
 	if err := t.setInfo(&info); err != nil {
 		return err
 	}
 	t.metadataBytes = b
 	t.metadataCompletedChunks = nil
+	t.metadataChunkSources = nil
 	t.onSetInfo()
 	return nil
 }
 
+// Whether the torrent is private per BEP 27. Private torrents only obtain peers from trackers, and
+// don't use the DHT or PEX.
+func (t *Torrent) private() bool {
+	return t.haveInfo() && t.info.IsPrivate()
+}
+
 func (t *Torrent) haveAllMetadataPieces() bool {
 	if t.haveInfo() {
 		return true
@@ -452,20 +633,58 @@ func (t *Torrent) haveAllMetadataPieces() bool {
 	return true
 }
 
+func (t *Torrent) maxMetadataSize() int {
+	if max := t.cl.config.MaxMetadataSize; max > 0 {
+		return max
+	}
+	return defaultMaxMetadataSize
+}
+
+// Checks the info against ClientConfig.MaxPieces and ClientConfig.MaxTorrentSize.
+func (t *Torrent) checkInfoLimits(info *metainfo.Info) error {
+	maxPieces := t.cl.config.MaxPieces
+	if maxPieces <= 0 {
+		maxPieces = defaultMaxPieces
+	}
+	if n := info.NumPieces(); n > maxPieces {
+		return fmt.Errorf("%d pieces exceeds maximum of %d", n, maxPieces)
+	}
+	maxSize := t.cl.config.MaxTorrentSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxTorrentSize
+	}
+	// Summed so that huge file lengths can't overflow past the check.
+	var size int64
+	for _, fi := range info.UpvertedFiles() {
+		if fi.Length < 0 {
+			return errors.New("negative file length")
+		}
+		if fi.Length > maxSize-size {
+			return fmt.Errorf("length exceeds maximum of %d", maxSize)
+		}
+		size += fi.Length
+	}
+	return nil
+}
+
 // TODO: Propagate errors to disconnect peer.
 func (t *Torrent) setMetadataSize(bytes int) (err error) {
 	if t.haveInfo() {
 		// We already know the correct metadata size.
 		return
 	}
-	if bytes <= 0 || bytes > 10000000 { // 10MB, pulled from my ass.
+	if bytes <= 0 {
 		return errors.New("bad size")
 	}
+	if max := t.maxMetadataSize(); bytes > max {
+		return fmt.Errorf("exceeds maximum of %d", max)
+	}
 	if t.metadataBytes != nil && len(t.metadataBytes) == int(bytes) {
 		return
 	}
 	t.metadataBytes = make([]byte, bytes)
 	t.metadataCompletedChunks = make([]bool, (bytes+(1<<14)-1)/(1<<14))
+	t.metadataChunkSources = make([]*PeerConn, len(t.metadataCompletedChunks))
 	t.metadataChanged.Broadcast()
 	for c := range t.conns {
 		c.requestPendingMetadata()
@@ -478,12 +697,32 @@ func (t *Torrent) setMetadataSize(bytes int) (err error) {
 func (t *Torrent) name() string {
 	t.nameMu.RLock()
 	defer t.nameMu.RUnlock()
+	return t.nameLocked()
+}
+
+// nameMu must be held.
+func (t *Torrent) nameLocked() string {
 	if t.haveInfo() {
 		return t.info.Name
 	}
 	return t.displayName
 }
 
+// Sends the name to the channels from SubscribeName if it's changed from old. nameMu must be held.
+func (t *Torrent) publishNameChange(old string) {
+	name := t.nameLocked()
+	if name == old {
+		return
+	}
+	for ch := range t.nameSubs {
+		select {
+		case ch <- name:
+		default:
+			torrent.Add("name changes dropped", 1)
+		}
+	}
+}
+
 func (t *Torrent) pieceState(index pieceIndex) (ret PieceState) {
 	p := &t.pieces[index]
 	ret.Priority = t.piecePriority(index)
@@ -493,6 +732,8 @@ func (t *Torrent) pieceState(index pieceIndex) (ret PieceState) {
 	}
 	if !ret.Complete && t.piecePartiallyDownloaded(index) {
 		ret.Partial = true
+		ret.NumChunks = int(p.numChunks())
+		ret.NumChunksReceived = int(p.numDirtyChunks())
 	}
 	return
 }
@@ -645,6 +886,9 @@ func (t *Torrent) newMetaInfo() metainfo.MetaInfo {
 		Comment:      "dynamic metainfo from client",
 		CreatedBy:    "go.torrent",
 		AnnounceList: t.metainfo.UpvertedAnnounceList().Clone(),
+		UrlList:      append([]string(nil), t.metainfo.UrlList...),
+		HttpSeeds:    append([]string(nil), t.metainfo.HttpSeeds...),
+		Nodes:        append([]metainfo.Node(nil), t.metainfo.Nodes...),
 		InfoBytes: func() []byte {
 			if t.haveInfo() {
 				return t.metadataBytes
@@ -674,13 +918,29 @@ func (t *Torrent) bytesLeft() (left int64) {
 	return
 }
 
-// Bytes left to give in tracker announces.
+// Bytes left to give in tracker announces. Only the pieces we want count, so a partial seed that
+// has completed the files it wants reports none left. If nothing is wanted, the whole torrent
+// counts, so that we aren't mistaken for a seed.
 func (t *Torrent) bytesLeftAnnounce() int64 {
-	if t.haveInfo() {
-		return t.bytesLeft()
-	} else {
+	if !t.haveInfo() {
 		return -1
 	}
+	var left int64
+	anyWanted := false
+	for i := range t.pieces {
+		p := &t.pieces[i]
+		if p.requestedPriority() == PiecePriorityNone {
+			continue
+		}
+		anyWanted = true
+		if !t.pieceComplete(pieceIndex(i)) {
+			left += int64(p.length() - p.numDirtyBytes())
+		}
+	}
+	if !anyWanted {
+		return t.bytesLeft()
+	}
+	return left
 }
 
 func (t *Torrent) piecePartiallyDownloaded(piece pieceIndex) bool {
@@ -707,18 +967,57 @@ func (t *Torrent) numPiecesCompleted() (num int) {
 
 func (t *Torrent) close() (err error) {
 	t.closed.Set()
+	if t.seedingGoalTimer != nil {
+		t.seedingGoalTimer.Stop()
+	}
+	if t.deferredPieceCheckTimer != nil {
+		t.deferredPieceCheckTimer.Stop()
+	}
+	if t.rechokeTimer != nil {
+		t.rechokeTimer.Stop()
+	}
+	if t.scrub.timer != nil {
+		t.scrub.timer.Stop()
+	}
+	if t.stallTimer != nil {
+		t.stallTimer.Stop()
+	}
+	if t.rateHistory.timer != nil {
+		t.rateHistory.timer.Stop()
+	}
+	if t.requestHoldTimer != nil {
+		t.requestHoldTimer.Stop()
+	}
+	if t.deadlineTimer != nil {
+		t.deadlineTimer.Stop()
+	}
 	t.tickleReaders()
+	t.tickleWebSeeds()
 	if t.storage != nil {
 		t.storageLock.Lock()
 		t.storage.Close()
 		t.storageLock.Unlock()
 	}
 	for conn := range t.conns {
-		conn.close()
+		conn.closeWithReason(ConnDropLocal)
 	}
 	t.pex.Reset()
 	t.cl.event.Broadcast()
 	t.pieceStateChanges.Close()
+	for ch := range t.pieceCompletedSubs {
+		close(ch)
+		delete(t.pieceCompletedSubs, ch)
+	}
+	for ch := range t.verificationSubs {
+		close(ch)
+		delete(t.verificationSubs, ch)
+	}
+	t.nameMu.Lock()
+	for ch := range t.nameSubs {
+		close(ch)
+		delete(t.nameSubs, ch)
+	}
+	t.nameMu.Unlock()
 	t.updateWantPeersEvent()
 	return
 }
@@ -735,7 +1034,7 @@ func (t *Torrent) offsetRequest(off int64) (req request, ok bool) {
 
 func (t *Torrent) writeChunk(piece int, begin int64, data []byte) (err error) {
 	defer perf.ScopeTimerErr(&err)()
-	n, err := t.pieces[piece].Storage().WriteAt(data, begin)
+	n, err := t.pieces[piece].writeStorage(data, begin)
 	if err == nil && n != len(data) {
 		err = io.ErrShortWrite
 	}
@@ -756,7 +1055,9 @@ func (t *Torrent) pieceNumChunks(piece pieceIndex) pp.Integer {
 }
 
 func (t *Torrent) pendAllChunkSpecs(pieceIndex pieceIndex) {
+	near := t.pieceNearComplete(pieceIndex)
 	t.pieces[pieceIndex]._dirtyChunks.Clear()
+	t.onPieceNearCompleteChanged(pieceIndex, near)
 }
 
 func (t *Torrent) pieceLength(piece pieceIndex) pp.Integer {
@@ -774,13 +1075,15 @@ func (t *Torrent) pieceLength(piece pieceIndex) pp.Integer {
 }
 
 func (t *Torrent) hashPiece(piece pieceIndex) (ret metainfo.Hash, copyErr error) {
-	hash := pieceHash.New()
 	p := t.piece(piece)
 	p.waitNoPendingWrites()
-	ip := t.info.Piece(int(piece))
-	pl := ip.Length()
-	_, copyErr = io.CopyN( // Return no error iff pl bytes are copied.
-		hash, io.NewSectionReader(t.pieces[piece].Storage(), 0, pl), pl)
+	return hashPieceData(pieceStorageReader{p}, t.info.Piece(int(piece)).Length())
+}
+
+// Hashes the length bytes of piece data read from r. Returns no error iff they're all read.
+func hashPieceData(r io.ReaderAt, length int64) (ret metainfo.Hash, copyErr error) {
+	hash := pieceHash.New()
+	_, copyErr = io.CopyN(hash, io.NewSectionReader(r, 0, length), length)
 	missinggo.CopyExact(&ret, hash.Sum(nil))
 	return
 }
@@ -858,7 +1161,7 @@ func (t *Torrent) worstBadConn() *PeerConn {
 		}
 		// If the connection is in the worst half of the established
 		// connection quota and is older than a minute.
-		if wcs.Len() >= (t.maxEstablishedConns+1)/2 {
+		if wcs.Len() >= (t.targetConns()+1)/2 {
 			// Give connections 1 minute to prove themselves.
 			if time.Since(c.completedHandshake) > time.Minute {
 				return c
@@ -901,6 +1204,7 @@ func (t *Torrent) pieceAllDirty(piece pieceIndex) bool {
 func (t *Torrent) readersChanged() {
 	t.updateReaderPieces()
 	t.updateAllPiecePriorities()
+	t.updateReaderDeadlines()
 }
 
 func (t *Torrent) updateReaderPieces() {
@@ -912,6 +1216,7 @@ func (t *Torrent) readerPosChanged(from, to pieceRange) {
 		return
 	}
 	t.updateReaderPieces()
+	t.updateReaderDeadlines()
 	// Order the ranges, high and low.
 	l, h := from, to
 	if l.begin > h.begin {
@@ -939,6 +1244,7 @@ func (t *Torrent) maybeNewConns() {
 
 func (t *Torrent) piecePriorityChanged(piece pieceIndex) {
 	// t.logger.Printf("piece %d priority changed", piece)
+	t.updateWantPeersEvent()
 	for c := range t.conns {
 		if c.updatePiecePriority(piece) {
 			// log.Print("conn piece priority changed")
@@ -947,6 +1253,7 @@ func (t *Torrent) piecePriorityChanged(piece pieceIndex) {
 	}
 	t.maybeNewConns()
 	t.publishPieceChange(piece)
+	t.tickleWebSeeds()
 }
 
 func (t *Torrent) updatePiecePriority(piece pieceIndex) {
@@ -1053,14 +1360,60 @@ func (t *Torrent) numReceivedConns() (ret int) {
 	return
 }
 
+// Whether the torrent is seeding and wants no data, and so uses the seeding connection limits.
+func (t *Torrent) seedingConservatively() bool {
+	return t.seeding() && !t.needData()
+}
+
+// Whether any of the connection limits for seeding torrents are set. Seeding torrents otherwise
+// connect as they do when downloading.
+func (cl *Client) seedingConnLimitsConfigured() bool {
+	return cl.config.SeedingEstablishedConnsPerTorrent > 0 || cl.config.SeedingHalfOpenConnsPerTorrent > 0
+}
+
+// The number of established connections the torrent aims for. See
+// ClientConfig.SeedingEstablishedConnsPerTorrent.
+func (t *Torrent) targetConns() int {
+	if t.seedingConservatively() {
+		if n := t.cl.config.SeedingEstablishedConnsPerTorrent; n > 0 && n < t.maxEstablishedConns {
+			return n
+		}
+	}
+	return t.maxEstablishedConns
+}
+
+// Returns the number of established connections the torrent currently aims for, which depends on
+// whether it's downloading or seeding.
+func (t *Torrent) TargetConns() int {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	return t.targetConns()
+}
+
+// The configured limit on half-open dials and connections warming up.
+func (t *Torrent) halfOpenLimit() int {
+	if n := t.cl.config.SeedingHalfOpenConnsPerTorrent; n > 0 && t.seedingConservatively() {
+		return n
+	}
+	return t.cl.config.HalfOpenConnsPerTorrent
+}
+
 func (t *Torrent) maxHalfOpen() int {
+	target := t.targetConns()
+	if outgoing, _, ok := t.connSlots(); ok {
+		return int(min(int64(outgoing-(len(t.conns)-t.numReceivedConns())), int64(t.halfOpenLimit())))
+	}
+	if t.seedingConservatively() && t.cl.seedingConnLimitsConfigured() {
+		// Only dial for half the target, leaving the rest for peers that connect to us.
+		return int(min(int64(target/2-t.numWarmConns()), int64(t.halfOpenLimit())))
+	}
 	// Note that if we somehow exceed the maximum established conns, we want
 	// the negative value to have an effect.
-	establishedHeadroom := int64(t.maxEstablishedConns - len(t.conns))
-	extraIncoming := int64(t.numReceivedConns() - t.maxEstablishedConns/2)
+	establishedHeadroom := int64(target - t.numWarmConns())
+	extraIncoming := int64(t.numReceivedConns() - target/2)
 	// We want to allow some experimentation with new peers, and to try to
 	// upset an oversupply of received connections.
-	return int(min(max(5, extraIncoming)+establishedHeadroom, int64(t.cl.config.HalfOpenConnsPerTorrent)))
+	return int(min(max(5, extraIncoming)+establishedHeadroom, int64(t.halfOpenLimit())))
 }
 
 func (t *Torrent) openNewConns() {
@@ -1069,10 +1422,10 @@ func (t *Torrent) openNewConns() {
 		if !t.wantConns() {
 			return
 		}
-		if len(t.halfOpen) >= t.maxHalfOpen() {
+		if len(t.halfOpen)+t.numWarmingUpConns >= t.maxHalfOpen() {
 			return
 		}
-		if len(t.cl.dialers) == 0 {
+		if len(t.peerDialers()) == 0 {
 			return
 		}
 		p := t.peers.PopMax()
@@ -1104,10 +1457,10 @@ func (t *Torrent) updatePieceCompletion(piece pieceIndex) bool {
 	p.storageCompletionOk = uncached.Ok
 	t._completedPieces.Set(bitmap.BitIndex(piece), complete)
 	if complete && len(p.dirtiers) != 0 {
-		t.logger.Printf("marked piece %v complete but still has dirtiers", piece)
+		t.subsystemLogger(LogSubsystemPiece).Printf("marked piece %v complete but still has dirtiers", piece)
 	}
 	if changed {
-		log.Fstr("piece %d completion changed: %+v -> %+v", piece, cached, uncached).SetLevel(log.Debug).Log(t.logger)
+		log.Fstr("piece %d completion changed: %+v -> %+v", piece, cached, uncached).SetLevel(log.Debug).Log(t.subsystemLogger(LogSubsystemPiece))
 		t.pieceCompletionChanged(piece)
 	}
 	return changed
@@ -1117,7 +1470,7 @@ func (t *Torrent) updatePieceCompletion(piece pieceIndex) bool {
 func (t *Torrent) readAt(b []byte, off int64) (n int, err error) {
 	p := &t.pieces[off/t.info.PieceLength]
 	p.waitNoPendingWrites()
-	return p.Storage().ReadAt(b, off-p.Info().Offset())
+	return pieceStorageReader{p}.ReadAt(b, off-p.Info().Offset())
 }
 
 // Returns an error if the metadata was completed, but couldn't be set for
@@ -1133,6 +1486,9 @@ func (t *Torrent) maybeCompleteMetadata() error {
 	}
 	err := t.setInfoBytes(t.metadataBytes)
 	if err != nil {
+		if err == errInfoHashMismatch {
+			t.onMetadataHashMismatch()
+		}
 		t.invalidateMetadata()
 		return fmt.Errorf("error setting info bytes: %s", err)
 	}
@@ -1142,6 +1498,39 @@ func (t *Torrent) maybeCompleteMetadata() error {
 	return nil
 }
 
+// Metadata assembled from pieces received from peers that didn't hash to the torrent's infohash.
+type MetadataRejection struct {
+	// The remote addresses of the peers that supplied pieces of the metadata. At least one of them
+	// sent bad data.
+	Peers []net.Addr
+}
+
+func (t *Torrent) onMetadataHashMismatch() {
+	torrent.Add("metadata hash mismatches", 1)
+	t.metadataHashMismatches++
+	if t.userOnMetadataRejected == nil {
+		return
+	}
+	var mr MetadataRejection
+	seen := make(map[*PeerConn]struct{})
+	for _, c := range t.metadataChunkSources {
+		if _, ok := seen[c]; ok || c == nil {
+			continue
+		}
+		seen[c] = struct{}{}
+		mr.Peers = append(mr.Peers, c.remoteAddr)
+	}
+	go t.userOnMetadataRejected(mr)
+}
+
+// Sets a function to be called when metadata received from peers is discarded because it doesn't
+// match the infohash. The metadata is requested again afterwards.
+func (t *Torrent) SetOnMetadataRejected(f func(MetadataRejection)) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.userOnMetadataRejected = f
+}
+
 func (t *Torrent) readerPiecePriorities() (now, readahead bitmap.Bitmap) {
 	t.forReaderOffsetPieces(func(begin, end pieceIndex) bool {
 		if end > begin {
@@ -1160,6 +1549,9 @@ func (t *Torrent) needData() bool {
 	if !t.haveInfo() {
 		return true
 	}
+	if t.seedOnly {
+		return false
+	}
 	return t._pendingPieces.Len() != 0
 }
 
@@ -1195,12 +1587,98 @@ func (t *Torrent) addTrackers(announceList [][]string) {
 	t.updateWantPeersEvent()
 }
 
+// Removes the tracker URL from the torrent's metainfo, and stops announcing to it. UDP trackers are
+// announced to over both IPv4 and IPv6, which are both stopped.
+func (t *Torrent) removeTracker(_url string) (found bool) {
+	if t.metainfo.Announce == _url {
+		t.metainfo.Announce = ""
+		found = true
+	}
+	var announceList metainfo.AnnounceList
+	for _, tier := range t.metainfo.AnnounceList {
+		var kept []string
+		for _, u := range tier {
+			if u == _url {
+				found = true
+				continue
+			}
+			kept = append(kept, u)
+		}
+		if len(kept) != 0 {
+			announceList = append(announceList, kept)
+		}
+	}
+	t.metainfo.AnnounceList = announceList
+	keys := []string{_url}
+	if u, err := url.Parse(_url); err == nil && u.Scheme == "udp" {
+		for _, scheme := range []string{"udp4", "udp6"} {
+			u.Scheme = scheme
+			keys = append(keys, u.String())
+		}
+	}
+	for _, k := range keys {
+		ta, ok := t.trackerAnnouncers[k]
+		if !ok {
+			continue
+		}
+		found = true
+		delete(t.trackerAnnouncers, k)
+		switch ta := ta.(type) {
+		case *trackerScraper:
+			ta.remove()
+		case websocketTracker:
+			ta.Close()
+		}
+	}
+	t.updateWantPeersEvent()
+	return
+}
+
+// Adds DHT nodes suggested for the torrent, and keeps them for its metainfo. They aren't used if
+// the torrent doesn't use the DHT.
+func (t *Torrent) addDhtNodes(nodes []string) {
+	var added []string
+	for _, n := range nodes {
+		if t.hasDhtNode(n) {
+			continue
+		}
+		t.metainfo.Nodes = append(t.metainfo.Nodes, metainfo.Node(n))
+		added = append(added, n)
+	}
+	if len(added) == 0 || t.private() || t.dialers != nil {
+		return
+	}
+	t.cl.AddDHTNodes(added)
+}
+
+func (t *Torrent) hasDhtNode(n string) bool {
+	for _, have := range t.metainfo.Nodes {
+		if string(have) == n {
+			return true
+		}
+	}
+	return false
+}
+
 // Don't call this before the info is available.
-func (t *Torrent) bytesCompleted() int64 {
+func (t *Torrent) bytesCompleted() (ret int64) {
+	t._completedPieces.IterTyped(func(piece int) bool {
+		ret += int64(t.pieces[piece].length())
+		return true
+	})
+	return
+}
+
+// Dirty bytes of incomplete pieces.
+func (t *Torrent) bytesPending() (ret int64) {
 	if !t.haveInfo() {
-		return 0
+		return
 	}
-	return t.info.TotalLength() - t.bytesLeft()
+	bitmap.Flip(t._completedPieces, 0, bitmap.BitIndex(t.numPieces())).IterTyped(func(piece int) bool {
+		ret += int64(t.pieces[piece].numDirtyBytes())
+		return true
+	})
+	return
 }
 
 func (t *Torrent) SetInfoBytes(b []byte) (err error) {
@@ -1218,6 +1696,13 @@ func (t *Torrent) deleteConnection(c *PeerConn) (ret bool) {
 	}
 	_, ret = t.conns[c]
 	delete(t.conns, c)
+	if ret {
+		t.endConnWarmUp(c)
+		if !c.peerChoking {
+			t.numUnchokingConns--
+		}
+		c.setAvailabilityCounted(false)
+	}
 	if !t.cl.config.DisablePEX {
 		t.pex.Drop(c)
 	}
@@ -1226,6 +1711,16 @@ func (t *Torrent) deleteConnection(c *PeerConn) (ret bool) {
 	if len(t.conns) == 0 {
 		t.assertNoPendingRequests()
 	}
+	if ret {
+		t.allPieceAvailabilityChanged()
+		t.tickleWebSeeds()
+		t.cl.onPeerConnClosedReputation(c)
+		t.onConnDropped(c)
+		if len(t.conns) == 0 {
+			// The torrent had peers until now.
+			t.onPeerSourceActivity()
+		}
+	}
 	return
 }
 
@@ -1250,6 +1745,9 @@ func (t *Torrent) wantPeers() bool {
 	if t.closed.IsSet() {
 		return false
 	}
+	if t.paused.IsSet() {
+		return false
+	}
 	if t.peers.Len() > t.cl.config.TorrentPeersLowWater {
 		return false
 	}
@@ -1258,12 +1756,24 @@ func (t *Torrent) wantPeers() bool {
 
 func (t *Torrent) updateWantPeersEvent() {
 	if t.wantPeers() {
-		t.wantPeersEvent.Set()
+		if t.wantPeersEvent.Set() {
+			// Wake tracker announcers waiting for the torrent to stop being idle.
+			t.cl.event.Broadcast()
+		}
 	} else {
 		t.wantPeersEvent.Clear()
 	}
 }
 
+// Whether the torrent wants no data and has none to seed, so there's no point joining the swarm
+// yet. Only applies with ClientConfig.DelayIdleTrackerAnnounces.
+func (t *Torrent) announceIdle() bool {
+	if !t.cl.config.DelayIdleTrackerAnnounces || !t.haveInfo() || t.needData() {
+		return false
+	}
+	return !t.seeding() || t.numPiecesCompleted() == 0
+}
+
 // Returns whether the client should make effort to seed the torrent.
 func (t *Torrent) seeding() bool {
 	cl := t.cl
@@ -1318,7 +1828,7 @@ func (t *Torrent) startScrapingTracker(_url string) {
 		// URLs with a leading '*' appear to be a uTorrent convention to
 		// disable trackers.
 		if _url[0] != '*' {
-			log.Str("error parsing tracker url").AddValues("url", _url).Log(t.logger)
+			log.Str("error parsing tracker url").AddValues("url", _url).Log(t.subsystemLogger(LogSubsystemTracker))
 		}
 		return
 	}
@@ -1336,24 +1846,24 @@ func (t *Torrent) startScrapingTracker(_url string) {
 		switch u.Scheme {
 		case "ws", "wss":
 			wst := websocketTracker{*u, webtorrent.NewTrackerClient(t.cl.peerID, t.infoHash, t.onWebRtcConn,
-				t.logger.WithText(func(m log.Msg) string {
+				t.subsystemLogger(LogSubsystemTracker).WithText(func(m log.Msg) string {
 					return fmt.Sprintf("%q: %v", u.String(), m.Text())
 				}).WithDefaultLevel(log.Debug))}
 			ar := t.announceRequest(tracker.Started)
 			go func() {
 				err := wst.TrackerClient.Run(ar, u.String())
 				if err != nil {
-					t.logger.WithDefaultLevel(log.Error).Printf(
+					t.subsystemLogger(LogSubsystemTracker).WithDefaultLevel(log.Error).Printf(
 						"error running websocket tracker announcer for %q: %v",
 						u.String(), err)
 				}
 			}()
 			return wst
 		}
-		if u.Scheme == "udp4" && (t.cl.config.DisableIPv4Peers || t.cl.config.DisableIPv4) {
+		if u.Scheme == "udp4" && (t.cl.config.DisableIPv4Peers || !ipv4Enabled(t.cl.config)) {
 			return nil
 		}
-		if u.Scheme == "udp6" && t.cl.config.DisableIPv6 {
+		if u.Scheme == "udp6" && !ipv6Enabled(t.cl.config) {
 			return nil
 		}
 		newAnnouncer := &trackerScraper{
@@ -1372,7 +1882,7 @@ func (t *Torrent) startScrapingTracker(_url string) {
 // Adds and starts tracker scrapers for tracker URLs that aren't already
 // running.
 func (t *Torrent) startMissingTrackerScrapers() {
-	if t.cl.config.DisableTrackers {
+	if t.cl.config.DisableTrackers || t.cl.config.DisableNetwork {
 		return
 	}
 	t.startScrapingTracker(t.metainfo.Announce)
@@ -1388,11 +1898,11 @@ func (t *Torrent) startMissingTrackerScrapers() {
 func (t *Torrent) announceRequest(event tracker.AnnounceEvent) tracker.AnnounceRequest {
 	// Note that IPAddress is not set. It's set for UDP inside the tracker code, since it's
 	// dependent on the network in use.
-	return tracker.AnnounceRequest{
+	req := tracker.AnnounceRequest{
 		Event: event,
 		NumWant: func() int32 {
-			if t.wantPeers() && len(t.cl.dialers) > 0 {
-				return -1
+			if t.wantPeers() && len(t.peerDialers()) > 0 {
+				return t.announceNumWant()
 			} else {
 				return 0
 			}
@@ -1401,7 +1911,38 @@ func (t *Torrent) announceRequest(event tracker.AnnounceEvent) tracker.AnnounceR
 		PeerId:   t.cl.peerID,
 		InfoHash: t.infoHash,
 		Key:      t.cl.announceKey(),
+	}
+	ab := t.announceBytes()
+	req.Left = ab.Left
+	req.Uploaded = ab.Uploaded
+	req.Downloaded = ab.Downloaded
+	return req
+}
+
+// The number of peers to ask trackers for when we want peers. See ClientConfig.TrackerNumWantMax.
+func (t *Torrent) announceNumWant() int32 {
+	max := t.cl.config.TrackerNumWantMax
+	if max <= 0 {
+		return -1
+	}
+	min := t.cl.config.TrackerNumWantMin
+	if min > max {
+		min = max
+	}
+	target := t.targetConns()
+	if target <= 0 {
+		return int32(min)
+	}
+	conns := len(t.conns)
+	if conns > target {
+		conns = target
+	}
+	return int32(max - (max-min)*conns/target)
+}
 
+// The byte counts to give in an announce, per the Client's AnnounceBytesReporting.
+func (t *Torrent) announceBytes() AnnounceBytes {
+	actual := AnnounceBytes{
 		// The following are vaguely described in BEP 3.
 
 		Left:     t.bytesLeftAnnounce(),
@@ -1409,6 +1950,15 @@ func (t *Torrent) announceRequest(event tracker.AnnounceEvent) tracker.AnnounceR
 		// There's no mention of wasted or unwanted download in the BEP.
 		Downloaded: t.stats.BytesReadUsefulData.Int64(),
 	}
+	switch t.cl.config.AnnounceBytesReporting {
+	case AnnounceBytesReportingZeroed:
+		return AnnounceBytes{Left: actual.Left}
+	case AnnounceBytesReportingCustom:
+		if f := t.cl.config.AnnounceBytesReporter; f != nil {
+			return f(t.infoHash, actual)
+		}
+	}
+	return actual
 }
 
 // Adds peers revealed in an announce until the announce ends, or we have
@@ -1417,6 +1967,9 @@ func (t *Torrent) consumeDhtAnnouncePeers(pvs <-chan dht.PeersValues) {
 	cl := t.cl
 	for v := range pvs {
 		cl.lock()
+		if len(v.Peers) != 0 {
+			t.onPeerSourceActivity()
+		}
 		for _, cp := range v.Peers {
 			if cp.Port == 0 {
 				// Can't do anything with this.
@@ -1445,16 +1998,78 @@ func (t *Torrent) announceToDht(impliedPort bool, s DhtServer) error {
 	return nil
 }
 
+// Waits until the next announce to the DHT server is due, per ClientConfig.DhtAnnounceInterval and
+// ClientConfig.DhtAnnounceRateLimiter. last is when the previous announce started, and is zero for
+// the first. Returns false if the torrent is closed. The Client lock is released while waiting.
+func (t *Torrent) waitDhtAnnounceDue(s DhtServer, last time.Time) bool {
+	cl := t.cl
+	// Torrents announcing for the first time that need data shouldn't wait behind the rest.
+	urgent := last.IsZero() && t.needData()
+	due := time.Now()
+	if interval := cl.config.DhtAnnounceInterval; interval > 0 && !last.IsZero() {
+		if next := last.Add(interval + time.Duration(rand.Int63n(int64(interval)/10+1))); next.After(due) {
+			due = next
+		}
+	}
+	var reservation *rate.Reservation
+	if l := cl.config.DhtAnnounceRateLimiter; l != nil && !urgent {
+		reservation = l.ReserveN(due, 1)
+		if reservation.OK() {
+			due = due.Add(reservation.DelayFrom(due))
+		}
+	}
+	if t.nextDhtAnnounces == nil {
+		t.nextDhtAnnounces = make(map[DhtServer]time.Time)
+	}
+	t.nextDhtAnnounces[s] = due
+	defer delete(t.nextDhtAnnounces, s)
+	closed := t.closed.C()
+	cl.unlock()
+	defer cl.lock()
+	select {
+	case <-closed:
+		if reservation != nil {
+			reservation.Cancel()
+		}
+		return false
+	case <-time.After(time.Until(due)):
+		return true
+	}
+}
+
+// The torrent's own dialers for peer connections, from TorrentSpec.Dialers or PeerLocalIp. Nil if
+// it uses the Client's.
+func (t *Torrent) ownPeerDialers() []Dialer {
+	if t.dialers != nil {
+		return t.dialers
+	}
+	if t.localIpDialer != nil {
+		return []Dialer{t.localIpDialer}
+	}
+	return nil
+}
+
+// The dialers used for the torrent's peer connections.
+func (t *Torrent) peerDialers() []Dialer {
+	if ds := t.ownPeerDialers(); ds != nil {
+		return ds
+	}
+	return t.cl.dialers
+}
+
 func (t *Torrent) dhtAnnouncer(s DhtServer) {
 	cl := t.cl
 	cl.lock()
 	defer cl.unlock()
+	var last time.Time
 	for {
 		for {
 			if t.closed.IsSet() {
 				return
 			}
-			if !t.wantPeers() {
+			// DHT traffic goes through the Client's sockets, so it would reveal torrents that have
+			// their own dialers.
+			if !t.wantPeers() || t.private() || t.dialers != nil {
 				goto wait
 			}
 			// TODO: Determine if there's a listener on the port we're announcing.
@@ -1465,15 +2080,28 @@ func (t *Torrent) dhtAnnouncer(s DhtServer) {
 		wait:
 			cl.event.Wait()
 		}
+		if !t.waitDhtAnnounceDue(s, last) {
+			return
+		}
+		if !t.wantPeers() {
+			continue
+		}
+		if !cl.acquireDiscoverySlot(t) {
+			return
+		}
+		last = time.Now()
 		func() {
 			t.numDHTAnnounces++
+			cl.activeDhtAnnounces++
 			cl.unlock()
 			defer cl.lock()
 			err := t.announceToDht(true, s)
 			if err != nil {
-				t.logger.WithDefaultLevel(log.Warning).Printf("error announcing %q to DHT: %s", t, err)
+				t.subsystemLogger(LogSubsystemDht).WithDefaultLevel(log.Warning).Printf("error announcing %q to DHT: %s", t, err)
 			}
 		}()
+		cl.activeDhtAnnounces--
+		cl.releaseDiscoverySlot()
 	}
 }
 
@@ -1497,6 +2125,7 @@ func (t *Torrent) Stats() TorrentStats {
 func (t *Torrent) statsLocked() (ret TorrentStats) {
 	ret.ActivePeers = len(t.conns)
 	ret.HalfOpenPeers = len(t.halfOpen)
+	ret.WarmingUpPeers = t.numWarmingUpConns
 	ret.PendingPeers = t.peers.Len()
 	ret.TotalPeers = t.numTotalPeers()
 	ret.ConnectedSeeders = 0
@@ -1505,6 +2134,27 @@ func (t *Torrent) statsLocked() (ret TorrentStats) {
 			ret.ConnectedSeeders++
 		}
 	}
+	ret.DuplicateConnsDropped = t.duplicateConnsDropped
+	ret.MetadataHashMismatches = t.metadataHashMismatches
+	ret.NewcomerUploadSlots, ret.EstablishedUploadSlots = t.uploadSlotsInUse()
+	if t.rechokeTimer != nil {
+		ret.RechokeInterval = t.rechokeInterval()
+	}
+	ret.UploadShare = t.uploadShare()
+	ret.ConnsEstablished = t.connChurn.established
+	ret.IncomingConns = t.numReceivedConns()
+	ret.OutgoingConns = len(t.conns) - ret.IncomingConns
+	ret.OutgoingConnSlots, ret.IncomingConnSlots, _ = t.connSlots()
+	ret.ScrubProgress = t.scrubProgress()
+	ret.LastScrubCompleted = t.scrub.lastPassCompleted
+	ret.ScrubFailedPieces = t.scrub.failed
+	ret.WebSeedBytesRead = t.webSeedBytesRead
+	ret.PeerBytesRead = t.stats.BytesReadUsefulData.Int64() - t.webSeedBytesRead
+	ret.ConnDrops = t.connChurn.dropsMap()
+	ret.ConnFailures = make(map[ConnFailureReason]int, len(t.connFailures))
+	for r, n := range t.connFailures {
+		ret.ConnFailures[r] = n
+	}
 	ret.ConnStats = t.stats.Copy()
 	return
 }
@@ -1551,11 +2201,19 @@ func (t *Torrent) addConnection(c *PeerConn) (err error) {
 	defer func() {
 		if err == nil {
 			torrent.Add("added connections", 1)
+			t.onConnEstablished()
+			t.onPeerSourceActivity()
 		}
 	}()
 	if t.closed.IsSet() {
 		return errors.New("torrent closed")
 	}
+	if t.paused.IsSet() {
+		return errors.New("torrent paused")
+	}
+	if !t.networkingEnabled {
+		return errors.New("torrent transfer disabled")
+	}
 	for c0 := range t.conns {
 		if c.PeerID != c0.PeerID {
 			continue
@@ -1563,25 +2221,42 @@ func (t *Torrent) addConnection(c *PeerConn) (err error) {
 		if !t.cl.config.DropDuplicatePeerIds {
 			continue
 		}
+		t.duplicateConnsDropped++
+		torrent.Add("duplicate connections dropped", 1)
 		if left, ok := c.hasPreferredNetworkOver(c0); ok && left {
-			c0.close()
+			c0.closeWithReason(ConnDropDuplicate)
 			t.deleteConnection(c0)
 		} else {
 			return errors.New("existing connection preferred")
 		}
 	}
-	if len(t.conns) >= t.maxEstablishedConns {
+	if !t.haveConnSlot(c.Discovery == PeerSourceIncoming) {
+		return errors.New("no slots for connections in this direction")
+	}
+	if t.cl.config.ConnWarmUpTimeout > 0 {
+		// The connection doesn't count toward the established limit until it's warmed up, which
+		// is when a connection is dropped if there are too many.
+		if t.numWarmingUpConns >= t.halfOpenLimit() {
+			return errors.New("too many connections warming up")
+		}
+	} else if t.numWarmConns() >= t.targetConns() {
 		c := t.worstBadConn()
 		if c == nil {
 			return errors.New("don't want conns")
 		}
-		c.close()
+		c.closeWithReason(ConnDropOverLimit)
 		t.deleteConnection(c)
 	}
-	if len(t.conns) >= t.maxEstablishedConns {
-		panic(len(t.conns))
-	}
 	t.conns[c] = struct{}{}
+	if !c.peerChoking {
+		t.numUnchokingConns++
+	}
+	c.setAvailabilityCounted(true)
+	t.startConnWarmUp(c)
+	t.startRechokeTimer()
+	t.checkRequestHold()
+	// Wake Torrent.WaitForPeers.
+	t.cl.event.Broadcast()
 	if !t.cl.config.DisablePEX && !c.PeerExtensionBytes.SupportsExtended() {
 		t.pex.Add(c) // as no further extended handshake expected
 	}
@@ -1595,10 +2270,13 @@ func (t *Torrent) wantConns() bool {
 	if t.closed.IsSet() {
 		return false
 	}
+	if t.paused.IsSet() {
+		return false
+	}
 	if !t.seeding() && !t.needData() {
 		return false
 	}
-	if len(t.conns) < t.maxEstablishedConns {
+	if t.numWarmConns() < t.targetConns() {
 		return true
 	}
 	return t.worstBadConn() != nil
@@ -1611,27 +2289,35 @@ func (t *Torrent) SetMaxEstablishedConns(max int) (oldMax int) {
 	t.maxEstablishedConns = max
 	wcs := slices.HeapInterface(slices.FromMapKeys(t.conns), worseConn)
 	for len(t.conns) > t.maxEstablishedConns && wcs.Len() > 0 {
-		t.dropConnection(wcs.Pop().(*PeerConn))
+		t.dropConnectionWithReason(wcs.Pop().(*PeerConn), ConnDropOverLimit)
 	}
 	t.openNewConns()
 	return oldMax
 }
 
 func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
-	t.logger.Log(log.Fstr("hashed piece %d (passed=%t)", piece, passed).SetLevel(log.Debug))
+	t.subsystemLogger(LogSubsystemPiece).Log(log.Fstr("hashed piece %d (passed=%t)", piece, passed).SetLevel(log.Debug))
 	p := t.piece(piece)
 	p.numVerifies++
 	t.cl.event.Broadcast()
 	if t.closed.IsSet() {
 		return
 	}
+	t.onScrubPieceHashed(piece, passed)
+
+	if ws := p.webSeedWritten; ws != nil {
+		p.webSeedWritten = nil
+		if !passed {
+			ws.onBadPiece(piece)
+		}
+	}
 
 	// Don't score the first time a piece is hashed, it could be an initial check.
 	if p.storageCompletionOk {
 		if passed {
 			pieceHashedCorrect.Add(1)
 		} else {
-			log.Fmsg("piece %d failed hash: %d connections contributed", piece, len(p.dirtiers)).AddValues(t, p).Log(t.logger)
+			log.Fmsg("piece %d failed hash: %d connections contributed", piece, len(p.dirtiers)).AddValues(t, p).Log(t.subsystemLogger(LogSubsystemPiece))
 			pieceHashedNotCorrect.Add(1)
 		}
 	}
@@ -1643,13 +2329,17 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 		}
 		for c := range p.dirtiers {
 			c._stats.incrementPiecesDirtiedGood()
+			t.cl.adjustPeerReputation(c.remoteIp(), reputationGoodPiece, reputationMin)
 		}
 		t.clearPieceTouchers(piece)
 		err := p.Storage().MarkComplete()
 		if err != nil {
-			t.logger.Printf("%T: error marking piece complete %d: %s", t.storage, piece, err)
+			t.subsystemLogger(LogSubsystemStorage).Printf("%T: error marking piece complete %d: %s", t.storage, piece, err)
 		}
 		t.pendAllChunkSpecs(piece)
+		if err == nil {
+			t.clearPieceJournal(piece)
+		}
 	} else {
 		if len(p.dirtiers) != 0 && p.allChunksDirty() && hashIoErr == nil {
 			// Peers contributed to all the data for this piece hash failure, and the failure was
@@ -1657,10 +2347,15 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 
 			// Increment Torrent and above stats, and then specific connections.
 			t.allStats((*ConnStats).incrementPiecesDirtiedBad)
+			// Which connections contributed what isn't tracked, so the wasted data is only counted
+			// above them.
+			t.allStats(add(int64(p.numDirtyBytes()), func(cs *ConnStats) *Count { return &cs.BytesReadWastedData }))
+			t.corruptBytes += int64(p.numDirtyBytes())
 			for c := range p.dirtiers {
 				// Y u do dis peer?!
 				c.stats().incrementPiecesDirtiedBad()
 			}
+			t.cl.onBadPieceReputation(p.dirtiers)
 
 			bannableTouchers := make([]*PeerConn, 0, len(p.dirtiers))
 			for c := range p.dirtiers {
@@ -1687,13 +2382,59 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 			if len(bannableTouchers) >= 1 {
 				c := bannableTouchers[0]
 				t.cl.banPeerIP(c.remoteIp())
-				c.drop()
+				t.dropConnectionWithReason(c, ConnDropBadData)
 			}
 		}
 		t.onIncompletePiece(piece)
 		p.Storage().MarkNotComplete()
+		t.clearPieceJournal(piece)
 	}
 	t.updatePieceCompletion(piece)
+	t.updateStorageWindow()
+	t.tickleWebSeeds()
+}
+
+// Updates the pieces that can be downloaded, for storage that implements storage.PieceWindower.
+func (t *Torrent) updateStorageWindow() {
+	if t.storage == nil || !t.haveInfo() {
+		return
+	}
+	w, ok := t.storage.TorrentImpl.(storage.PieceWindower)
+	if !ok {
+		return
+	}
+	var window pieceRange
+	window.begin, window.end = w.PieceWindow()
+	if t.hasStorageWindow && window == t.storageWindow {
+		return
+	}
+	old, hadWindow := t.storageWindow, t.hasStorageWindow
+	t.storageWindow = window
+	t.hasStorageWindow = true
+	if !hadWindow {
+		t.updateAllPiecePriorities()
+		return
+	}
+	t.updatePiecePriorities(pieceIndex(min(int64(old.begin), int64(window.begin))), pieceIndex(max(int64(old.end), int64(window.end))))
+}
+
+// Called by storage that implements storage.PieceWindowNotifier, without the client lock.
+func (t *Torrent) onStorageWindowChanged(err error) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	if t.closed.IsSet() {
+		return
+	}
+	if err != nil {
+		t.subsystemLogger(LogSubsystemStorage).Printf("%T: %s", t.storage, err)
+		var sinkErr *storage.SinkWriteError
+		if errors.As(err, &sinkErr) {
+			// The data can't be passed on, so stop getting more until the user intervenes.
+			t.pause()
+		}
+		return
+	}
+	t.updateStorageWindow()
 }
 
 func (t *Torrent) cancelRequestsForPiece(piece pieceIndex) {
@@ -1703,12 +2444,68 @@ func (t *Torrent) cancelRequestsForPiece(piece pieceIndex) {
 	}
 }
 
+// Cancels requests for pieces in the range that are no longer wanted.
+func (t *Torrent) cancelUnwantedRequests(begin, end pieceIndex) {
+	for c := range t.conns {
+		for r := range c.requests {
+			piece := pieceIndex(r.Index)
+			if piece >= begin && piece < end && t.piece(piece).requestedPriority() == PiecePriorityNone {
+				c.postCancel(r)
+			}
+		}
+	}
+}
+
+// Releases the piece's data from storage, and forgets the chunks we've written for it.
+func (t *Torrent) discardPiece(piece pieceIndex) error {
+	err := t.piece(piece).Storage().Discard()
+	t.pendAllChunkSpecs(piece)
+	t.updatePieceCompletion(piece)
+	return err
+}
+
+func (t *Torrent) invalidatePiece(piece pieceIndex) error {
+	p := t.piece(piece)
+	// A verification that read the old data could otherwise mark the piece complete again.
+	for p.hashing && !t.closed.IsSet() {
+		t.cl.event.Wait()
+	}
+	for c := range t.conns {
+		for r := range c.peerRequests {
+			if pieceIndex(r.Index) != piece {
+				continue
+			}
+			if c.fastEnabled() {
+				c.reject(r)
+			} else {
+				delete(c.peerRequests, r)
+			}
+		}
+	}
+	return t.discardPiece(piece)
+}
+
 func (t *Torrent) onPieceCompleted(piece pieceIndex) {
+	t.clearPieceDeadlines(piece)
 	t.pendAllChunkSpecs(piece)
 	t.cancelRequestsForPiece(piece)
 	for conn := range t.conns {
 		conn.have(piece)
 	}
+	if t.seedingSince.IsZero() && t.haveAllPieces() {
+		t.seedingSince = time.Now()
+		t.updateSeedingGoalTimer()
+	}
+	if t.haveAllPieces() && t.stats.BytesReadUsefulData.Int64() != 0 {
+		t.downloadCompleted.Set()
+	}
+	for ch := range t.pieceCompletedSubs {
+		select {
+		case ch <- piece:
+		default:
+			torrent.Add("piece completed notifications dropped", 1)
+		}
+	}
 }
 
 // Called when a piece is found to be not complete.
@@ -1739,7 +2536,11 @@ func (t *Torrent) onIncompletePiece(piece pieceIndex) {
 }
 
 func (t *Torrent) tryCreateMorePieceHashers() {
-	for !t.closed.IsSet() && t.activePieceHashes < 2 && t.tryCreatePieceHasher() {
+	max := t.cl.config.PieceHashersPerTorrent
+	if max <= 0 {
+		max = defaultPieceHashersPerTorrent
+	}
+	for !t.closed.IsSet() && t.activePieceHashes < max && t.tryCreatePieceHasher() {
 	}
 }
 
@@ -1762,6 +2563,25 @@ func (t *Torrent) tryCreatePieceHasher() bool {
 	return true
 }
 
+// Sends progress to the channels from SubscribeVerification after a piece is hashed.
+func (t *Torrent) publishVerificationProgress(piece pieceIndex, passed bool) {
+	if len(t.verificationSubs) == 0 {
+		return
+	}
+	vp := VerificationProgress{
+		Piece:     piece,
+		Passed:    passed,
+		Remaining: t.piecesQueuedForHash.Len() + t.deferredPieceChecks.Len() + t.activePieceHashes,
+	}
+	for ch := range t.verificationSubs {
+		select {
+		case ch <- vp:
+		default:
+			torrent.Add("verification progress notifications dropped", 1)
+		}
+	}
+}
+
 func (t *Torrent) getPieceToHash() (ret pieceIndex, ok bool) {
 	t.piecesQueuedForHash.IterTyped(func(i pieceIndex) bool {
 		if t.piece(i).hashing {
@@ -1776,12 +2596,12 @@ func (t *Torrent) getPieceToHash() (ret pieceIndex, ok bool) {
 
 func (t *Torrent) pieceHasher(index pieceIndex) {
 	p := t.piece(index)
-	sum, copyErr := t.hashPiece(index)
+	sum, copyErr := t.hashPieceRetrying(index)
 	correct := sum == *p.hash
 	switch copyErr {
 	case nil, io.EOF:
 	default:
-		log.Fmsg("piece %v (%s) hash failure copy error: %v", p, p.hash.HexString(), copyErr).Log(t.logger)
+		log.Fmsg("piece %v (%s) hash failure copy error: %v", p, p.hash.HexString(), copyErr).Log(t.subsystemLogger(LogSubsystemPiece))
 	}
 	t.storageLock.RUnlock()
 	t.cl.lock()
@@ -1792,6 +2612,7 @@ func (t *Torrent) pieceHasher(index pieceIndex) {
 	t.publishPieceChange(index)
 	t.activePieceHashes--
 	t.tryCreateMorePieceHashers()
+	t.publishVerificationProgress(index, correct)
 }
 
 // Return the connections that touched a piece, and clear the entries while doing it.
@@ -1811,13 +2632,67 @@ func (t *Torrent) connsAsSlice() (ret []*PeerConn) {
 }
 
 func (t *Torrent) queuePieceCheck(pieceIndex pieceIndex) {
-	piece := t.piece(pieceIndex)
-	if piece.queuedForHash() {
-		return
+	if t.queuePieceCheckNoHash(pieceIndex) {
+		t.tryCreateMorePieceHashers()
+	}
+}
+
+// A deferred check is moved to the hash queue.
+func (t *Torrent) queuePieceCheckNoHash(pieceIndex pieceIndex) bool {
+	if t.piecesQueuedForHash.Get(bitmap.BitIndex(pieceIndex)) {
+		return false
 	}
+	deferred := t.deferredPieceChecks.Get(bitmap.BitIndex(pieceIndex))
+	t.deferredPieceChecks.Remove(bitmap.BitIndex(pieceIndex))
 	t.piecesQueuedForHash.Add(bitmap.BitIndex(pieceIndex))
+	if !deferred {
+		t.publishPieceChange(pieceIndex)
+		t.updatePiecePriority(pieceIndex)
+	}
+	return true
+}
+
+// Queues a check for a piece that all the chunks have been received for, deferring it per
+// ClientConfig.PieceVerification. The piece isn't considered complete until it's verified either
+// way.
+func (t *Torrent) queueReceivedPieceCheck(pieceIndex pieceIndex) {
+	if t.cl.config.PieceVerification != PieceVerificationDeferred {
+		t.queuePieceCheck(pieceIndex)
+		return
+	}
+	if t.piece(pieceIndex).queuedForHash() {
+		return
+	}
+	t.deferredPieceChecks.Add(bitmap.BitIndex(pieceIndex))
 	t.publishPieceChange(pieceIndex)
 	t.updatePiecePriority(pieceIndex)
+	if t.deferredPieceChecks.Len() >= t.cl.config.PieceVerificationBatchSize {
+		t.releaseDeferredPieceChecks()
+		return
+	}
+	if t.deferredPieceCheckTimer == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(t.cl.config.PieceVerificationDelay, func() {
+			t.cl.lock()
+			defer t.cl.unlock()
+			// The checks may have been released, and another timer armed, since this fired.
+			if t.deferredPieceCheckTimer != timer {
+				return
+			}
+			t.releaseDeferredPieceChecks()
+		})
+		t.deferredPieceCheckTimer = timer
+	}
+}
+
+// Moves the deferred checks to the hash queue.
+func (t *Torrent) releaseDeferredPieceChecks() {
+	if t.deferredPieceCheckTimer != nil {
+		t.deferredPieceCheckTimer.Stop()
+		t.deferredPieceCheckTimer = nil
+	}
+	t.piecesQueuedForHash.Union(t.deferredPieceChecks)
+	t.deferredPieceChecks.Clear()
 	t.tryCreateMorePieceHashers()
 }
 
@@ -1835,7 +2710,15 @@ func (t *Torrent) initiateConn(peer Peer) {
 		return
 	}
 
+	if !t.cl.peerAddrFamilyEnabled(peer.Addr) {
+		return
+	}
 	if t.cl.badPeerAddr(peer.Addr) && !peer.Trusted {
+		t.onConnFailure(ConnFailure{
+			Addr:   peer.Addr,
+			Reason: ConnFailureBlocked,
+			Err:    errBadPeerAddr,
+		})
 		return
 	}
 	addr := peer.Addr
@@ -1872,7 +2755,7 @@ func (t *Torrent) hashingPiece(i pieceIndex) bool {
 }
 
 func (t *Torrent) pieceQueuedForHash(i pieceIndex) bool {
-	return t.piecesQueuedForHash.Get(bitmap.BitIndex(i))
+	return t.piece(i).queuedForHash()
 }
 
 func (t *Torrent) dialTimeout() time.Duration {
@@ -1908,6 +2791,10 @@ func (t *Torrent) requestStrategyCallbacks() requestStrategyCallbacks {
 }
 
 func (t *Torrent) onWriteChunkErr(err error) {
+	if errors.Is(err, syscall.ENOSPC) {
+		t.onStorageFull(err)
+		return
+	}
 	if t.userOnWriteChunkErr != nil {
 		go t.userOnWriteChunkErr(err)
 		return
@@ -1945,3 +2832,260 @@ func (t *Torrent) SetOnWriteChunkError(f func(error)) {
 	defer t.cl.unlock()
 	t.userOnWriteChunkErr = f
 }
+
+// Stops requesting data when storage has run out of space. Chunks that failed to write have
+// already been pended again, and will be requested once AllowDataDownload is called.
+func (t *Torrent) onStorageFull(err error) {
+	if !t.dataDownloadDisallowed {
+		t.disallowDataDownloadLocked()
+	}
+	// Downloads may have been disallowed already, by the user or an earlier write, but the
+	// storage is still full.
+	if t.userOnStorageFull != nil {
+		go t.userOnStorageFull(err)
+	}
+}
+
+// Sets a function to be called when writing data for the torrent fails because storage is out of
+// space. Data download is disallowed when that happens, and can be resumed with AllowDataDownload
+// once space is freed.
+func (t *Torrent) SetOnStorageFull(f func(error)) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.userOnStorageFull = f
+}
+
+func (t *Torrent) pause() {
+	if !t.paused.Set() {
+		return
+	}
+	t.logger.Printf("pausing")
+	for c := range t.conns {
+		t.dropConnectionWithReason(c, ConnDropLocal)
+	}
+	t.updateWantPeersEvent()
+	// Wake the tracker announcers.
+	t.cl.event.Broadcast()
+}
+
+func (t *Torrent) setTransferEnabled(enabled bool) {
+	if enabled == t.networkingEnabled {
+		return
+	}
+	t.networkingEnabled = enabled
+	if enabled {
+		t.logger.Printf("enabling transfer")
+		t.maybeNewConns()
+	} else {
+		t.logger.Printf("disabling transfer")
+		for c := range t.conns {
+			t.dropConnectionWithReason(c, ConnDropLocal)
+		}
+	}
+	t.tickleWebSeeds()
+}
+
+func (t *Torrent) resume() {
+	if !t.paused.IsSet() {
+		return
+	}
+	t.logger.Printf("resuming")
+	t.paused.Clear()
+	t.pausedByClient = false
+	t.updateStorageWindow()
+	t.updateWantPeersEvent()
+	t.maybeNewConns()
+}
+
+// The ratio of data uploaded to downloaded. If nothing has been downloaded, such as when seeding
+// existing data, the torrent length is used in place of the downloaded bytes.
+func (t *Torrent) ratio() float64 {
+	downloaded := t.stats.BytesReadUsefulData.Int64()
+	if downloaded == 0 && t.haveInfo() {
+		downloaded = t.info.TotalLength()
+	}
+	if downloaded == 0 {
+		return 0
+	}
+	return float64(t.stats.BytesWrittenData.Int64()) / float64(downloaded)
+}
+
+func (t *Torrent) seedingGoalReached() bool {
+	if !t.haveAllPieces() {
+		return false
+	}
+	if t.ratioLimit > 0 && t.ratio() >= t.ratioLimit {
+		return true
+	}
+	if t.seedingTimeLimit > 0 && !t.seedingSince.IsZero() && time.Since(t.seedingSince) >= t.seedingTimeLimit {
+		return true
+	}
+	return false
+}
+
+// Pauses the torrent if a seeding goal has been reached.
+func (t *Torrent) checkSeedingGoals() {
+	if t.closed.IsSet() || t.paused.IsSet() || !t.seedingGoalReached() {
+		return
+	}
+	t.logger.Printf("seeding goal reached (ratio=%.2f)", t.ratio())
+	t.pause()
+	if t.userOnSeedingGoalReached != nil {
+		go t.userOnSeedingGoalReached()
+	}
+}
+
+// Arranges for the seeding time limit to be checked when it's due to expire.
+func (t *Torrent) updateSeedingGoalTimer() {
+	if t.seedingGoalTimer != nil {
+		t.seedingGoalTimer.Stop()
+	}
+	if t.seedingTimeLimit <= 0 || t.seedingSince.IsZero() {
+		return
+	}
+	t.seedingGoalTimer = time.AfterFunc(time.Until(t.seedingSince.Add(t.seedingTimeLimit)), func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		t.checkSeedingGoals()
+	})
+}
+
+// Writes the priorities set by the user on files and pieces to the configured store. The file
+// priorities come first, one byte per file, followed by one byte per piece.
+func (t *Torrent) savePiecePriorities() {
+	if t.cl.config.PiecePriorityStore == nil || !t.haveInfo() {
+		return
+	}
+	prios := make([]byte, 0, len(*t.files)+t.numPieces())
+	for _, f := range *t.files {
+		prios = append(prios, byte(f.prio))
+	}
+	for i := range t.pieces {
+		prios = append(prios, byte(t.pieces[i].priority))
+	}
+	t.queuePrioritiesStore(prios)
+}
+
+// Stores the priorities outside the Client lock, as the store may be slow. Only the latest
+// priorities queued are written. Nothing is queued once the Client is closed.
+func (t *Torrent) queuePrioritiesStore(prios []byte) {
+	if t.cl.closed.IsSet() {
+		return
+	}
+	t.prioritiesToStore = prios
+	t.prioritiesPending = true
+	if t.storingPriorities {
+		return
+	}
+	t.storingPriorities = true
+	t.cl.priorityStores.Add(1)
+	go t.storePriorities()
+}
+
+func (t *Torrent) storePriorities() {
+	defer t.cl.priorityStores.Done()
+	store := t.cl.config.PiecePriorityStore
+	t.cl.lock()
+	defer t.cl.unlock()
+	for t.prioritiesPending {
+		prios := t.prioritiesToStore
+		t.prioritiesToStore = nil
+		t.prioritiesPending = false
+		t.cl.unlock()
+		err := store.SetPiecePriorities(t.infoHash, prios)
+		t.cl.lock()
+		if err != nil {
+			t.subsystemLogger(LogSubsystemStorage).Printf("error storing priorities: %v", err)
+		}
+	}
+	t.storingPriorities = false
+}
+
+func (t *Torrent) restorePiecePriorities() {
+	store := t.cl.config.PiecePriorityStore
+	if store == nil {
+		return
+	}
+	prios, err := store.GetPiecePriorities(t.infoHash)
+	if err != nil {
+		t.subsystemLogger(LogSubsystemStorage).Printf("error getting stored priorities: %v", err)
+		return
+	}
+	if prios == nil {
+		return
+	}
+	numFiles := len(*t.files)
+	if len(prios) != numFiles+t.numPieces() {
+		t.logger.Printf("ignoring %v bytes of stored priorities, torrent has %v files and %v pieces", len(prios), numFiles, t.numPieces())
+		return
+	}
+	for i, f := range *t.files {
+		f.prio = piecePriority(prios[i])
+	}
+	for i, prio := range prios[numFiles:] {
+		t.pieces[i].priority = piecePriority(prio)
+	}
+	t.updateAllPiecePriorities()
+}
+
+// Records the piece in the write journal ahead of writing to it, if it isn't already.
+func (t *Torrent) journalPieceWritten(piece pieceIndex) {
+	journal := t.cl.config.PieceWriteJournal
+	p := t.piece(piece)
+	if journal == nil || p.journalled {
+		return
+	}
+	if err := journal.SetPieceWritten(metainfo.PieceKey{InfoHash: t.infoHash, Index: piece}, true); err != nil {
+		t.subsystemLogger(LogSubsystemStorage).Printf("error journalling piece %v: %v", piece, err)
+		return
+	}
+	p.journalled = true
+}
+
+// Removes the piece from the write journal once its completion has been stored.
+func (t *Torrent) clearPieceJournal(piece pieceIndex) {
+	p := t.piece(piece)
+	if !p.journalled {
+		return
+	}
+	if err := t.cl.config.PieceWriteJournal.SetPieceWritten(metainfo.PieceKey{InfoHash: t.infoHash, Index: piece}, false); err != nil {
+		t.subsystemLogger(LogSubsystemStorage).Printf("error clearing journalled piece %v: %v", piece, err)
+		return
+	}
+	p.journalled = false
+}
+
+// Queues checks for pieces that were written to but whose completion wasn't stored, such as after a
+// crash.
+func (t *Torrent) restorePieceJournal() {
+	journal := t.cl.config.PieceWriteJournal
+	if journal == nil {
+		return
+	}
+	pieces, err := journal.GetWrittenPieces(t.infoHash)
+	if err != nil {
+		t.subsystemLogger(LogSubsystemStorage).Printf("error getting journalled pieces: %v", err)
+		return
+	}
+	for _, i := range pieces {
+		if i < 0 || i >= t.numPieces() {
+			t.logger.Printf("ignoring journalled piece %v, torrent has %v", i, t.numPieces())
+			continue
+		}
+		t.pieces[i].journalled = true
+		t.queuePieceCheck(i)
+	}
+}
+
+func (t *Torrent) resetPiecePriorities() {
+	for _, f := range *t.files {
+		f.prio = PiecePriorityNone
+	}
+	for i := range t.pieces {
+		t.pieces[i].priority = PiecePriorityNone
+	}
+	t.updateAllPiecePriorities()
+	if t.cl.config.PiecePriorityStore != nil {
+		t.queuePrioritiesStore(nil)
+	}
+}
@@ -1,5 +1,7 @@
 package torrent
 
+import "time"
+
 // Due to ConnStats, may require special alignment on some platforms. See
 // https://github.com/anacrolix/torrent/issues/383.
 type TorrentStats struct {
@@ -13,4 +15,45 @@ type TorrentStats struct {
 	ActivePeers      int
 	ConnectedSeeders int
 	HalfOpenPeers    int
+	// Connected peers that are still warming up. These are included in ActivePeers. See
+	// ClientConfig.ConnWarmUpTimeout.
+	WarmingUpPeers int
+
+	// Connections dropped because another connection had the same peer ID.
+	DuplicateConnsDropped int
+	// Failed outgoing connection attempts by reason.
+	ConnFailures map[ConnFailureReason]int
+	// Peer connections established, and those since dropped by reason. Reasons that never
+	// occurred are omitted.
+	ConnsEstablished int
+	ConnDrops        map[ConnDropReason]int
+	// Useful data obtained from web seeds, and from peers.
+	WebSeedBytesRead int64
+	PeerBytesRead    int64
+	// Times metadata received from peers was discarded for not matching the infohash.
+	MetadataHashMismatches int
+	// Peers with seeding upload slots reserved for newcomers, and with the remaining slots. See
+	// ClientConfig.SeedingUploadSlots.
+	NewcomerUploadSlots    int
+	EstablishedUploadSlots int
+	// How long until upload slots are next reassigned, at the current number of connections. Zero
+	// until upload slots are being reassigned, which starts with the first connection if
+	// ClientConfig.SeedingUploadSlots is set.
+	RechokeInterval time.Duration
+	// The fraction of the Client's upload budget the torrent gets while competing with the other
+	// torrents currently uploading, per their upload priorities. Zero if
+	// ClientConfig.UploadRateLimiter is unlimited. See Torrent.SetUploadPriority.
+	UploadShare float64
+	// Established connections we dialed, and that peers made to us, and the slots for each when
+	// they're split by ClientConfig.DownloadingOutgoingConnsShare or SeedingOutgoingConnsShare.
+	// The slots are zero if the connections aren't split.
+	OutgoingConns     int
+	IncomingConns     int
+	OutgoingConnSlots int
+	IncomingConnSlots int
+	// The fraction of the current pass re-verifying complete pieces that's done, when the last pass
+	// finished, and complete pieces that have failed. See ClientConfig.ScrubInterval.
+	ScrubProgress      float64
+	LastScrubCompleted time.Time
+	ScrubFailedPieces  int
 }
@@ -1,22 +1,37 @@
 package torrent
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo"
 	"github.com/bradfitz/iter"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/internal/testutil"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
 	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/tracker"
 )
 
 func r(i, b, l pp.Integer) request {
@@ -120,7 +135,7 @@ func testEmptyFilesAndZeroPieceLength(t *testing.T, cfg *ClientConfig) {
 	fp := filepath.Join(cfg.DataDir, "empty")
 	os.Remove(fp)
 	assert.False(t, missinggo.FilePathExists(fp))
-	tt, err := cl.AddTorrent(&metainfo.MetaInfo{
+	tt, _, err := cl.AddTorrent(&metainfo.MetaInfo{
 		InfoBytes: ib,
 	})
 	require.NoError(t, err)
@@ -163,6 +178,71 @@ func TestPieceHashFailed(t *testing.T) {
 	tt.cl.unlock()
 }
 
+func TestBytesPending(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	tt := cl.newTorrent(mi.HashInfoBytes(), storage.NewFileWithCompletion(cl.config.DataDir, storage.NewMapPieceCompletion()))
+	tt.setChunkSize(2)
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt.cl.lock()
+	defer tt.cl.unlock()
+	filesCompleted := func() (ret int64) {
+		for _, f := range *tt.files {
+			ret += f.bytesCompleted()
+		}
+		return
+	}
+	assert.Zero(t, tt.bytesCompleted())
+	assert.Zero(t, tt.bytesPending())
+	tt.pieces[1]._dirtyChunks.Add(0)
+	assert.Zero(t, tt.bytesCompleted())
+	assert.Zero(t, filesCompleted())
+	assert.EqualValues(t, 2, tt.bytesPending())
+	assert.EqualValues(t, *tt.length-2, tt.bytesLeft())
+	// Pretend the rest of the piece was downloaded.
+	testutil.CreateDummyTorrentData(cl.config.DataDir)
+	tt.pieces[1]._dirtyChunks.AddRange(0, 3)
+	tt.pieceHashed(1, true, nil)
+	tt.updatePieceCompletion(1)
+	assert.EqualValues(t, tt.pieces[1].length(), tt.bytesCompleted())
+	assert.Equal(t, tt.bytesCompleted(), filesCompleted())
+	assert.Zero(t, tt.bytesPending())
+}
+
+func TestRateHistory(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	start := time.Now()
+	for i := 0; i < rateHistoryLength+10; i++ {
+		tt.stats.BytesReadUsefulData.Add(int64(i))
+		tt.sampleRates(start.Add(time.Duration(i)*time.Second), time.Second)
+	}
+	h := tt.rateHistory.get()
+	require.Len(t, h, rateHistoryLength)
+	assert.Equal(t, start.Add(10*time.Second), h[0].Time)
+	assert.EqualValues(t, 10, h[0].DownloadRate)
+	assert.EqualValues(t, rateHistoryLength+9, h[len(h)-1].DownloadRate)
+	assert.Zero(t, h[0].UploadRate)
+	assert.Zero(t, h[0].Completion)
+}
+
+func TestRateHistoryInterval(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.RateHistoryInterval = time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _ := cl.AddTorrentInfoHash(metainfo.Hash{})
+	require.Eventually(t, func() bool { return len(tt.RateHistory()) == rateHistoryLength }, 10*time.Second, time.Millisecond)
+	assert.Len(t, tt.RateHistory(), rateHistoryLength)
+}
+
 // Check the behaviour of Torrent.Metainfo when metadata is not completed.
 func TestTorrentMetainfoIncompleteMetadata(t *testing.T) {
 	cfg := TestingConfig()
@@ -218,3 +298,1799 @@ func TestTorrentMetainfoIncompleteMetadata(t *testing.T) {
 	assert.False(t, tt.haveAllMetadataPieces())
 	assert.Nil(t, tt.Metainfo().InfoBytes)
 }
+
+func TestTorrentFullMetainfo(t *testing.T) {
+	cl, err := NewClient(TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	ih := mi.HashInfoBytes()
+	// Like a magnet link, before the info is fetched.
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash: ih,
+		Trackers: [][]string{{"http://tracker.example/announce"}},
+	})
+	require.NoError(t, err)
+	_, err = tt.FullMetainfo()
+	assert.Error(t, err)
+	require.NoError(t, tt.SetInfoBytes(mi.InfoBytes))
+	tt.AddTrackers([][]string{{}, {"udp://tracker.example:1337"}})
+	require.NoError(t, tt.AddWebSeeds([]string{"http://seed.example/"}))
+	full, err := tt.FullMetainfo()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, full.Write(&buf))
+	loaded, err := metainfo.Load(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, ih, loaded.HashInfoBytes())
+	assert.Equal(t, "http://tracker.example/announce", loaded.Announce)
+	assert.Equal(t, [][]string{{"http://tracker.example/announce"}, {"udp://tracker.example:1337"}}, [][]string(loaded.AnnounceList))
+	assert.Equal(t, []string{"http://seed.example/"}, []string(loaded.UrlList))
+}
+
+func testAnnounceBytesReporting(t *testing.T, configure func(*ClientConfig), complete bool, expected AnnounceBytes) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	configure(cl.config)
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt.stats.BytesWrittenData.Add(3)
+	tt.stats.BytesReadUsefulData.Add(5)
+	// badStorage claims all pieces are complete.
+	if !complete {
+		tt._completedPieces.Clear()
+	}
+	ar := tt.announceRequest(tracker.None)
+	assert.EqualValues(t, expected, AnnounceBytes{
+		Uploaded:   ar.Uploaded,
+		Downloaded: ar.Downloaded,
+		Left:       ar.Left,
+	})
+}
+
+func TestAnnounceBytesReporting(t *testing.T) {
+	greetingLength := int64(len(testutil.GreetingFileContents))
+	testAnnounceBytesReporting(t, func(*ClientConfig) {}, false, AnnounceBytes{3, 5, greetingLength})
+	testAnnounceBytesReporting(t, func(*ClientConfig) {}, true, AnnounceBytes{3, 5, 0})
+	testAnnounceBytesReporting(t, func(cfg *ClientConfig) {
+		cfg.AnnounceBytesReporting = AnnounceBytesReportingZeroed
+	}, false, AnnounceBytes{0, 0, greetingLength})
+	testAnnounceBytesReporting(t, func(cfg *ClientConfig) {
+		cfg.AnnounceBytesReporting = AnnounceBytesReportingZeroed
+	}, true, AnnounceBytes{0, 0, 0})
+	testAnnounceBytesReporting(t, func(cfg *ClientConfig) {
+		cfg.AnnounceBytesReporting = AnnounceBytesReportingCustom
+		cfg.AnnounceBytesReporter = func(_ InfoHash, actual AnnounceBytes) AnnounceBytes {
+			return AnnounceBytes{
+				Uploaded:   actual.Uploaded * 2,
+				Downloaded: 42,
+				Left:       actual.Left,
+			}
+		}
+	}, true, AnnounceBytes{6, 42, 0})
+}
+
+func TestAnnounceLeftPartialSeed(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	info := metainfo.Info{
+		Name:        "partial",
+		PieceLength: 2,
+		Pieces:      make([]byte, 3*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 2},
+			{Path: []string{"b"}, Length: 2},
+			{Path: []string{"c"}, Length: 2},
+		},
+	}
+	infoBytes := bencode.MustMarshal(info)
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	tt._completedPieces.Clear()
+	left := func() int64 {
+		cl.lock()
+		defer cl.unlock()
+		return tt.announceRequest(tracker.None).Left
+	}
+	assert.EqualValues(t, 6, left())
+	// Nothing is wanted, so we're not any kind of seed.
+	tt._completedPieces.Add(0)
+	assert.EqualValues(t, 4, left())
+	// Only a is wanted, and it's complete.
+	tt.Files()[0].Download()
+	assert.EqualValues(t, 0, left())
+	tt.Files()[1].Download()
+	assert.EqualValues(t, 2, left())
+}
+
+func TestTorrentRatioLimitPauses(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	// badStorage claims all pieces are complete, so we're seeding.
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	reached := make(chan struct{})
+	tt.SetOnSeedingGoalReached(func() { close(reached) })
+	tt.SetRatioLimit(2)
+	assert.False(t, tt.Paused())
+	cl.lock()
+	tt.stats.BytesWrittenData.Add(tt.info.TotalLength())
+	tt.checkSeedingGoals()
+	assert.False(t, tt.paused.IsSet())
+	tt.stats.BytesWrittenData.Add(tt.info.TotalLength())
+	tt.checkSeedingGoals()
+	assert.True(t, tt.paused.IsSet())
+	assert.False(t, tt.wantConns())
+	cl.unlock()
+	<-reached
+	// Removing the limit allows the torrent to be resumed.
+	tt.SetRatioLimit(0)
+	tt.Resume()
+	assert.False(t, tt.Paused())
+}
+
+// Simulate a cross-connect: we dial a peer at the same time as it dials us.
+func TestTorrentDropDuplicatePeerIds(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.DropDuplicatePeerIds = true
+	cl.initLogger()
+	cl.peerID = PeerID{1}
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	peerId := PeerID{2}
+	newConn := func(outgoing bool) *PeerConn {
+		c := cl.newConnection(nil, outgoing, nil, "tcp", "")
+		c.setTorrent(tt)
+		c.PeerID = peerId
+		return c
+	}
+	// We have the lower peer ID, so our outgoing connection is preferred.
+	incoming := newConn(false)
+	outgoing := newConn(true)
+	cl.lock()
+	defer cl.unlock()
+	require.NoError(t, tt.addConnection(incoming))
+	require.NoError(t, tt.addConnection(outgoing))
+	assert.True(t, incoming.closed.IsSet())
+	assert.Equal(t, map[*PeerConn]struct{}{outgoing: {}}, tt.conns)
+	assert.Error(t, tt.addConnection(newConn(false)))
+	assert.Len(t, tt.conns, 1)
+	assert.EqualValues(t, 2, tt.duplicateConnsDropped)
+}
+
+func TestPieceStateChunkProgress(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	tt.setChunkSize(2)
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	cl.lock()
+	tt._completedPieces.Clear()
+	tt.pieces[1]._dirtyChunks.Add(0, 2)
+	cl.unlock()
+	ps := tt.PieceState(1)
+	assert.True(t, ps.Partial)
+	assert.EqualValues(t, 3, ps.NumChunks)
+	assert.EqualValues(t, 2, ps.NumChunksReceived)
+	assert.EqualValues(t, []bool{true, false, true}, tt.Piece(1).ReceivedChunks())
+	ps = tt.PieceState(0)
+	assert.False(t, ps.Partial)
+	assert.Zero(t, ps.NumChunks)
+	assert.EqualValues(t, []bool{false, false, false}, tt.Piece(0).ReceivedChunks())
+}
+
+func TestDeferredPieceVerification(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.PieceVerification = PieceVerificationDeferred
+	cl.config.PieceVerificationBatchSize = 2
+	cl.config.PieceVerificationDelay = time.Hour
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	cl.lock()
+	defer cl.unlock()
+	tt._completedPieces.Clear()
+	tt.queueReceivedPieceCheck(0)
+	// The check is held back until the batch fills, and the piece isn't complete until then.
+	assert.True(t, tt.pieceQueuedForHash(0))
+	assert.False(t, tt.pieceComplete(0))
+	assert.EqualValues(t, 0, tt.activePieceHashes)
+	assert.NotNil(t, tt.deferredPieceCheckTimer)
+	tt.queueReceivedPieceCheck(0)
+	assert.EqualValues(t, 1, tt.deferredPieceChecks.Len())
+	// Deferred pieces aren't picked up by hashers started for other reasons.
+	tt.tryCreateMorePieceHashers()
+	assert.EqualValues(t, 0, tt.activePieceHashes)
+	tt.queueReceivedPieceCheck(1)
+	assert.EqualValues(t, 2, tt.activePieceHashes)
+	assert.True(t, tt.hashingPiece(0))
+	assert.True(t, tt.hashingPiece(1))
+	assert.Nil(t, tt.deferredPieceCheckTimer)
+	assert.EqualValues(t, 0, tt.deferredPieceChecks.Len())
+	// An explicit check isn't held back.
+	tt.queueReceivedPieceCheck(2)
+	assert.True(t, tt.pieceQueuedForHash(2))
+	tt.queuePieceCheck(2)
+	assert.EqualValues(t, 0, tt.deferredPieceChecks.Len())
+	assert.True(t, tt.piecesQueuedForHash.Get(2))
+}
+
+func TestSubscribePieceCompleted(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt._completedPieces.Clear()
+	completed, unsubscribe := tt.SubscribePieceCompleted()
+	other, _ := tt.SubscribePieceCompleted()
+	cl.lock()
+	tt._completedPieces.Add(2)
+	tt.pieceCompletionChanged(2)
+	tt._completedPieces.Add(0)
+	tt.pieceCompletionChanged(0)
+	cl.unlock()
+	assert.EqualValues(t, 2, <-completed)
+	assert.EqualValues(t, 0, <-completed)
+	unsubscribe()
+	unsubscribe()
+	_, ok := <-completed
+	assert.False(t, ok)
+	assert.EqualValues(t, 2, <-other)
+	assert.EqualValues(t, 0, <-other)
+	cl.lock()
+	tt.close()
+	cl.unlock()
+	_, ok = <-other
+	assert.False(t, ok)
+}
+
+func TestShareModeFavoursRarePieces(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt._completedPieces.Clear()
+	tt.DownloadAll()
+	cl.lock()
+	defer cl.unlock()
+	// Without peers, the pieces aren't ubiquitous, and are still wanted.
+	tt.setShareMode(true)
+	assert.False(t, tt.pieceUbiquitous(0))
+	assert.NotEqual(t, PiecePriorityNone, tt.piecePriority(0))
+	tt.setShareMode(false)
+	newConn := func() *PeerConn {
+		c := cl.newConnection(nil, false, nil, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+		return c
+	}
+	seeder := newConn()
+	require.NoError(t, seeder.onPeerSentHaveAll())
+	// Piece 2 is only available from the seeder.
+	partial := newConn()
+	require.NoError(t, partial.peerSentBitfield([]bool{true, true, false, false, false, false, false, false}))
+	leecher := newConn()
+	require.NoError(t, leecher.peerSentHaveNone())
+	order := func() (ret []pieceIndex) {
+		iterUnbiasedPieceRequestOrder(seeder, func(piece pieceIndex) bool {
+			ret = append(ret, piece)
+			return true
+		})
+		return
+	}
+	assert.EqualValues(t, []pieceIndex{0, 1, 2}, order())
+	tt.setShareMode(true)
+	assert.EqualValues(t, []pieceIndex{2, 0, 1}, order())
+	assert.True(t, seeder.peerHasWantedPieces())
+	// Once every peer has the pieces, there's nobody to upload them to.
+	require.NoError(t, leecher.onPeerSentHaveAll())
+	require.NoError(t, partial.onPeerSentHaveAll())
+	assert.Empty(t, order())
+	assert.False(t, seeder.peerHasWantedPieces())
+	tt.setShareMode(false)
+	assert.Len(t, order(), 3)
+}
+
+func TestSeedingUploadSlotsReservedForNewcomers(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Seed = true
+	cl.config.SeedingUploadSlots = 4
+	cl.config.SeedingNewcomerSlotShare = 0.5
+	cl.initLogger()
+	// badStorage claims all pieces are complete, so we're seeding.
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	cl.lock()
+	defer cl.unlock()
+	require.True(t, tt.uploadSlotsLimited())
+	var numConns byte
+	newConn := func(newcomer bool, uploaded int64) *PeerConn {
+		numConns++
+		c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, numConns), Port: 1}, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+		if newcomer {
+			require.NoError(t, c.peerSentHaveNone())
+		} else {
+			require.NoError(t, c.peerSentBitfield([]bool{true, true, false, false, false, false, false, false}))
+		}
+		c.peerInterested = true
+		c._stats.BytesWrittenData.Add(uploaded)
+		return c
+	}
+	newcomers := []*PeerConn{newConn(true, 0), newConn(true, 0), newConn(true, 0)}
+	slow := newConn(false, 1)
+	fast := []*PeerConn{newConn(false, 3), newConn(false, 2)}
+	tt.rechoke()
+	newcomerSlots, establishedSlots := tt.uploadSlotsInUse()
+	assert.EqualValues(t, 2, newcomerSlots)
+	assert.EqualValues(t, 2, establishedSlots)
+	for _, c := range fast {
+		assert.True(t, c.uploadAllowed())
+	}
+	assert.False(t, slow.uploadAllowed())
+	var waiting *PeerConn
+	for _, c := range newcomers {
+		if !c.uploadSlot {
+			waiting = c
+		}
+	}
+	require.NotNil(t, waiting)
+	// The newcomer that missed out gets a turn next time.
+	time.Sleep(time.Millisecond)
+	tt.rechoke()
+	assert.True(t, waiting.uploadAllowed())
+	assert.True(t, waiting.newcomerUploadSlot)
+	// Without a limit, everyone interested is uploaded to.
+	cl.config.SeedingUploadSlots = 0
+	tt.rechoke()
+	assert.True(t, slow.uploadAllowed())
+	newcomerSlots, _ = tt.uploadSlotsInUse()
+	assert.Zero(t, newcomerSlots)
+}
+
+func TestRechokeIntervalAdaptsToPeers(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.EstablishedConnsPerTorrent = 4
+	cl.config.RechokeIntervalMin = 2 * time.Second
+	cl.config.RechokeIntervalMax = 10 * time.Second
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	cl.lock()
+	defer cl.unlock()
+	assert.EqualValues(t, 2*time.Second, tt.rechokeInterval())
+	for i := 0; i < 2; i++ {
+		c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 1}, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+	}
+	assert.EqualValues(t, 6*time.Second, tt.rechokeInterval())
+	tt.maxEstablishedConns = 2
+	assert.EqualValues(t, 10*time.Second, tt.rechokeInterval())
+	cl.config.RechokeIntervalMax = 0
+	assert.EqualValues(t, fixedRechokeInterval, tt.rechokeInterval())
+}
+
+func TestConnDropReasons(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	cl.lock()
+	defer cl.unlock()
+	for i := 0; i < 2; i++ {
+		c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 1}, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+	}
+	cl.unlock()
+	tt.SetMaxEstablishedConns(1)
+	cl.lock()
+	assert.EqualValues(t, 2, tt.connChurn.established)
+	assert.Equal(t, map[ConnDropReason]int{ConnDropOverLimit: 1}, tt.connChurn.dropsMap())
+	tt.pause()
+	assert.Equal(t, map[ConnDropReason]int{ConnDropOverLimit: 1, ConnDropLocal: 1}, tt.connChurn.dropsMap())
+	assert.Equal(t, map[ConnDropReason]int{ConnDropOverLimit: 1, ConnDropLocal: 1}, cl.connChurn.dropsMap())
+	assert.EqualValues(t, 2, cl.connChurn.established)
+	assert.Equal(t, ConnDropPeerClosed, connDropReasonForReadErr(io.EOF))
+}
+
+func TestWebSeedPolicy(t *testing.T) {
+	info := metainfo.Info{
+		Name:        "webseed",
+		PieceLength: 1,
+		Pieces:      make([]byte, 4*metainfo.HashSize),
+		Length:      4,
+	}
+	ib, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	tt := cl.newTorrent(metainfo.HashBytes(ib), storage.NewFileWithCompletion(cl.config.DataDir, storage.NewMapPieceCompletion()))
+	require.NoError(t, tt.setInfoBytes(ib))
+	tt.VerifyData()
+	tt.DownloadAll()
+	tt.networkingEnabled = true
+	ws := &webSeed{t: tt}
+	cl.lock()
+	defer cl.unlock()
+	addConn := func(choking bool, pieces ...int) {
+		c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, byte(len(tt.conns))), Port: 1}, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+		c.setPeerChoking(choking)
+		for _, i := range pieces {
+			require.NoError(t, c.peerSentHave(i))
+		}
+	}
+	addConn(false, 0, 1)
+	addConn(false, 0)
+	addConn(true, 3)
+	next := func() pieceIndex {
+		i, ok := ws.nextPiece()
+		if !ok {
+			return -1
+		}
+		return i
+	}
+	// Only pieces no unchoking peer has are fetched.
+	assert.EqualValues(t, 2, next())
+	tt.pieces[2].webSeedFetching = true
+	assert.EqualValues(t, 3, next())
+	tt.pieces[3].webSeedFetching = true
+	assert.EqualValues(t, -1, next())
+	tt.webSeedPolicy = WebSeedRarestFirst
+	assert.EqualValues(t, 1, next())
+	tt.pieces[2].webSeedFetching = false
+	assert.EqualValues(t, 2, next())
+	tt.webSeedPolicy = WebSeedDisabled
+	assert.EqualValues(t, -1, next())
+	tt.webSeedPolicy = WebSeedPeersFirst
+	cl.config.DisableNetwork = true
+	assert.EqualValues(t, -1, next())
+	cl.config.DisableNetwork = false
+	// Availability follows choking and dropped connections.
+	tt.pieces[2].webSeedFetching = true
+	tt.pieces[3].webSeedFetching = false
+	assert.EqualValues(t, 3, next())
+	for c := range tt.conns {
+		if c.peerChoking {
+			c.setPeerChoking(false)
+		}
+	}
+	assert.EqualValues(t, -1, next())
+	for c := range tt.conns {
+		c.closeWithReason(ConnDropLocal)
+		tt.deleteConnection(c)
+	}
+	for i := range tt.pieces {
+		assert.Zero(t, tt.pieces[i].availability)
+		assert.Zero(t, tt.pieces[i].unchokingAvailability)
+	}
+}
+
+func TestWebSeedExcludesPeerRequests(t *testing.T) {
+	info := metainfo.Info{
+		Name:        "webseed",
+		PieceLength: 1,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Length:      2,
+	}
+	ib, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	tt := cl.newTorrent(metainfo.HashBytes(ib), badStorage{})
+	require.NoError(t, tt.setInfoBytes(ib))
+	tt._completedPieces.Clear()
+	tt.networkingEnabled = true
+	tt.webSeedPolicy = WebSeedRarestFirst
+	ws := &webSeed{t: tt}
+	cl.lock()
+	defer cl.unlock()
+	tt.downloadPiecesLocked(0, tt.numPieces())
+	c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	c.setPeerChoking(false)
+	require.NoError(t, c.onPeerSentHaveAll())
+	// The web seed is fetching the first piece, so the peer is only asked for the second.
+	tt.pieces[0].webSeedFetching = true
+	c.fillWriteBuffer(func(pp.Message) bool { return true })
+	require.NotEmpty(t, c.requests)
+	for r := range c.requests {
+		assert.EqualValues(t, 1, r.Index)
+	}
+	// The web seed doesn't fetch the piece requested from the peer either.
+	_, ok := ws.nextPiece()
+	assert.False(t, ok)
+	c.deleteAllRequests()
+	next, ok := ws.nextPiece()
+	assert.True(t, ok)
+	assert.EqualValues(t, 1, next)
+}
+
+func TestFillFreeUploadSlot(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Seed = true
+	cl.config.SeedingUploadSlots = 2
+	cl.config.SeedingNewcomerSlotShare = 0.5
+	cl.initLogger()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	cl.lock()
+	defer cl.unlock()
+	newConn := func(newcomer bool) *PeerConn {
+		c := cl.newConnection(nil, false, nil, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+		if newcomer {
+			require.NoError(t, c.peerSentHaveNone())
+		} else {
+			require.NoError(t, c.onPeerSentHaveAll())
+		}
+		c.peerInterested = true
+		return c
+	}
+	a, b := newConn(false), newConn(false)
+	tt.fillFreeUploadSlot(a)
+	assert.True(t, a.uploadSlot)
+	// The slot reserved for newcomers is free, so an established peer can use it.
+	tt.fillFreeUploadSlot(b)
+	assert.True(t, b.uploadSlot)
+	// A newcomer waits for the next rechoke to take the reserved slot back.
+	n := newConn(true)
+	tt.fillFreeUploadSlot(n)
+	assert.False(t, n.uploadSlot)
+	tt.rechoke()
+	assert.True(t, n.uploadSlot)
+	assert.True(t, n.newcomerUploadSlot)
+	assert.NotEqual(t, a.uploadSlot, b.uploadSlot)
+}
+
+// Serves an HTTP tracker that returns no peers, and sends the event of each announce.
+func newAnnounceEventServer() (*httptest.Server, <-chan string) {
+	events := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	return s, events
+}
+
+func TestTrackerStartedAnnounceDelay(t *testing.T) {
+	s, events := newAnnounceEventServer()
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TrackerStartedAnnounceDelay = 100 * time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	dropped, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash: metainfo.Hash{1},
+		Trackers: [][]string{{s.URL}},
+	})
+	require.NoError(t, err)
+	dropped.Drop()
+	select {
+	case e := <-events:
+		t.Fatalf("torrent dropped within the delay announced %q", e)
+	case <-time.After(3 * cfg.TrackerStartedAnnounceDelay):
+	}
+	added := time.Now()
+	_, _, err = cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash: metainfo.Hash{2},
+		Trackers: [][]string{{s.URL}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "started", <-events)
+	assert.True(t, time.Since(added) >= cfg.TrackerStartedAnnounceDelay)
+}
+
+func TestTorrentRemoveTracker(t *testing.T) {
+	kept, keptEvents := newAnnounceEventServer()
+	defer kept.Close()
+	removed, removedEvents := newAnnounceEventServer()
+	defer removed.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{kept.URL + "/announce"}, {removed.URL + "/announce"}},
+	})
+	require.NoError(t, err)
+	nextEvent := func(events <-chan string) string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for announce")
+			panic("unreachable")
+		}
+	}
+	require.Equal(t, "started", nextEvent(keptEvents))
+	require.Equal(t, "started", nextEvent(removedEvents))
+	trackers := tt.Trackers()
+	require.Len(t, trackers, 2)
+	assert.True(t, tt.RemoveTracker(trackers[1]))
+	assert.False(t, tt.RemoveTracker(trackers[1]))
+	// The scraper leaves the swarm as it exits.
+	assert.Equal(t, "stopped", nextEvent(removedEvents))
+	assert.Equal(t, []url.URL{trackers[0]}, tt.Trackers())
+	assert.Equal(t, [][]string{{kept.URL + "/announce"}}, [][]string(tt.Metainfo().AnnounceList))
+	tt.AnnounceWithEvent(tracker.None)
+	assert.Equal(t, "", nextEvent(keptEvents))
+	select {
+	case e := <-removedEvents:
+		t.Fatalf("unexpected announce event %q to removed tracker", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTorrentStalled(t *testing.T) {
+	// A tracker that always fails.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer s.Close()
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, err := seeder.AddTorrent(mi)
+	require.NoError(t, err)
+	seederTorrent.VerifyData()
+
+	type stall struct {
+		t *Torrent
+		d time.Duration
+	}
+	stalls := make(chan stall, 10)
+	cfg = TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TorrentStallTimeout = 50 * time.Millisecond
+	cfg.Callbacks.OnTorrentStalled = func(t *Torrent, d time.Duration) {
+		stalls <- stall{t, d}
+	}
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/announce"}},
+	})
+	require.NoError(t, err)
+	nextStall := func() stall {
+		select {
+		case s := <-stalls:
+			return s
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for stall")
+			panic("unreachable")
+		}
+	}
+	st := nextStall()
+	assert.Equal(t, tt, st.t)
+	assert.True(t, st.d >= cfg.TorrentStallTimeout)
+	// Once per stall.
+	select {
+	case <-stalls:
+		t.Fatal("stalled again without recovering")
+	case <-time.After(200 * time.Millisecond):
+	}
+	// Peers return, and then leave again.
+	tt.DownloadAll()
+	tt.AddClientPeer(seeder)
+	require.True(t, cl.WaitAll())
+	seeder.Close()
+	nextStall()
+}
+
+func TestTorrentSetTransferEnabled(t *testing.T) {
+	s, events := newAnnounceEventServer()
+	defer s.Close()
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	seeder, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seederTorrent, _, err := seeder.AddTorrent(mi)
+	require.NoError(t, err)
+	seederTorrent.VerifyData()
+
+	cfg = TestingConfig()
+	cfg.DisableTrackers = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/announce"}},
+	})
+	require.NoError(t, err)
+	nextEvent := func() string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for announce")
+			panic("unreachable")
+		}
+	}
+	require.Equal(t, "started", nextEvent())
+	tt.SetTransferEnabled(false)
+	tt.DownloadAll()
+	tt.AddClientPeer(seeder)
+	// Announces continue.
+	tt.AnnounceWithEvent(tracker.None)
+	assert.Equal(t, "", nextEvent())
+	time.Sleep(100 * time.Millisecond)
+	stats := tt.Stats()
+	assert.Zero(t, stats.ActivePeers)
+	assert.Zero(t, stats.BytesReadData.Int64())
+	assert.NotZero(t, stats.PendingPeers)
+	assert.Zero(t, tt.BytesCompleted())
+	// The peer found while disabled is used.
+	tt.SetTransferEnabled(true)
+	require.True(t, cl.WaitAll())
+}
+
+func TestTrackerReportCorrupt(t *testing.T) {
+	announces := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		announces <- q.Get("event") + " " + q.Get("corrupt")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TrackerReportCorrupt = true
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/announce"}},
+	})
+	require.NoError(t, err)
+	next := func() string {
+		select {
+		case a := <-announces:
+			return a
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for announce")
+			panic("unreachable")
+		}
+	}
+	require.Equal(t, "started 0", next())
+	cl.lock()
+	tt.corruptBytes = 100
+	cl.unlock()
+	tt.AnnounceWithEvent(tracker.None)
+	assert.Equal(t, " 100", next())
+	tt.AnnounceWithEvent(tracker.Stopped)
+	assert.Equal(t, "stopped 100", next())
+	// Rejoining the swarm starts the count again.
+	tt.AnnounceWithEvent(tracker.Started)
+	assert.Equal(t, "started 0", next())
+}
+
+func TestTrackerNumWantScaling(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.TrackerNumWantMin = 10
+	cfg.TrackerNumWantMax = 200
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _ := cl.AddTorrentInfoHash(metainfo.Hash{1})
+	tt.SetMaxEstablishedConns(4)
+	cl.lock()
+	defer cl.unlock()
+	numWant := func() int32 {
+		return tt.announceRequest(tracker.None).NumWant
+	}
+	assert.EqualValues(t, 200, numWant())
+	for i := 0; i < 4; i++ {
+		nc, _ := net.Pipe()
+		defer nc.Close()
+		c := cl.newConnection(nc, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 1}, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+		if i == 1 {
+			assert.EqualValues(t, 105, numWant())
+		}
+	}
+	assert.EqualValues(t, 10, numWant())
+	cl.config.TrackerNumWantMax = 0
+	assert.EqualValues(t, -1, numWant())
+}
+
+func TestConnWarmUp(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.ConnWarmUpTimeout = 100 * time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _ := cl.AddTorrentInfoHash(metainfo.Hash{1})
+	tt.SetMaxEstablishedConns(1)
+	cl.lock()
+	var conns []*PeerConn
+	for i := 0; i < 2; i++ {
+		nc, _ := net.Pipe()
+		defer nc.Close()
+		c := cl.newConnection(nc, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 1}, "", "")
+		c.setTorrent(tt)
+		c.completedHandshake = time.Now()
+		require.NoError(t, tt.addConnection(c))
+		conns = append(conns, c)
+		// Connections warming up don't stop us wanting more.
+		assert.True(t, tt.wantConns())
+	}
+	assert.EqualValues(t, 2, tt.statsLocked().WarmingUpPeers)
+	require.NoError(t, conns[0].onPeerSentHaveAll())
+	assert.False(t, tt.wantConns())
+	assert.EqualValues(t, 1, tt.statsLocked().WarmingUpPeers)
+	// A connection that can't warm up is refused without evicting the established one.
+	cl.config.HalfOpenConnsPerTorrent = 1
+	conns[0].completedHandshake = time.Now().Add(-2 * time.Minute)
+	nc, _ := net.Pipe()
+	defer nc.Close()
+	c := cl.newConnection(nc, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 2), Port: 1}, "", "")
+	c.setTorrent(tt)
+	c.completedHandshake = time.Now()
+	assert.Error(t, tt.addConnection(c))
+	assert.Len(t, tt.conns, 2)
+	assert.Empty(t, tt.connChurn.dropsMap())
+	conns[0].completedHandshake = time.Now()
+	cl.unlock()
+	// The other connection times out of warm-up, and is dropped as there's no room for it.
+	assert.Eventually(t, func() bool {
+		cl.lock()
+		defer cl.unlock()
+		return conns[1].closed.IsSet()
+	}, 10*time.Second, 10*time.Millisecond)
+	cl.lock()
+	defer cl.unlock()
+	assert.False(t, conns[0].closed.IsSet())
+	assert.Len(t, tt.conns, 1)
+	assert.EqualValues(t, 0, tt.statsLocked().WarmingUpPeers)
+	assert.Equal(t, map[ConnDropReason]int{ConnDropOverLimit: 1}, tt.connChurn.dropsMap())
+}
+
+func TestPeerChokedTimeout(t *testing.T) {
+	cfg := TestingConfig()
+	cfg.PeerChokedTimeout = 50 * time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	require.NoError(t, err)
+	tt.DownloadAll()
+	// Pieces aren't wanted until their completion is known.
+	tt.VerifyData()
+	cl.lock()
+	nc, _ := net.Pipe()
+	defer nc.Close()
+	ip := net.IPv4(1, 2, 3, 4)
+	c := cl.newConnection(nc, false, &net.TCPAddr{IP: ip, Port: 1}, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	require.NoError(t, c.onPeerSentHaveAll())
+	// The peer has everything we want, but never unchokes us.
+	c.fillWriteBuffer(func(pp.Message) bool { return true })
+	assert.True(t, c.interested)
+	assert.True(t, c.peerChoking)
+	cl.unlock()
+	assert.Eventually(t, func() bool {
+		cl.lock()
+		defer cl.unlock()
+		return c.closed.IsSet()
+	}, 10*time.Second, time.Millisecond)
+	cl.lock()
+	defer cl.unlock()
+	assert.Empty(t, tt.conns)
+	assert.Equal(t, map[ConnDropReason]int{ConnDropSnubbed: 1}, tt.connChurn.dropsMap())
+	assert.True(t, cl.peerReputation(ip) < 0)
+}
+
+func TestVerifyDirectory(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	complete, err := VerifyDirectory(mi, dir)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, true}, complete)
+	// The file ends partway through the second piece.
+	fp := filepath.Join(dir, testutil.GreetingFileName)
+	require.NoError(t, os.Truncate(fp, 7))
+	complete, err = VerifyDirectory(mi, dir)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, false}, complete)
+	require.NoError(t, os.Remove(fp))
+	complete, err = VerifyDirectory(mi, dir)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, false}, complete)
+	assert.False(t, missinggo.FilePathExists(fp))
+	// Verifying doesn't create anything.
+	missing := filepath.Join(dir, "missing")
+	complete, err = VerifyDirectory(mi, missing)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, false}, complete)
+	assert.False(t, missinggo.FilePathExists(missing))
+}
+
+func TestVerifyDirectoryMissingZeroLengthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "d")
+	require.NoError(t, os.Mkdir(root, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "a"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "b"), []byte("hello"), 0644))
+	info := metainfo.Info{PieceLength: 4}
+	require.NoError(t, info.BuildFromFilePath(root))
+	mi := &metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+	complete, err := VerifyDirectory(mi, dir)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true}, complete)
+	require.NoError(t, os.Remove(filepath.Join(root, "a")))
+	complete, err = VerifyDirectory(mi, dir)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true}, complete)
+	assert.False(t, missinggo.FilePathExists(filepath.Join(root, "a")))
+}
+
+func TestTrackerAnnouncesCompletedOnce(t *testing.T) {
+	s, events := newAnnounceEventServer()
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/announce"}},
+	})
+	require.NoError(t, err)
+	nextEvent := func() string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for announce")
+			panic("unreachable")
+		}
+	}
+	require.Equal(t, "started", nextEvent())
+	require.NotZero(t, tt.BytesMissing())
+	// Pretend the data was downloaded from peers.
+	cl.lock()
+	tt.stats.BytesReadUsefulData.Add(int64(len(testutil.GreetingFileContents)))
+	cl.unlock()
+	testutil.CreateDummyTorrentData(cfg.DataDir)
+	tt.VerifyData()
+	require.Zero(t, tt.BytesMissing())
+	assert.Equal(t, "completed", nextEvent())
+	// Losing and regaining a piece doesn't complete the download again.
+	cl.lock()
+	tt.piece(0).Storage().MarkNotComplete()
+	tt.updatePieceCompletion(0)
+	cl.unlock()
+	require.NotZero(t, tt.BytesMissing())
+	tt.VerifyData()
+	require.Zero(t, tt.BytesMissing())
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected announce event %q", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTorrentAnnounceWithEvent(t *testing.T) {
+	s, events := newAnnounceEventServer()
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/announce"}},
+	})
+	require.NoError(t, err)
+	nextEvent := func() string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for announce")
+			panic("unreachable")
+		}
+	}
+	require.Equal(t, "started", nextEvent())
+	// The torrent is incomplete, which is warned about, but the event is sent anyway.
+	tt.AnnounceWithEvent(tracker.Completed)
+	assert.Equal(t, "completed", nextEvent())
+	tt.AnnounceWithEvent(tracker.None)
+	assert.Equal(t, "", nextEvent())
+	// The forced event doesn't stop the tracker being told when the download does complete.
+	cl.lock()
+	tt.stats.BytesReadUsefulData.Add(int64(len(testutil.GreetingFileContents)))
+	cl.unlock()
+	testutil.CreateDummyTorrentData(cfg.DataDir)
+	tt.VerifyData()
+	require.Zero(t, tt.BytesMissing())
+	assert.Equal(t, "completed", nextEvent())
+	tt.AnnounceWithEvent(tracker.Stopped)
+	assert.Equal(t, "stopped", nextEvent())
+	// Having left the swarm, closing the torrent doesn't send another stopped.
+	tt.Drop()
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected announce event %q", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTrackerStartedAnnounceRateLimiter(t *testing.T) {
+	s, events := newAnnounceEventServer()
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TrackerStartedAnnounceRateLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/a"}, {s.URL + "/b"}},
+	})
+	require.NoError(t, err)
+	select {
+	case e := <-events:
+		require.Equal(t, "started", e)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for announce")
+	}
+	// The other tracker's started announce waits for a token.
+	assert.Eventually(t, func() bool { return cl.Stats().TrackerStartedAnnouncesWaiting == 1 }, 10*time.Second, time.Millisecond)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected announce event %q", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	tt.Drop()
+	assert.Eventually(t, func() bool { return cl.Stats().TrackerStartedAnnouncesWaiting == 0 }, 10*time.Second, time.Millisecond)
+}
+
+func TestTrackerPersistRedirects(t *testing.T) {
+	paths := make(chan string, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.Write([]byte("d8:intervali1e5:peers0:e"))
+	})
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		http.Redirect(w, r, "/announce", http.StatusMovedPermanently)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TrackerPersistRedirects = true
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/old"}},
+	})
+	require.NoError(t, err)
+	for _, expected := range []string{"/old", "/announce"} {
+		select {
+		case p := <-paths:
+			require.Equal(t, expected, p)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for announce")
+		}
+	}
+	// The tracker is still known by its original URL, but announces go to the new one.
+	assert.Eventually(t, func() bool {
+		cl.lock()
+		defer cl.unlock()
+		u := tt.trackerAnnouncers[s.URL+"/old"].URL()
+		return u.String() == s.URL+"/announce"
+	}, 10*time.Second, time.Millisecond)
+}
+
+func TestTrackerAutoDisable(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason4:nopee"))
+	}))
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TrackerAutoDisableErrors = 1
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL}},
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return tt.TrackerStatuses()[0].AutoDisabled != ""
+	}, 10*time.Second, time.Millisecond)
+	ts := tt.TrackerStatuses()[0]
+	assert.Equal(t, s.URL, ts.URL.String())
+	assert.Equal(t, 1, ts.ConsecutiveErrors)
+	assert.Contains(t, ts.AutoDisabled, "nope")
+	assert.Error(t, ts.LastErr)
+	// A retest that returns peers re-enables the tracker.
+	cl.lock()
+	scraper := tt.trackerAnnouncers[s.URL].(*trackerScraper)
+	scraper.updateAutoDisable(trackerAnnounceResult{Err: errors.New("still failing")})
+	assert.NotEmpty(t, scraper.autoDisabled)
+	scraper.updateAutoDisable(trackerAnnounceResult{NumPeers: 1})
+	cl.unlock()
+	ts = tt.TrackerStatuses()[0]
+	assert.Empty(t, ts.AutoDisabled)
+	assert.Zero(t, ts.ConsecutiveErrors)
+	// Only announces that asked for peers count as empty.
+	cl.lock()
+	cl.config.TrackerAutoDisableEmpty = 1
+	scraper.updateAutoDisable(trackerAnnounceResult{})
+	assert.Zero(t, scraper.consecutiveEmpty)
+	assert.Empty(t, scraper.autoDisabled)
+	scraper.updateAutoDisable(trackerAnnounceResult{WantedPeers: true})
+	assert.Equal(t, 1, scraper.consecutiveEmpty)
+	assert.NotEmpty(t, scraper.autoDisabled)
+	// A seeding retest doesn't want peers, and its success re-enables the tracker.
+	scraper.updateAutoDisable(trackerAnnounceResult{})
+	assert.Empty(t, scraper.autoDisabled)
+	// So does any successful retest of a tracker disabled for errors, even one without peers.
+	cl.config.TrackerAutoDisableEmpty = 0
+	scraper.updateAutoDisable(trackerAnnounceResult{Err: errors.New("failing again")})
+	assert.NotEmpty(t, scraper.autoDisabled)
+	scraper.updateAutoDisable(trackerAnnounceResult{WantedPeers: true})
+	assert.Empty(t, scraper.autoDisabled)
+	assert.Equal(t, 1, scraper.consecutiveEmpty)
+	cl.unlock()
+}
+
+func TestTrackerAnnounceBatch(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	var (
+		mu        sync.Mutex
+		sources   = make(map[string]struct{})
+		announced [][20]byte
+	)
+	go func() {
+		b := make([]byte, 0x800)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			r := bytes.NewReader(b[:n])
+			var h tracker.RequestHeader
+			binary.Read(r, binary.BigEndian, &h)
+			var w bytes.Buffer
+			binary.Write(&w, binary.BigEndian, tracker.ResponseHeader{Action: h.Action, TransactionId: h.TransactionId})
+			switch h.Action {
+			case tracker.ActionConnect:
+				binary.Write(&w, binary.BigEndian, tracker.ConnectionResponse{ConnectionId: 1})
+			case tracker.ActionAnnounce:
+				var ar tracker.AnnounceRequest
+				binary.Read(r, binary.BigEndian, &ar)
+				mu.Lock()
+				sources[addr.String()] = struct{}{}
+				announced = append(announced, ar.InfoHash)
+				mu.Unlock()
+				binary.Write(&w, binary.BigEndian, tracker.AnnounceResponseHeader{Interval: 900, Seeders: int32(ar.InfoHash[0])})
+			}
+			pc.WriteTo(w.Bytes(), addr)
+		}
+	}()
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.TrackerAnnounceBatchDelay = 200 * time.Millisecond
+	cl.initLogger()
+	announce := func(n int) {
+		var wg sync.WaitGroup
+		for i := 1; i <= n; i++ {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var ih [20]byte
+				ih[0] = byte(i)
+				res, err := cl.batchTrackerAnnounce(tracker.Announce{
+					TrackerUrl: fmt.Sprintf("udp://%s/announce", pc.LocalAddr()),
+					Request:    tracker.AnnounceRequest{InfoHash: ih, NumWant: -1},
+					UdpNetwork: "udp4",
+				})
+				if assert.NoError(t, err) {
+					// Results go back to the torrent that made the announce.
+					assert.EqualValues(t, i, res.Seeders)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	announce(3)
+	mu.Lock()
+	assert.Len(t, announced, 3)
+	// Announces made together share a socket.
+	assert.Len(t, sources, 1)
+	announced = nil
+	mu.Unlock()
+	assert.Empty(t, cl.trackerAnnounceBatches)
+	// A full batch is sent without waiting for the delay, and isn't sent again when it's up.
+	cl.config.TrackerAnnounceBatchDelay = time.Second
+	started := time.Now()
+	announce(maxTrackerAnnounceBatch)
+	assert.True(t, time.Since(started) < cl.config.TrackerAnnounceBatchDelay)
+	time.Sleep(cl.config.TrackerAnnounceBatchDelay + 100*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, maxTrackerAnnounceBatch, len(announced))
+	mu.Unlock()
+	assert.Empty(t, cl.trackerAnnounceBatches)
+}
+
+func TestTrackerAnnounceIntervalClamped(t *testing.T) {
+	events := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali1e5:peers0:e"))
+	}))
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.TrackerMinAnnounceInterval = 3 * time.Second
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash: metainfo.Hash{1},
+		Trackers: [][]string{{s.URL}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "started", <-events)
+	require.Eventually(t, func() bool {
+		return !tt.TrackerStatuses()[0].LastAnnounce.IsZero()
+	}, 10*time.Second, time.Millisecond)
+	assert.Equal(t, cfg.TrackerMinAnnounceInterval, tt.TrackerStatuses()[0].LastInterval)
+	select {
+	case e := <-events:
+		t.Fatalf("announced %q within the minimum interval", e)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	// Intervals over the maximum are clamped down.
+	cl.lock()
+	cl.config.TrackerMaxAnnounceInterval = time.Hour
+	scraper := tt.trackerAnnouncers[s.URL].(*trackerScraper)
+	assert.Equal(t, time.Hour, scraper.clampInterval(24*time.Hour))
+	assert.Equal(t, 30*time.Minute, scraper.clampInterval(30*time.Minute))
+	cl.unlock()
+}
+
+func TestTrackerAnnounceWaitClockJump(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	me := trackerScraper{t: cl.newTorrent(metainfo.Hash{}, nil)}
+	const interval = 30 * time.Minute
+	wait := me.announceWait(time.Now(), interval)
+	assert.True(t, wait > interval-time.Minute && wait <= interval, wait)
+	assert.True(t, me.announceWait(time.Now().Add(-2*interval), interval) <= 0)
+	// A wall clock time from before the clock was set back an hour. Without a monotonic reading,
+	// the last announce appears to be in the future, but the wait doesn't exceed the interval.
+	assert.Equal(t, interval, me.announceWait(time.Now().Round(0).Add(time.Hour), interval))
+	// Only the remainder of the interval is waited.
+	wait = me.announceWait(time.Now().Add(-interval/2), interval)
+	assert.True(t, wait > interval/2-time.Minute && wait <= interval/2, wait)
+}
+
+func TestDelayIdleTrackerAnnounces(t *testing.T) {
+	s, events := newAnnounceEventServer()
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DisableTrackers = false
+	cfg.DelayIdleTrackerAnnounces = true
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	// No pieces are wanted, and there's nothing to seed.
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:  mi.HashInfoBytes(),
+		InfoBytes: mi.InfoBytes,
+		Trackers:  [][]string{{s.URL + "/announce"}},
+	})
+	require.NoError(t, err)
+	select {
+	case e := <-events:
+		t.Fatalf("idle torrent announced %q", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	tt.DownloadAll()
+	select {
+	case e := <-events:
+		assert.Equal(t, "started", e)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for announce")
+	}
+}
+
+func TestDhtAnnounceScheduling(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.DhtAnnounceInterval = time.Hour
+	cl.config.DhtAnnounceRateLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	cl.initLogger()
+	s := &announceRecordingDhtServer{announced: make(map[[20]byte]bool)}
+	mi := testutil.GreetingMetaInfo()
+	newTorrent := func(complete bool) *Torrent {
+		tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+		if complete {
+			require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+		}
+		return tt
+	}
+	// Returns a channel that receives the result of waiting, once the announce is scheduled.
+	wait := func(tt *Torrent, last time.Time) <-chan bool {
+		ret := make(chan bool, 1)
+		go func() {
+			cl.lock()
+			defer cl.unlock()
+			ret <- tt.waitDhtAnnounceDue(s, last)
+		}()
+		for tt.NextDhtAnnounce().IsZero() && len(ret) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return ret
+	}
+	assertScheduledIn := func(tt *Torrent, min, max time.Duration) {
+		next := time.Until(tt.NextDhtAnnounce())
+		assert.True(t, next > min && next <= max, next)
+	}
+	closeTorrent := func(tt *Torrent, waited <-chan bool) {
+		cl.lock()
+		tt.closed.Set()
+		cl.unlock()
+		assert.False(t, <-waited)
+		assert.True(t, tt.NextDhtAnnounce().IsZero())
+	}
+	// A new torrent that needs data announces immediately, without using the limiter.
+	leecher := newTorrent(false)
+	assert.True(t, <-wait(leecher, time.Time{}))
+	// Later announces wait for the interval, plus some jitter.
+	waited := wait(leecher, time.Now())
+	assertScheduledIn(leecher, 59*time.Minute, 66*time.Minute)
+	closeTorrent(leecher, waited)
+	// Seeding torrents share the limiter's single token, so the second waits for it.
+	assert.True(t, <-wait(newTorrent(true), time.Time{}))
+	seeder := newTorrent(true)
+	waited = wait(seeder, time.Time{})
+	assertScheduledIn(seeder, 59*time.Minute, time.Hour)
+	closeTorrent(seeder, waited)
+}
+
+func TestAddWebSeeds(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	s := httptest.NewServer(http.FileServer(http.Dir(greetingDir)))
+	defer s.Close()
+	cfg := TestingConfig()
+	cfg.DataDir = filepath.Join(cfg.DataDir, "leecher")
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	err = tt.AddWebSeeds([]string{s.URL + "/", "ftp://example.com/", s.URL + "/", "http://"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ftp://example.com/")
+	assert.Contains(t, err.Error(), `"http://"`)
+	assert.EqualValues(t, []string{s.URL + "/"}, tt.Metainfo().UrlList)
+	tt.DownloadAll()
+	require.True(t, cl.WaitAll())
+	assert.EqualValues(t, tt.Length(), tt.BytesCompleted())
+	stats := tt.Stats()
+	assert.EqualValues(t, tt.Length(), stats.BytesReadUsefulData.Int64())
+	assert.EqualValues(t, tt.Length(), stats.WebSeedBytesRead)
+	assert.EqualValues(t, 0, stats.PeerBytesRead)
+}
+
+func TestHttpSeed(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	info, err := mi.UnmarshalInfo()
+	require.NoError(t, err)
+	var (
+		mu     sync.Mutex
+		pieces []string
+		busy   = true
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		assert.Equal(t, string(mi.HashInfoBytes().Bytes()), q.Get("info_hash"))
+		assert.Empty(t, r.Header.Get("Range"))
+		if busy {
+			busy = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "0")
+			return
+		}
+		i, err := strconv.Atoi(q.Get("piece"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		pieces = append(pieces, q.Get("piece"))
+		p := info.Piece(i)
+		io.WriteString(w, testutil.GreetingFileContents[p.Offset():p.Offset()+p.Length()])
+	}))
+	defer s.Close()
+	mi.HttpSeeds = []string{s.URL + "/seed"}
+	cfg := TestingConfig()
+	cfg.DataDir = filepath.Join(cfg.DataDir, "leecher")
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	assert.EqualValues(t, mi.HttpSeeds, tt.Metainfo().HttpSeeds)
+	assert.Empty(t, tt.Metainfo().UrlList)
+	tt.DownloadAll()
+	require.True(t, cl.WaitAll())
+	assert.EqualValues(t, tt.Length(), tt.Stats().WebSeedBytesRead)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, pieces, info.NumPieces())
+}
+
+func TestParseHttpSeedRetryAfter(t *testing.T) {
+	for _, c := range []struct {
+		body string
+		d    time.Duration
+		ok   bool
+	}{
+		{"0", 0, true},
+		{" 30\n", 30 * time.Second, true},
+		{"86400", maxHttpSeedRetryAfter, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	} {
+		d, ok := parseHttpSeedRetryAfter([]byte(c.body))
+		assert.Equal(t, c.ok, ok, c.body)
+		assert.Equal(t, c.d, d, c.body)
+	}
+}
+
+func TestSeedingConnLimits(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Seed = true
+	cl.config.EstablishedConnsPerTorrent = 50
+	cl.config.HalfOpenConnsPerTorrent = 25
+	cl.config.SeedingEstablishedConnsPerTorrent = 20
+	cl.config.SeedingHalfOpenConnsPerTorrent = 5
+	cl.initLogger()
+	infoBytes := bencode.MustMarshal(metainfo.Info{
+		Name:        "a",
+		Pieces:      make([]byte, metainfo.HashSize),
+		Length:      1,
+		PieceLength: 1,
+	})
+	tt := cl.newTorrent(metainfo.HashBytes(infoBytes), badStorage{})
+	// Without the info, the torrent needs data.
+	assert.Equal(t, 50, tt.TargetConns())
+	assert.Equal(t, 25, tt.maxHalfOpen())
+	require.NoError(t, tt.setInfoBytes(infoBytes))
+	// The data is complete, so the torrent is only seeding.
+	assert.Equal(t, 20, tt.TargetConns())
+	assert.Equal(t, 5, tt.maxHalfOpen())
+	for i := range iter.N(8) {
+		c := cl.newConnection(nil, false, &net.TCPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 1}, "", "")
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+	}
+	// Dial only for half the target.
+	assert.Equal(t, 2, tt.maxHalfOpen())
+	assert.True(t, tt.wantConns())
+	// Peers asked of trackers fall as the seeding target is approached.
+	cl.config.TrackerNumWantMax = 100
+	assert.EqualValues(t, 60, tt.announceNumWant())
+	cl.config.TrackerNumWantMax = 0
+	// User limits still apply.
+	tt.maxEstablishedConns = 10
+	assert.Equal(t, 10, tt.TargetConns())
+	// Without seeding limits, seeding torrents dial as they do when downloading.
+	cl.config.SeedingEstablishedConnsPerTorrent = 0
+	cl.config.SeedingHalfOpenConnsPerTorrent = 0
+	tt.maxEstablishedConns = 50
+	assert.Equal(t, 50, tt.TargetConns())
+	assert.Equal(t, 25, tt.maxHalfOpen())
+}
+
+func TestInvalidatePieceDropsPeerRequests(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.initLogger()
+	cl.event.L = cl.locker()
+	tt := cl.newTorrent(mi.HashInfoBytes(), storage.NewFileWithCompletion(greetingDir, storage.NewMapPieceCompletion()))
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt.VerifyData()
+	require.True(t, tt.haveAllPieces())
+	cl.lock()
+	c := cl.newConnection(nil, false, nil, "", "")
+	c.setTorrent(tt)
+	require.NoError(t, tt.addConnection(c))
+	c.peerRequests = map[request]struct{}{
+		newRequest(1, 0, 5): {},
+		newRequest(2, 0, 3): {},
+	}
+	cl.unlock()
+	require.NoError(t, tt.InvalidatePiece(1))
+	cl.lock()
+	defer cl.unlock()
+	// The fast extension isn't enabled, so the request is dropped without a reject.
+	assert.Equal(t, map[request]struct{}{newRequest(2, 0, 3): {}}, c.peerRequests)
+	assert.False(t, tt.pieceComplete(1))
+	assert.True(t, tt.pieceComplete(2))
+}
+
+func TestSubsystemLogLevels(t *testing.T) {
+	var logged []string
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Logger = log.Logger{LoggerImpl: log.LoggerFunc(func(m log.Msg) {
+		logged = append(logged, m.Text())
+	})}
+	cl.config.LogLevels = map[string]log.Level{LogSubsystemTracker: log.Debug}
+	cl.initLogger()
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	debug := func(l log.Logger, text string) {
+		l.WithDefaultLevel(log.Debug).Printf(text)
+	}
+	debug(tt.logger, "torrent")
+	debug(tt.subsystemLogger(LogSubsystemPiece), "piece")
+	debug(tt.subsystemLogger(LogSubsystemTracker), "tracker")
+	debug(cl.subsystemLogger(LogSubsystemTracker), "client tracker")
+	// Only the tracker subsystem logs at the debug level, and its torrent messages are still
+	// prefixed with the torrent.
+	assert.Equal(t, []string{fmt.Sprintf("%v: tracker", tt), "client tracker"}, logged)
+}
+
+func TestScrubDetectsCorruptPiece(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	cfg := TestingConfig()
+	cfg.Seed = true
+	cfg.DataDir = greetingDir
+	cfg.ScrubInterval = time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	tt.VerifyData()
+	require.True(t, tt.Seeding())
+	assert.Eventually(t, func() bool { return !tt.Stats().LastScrubCompleted.IsZero() }, 10*time.Second, time.Millisecond)
+	assert.Zero(t, tt.Stats().ScrubFailedPieces)
+
+	// Corrupt the second piece behind the client's back.
+	f, err := os.OpenFile(filepath.Join(greetingDir, testutil.GreetingFileName), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("X"), 6)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Eventually(t, func() bool { return tt.Stats().ScrubFailedPieces == 1 }, 10*time.Second, time.Millisecond)
+	assert.False(t, tt.PieceState(1).Complete)
+	assert.True(t, tt.PieceState(0).Complete)
+	assert.True(t, tt.PieceState(2).Complete)
+	assert.EqualValues(t, 5, tt.BytesMissing())
+}
+
+// Storage whose reads of the first piece fail until fails reaches zero.
+type flakyReadStorage struct {
+	storage.ClientImpl
+	fails *int32
+}
+
+func (me flakyReadStorage) OpenTorrent(info *metainfo.Info, ih metainfo.Hash) (storage.TorrentImpl, error) {
+	ti, err := me.ClientImpl.OpenTorrent(info, ih)
+	return flakyReadTorrent{ti, me.fails}, err
+}
+
+type flakyReadTorrent struct {
+	storage.TorrentImpl
+	fails *int32
+}
+
+func (me flakyReadTorrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	pi := me.TorrentImpl.Piece(p)
+	if p.Index() != 0 {
+		return pi
+	}
+	return flakyReadPiece{pi, me.fails}
+}
+
+type flakyReadPiece struct {
+	storage.PieceImpl
+	fails *int32
+}
+
+func (me flakyReadPiece) ReadAt(b []byte, off int64) (int, error) {
+	if atomic.AddInt32(me.fails, -1) >= 0 {
+		return 0, errors.New("transient")
+	}
+	return me.PieceImpl.ReadAt(b, off)
+}
+
+func TestPieceHashReadRetries(t *testing.T) {
+	greetingDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDir)
+	verify := func(retries int, fails int32) bool {
+		cfg := TestingConfig()
+		cfg.PieceHashReadRetries = retries
+		cfg.PieceHashReadRetryDelay = time.Millisecond
+		cfg.DefaultStorage = flakyReadStorage{storage.NewFileWithCompletion(greetingDir, storage.NewMapPieceCompletion()), &fails}
+		cl, err := NewClient(cfg)
+		require.NoError(t, err)
+		defer cl.Close()
+		tt, _, err := cl.AddTorrent(mi)
+		require.NoError(t, err)
+		tt.VerifyData()
+		assert.True(t, tt.PieceState(1).Complete)
+		return tt.PieceState(0).Complete
+	}
+	assert.True(t, verify(2, 2))
+	assert.False(t, verify(1, 100))
+	assert.False(t, verify(0, 100))
+	// Dropping the torrent isn't held up by a hash waiting to retry.
+	cfg := TestingConfig()
+	cfg.PieceHashReadRetries = 1
+	cfg.PieceHashReadRetryDelay = time.Hour
+	fails := int32(100)
+	cfg.DefaultStorage = flakyReadStorage{storage.NewFileWithCompletion(greetingDir, storage.NewMapPieceCompletion()), &fails}
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, _, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	cl.lock()
+	tt.queuePieceCheck(0)
+	cl.unlock()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&fails) < 100 }, 10*time.Second, time.Millisecond)
+	dropped := make(chan struct{})
+	go func() {
+		tt.Drop()
+		close(dropped)
+	}()
+	select {
+	case <-dropped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("drop blocked by hash retry")
+	}
+	assert.False(t, pieceHashReadErrTransient(io.EOF))
+	assert.False(t, pieceHashReadErrTransient(os.ErrNotExist))
+	assert.True(t, pieceHashReadErrTransient(errors.New("transient")))
+}
+
+func TestOutgoingConnsShare(t *testing.T) {
+	cl := new(Client)
+	cl.config = TestingConfig()
+	cl.config.Seed = true
+	cl.config.SeedingEstablishedConnsPerTorrent = 10
+	cl.config.SeedingOutgoingConnsShare = 0.2
+	cl.config.DownloadingOutgoingConnsShare = 0.8
+	cl.initLogger()
+	mi := testutil.GreetingMetaInfo()
+	tt := cl.newTorrent(mi.HashInfoBytes(), badStorage{})
+	require.NoError(t, tt.setInfoBytes(mi.InfoBytes))
+	tt.SetMaxEstablishedConns(10)
+	cl.lock()
+	defer cl.unlock()
+	require.True(t, tt.seedingConservatively())
+	newConn := func(incoming bool) error {
+		nc, _ := net.Pipe()
+		c := cl.newConnection(nc, !incoming, nil, "", "")
+		if incoming {
+			c.Discovery = PeerSourceIncoming
+		}
+		c.setTorrent(tt)
+		return tt.addConnection(c)
+	}
+	for range iter.N(2) {
+		require.NoError(t, newConn(false))
+	}
+	assert.Error(t, newConn(false))
+	assert.EqualValues(t, 0, tt.maxHalfOpen())
+	for range iter.N(8) {
+		require.NoError(t, newConn(true))
+	}
+	assert.Error(t, newConn(true))
+	stats := tt.statsLocked()
+	assert.EqualValues(t, 2, stats.OutgoingConns)
+	assert.EqualValues(t, 8, stats.IncomingConns)
+	assert.EqualValues(t, 2, stats.OutgoingConnSlots)
+	assert.EqualValues(t, 8, stats.IncomingConnSlots)
+
+	// Downloading torrents dial most of their connections.
+	tt._completedPieces.Clear()
+	tt.downloadPiecesLocked(0, tt.numPieces())
+	require.False(t, tt.seedingConservatively())
+	out, in, ok := tt.connSlots()
+	require.True(t, ok)
+	assert.EqualValues(t, 8, out)
+	assert.EqualValues(t, 2, in)
+	assert.EqualValues(t, 6, tt.maxHalfOpen())
+
+	cl.config.DownloadingOutgoingConnsShare = 0
+	_, _, ok = tt.connSlots()
+	assert.False(t, ok)
+}
@@ -2,6 +2,7 @@ package tracker
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/anacrolix/dht/v2/krpc"
@@ -26,12 +28,76 @@ type HttpResponse struct {
 	Incomplete    int32  `bencode:"incomplete"`
 	Peers         Peers  `bencode:"peers"`
 	// BEP 7
-	Peers6 krpc.CompactIPv6NodeAddrs `bencode:"peers6"`
+	Peers6 Peers6 `bencode:"peers6"`
+	// BEP 24: The IP the tracker sees the request coming from, in 4 or 16 bytes.
+	ExternalIp string `bencode:"external ip,omitempty"`
+	// Entries skipped from Peers and Peers6 for being malformed. Set when unmarshalled.
+	MalformedPeers int `bencode:"-"`
 }
 
+func (me *HttpResponse) UnmarshalBencode(b []byte) (err error) {
+	var r struct {
+		FailureReason string        `bencode:"failure reason"`
+		Interval      int32         `bencode:"interval"`
+		TrackerId     string        `bencode:"tracker id"`
+		Complete      int32         `bencode:"complete"`
+		Incomplete    int32         `bencode:"incomplete"`
+		Peers         countedPeers  `bencode:"peers"`
+		Peers6        countedPeers6 `bencode:"peers6"`
+		ExternalIp    string        `bencode:"external ip"`
+	}
+	err = bencode.Unmarshal(b, &r)
+	if err != nil {
+		return
+	}
+	*me = HttpResponse{
+		FailureReason:  r.FailureReason,
+		Interval:       r.Interval,
+		TrackerId:      r.TrackerId,
+		Complete:       r.Complete,
+		Incomplete:     r.Incomplete,
+		Peers:          r.Peers.peers,
+		Peers6:         r.Peers6.peers,
+		ExternalIp:     r.ExternalIp,
+		MalformedPeers: r.Peers.malformed + r.Peers6.malformed,
+	}
+	return
+}
+
+// Decodes the "peers" value for HttpResponse, keeping the count of malformed entries.
+type countedPeers struct {
+	peers     Peers
+	malformed int
+}
+
+func (me *countedPeers) UnmarshalBencode(b []byte) (err error) {
+	me.peers, me.malformed, err = parseHttpPeers(b)
+	return
+}
+
+// Decodes the "peers6" value for HttpResponse, keeping the count of malformed entries.
+type countedPeers6 struct {
+	peers     Peers6
+	malformed int
+}
+
+func (me *countedPeers6) UnmarshalBencode(b []byte) (err error) {
+	me.peers, me.malformed, err = parseHttpPeers6(b)
+	return
+}
+
+// Peers in compact IPv4 or dict form. Malformed entries are skipped.
 type Peers []Peer
 
 func (me *Peers) UnmarshalBencode(b []byte) (err error) {
+	*me, _, err = parseHttpPeers(b)
+	return
+}
+
+func parseHttpPeers(b []byte) (ret []Peer, malformed int, err error) {
+	if len(b) == 0 {
+		return
+	}
 	var _v interface{}
 	err = bencode.Unmarshal(b, &_v)
 	if err != nil {
@@ -40,31 +106,44 @@ func (me *Peers) UnmarshalBencode(b []byte) (err error) {
 	switch v := _v.(type) {
 	case string:
 		vars.Add("http responses with string peers", 1)
-		var cnas krpc.CompactIPv4NodeAddrs
-		err = cnas.UnmarshalBinary([]byte(v))
-		if err != nil {
-			return
-		}
-		for _, cp := range cnas {
-			*me = append(*me, Peer{
-				IP:   cp.IP[:],
-				Port: int(cp.Port),
-			})
-		}
-		return
+		ret, malformed = parseCompactPeers([]byte(v), net.IPv4len)
 	case []interface{}:
 		vars.Add("http responses with list peers", 1)
-		for _, i := range v {
-			var p Peer
-			p.FromDictInterface(i.(map[string]interface{}))
-			*me = append(*me, p)
-		}
-		return
+		ret, malformed = parseDictPeers(v)
 	default:
 		vars.Add("http responses with unhandled peers type", 1)
 		err = fmt.Errorf("unsupported type: %T", _v)
+	}
+	return
+}
+
+// Peers in compact IPv6 form (BEP 7). A truncated final entry is skipped.
+type Peers6 []Peer
+
+func (me *Peers6) UnmarshalBencode(b []byte) (err error) {
+	*me, _, err = parseHttpPeers6(b)
+	return
+}
+
+func (me Peers6) MarshalBencode() ([]byte, error) {
+	var nas krpc.CompactIPv6NodeAddrs
+	for _, p := range me {
+		nas = append(nas, krpc.NodeAddr{IP: p.IP, Port: p.Port})
+	}
+	return nas.MarshalBencode()
+}
+
+func parseHttpPeers6(b []byte) (ret []Peer, malformed int, err error) {
+	if len(b) == 0 {
 		return
 	}
+	var s string
+	err = bencode.Unmarshal(b, &s)
+	if err != nil {
+		return
+	}
+	ret, malformed = parseCompactPeers([]byte(s), net.IPv6len)
+	return
 }
 
 func setAnnounceParams(_url *url.URL, ar *AnnounceRequest, opts Announce) {
@@ -89,6 +168,9 @@ func setAnnounceParams(_url *url.URL, ar *AnnounceRequest, opts Announce) {
 	if ar.Event != None {
 		q.Set("event", ar.Event.String())
 	}
+	if opts.ReportCorrupt {
+		q.Set("corrupt", strconv.FormatInt(opts.Corrupt, 10))
+	}
 	// http://stackoverflow.com/questions/17418004/why-does-tracker-server-not-understand-my-request-bittorrent-protocol
 	q.Set("compact", "1")
 	// According to https://wiki.vuze.com/w/Message_Stream_Encryption. TODO:
@@ -103,29 +185,168 @@ func setAnnounceParams(_url *url.URL, ar *AnnounceRequest, opts Announce) {
 	_url.RawQuery = q.Encode()
 }
 
+type httpProxyContextKey struct{}
+
+type redirectPolicyContextKey struct{}
+
+// Limits the redirects followed for an announce, and records where they led.
+type redirectPolicy struct {
+	max            int
+	allowDowngrade bool
+	// The URL the announce was last redirected to, and whether all the redirects were permanent.
+	final     *url.URL
+	permanent bool
+}
+
+// Applies the redirectPolicy in the request context.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	p, _ := req.Context().Value(redirectPolicyContextKey{}).(*redirectPolicy)
+	if p == nil {
+		p = &redirectPolicy{max: DefaultMaxRedirects}
+	}
+	if len(via) > p.max {
+		return fmt.Errorf("stopped after %d redirects", p.max)
+	}
+	for _, r := range via {
+		if r.URL.String() == req.URL.String() {
+			return fmt.Errorf("redirect loop at %q", req.URL.String())
+		}
+	}
+	if !p.allowDowngrade && via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing redirect from https to %q", req.URL.String())
+	}
+	permanent := false
+	if req.Response != nil {
+		switch req.Response.StatusCode {
+		case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+			permanent = true
+		}
+	}
+	p.permanent = permanent && (p.final == nil || p.permanent)
+	p.final = req.URL
+	return nil
+}
+
+// The query parameters set by setAnnounceParams.
+var announceParams = []string{
+	"info_hash", "peer_id", "port", "uploaded", "downloaded", "left", "event", "compact",
+	"supportcrypto", "ipv4", "ipv6",
+}
+
+// Returns the tracker URL that the announce was redirected to. host replaces the host of requestUrl
+// where redirects stayed on it, such as when the announce was made to a resolved IP.
+func redirectedTrackerUrl(final, requestUrl *url.URL, host string) string {
+	u := httptoo.CopyURL(final)
+	q := u.Query()
+	for _, k := range announceParams {
+		q.Del(k)
+	}
+	u.RawQuery = q.Encode()
+	if host != "" && u.Host == requestUrl.Host {
+		u.Host = host
+	}
+	return u.String()
+}
+
+var (
+	httpClientsMu sync.Mutex
+	// Shared HTTP clients, keyed by TLS server name. Sharing the underlying Transport means idle
+	// connections to trackers are reused across announces, and across torrents.
+	httpClients = make(map[string]*http.Client)
+)
+
+// Returns a shared HTTP client for trackers with the given TLS server name. The proxy for each
+// request is taken from its context, so that connections are pooled per proxy.
+func httpClient(serverName string) *http.Client {
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+	if c, ok := httpClients[serverName]; ok {
+		return c
+	}
+	c := newHttpClient(defaultTLSConfig(serverName), nil)
+	httpClients[serverName] = c
+	return c
+}
+
+// Trackers' certificates aren't verified by default, as many are self-signed.
+func defaultTLSConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+	}
+}
+
+// Returns a new HTTP client for trackers with the given TLS config. If dial is nil, the default
+// dialer is used.
+func newHttpClient(tlsConfig *tls.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout: 15 * time.Second,
+		}).DialContext
+	}
+	return &http.Client{
+		Timeout:       time.Second * 15,
+		CheckRedirect: checkRedirect,
+		Transport: &http.Transport{
+			DialContext: dial,
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				proxy, _ := r.Context().Value(httpProxyContextKey{}).(func(*http.Request) (*url.URL, error))
+				if proxy == nil {
+					return nil, nil
+				}
+				return proxy(r)
+			},
+			TLSHandshakeTimeout: 15 * time.Second,
+			TLSClientConfig:     tlsConfig,
+			// Required for HTTP/2 since we provide our own TLS config.
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		},
+	}
+}
+
 func announceHTTP(opt Announce, _url *url.URL) (ret AnnounceResponse, err error) {
 	_url = httptoo.CopyURL(_url)
 	setAnnounceParams(_url, &opt.Request, opt)
 	req, err := http.NewRequest("GET", _url.String(), nil)
+	if err != nil {
+		return
+	}
 	req.Header.Set("User-Agent", opt.UserAgent)
 	req.Host = opt.HostHeader
-	if opt.Context != nil {
-		req = req.WithContext(opt.Context)
+	ctx := opt.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	resp, err := (&http.Client{
-		Timeout: time.Second * 15,
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout: 15 * time.Second,
-			}).Dial,
-			Proxy:               opt.HTTPProxy,
-			TLSHandshakeTimeout: 15 * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-				ServerName:         opt.ServerName,
-			},
-		},
-	}).Do(req)
+	if opt.HTTPProxy != nil {
+		ctx = context.WithValue(ctx, httpProxyContextKey{}, opt.HTTPProxy)
+	}
+	redirects := &redirectPolicy{
+		max:            opt.MaxRedirects,
+		allowDowngrade: opt.AllowRedirectDowngrade,
+	}
+	if redirects.max == 0 {
+		redirects.max = DefaultMaxRedirects
+	} else if redirects.max < 0 {
+		redirects.max = 0
+	}
+	ctx = context.WithValue(ctx, redirectPolicyContextKey{}, redirects)
+	req = req.WithContext(ctx)
+	client := httpClient(opt.ServerName)
+	if opt.DialContext != nil || opt.TLSConfig != nil {
+		// Connections from other dialers or TLS configs mustn't be reused for this one, or vice
+		// versa.
+		tlsConfig := defaultTLSConfig(opt.ServerName)
+		if opt.TLSConfig != nil {
+			tlsConfig = opt.TLSConfig.Clone()
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName = opt.ServerName
+			}
+		}
+		client = newHttpClient(tlsConfig, opt.DialContext)
+		defer client.CloseIdleConnections()
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return
 	}
@@ -149,6 +370,9 @@ func announceHTTP(opt Announce, _url *url.URL) (ret AnnounceResponse, err error)
 		return
 	}
 	vars.Add("successful http announces", 1)
+	if redirects.final != nil && redirects.permanent {
+		ret.RedirectedUrl = redirectedTrackerUrl(redirects.final, _url, opt.HostHeader)
+	}
 	ret.Interval = trackerResponse.Interval
 	ret.Leechers = trackerResponse.Incomplete
 	ret.Seeders = trackerResponse.Complete
@@ -159,11 +383,11 @@ func announceHTTP(opt Announce, _url *url.URL) (ret AnnounceResponse, err error)
 	if len(trackerResponse.Peers6) != 0 {
 		vars.Add("http responses with nonempty peers6 key", 1)
 	}
-	for _, na := range trackerResponse.Peers6 {
-		ret.Peers = append(ret.Peers, Peer{
-			IP:   na.IP,
-			Port: na.Port,
-		})
+	ret.Peers = append(ret.Peers, trackerResponse.Peers6...)
+	ret.MalformedPeers = trackerResponse.MalformedPeers
+	switch len(trackerResponse.ExternalIp) {
+	case net.IPv4len, net.IPv6len:
+		ret.ExternalIp = net.IP(trackerResponse.ExternalIp)
 	}
 	return
 }
@@ -1,6 +1,14 @@
 package tracker
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -49,3 +57,194 @@ func TestUnmarshalHttpResponsePeers6NotCompact(t *testing.T) {
 		&hr,
 	))
 }
+
+func TestUnmarshalHttpResponseMalformedPeers(t *testing.T) {
+	var hr HttpResponse
+	require.NoError(t, bencode.Unmarshal(
+		[]byte("d5:peers15:\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x1a\xe2\x09\x0a\x0b"+
+			"6:peers621:123412341234123456789e"),
+		&hr))
+	require.Len(t, hr.Peers, 2)
+	assert.Equal(t, "1.2.3.4", hr.Peers[0].IP.String())
+	assert.Equal(t, 6881, hr.Peers[0].Port)
+	assert.Equal(t, "5.6.7.8", hr.Peers[1].IP.String())
+	assert.Equal(t, 6882, hr.Peers[1].Port)
+	assert.Len(t, hr.Peers6, 1)
+	assert.Equal(t, 2, hr.MalformedPeers)
+	require.NoError(t, bencode.Unmarshal(
+		[]byte("d5:peersl"+
+			"d2:ip7:1.2.3.44:porti9999ee"+
+			"d2:ip7:1.2.3.5e"+
+			"d2:ip3:foo4:porti9999ee"+
+			"i42e"+
+			"ee"),
+		&hr))
+	require.Len(t, hr.Peers, 1)
+	assert.Equal(t, 9999, hr.Peers[0].Port)
+	assert.Equal(t, 3, hr.MalformedPeers)
+}
+
+func TestHttpAnnounceMalformedPeers(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers9:\x01\x02\x03\x04\x1a\xe1\x05\x06\x07e"))
+	}))
+	defer s.Close()
+	res, err := Announce{TrackerUrl: s.URL}.Do()
+	require.NoError(t, err)
+	require.Len(t, res.Peers, 1)
+	assert.Equal(t, "1.2.3.4", res.Peers[0].IP.String())
+	assert.Equal(t, 1, res.MalformedPeers)
+}
+
+// Check that announces to the same tracker reuse connections.
+func TestHttpAnnounceConnectionReuse(t *testing.T) {
+	var newConns int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bencode.MustMarshal(HttpResponse{Interval: 1800}))
+	}))
+	s.Config.ConnState = func(_ net.Conn, cs http.ConnState) {
+		if cs == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		res, err := Announce{
+			TrackerUrl: s.URL,
+			Request:    AnnounceRequest{InfoHash: [20]byte{byte(i)}},
+		}.Do()
+		require.NoError(t, err)
+		assert.EqualValues(t, 1800, res.Interval)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&newConns))
+}
+
+func TestHttpAnnounceExternalIp(t *testing.T) {
+	externalIp := "\x01\x02\x03\x04"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bencode.MustMarshal(HttpResponse{Interval: 1800, ExternalIp: externalIp}))
+	}))
+	defer s.Close()
+	announce := func() AnnounceResponse {
+		res, err := Announce{TrackerUrl: s.URL}.Do()
+		require.NoError(t, err)
+		return res
+	}
+	assert.EqualValues(t, "1.2.3.4", announce().ExternalIp.String())
+	// Malformed IPs are ignored.
+	externalIp = "\x01\x02\x03"
+	assert.Nil(t, announce().ExternalIp)
+}
+
+func TestHttpAnnounceCorrupt(t *testing.T) {
+	var query url.Values
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write(bencode.MustMarshal(HttpResponse{Interval: 1800}))
+	}))
+	defer s.Close()
+	_, err := Announce{TrackerUrl: s.URL, Corrupt: 42}.Do()
+	require.NoError(t, err)
+	assert.NotContains(t, query, "corrupt")
+	_, err = Announce{TrackerUrl: s.URL, ReportCorrupt: true, Corrupt: 42}.Do()
+	require.NoError(t, err)
+	assert.Equal(t, "42", query.Get("corrupt"))
+	_, err = Announce{TrackerUrl: s.URL, ReportCorrupt: true}.Do()
+	require.NoError(t, err)
+	assert.Equal(t, "0", query.Get("corrupt"))
+}
+
+func TestHttpAnnounceDialContext(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bencode.MustMarshal(HttpResponse{Interval: 1800}))
+	}))
+	defer s.Close()
+	var dialed []string
+	a := Announce{
+		TrackerUrl: s.URL,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}
+	_, err := a.Do()
+	require.NoError(t, err)
+	// Connections from the dialer aren't pooled, and those of the shared client aren't used.
+	_, err = Announce{TrackerUrl: s.URL}.Do()
+	require.NoError(t, err)
+	_, err = a.Do()
+	require.NoError(t, err)
+	assert.Equal(t, []string{s.Listener.Addr().String(), s.Listener.Addr().String()}, dialed)
+}
+
+func TestHttpsAnnounceTLSConfig(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bencode.MustMarshal(HttpResponse{Interval: 1800}))
+	}))
+	defer s.Close()
+	announce := func(roots *x509.CertPool) error {
+		_, err := Announce{
+			TrackerUrl: s.URL,
+			ServerName: "example.com",
+			TLSConfig:  &tls.Config{RootCAs: roots},
+		}.Do()
+		return err
+	}
+	// The test server's certificate is for example.com, and signed by its own CA.
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	require.NoError(t, announce(roots))
+	assert.Error(t, announce(x509.NewCertPool()))
+	// The default doesn't verify certificates.
+	_, err := Announce{TrackerUrl: s.URL}.Do()
+	assert.NoError(t, err)
+}
+
+func TestHttpAnnounceRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bencode.MustMarshal(HttpResponse{Interval: 1800}))
+	})
+	mux.Handle("/moved", http.RedirectHandler("/announce?key=a", http.StatusMovedPermanently))
+	mux.Handle("/temporary", http.RedirectHandler("/moved", http.StatusFound))
+	mux.Handle("/loop", http.RedirectHandler("/loop", http.StatusFound))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	announce := func(path string, maxRedirects int) (AnnounceResponse, error) {
+		return Announce{
+			TrackerUrl:   s.URL + path,
+			Request:      AnnounceRequest{Event: Started},
+			MaxRedirects: maxRedirects,
+		}.Do()
+	}
+	res, err := announce("/moved", 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1800, res.Interval)
+	// The announce parameters aren't part of the new tracker URL.
+	assert.Equal(t, s.URL+"/announce?key=a", res.RedirectedUrl)
+	// The tracker URL isn't permanently changed if any redirect was temporary.
+	res, err = announce("/temporary", 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.RedirectedUrl)
+	_, err = announce("/temporary", 1)
+	assert.Error(t, err)
+	_, err = announce("/moved", -1)
+	assert.Error(t, err)
+	_, err = announce("/loop", 0)
+	assert.Error(t, err)
+}
+
+func TestHttpAnnounceRedirectDowngrade(t *testing.T) {
+	insecure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bencode.MustMarshal(HttpResponse{Interval: 1800}))
+	}))
+	defer insecure.Close()
+	s := httptest.NewTLSServer(http.RedirectHandler(insecure.URL, http.StatusFound))
+	defer s.Close()
+	_, err := Announce{TrackerUrl: s.URL}.Do()
+	assert.Error(t, err)
+	res, err := Announce{TrackerUrl: s.URL, AllowRedirectDowngrade: true}.Do()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1800, res.Interval)
+}
@@ -1,6 +1,7 @@
 package tracker
 
 import (
+	"encoding/binary"
 	"net"
 
 	"github.com/anacrolix/dht/v2/krpc"
@@ -21,8 +22,60 @@ func (p *Peer) FromDictInterface(d map[string]interface{}) {
 	p.Port = int(d["port"].(int64))
 }
 
+// Like FromDictInterface, but returns false instead of panicking if the entry isn't a dict with a
+// valid IP and port.
+func (p *Peer) fromDict(v interface{}) bool {
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	ip, _ := d["ip"].(string)
+	port, ok := d["port"].(int64)
+	if !ok || port <= 0 || port > 0xffff {
+		return false
+	}
+	p.IP = net.ParseIP(ip)
+	if p.IP == nil {
+		return false
+	}
+	p.Port = int(port)
+	if id, ok := d["peer id"].(string); ok {
+		p.ID = []byte(id)
+	}
+	return true
+}
+
 func (p Peer) FromNodeAddr(na krpc.NodeAddr) Peer {
 	p.IP = na.IP
 	p.Port = na.Port
 	return p
 }
+
+// Parses compact peers, each an IP of ipLen bytes and a port. A truncated final entry is skipped
+// and counted as malformed.
+func parseCompactPeers(b []byte, ipLen int) (ret []Peer, malformed int) {
+	entryLen := ipLen + 2
+	for ; len(b) >= entryLen; b = b[entryLen:] {
+		ret = append(ret, Peer{
+			IP:   append(net.IP(nil), b[:ipLen]...),
+			Port: int(binary.BigEndian.Uint16(b[ipLen:])),
+		})
+	}
+	if len(b) != 0 {
+		malformed = 1
+	}
+	return
+}
+
+// Parses non-compact peers, skipping those that aren't valid.
+func parseDictPeers(l []interface{}) (ret []Peer, malformed int) {
+	for _, v := range l {
+		var p Peer
+		if !p.fromDict(v) {
+			malformed++
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return
+}
@@ -22,6 +22,8 @@ type server struct {
 	pc    net.PacketConn
 	conns map[int64]struct{}
 	t     map[[20]byte]torrent
+	// Error responses for announces of these infohashes.
+	errs map[[20]byte]string
 }
 
 func marshal(parts ...interface{}) (ret []byte, err error) {
@@ -92,6 +94,13 @@ func (s *server) serveOne() (err error) {
 		if err != nil {
 			return
 		}
+		if msg, ok := s.errs[ar.InfoHash]; ok {
+			s.respond(addr, ResponseHeader{
+				TransactionId: h.TransactionId,
+				Action:        ActionError,
+			}, []byte(msg))
+			return
+		}
 		t := s.t[ar.InfoHash]
 		bm := func() encoding.BinaryMarshaler {
 			ip := missinggo.AddrIP(addr)
@@ -113,6 +122,28 @@ func (s *server) serveOne() (err error) {
 			Seeders:  t.Seeders,
 		}, b)
 		return
+	case ActionScrape:
+		if _, ok := s.conns[h.ConnectionId]; !ok {
+			s.respond(addr, ResponseHeader{
+				TransactionId: h.TransactionId,
+				Action:        ActionError,
+			}, []byte("not connected"))
+			return
+		}
+		var parts []interface{}
+		for {
+			var ih [20]byte
+			if readBody(r, &ih) != nil {
+				break
+			}
+			t := s.t[ih]
+			parts = append(parts, ScrapeResult{Seeders: t.Seeders, Leechers: t.Leechers})
+		}
+		err = s.respond(addr, ResponseHeader{
+			TransactionId: h.TransactionId,
+			Action:        ActionScrape,
+		}, parts...)
+		return
 	default:
 		err = fmt.Errorf("unhandled action: %d", h.Action)
 		s.respond(addr, ResponseHeader{
@@ -2,7 +2,9 @@ package tracker
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"net"
 	"net/http"
 	"net/url"
 
@@ -30,6 +32,14 @@ type AnnounceResponse struct {
 	Leechers int32
 	Seeders  int32
 	Peers    []Peer
+	// Peer entries in the response that were malformed and skipped, such as a truncated compact
+	// entry, or a dict without a valid IP or port.
+	MalformedPeers int
+	// Our IP as the tracker sees it, if the tracker reports it.
+	ExternalIp net.IP
+	// The tracker URL that HTTP announces were permanently redirected to (301 or 308), without the
+	// announce parameters. Empty if there was no redirect, or any redirect was temporary.
+	RedirectedUrl string
 }
 
 type AnnounceEvent int32
@@ -50,6 +60,9 @@ var (
 	ErrBadScheme = errors.New("unknown scheme")
 )
 
+// The most redirects followed for HTTP announces if Announce.MaxRedirects is zero.
+const DefaultMaxRedirects = 10
+
 type Announce struct {
 	TrackerUrl string
 	Request    AnnounceRequest
@@ -63,6 +76,22 @@ type Announce struct {
 	// If the port is zero, it's assumed to be the same as the Request.Port.
 	ClientIp6 krpc.NodeAddr
 	Context   context.Context
+	// If set, used to connect to the tracker instead of the default dialer. HTTP connections made
+	// with it aren't pooled with others.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// If set, used for HTTPS announces instead of the default, which doesn't verify the tracker's
+	// certificate. ServerName is used if the config doesn't set one. HTTP connections made with it
+	// aren't pooled with others.
+	TLSConfig *tls.Config
+	// The most redirects followed for HTTP announces. If zero, DefaultMaxRedirects is used. If
+	// negative, redirects fail the announce.
+	MaxRedirects int
+	// Allow HTTP announces to be redirected from https to http.
+	AllowRedirectDowngrade bool
+	// Send Corrupt, the bytes received that failed hash checks, to HTTP trackers with the
+	// "corrupt" key (BEP 21).
+	ReportCorrupt bool
+	Corrupt       int64
 }
 
 func (me Announce) Do() (res AnnounceResponse, err error) {
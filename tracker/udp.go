@@ -3,16 +3,16 @@ package tracker
 import (
 	"bytes"
 	"context"
-	"encoding"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/anacrolix/dht/v2/krpc"
 	"github.com/anacrolix/missinggo"
 	"github.com/anacrolix/missinggo/pproffd"
 	"github.com/pkg/errors"
@@ -80,11 +80,88 @@ type udpAnnounce struct {
 	contiguousTimeouts   int
 	connectionIdReceived time.Time
 	connectionId         int64
-	socket               net.Conn
-	url                  url.URL
-	a                    *Announce
+	// The connection ID came from an earlier announce to the same tracker.
+	reusedConnectionId bool
+	socket             net.Conn
+	url                url.URL
+	a                  *Announce
 }
 
+type udpConnectionId struct {
+	id       int64
+	received time.Time
+}
+
+// Connection IDs by tracker address. BEP 15 permits a connection ID to be used for a minute after
+// it's received, so announces for many torrents to the same tracker can share one, rather than
+// each needing a connect round trip.
+var udpConnectionIds = struct {
+	mu sync.Mutex
+	m  map[string]udpConnectionId
+}{}
+
+func getUdpConnectionId(key string) (ret udpConnectionId, ok bool) {
+	udpConnectionIds.mu.Lock()
+	defer udpConnectionIds.mu.Unlock()
+	ret, ok = udpConnectionIds.m[key]
+	if ok && time.Since(ret.received) >= time.Minute {
+		delete(udpConnectionIds.m, key)
+		ok = false
+	}
+	return
+}
+
+func setUdpConnectionId(key string, id udpConnectionId) {
+	udpConnectionIds.mu.Lock()
+	defer udpConnectionIds.mu.Unlock()
+	if udpConnectionIds.m == nil {
+		udpConnectionIds.m = make(map[string]udpConnectionId)
+	}
+	udpConnectionIds.m[key] = id
+}
+
+// Forgets a connection ID, unless it has already been replaced.
+func forgetUdpConnectionId(key string, id int64) {
+	udpConnectionIds.mu.Lock()
+	defer udpConnectionIds.mu.Unlock()
+	if udpConnectionIds.m[key].id == id {
+		delete(udpConnectionIds.m, key)
+	}
+}
+
+// An error response from the tracker.
+type udpErrorResponse string
+
+func (me udpErrorResponse) Error() string {
+	return string(me)
+}
+
+// Whether the tracker rejected the connection ID, such as because it expired or was issued to
+// another address. BEP 15 doesn't define error codes, and trackers word this differently ("Connection
+// ID missmatch.", "invalid connection id", "not connected"), but they all mention connecting.
+func (me udpErrorResponse) connectionIdRejected() bool {
+	return strings.Contains(strings.ToLower(string(me)), "connect")
+}
+
+// The result of one announce in a batch. See AnnounceUDPBatch.
+type BatchAnnounceResult struct {
+	Response AnnounceResponse
+	Err      error
+	// There was no response to the announce, such as when the exchange timed out, or the tracker
+	// doesn't handle more than one request at a time.
+	Unanswered bool
+}
+
+// The counts for an infohash in a BEP 15 scrape response.
+type ScrapeResult struct {
+	Seeders   int32
+	Completed int32
+	Leechers  int32
+}
+
+// The most infohashes BEP 15 allows in one scrape request.
+const MaxUdpScrapeInfoHashes = 74
+
 func (c *udpAnnounce) Close() error {
 	if c.socket != nil {
 		return c.socket.Close()
@@ -101,24 +178,121 @@ func (c *udpAnnounce) ipv6() bool {
 }
 
 func (c *udpAnnounce) Do(req AnnounceRequest) (res AnnounceResponse, err error) {
+	rs, err := c.DoBatch([]AnnounceRequest{req})
+	if err != nil {
+		return
+	}
+	return rs[0].Response, rs[0].Err
+}
+
+// Announces each of the requests, sharing the connection ID and socket. The returned error is for
+// failures affecting all of them, such as not being able to connect.
+func (c *udpAnnounce) DoBatch(reqs []AnnounceRequest) (ret []BatchAnnounceResult, err error) {
+	ret, err = c.doBatch(reqs)
+	if err != nil || !c.reusedConnectionId {
+		return
+	}
+	var retry []int
+	for i, r := range ret {
+		if e, ok := r.Err.(udpErrorResponse); ok && e.connectionIdRejected() {
+			retry = append(retry, i)
+		}
+	}
+	if len(retry) == 0 {
+		return
+	}
+	// The tracker may not accept the connection ID from another announce, such as if it was
+	// issued for a different source address. Try again with a fresh one.
+	vars.Add("udp reused connection id rejected", 1)
+	forgetUdpConnectionId(c.connectionIdKey(), c.connectionId)
+	c.connectionIdReceived = time.Time{}
+	c.reusedConnectionId = false
+	again := make([]AnnounceRequest, 0, len(retry))
+	for _, i := range retry {
+		again = append(again, reqs[i])
+	}
+	rs, err := c.doBatch(again)
+	for j, i := range retry {
+		if err != nil {
+			ret[i].Err = err
+		} else {
+			ret[i] = rs[j]
+		}
+	}
+	return ret, nil
+}
+
+func (c *udpAnnounce) doBatch(reqs []AnnounceRequest) (ret []BatchAnnounceResult, err error) {
 	err = c.connect()
 	if err != nil {
 		return
 	}
-	reqURI := c.url.RequestURI()
-	if c.ipv6() {
-		// BEP 15
-		req.IPAddress = 0
-	} else if req.IPAddress == 0 && c.a.ClientIp4.IP != nil {
-		req.IPAddress = binary.BigEndian.Uint32(c.a.ClientIp4.IP.To4())
+	args := make([]interface{}, 0, len(reqs))
+	for _, req := range reqs {
+		if c.ipv6() {
+			// BEP 15
+			req.IPAddress = 0
+		} else if req.IPAddress == 0 && c.a.ClientIp4.IP != nil {
+			req.IPAddress = binary.BigEndian.Uint32(c.a.ClientIp4.IP.To4())
+		}
+		args = append(args, req)
 	}
+	ret = make([]BatchAnnounceResult, len(reqs))
+	for i, r := range c.requests(ActionAnnounce, args, c.urlDataOption()) {
+		if r.err != nil {
+			ret[i].Err = r.err
+			ret[i].Unanswered = r.unanswered
+			continue
+		}
+		ret[i].Response, ret[i].Err = parseUdpAnnounceResponse(r.buf, c.ipv6())
+	}
+	return
+}
+
+// Returns the BEP 41 option carrying the request URI.
+func (c *udpAnnounce) urlDataOption() []byte {
+	reqURI := c.url.RequestURI()
 	// Clearly this limits the request URI to 255 bytes. BEP 41 supports
 	// longer but I'm not fussed.
-	options := append([]byte{optionTypeURLData, byte(len(reqURI))}, []byte(reqURI)...)
-	b, err := c.request(ActionAnnounce, req, options)
-	if err != nil {
+	return append([]byte{optionTypeURLData, byte(len(reqURI))}, []byte(reqURI)...)
+}
+
+// Scrapes the infohashes, which must be no more than MaxUdpScrapeInfoHashes, in a single request.
+func (c *udpAnnounce) scrape(infoHashes [][20]byte) (ret []ScrapeResult, err error) {
+	if len(infoHashes) > MaxUdpScrapeInfoHashes {
+		return nil, fmt.Errorf("can't scrape more than %d infohashes at once", MaxUdpScrapeInfoHashes)
+	}
+	for attempt := 0; ; attempt++ {
+		err = c.connect()
+		if err != nil {
+			return
+		}
+		var b *bytes.Buffer
+		// BEP 41 options only follow announces, as a scrape's length gives the infohash count.
+		b, err = c.request(ActionScrape, infoHashes, nil)
+		if e, ok := err.(udpErrorResponse); ok && e.connectionIdRejected() && c.reusedConnectionId && attempt == 0 {
+			forgetUdpConnectionId(c.connectionIdKey(), c.connectionId)
+			c.connectionIdReceived = time.Time{}
+			c.reusedConnectionId = false
+			continue
+		}
+		if err != nil {
+			return
+		}
+		ret = make([]ScrapeResult, len(infoHashes))
+		for i := range ret {
+			err = readBody(b, &ret[i])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing scrape response: %s", io.ErrUnexpectedEOF)
+			}
+		}
 		return
 	}
+}
+
+// Parses the body of an announce response. Per BEP 15, peers are 18 byte IPv6 entries if the
+// announce was made over IPv6, and 6 byte IPv4 entries otherwise.
+func parseUdpAnnounceResponse(b *bytes.Buffer, ipv6 bool) (res AnnounceResponse, err error) {
 	var h AnnounceResponseHeader
 	err = readBody(b, &h)
 	if err != nil {
@@ -131,23 +305,11 @@ func (c *udpAnnounce) Do(req AnnounceRequest) (res AnnounceResponse, err error)
 	res.Interval = h.Interval
 	res.Leechers = h.Leechers
 	res.Seeders = h.Seeders
-	nas := func() interface {
-		encoding.BinaryUnmarshaler
-		NodeAddrs() []krpc.NodeAddr
-	} {
-		if c.ipv6() {
-			return &krpc.CompactIPv6NodeAddrs{}
-		} else {
-			return &krpc.CompactIPv4NodeAddrs{}
-		}
-	}()
-	err = nas.UnmarshalBinary(b.Bytes())
-	if err != nil {
-		return
-	}
-	for _, cp := range nas.NodeAddrs() {
-		res.Peers = append(res.Peers, Peer{}.FromNodeAddr(cp))
+	ipLen := net.IPv4len
+	if ipv6 {
+		ipLen = net.IPv6len
 	}
+	res.Peers, res.MalformedPeers = parseCompactPeers(b.Bytes(), ipLen)
 	return
 }
 
@@ -190,21 +352,48 @@ func write(w io.Writer, data interface{}) error {
 // args is the binary serializable request body. trailer is optional data
 // following it, such as for BEP 41.
 func (c *udpAnnounce) request(action Action, args interface{}, options []byte) (*bytes.Buffer, error) {
-	tid := newTransactionId()
-	if err := errors.Wrap(
-		c.write(
-			&RequestHeader{
-				ConnectionId:  c.connectionId,
-				Action:        action,
-				TransactionId: tid,
-			}, args, options),
-		"writing request",
-	); err != nil {
-		return nil, err
+	r := c.requests(action, []interface{}{args}, options)[0]
+	return r.buf, r.err
+}
+
+// The response to one of the requests sent by udpAnnounce.requests.
+type udpResponse struct {
+	buf *bytes.Buffer
+	err error
+	// There was no response, and err is why.
+	unanswered bool
+}
+
+// Sends a request for each of args, and then reads responses until each request has one,
+// matching them by transaction ID. Requests that fail, or that have no response before the
+// timeout, get an error.
+func (c *udpAnnounce) requests(action Action, args []interface{}, options []byte) (ret []udpResponse) {
+	ret = make([]udpResponse, len(args))
+	tids := make(map[int32]int, len(args))
+	for i, a := range args {
+		tid := newTransactionId()
+		for _, ok := tids[tid]; ok; _, ok = tids[tid] {
+			tid = newTransactionId()
+		}
+		tids[tid] = i
+		if err := errors.Wrap(
+			c.write(
+				&RequestHeader{
+					ConnectionId:  c.connectionId,
+					Action:        action,
+					TransactionId: tid,
+				}, a, options),
+			"writing request",
+		); err != nil {
+			for j := range ret {
+				ret[j].err = err
+			}
+			return
+		}
 	}
 	c.socket.SetReadDeadline(time.Now().Add(timeout(c.contiguousTimeouts)))
 	b := make([]byte, 0x800) // 2KiB
-	for {
+	for len(tids) != 0 {
 		var (
 			n        int
 			readErr  error
@@ -220,16 +409,23 @@ func (c *udpAnnounce) request(action Action, args interface{}, options []byte) (
 		}
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			readErr = ctx.Err()
 		case <-readDone:
-		}
-		if opE, ok := readErr.(*net.OpError); ok && opE.Timeout() {
-			c.contiguousTimeouts++
+			if opE, ok := readErr.(*net.OpError); ok && opE.Timeout() {
+				c.contiguousTimeouts++
+			}
+			if readErr != nil {
+				readErr = errors.Wrap(readErr, "reading from socket")
+			}
 		}
 		if readErr != nil {
-			return nil, errors.Wrap(readErr, "reading from socket")
+			for _, i := range tids {
+				ret[i].err = readErr
+				ret[i].unanswered = true
+			}
+			return
 		}
-		buf := bytes.NewBuffer(b[:n])
+		buf := bytes.NewBuffer(append([]byte(nil), b[:n]...))
 		var h ResponseHeader
 		err := binary.Read(buf, binary.BigEndian, &h)
 		switch err {
@@ -239,15 +435,19 @@ func (c *udpAnnounce) request(action Action, args interface{}, options []byte) (
 			continue
 		case nil:
 		}
-		if h.TransactionId != tid {
+		i, ok := tids[h.TransactionId]
+		if !ok {
 			continue
 		}
+		delete(tids, h.TransactionId)
 		c.contiguousTimeouts = 0
 		if h.Action == ActionError {
-			err = errors.New(buf.String())
+			ret[i].err = udpErrorResponse(buf.String())
+		} else {
+			ret[i].buf = buf
 		}
-		return buf, err
 	}
+	return
 }
 
 func readBody(r io.Reader, data ...interface{}) (err error) {
@@ -271,23 +471,46 @@ func (c *udpAnnounce) dialNetwork() string {
 	return "udp"
 }
 
+func (c *udpAnnounce) hostPort() string {
+	hmp := missinggo.SplitHostMaybePort(c.url.Host)
+	if hmp.NoPort {
+		hmp.NoPort = false
+		hmp.Port = 80
+	}
+	return hmp.String()
+}
+
+func (c *udpAnnounce) connectionIdKey() string {
+	return c.dialNetwork() + "/" + c.hostPort()
+}
+
 func (c *udpAnnounce) connect() (err error) {
 	if c.connected() {
 		return nil
 	}
-	c.connectionId = connectRequestConnectionId
 	if c.socket == nil {
-		hmp := missinggo.SplitHostMaybePort(c.url.Host)
-		if hmp.NoPort {
-			hmp.NoPort = false
-			hmp.Port = 80
+		if c.a.DialContext != nil {
+			ctx := c.a.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			c.socket, err = c.a.DialContext(ctx, c.dialNetwork(), c.hostPort())
+		} else {
+			c.socket, err = net.Dial(c.dialNetwork(), c.hostPort())
 		}
-		c.socket, err = net.Dial(c.dialNetwork(), hmp.String())
 		if err != nil {
 			return
 		}
 		c.socket = pproffd.WrapNetConn(c.socket)
 	}
+	if id, ok := getUdpConnectionId(c.connectionIdKey()); ok {
+		vars.Add("udp reused connection id", 1)
+		c.connectionId = id.id
+		c.connectionIdReceived = id.received
+		c.reusedConnectionId = true
+		return
+	}
+	c.connectionId = connectRequestConnectionId
 	b, err := c.request(ActionConnect, nil, nil)
 	if err != nil {
 		return
@@ -299,6 +522,8 @@ func (c *udpAnnounce) connect() (err error) {
 	}
 	c.connectionId = res.ConnectionId
 	c.connectionIdReceived = time.Now()
+	c.reusedConnectionId = false
+	setUdpConnectionId(c.connectionIdKey(), udpConnectionId{c.connectionId, c.connectionIdReceived})
 	return
 }
 
@@ -312,3 +537,51 @@ func announceUDP(opt Announce, _url *url.URL) (AnnounceResponse, error) {
 	defer ua.Close()
 	return ua.Do(opt.Request)
 }
+
+func parseUdpTrackerUrl(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "udp4", "udp6":
+		return u, nil
+	default:
+		return nil, ErrBadScheme
+	}
+}
+
+// Announces several torrents to the UDP tracker at opt.TrackerUrl in one exchange: one connect,
+// if a connection ID isn't already held, and then all the announces are sent over the same socket
+// before the responses are read and matched back to them. opt.Request is ignored. The results are
+// in the order of reqs. The returned error is for failures affecting the whole batch, such as not
+// being able to connect, in which case there are no results. Not all trackers handle a batch, so
+// unanswered announces may be worth retrying alone.
+func AnnounceUDPBatch(opt Announce, reqs []AnnounceRequest) ([]BatchAnnounceResult, error) {
+	u, err := parseUdpTrackerUrl(opt.TrackerUrl)
+	if err != nil {
+		return nil, err
+	}
+	ua := udpAnnounce{
+		url: *u,
+		a:   &opt,
+	}
+	defer ua.Close()
+	return ua.DoBatch(reqs)
+}
+
+// Scrapes up to MaxUdpScrapeInfoHashes infohashes from the UDP tracker at opt.TrackerUrl in a
+// single BEP 15 scrape request. opt.Request is ignored. The results are in the order of
+// infoHashes.
+func ScrapeUDP(opt Announce, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	u, err := parseUdpTrackerUrl(opt.TrackerUrl)
+	if err != nil {
+		return nil, err
+	}
+	ua := udpAnnounce{
+		url: *u,
+		a:   &opt,
+	}
+	defer ua.Close()
+	return ua.scrape(infoHashes)
+}
@@ -234,3 +234,186 @@ func TestURLPathOption(t *testing.T) {
 	write(w, AnnounceResponseHeader{})
 	conn.WriteTo(w.Bytes(), addr)
 }
+
+func TestUDPConnectionIdReuse(t *testing.T) {
+	var ih [20]byte
+	ih[0] = 1
+	srv := server{
+		t: map[[20]byte]torrent{
+			ih: {Seeders: 3},
+		},
+	}
+	var err error
+	srv.pc, err = net.ListenPacket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer srv.pc.Close()
+	serve := func(packets int) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < packets; i++ {
+				if err := srv.serveOne(); err != nil {
+					t.Log(err)
+				}
+			}
+		}()
+		return done
+	}
+	announce := func() {
+		ar, err := Announce{
+			TrackerUrl: fmt.Sprintf("udp://%s/announce", srv.pc.LocalAddr().String()),
+			Request:    AnnounceRequest{InfoHash: ih, NumWant: -1},
+			UdpNetwork: "udp4",
+		}.Do()
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, ar.Seeders)
+	}
+	// The second announce reuses the connection ID from the first, so only one connect and two
+	// announces are needed.
+	done := serve(3)
+	announce()
+	announce()
+	<-done
+	assert.Len(t, srv.conns, 1)
+	// The tracker has forgotten the connection ID, so the client connects again after the
+	// rejection.
+	srv.conns = nil
+	done = serve(3)
+	announce()
+	<-done
+	assert.Len(t, srv.conns, 1)
+}
+
+func TestParseUdpAnnounceResponseIPv6(t *testing.T) {
+	var w bytes.Buffer
+	write(&w, AnnounceResponseHeader{Interval: 900, Leechers: 1, Seeders: 2})
+	peers, err := krpc.CompactIPv6NodeAddrs{
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.ParseIP("2001:db8::2"), Port: 6882},
+	}.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, peers, 36)
+	w.Write(peers)
+	b := w.Bytes()
+	res, err := parseUdpAnnounceResponse(bytes.NewBuffer(b), true)
+	require.NoError(t, err)
+	assert.EqualValues(t, 900, res.Interval)
+	assert.EqualValues(t, 2, res.Seeders)
+	require.Len(t, res.Peers, 2)
+	assert.Equal(t, "2001:db8::1", res.Peers[0].IP.String())
+	assert.Equal(t, 6881, res.Peers[0].Port)
+	assert.Equal(t, "2001:db8::2", res.Peers[1].IP.String())
+	assert.Equal(t, 6882, res.Peers[1].Port)
+	assert.Zero(t, res.MalformedPeers)
+	// An IPv4 entry left over isn't a whole IPv6 one, and is skipped.
+	res, err = parseUdpAnnounceResponse(bytes.NewBuffer(append(b, 1, 2, 3, 4, 0, 1)), true)
+	require.NoError(t, err)
+	assert.Len(t, res.Peers, 2)
+	assert.Equal(t, 1, res.MalformedPeers)
+}
+
+func TestAnnounceUDP6(t *testing.T) {
+	var ih [20]byte
+	ih[0] = 1
+	srv := server{
+		t: map[[20]byte]torrent{
+			ih: {Peers: []krpc.NodeAddr{{IP: net.ParseIP("2001:db8::1"), Port: 6881}}},
+		},
+	}
+	var err error
+	srv.pc, err = net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer srv.pc.Close()
+	go func() {
+		for i := 0; i < 2; i++ {
+			srv.serveOne()
+		}
+	}()
+	ar, err := Announce{
+		TrackerUrl: fmt.Sprintf("udp://%s/announce", srv.pc.LocalAddr().String()),
+		Request:    AnnounceRequest{InfoHash: ih, NumWant: -1},
+		UdpNetwork: "udp6",
+	}.Do()
+	require.NoError(t, err)
+	require.Len(t, ar.Peers, 1)
+	assert.Equal(t, "2001:db8::1", ar.Peers[0].IP.String())
+	assert.Equal(t, 6881, ar.Peers[0].Port)
+}
+
+func TestAnnounceUDPBatch(t *testing.T) {
+	var ihs [3][20]byte
+	for i := range ihs {
+		ihs[i][0] = byte(i + 1)
+	}
+	srv := server{
+		t: map[[20]byte]torrent{
+			ihs[0]: {Seeders: 1},
+			ihs[1]: {Seeders: 2},
+		},
+		errs: map[[20]byte]string{
+			ihs[2]: "torrent not registered",
+		},
+	}
+	var err error
+	srv.pc, err = net.ListenPacket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer srv.pc.Close()
+	trackerUrl := fmt.Sprintf("udp://%s/announce", srv.pc.LocalAddr().String())
+	// One connect, and an announce for each torrent. The tracker's error isn't retried.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 4; i++ {
+			if err := srv.serveOne(); err != nil {
+				t.Log(err)
+			}
+		}
+	}()
+	var reqs []AnnounceRequest
+	for _, ih := range ihs {
+		reqs = append(reqs, AnnounceRequest{InfoHash: ih, NumWant: -1})
+	}
+	rs, err := AnnounceUDPBatch(Announce{TrackerUrl: trackerUrl, UdpNetwork: "udp4"}, reqs)
+	require.NoError(t, err)
+	<-done
+	require.Len(t, rs, 3)
+	require.NoError(t, rs[0].Err)
+	assert.EqualValues(t, 1, rs[0].Response.Seeders)
+	require.NoError(t, rs[1].Err)
+	assert.EqualValues(t, 2, rs[1].Response.Seeders)
+	assert.EqualError(t, rs[2].Err, "torrent not registered")
+	assert.Len(t, srv.conns, 1)
+}
+
+func TestScrapeUDP(t *testing.T) {
+	var ih1, ih2 [20]byte
+	ih1[0] = 1
+	ih2[0] = 2
+	srv := server{
+		t: map[[20]byte]torrent{
+			ih1: {Seeders: 1, Leechers: 2},
+			ih2: {Seeders: 3},
+		},
+	}
+	var err error
+	srv.pc, err = net.ListenPacket("udp", "localhost:0")
+	require.NoError(t, err)
+	defer srv.pc.Close()
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := srv.serveOne(); err != nil {
+				t.Log(err)
+			}
+		}
+	}()
+	rs, err := ScrapeUDP(Announce{
+		TrackerUrl: fmt.Sprintf("udp://%s/announce", srv.pc.LocalAddr().String()),
+		UdpNetwork: "udp4",
+	}, [][20]byte{ih1, ih2})
+	require.NoError(t, err)
+	assert.Equal(t, []ScrapeResult{{Seeders: 1, Leechers: 2}, {Seeders: 3}}, rs)
+	_, err = ScrapeUDP(Announce{TrackerUrl: "udp://localhost:1"}, make([][20]byte, MaxUdpScrapeInfoHashes+1))
+	assert.Error(t, err)
+}
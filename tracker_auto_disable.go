@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// The state of one of a torrent's trackers.
+type TrackerStatus struct {
+	URL url.URL
+	// The result of the last announce. LastAnnounce is zero if there hasn't been one.
+	LastAnnounce time.Time
+	LastErr      error
+	LastNumPeers int
+	// How long until the next regular announce after the last, once clamped by
+	// ClientConfig.TrackerMinAnnounceInterval and TrackerMaxAnnounceInterval.
+	LastInterval time.Duration
+	// Consecutive announces that failed, and that asked for peers and succeeded without any.
+	ConsecutiveErrors int
+	ConsecutiveEmpty  int
+	// Why the tracker was disabled by ClientConfig.TrackerAutoDisableErrors or
+	// ClientConfig.TrackerAutoDisableEmpty, or empty if it isn't disabled.
+	AutoDisabled string
+}
+
+func (cl *Client) trackerRetestInterval() time.Duration {
+	if d := cl.config.TrackerAutoDisableRetestInterval; d > 0 {
+		return d
+	}
+	return defaultTrackerAutoDisableRetestInterval
+}
+
+// Updates the tracker's counts with an announce result, disabling or re-enabling it as
+// configured.
+func (me *trackerScraper) updateAutoDisable(ar trackerAnnounceResult) {
+	cfg := me.t.cl.config
+	switch {
+	case ar.Err != nil:
+		me.consecutiveErrors++
+		me.consecutiveEmpty = 0
+	case ar.NumPeers == 0:
+		me.consecutiveErrors = 0
+		if !ar.WantedPeers {
+			// Says nothing about whether the tracker has peers for us, but it's working, as it
+			// always will be when seeding.
+			me.reenable()
+			return
+		}
+		if me.autoDisabledForErrors {
+			me.reenable()
+		}
+		me.consecutiveEmpty++
+	default:
+		me.consecutiveErrors = 0
+		me.consecutiveEmpty = 0
+		me.reenable()
+		return
+	}
+	if me.autoDisabled != "" {
+		return
+	}
+	if n := cfg.TrackerAutoDisableErrors; n > 0 && me.consecutiveErrors >= n {
+		me.autoDisabled = fmt.Sprintf("%d consecutive failed announces: %v", me.consecutiveErrors, ar.Err)
+		me.autoDisabledForErrors = true
+	} else if n := cfg.TrackerAutoDisableEmpty; n > 0 && me.consecutiveEmpty >= n {
+		me.autoDisabled = fmt.Sprintf("%d consecutive announces without peers", me.consecutiveEmpty)
+	} else {
+		return
+	}
+	me.logger().Printf("disabling tracker %q: %s", me.u.String(), me.autoDisabled)
+}
+
+func (me *trackerScraper) reenable() {
+	if me.autoDisabled == "" {
+		return
+	}
+	me.logger().Printf("re-enabling tracker %q", me.u.String())
+	me.autoDisabled = ""
+	me.autoDisabledForErrors = false
+}
+
+// Returns the status of each of the torrent's trackers, ordered by URL.
+func (t *Torrent) TrackerStatuses() (ret []TrackerStatus) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	for _, ta := range t.trackerAnnouncers {
+		ts, ok := ta.(*trackerScraper)
+		if !ok {
+			continue
+		}
+		ret = append(ret, TrackerStatus{
+			URL:               ts.u,
+			LastAnnounce:      ts.lastAnnounce.Completed,
+			LastErr:           ts.lastAnnounce.Err,
+			LastNumPeers:      ts.lastAnnounce.NumPeers,
+			LastInterval:      ts.lastAnnounce.Interval,
+			ConsecutiveErrors: ts.consecutiveErrors,
+			ConsecutiveEmpty:  ts.consecutiveEmpty,
+			AutoDisabled:      ts.autoDisabled,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].URL.String() < ret[j].URL.String()
+	})
+	return
+}
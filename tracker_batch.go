@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/anacrolix/torrent/tracker"
+)
+
+// Batches are sent early once they have this many announces.
+const maxTrackerAnnounceBatch = 64
+
+// Announces to one UDP tracker waiting to be sent together. See
+// ClientConfig.TrackerAnnounceBatchDelay. Only announces that dial the tracker the same way are
+// batched, see trackerScraper.batchAnnounces.
+type trackerAnnounceBatch struct {
+	announces []tracker.Announce
+	results   []chan tracker.BatchAnnounceResult
+	timer     *time.Timer
+}
+
+// Announces to a UDP tracker, together with other torrents' announces to it that are due within
+// the batch delay. Blocks until the announce is done.
+func (cl *Client) batchTrackerAnnounce(a tracker.Announce) (tracker.AnnounceResponse, error) {
+	c := make(chan tracker.BatchAnnounceResult, 1)
+	cl.lock()
+	key := a.TrackerUrl
+	b := cl.trackerAnnounceBatches[key]
+	if b == nil {
+		b = &trackerAnnounceBatch{}
+		if cl.trackerAnnounceBatches == nil {
+			cl.trackerAnnounceBatches = make(map[string]*trackerAnnounceBatch)
+		}
+		cl.trackerAnnounceBatches[key] = b
+		b.timer = time.AfterFunc(cl.config.TrackerAnnounceBatchDelay, func() {
+			cl.lock()
+			taken := cl.takeTrackerAnnounceBatch(key, b)
+			cl.unlock()
+			if taken {
+				b.send()
+			}
+		})
+	}
+	b.announces = append(b.announces, a)
+	b.results = append(b.results, c)
+	if len(b.announces) >= maxTrackerAnnounceBatch && cl.takeTrackerAnnounceBatch(key, b) {
+		b.timer.Stop()
+		go b.send()
+	}
+	cl.unlock()
+	r := <-c
+	return r.Response, r.Err
+}
+
+// Stops the batch taking more announces. Returns false if it's already been taken to be sent.
+func (cl *Client) takeTrackerAnnounceBatch(key string, b *trackerAnnounceBatch) bool {
+	if cl.trackerAnnounceBatches[key] != b {
+		return false
+	}
+	delete(cl.trackerAnnounceBatches, key)
+	return true
+}
+
+// Sends the batch, and delivers the results. Announces the tracker didn't answer, or all of them if
+// the batch failed as a whole, are made on their own instead. Each announce's request carries its
+// own client IP, and the exchange lasts until every announce's Context is done. Announces whose
+// Context is done get its error.
+func (b *trackerAnnounceBatch) send() {
+	if len(b.announces) == 1 {
+		b.sendAlone(0)
+		return
+	}
+	reqs := make([]tracker.AnnounceRequest, 0, len(b.announces))
+	for _, a := range b.announces {
+		req := a.Request
+		if req.IPAddress == 0 && a.ClientIp4.IP.To4() != nil {
+			req.IPAddress = binary.BigEndian.Uint32(a.ClientIp4.IP.To4())
+		}
+		reqs = append(reqs, req)
+	}
+	ctx, cancel := b.exchangeContext()
+	defer cancel()
+	opt := b.announces[0]
+	opt.Context = ctx
+	rs, err := tracker.AnnounceUDPBatch(opt, reqs)
+	if err != nil {
+		torrent.Add("tracker announce batches failed", 1)
+	}
+	for i, a := range b.announces {
+		if a.Context != nil && a.Context.Err() != nil {
+			b.results[i] <- tracker.BatchAnnounceResult{Err: a.Context.Err()}
+		} else if err != nil || rs[i].Unanswered {
+			go b.sendAlone(i)
+		} else {
+			b.results[i] <- rs[i]
+		}
+	}
+}
+
+// Returns a context for the batch's exchange that's done once every announce's Context is done.
+func (b *trackerAnnounceBatch) exchangeContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, a := range b.announces {
+		if a.Context == nil {
+			return ctx, cancel
+		}
+	}
+	go func() {
+		for _, a := range b.announces {
+			select {
+			case <-a.Context.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+func (b *trackerAnnounceBatch) sendAlone(i int) {
+	var r tracker.BatchAnnounceResult
+	r.Response, r.Err = b.announces[i].Do()
+	b.results[i] <- r
+}
@@ -0,0 +1,131 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// The longest to wait before retrying a failed tracker list update.
+	maxTrackerListRetryInterval = 15 * time.Minute
+	// The longest a tracker list fetch may take.
+	trackerListFetchTimeout = time.Minute
+)
+
+// Parses a list of tracker URLs, one per line. Blank lines and those starting with '#' are
+// skipped, as are duplicates.
+func parseTrackerList(r io.Reader) (ret []string, err error) {
+	seen := make(map[string]struct{})
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		u, err := url.Parse(l)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("bad tracker url %q", l)
+		}
+		if _, ok := seen[l]; ok {
+			continue
+		}
+		seen[l] = struct{}{}
+		ret = append(ret, l)
+	}
+	err = s.Err()
+	return
+}
+
+// Fetches the tracker list from ClientConfig.TrackerListURL, through ClientConfig.HTTPProxy, and
+// adds its trackers to the torrents. The previous list is kept if it's not valid.
+func (cl *Client) updateTrackerList(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, cl.config.TrackerListURL, nil)
+	if err != nil {
+		return err
+	}
+	tr := &http.Transport{Proxy: cl.config.HTTPProxy}
+	defer tr.CloseIdleConnections()
+	hc := http.Client{Timeout: trackerListFetchTimeout, Transport: tr}
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response from %q: %v", cl.config.TrackerListURL, resp.Status)
+	}
+	urls, err := parseTrackerList(resp.Body)
+	if err != nil {
+		return fmt.Errorf("parsing tracker list: %w", err)
+	}
+	cl.lock()
+	cl.trackerList = urls
+	cl.trackerListUpdated = time.Now()
+	ts := cl.torrentsAsSlice()
+	cl.unlock()
+	for _, t := range ts {
+		t.addListedTrackers(urls)
+	}
+	return nil
+}
+
+func (cl *Client) trackerListUpdater(ctx context.Context) {
+	for {
+		wait := cl.config.TrackerListUpdateInterval
+		if err := cl.updateTrackerList(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			cl.logger.Printf("error updating tracker list: %v", err)
+			if wait <= 0 || wait > maxTrackerListRetryInterval {
+				wait = maxTrackerListRetryInterval
+			}
+		} else if wait <= 0 {
+			// No periodic updates.
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Adds the trackers from ClientConfig.TrackerListURL that the torrent doesn't have, in a tier after
+// its own, unless it's private, its info isn't known yet, or ClientConfig.TrackerListFilter
+// excludes it. The Client lock must not be held.
+func (t *Torrent) addListedTrackers(urls []string) {
+	if f := t.cl.config.TrackerListFilter; f != nil && !f(t) {
+		return
+	}
+	t.cl.lock()
+	defer t.cl.unlock()
+	if t.closed.IsSet() || !t.haveInfo() || t.private() {
+		return
+	}
+	have := map[string]struct{}{t.metainfo.Announce: {}}
+	for _, tier := range t.metainfo.AnnounceList {
+		for _, u := range tier {
+			have[u] = struct{}{}
+		}
+	}
+	var missing []string
+	for _, u := range urls {
+		if _, ok := have[u]; !ok {
+			missing = append(missing, u)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	tiers := make([][]string, len(t.metainfo.AnnounceList)+1)
+	tiers[len(tiers)-1] = missing
+	t.addTrackers(tiers)
+}
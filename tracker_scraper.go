@@ -2,6 +2,8 @@ package torrent
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -10,6 +12,7 @@ import (
 
 	"github.com/anacrolix/dht/v2/krpc"
 	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo"
 
 	"github.com/anacrolix/torrent/tracker"
 )
@@ -20,6 +23,43 @@ type trackerScraper struct {
 	u            url.URL
 	t            *Torrent
 	lastAnnounce trackerAnnounceResult
+
+	// Set when the next announce should be made now, with forcedEvent. See
+	// Torrent.AnnounceWithEvent.
+	forced      missinggo.Event
+	forcedEvent tracker.AnnounceEvent
+	// The torrent's corrupt bytes at the last "started" announce. See
+	// ClientConfig.TrackerReportCorrupt.
+	corruptBase int64
+	// Set when the tracker is removed from the torrent. See Torrent.RemoveTracker.
+	removed missinggo.Event
+	// See TrackerStatus.
+	consecutiveErrors int
+	consecutiveEmpty  int
+	autoDisabled      string
+	// Whether autoDisabled is for announces failing, rather than returning no peers.
+	autoDisabledForErrors bool
+}
+
+// Stops the scraper once any announce in progress completes. The tracker is told we've stopped if
+// we joined its swarm.
+func (me *trackerScraper) remove() {
+	me.removed.Set()
+	me.t.cl.event.Broadcast()
+}
+
+// Whether the scraper should exit.
+func (me *trackerScraper) stopped() bool {
+	return me.t.closed.IsSet() || me.removed.IsSet()
+}
+
+func (me *trackerScraper) forceAnnounce(e tracker.AnnounceEvent) {
+	me.forcedEvent = e
+	me.forced.Set()
+}
+
+func (me *trackerScraper) logger() log.Logger {
+	return me.t.subsystemLogger(LogSubsystemTracker)
 }
 
 type torrentTrackerAnnouncer interface {
@@ -59,22 +99,45 @@ func (ts *trackerScraper) statusLine() string {
 }
 
 type trackerAnnounceResult struct {
-	Err       error
-	NumPeers  int
-	Interval  time.Duration
-	Completed time.Time
+	Err      error
+	NumPeers int
+	// Whether the announce asked for peers.
+	WantedPeers bool
+	Interval    time.Duration
+	Completed   time.Time
+}
+
+// Whether announces are batched with other torrents' announces to the tracker. See
+// ClientConfig.TrackerAnnounceBatchDelay.
+func (me *trackerScraper) batchAnnounces() bool {
+	if me.t.cl.config.TrackerAnnounceBatchDelay <= 0 || me.t.trackerDialContext != nil {
+		return false
+	}
+	switch me.u.Scheme {
+	case "udp", "udp4", "udp6":
+		return true
+	default:
+		return false
+	}
 }
 
 func (me *trackerScraper) getIp() (ip net.IP, err error) {
-	ips, err := net.LookupIP(me.u.Hostname())
+	r := me.t.cl.resolver()
+	if me.t.trackerDialContext != nil {
+		// Keep the lookup on the same route as the announce.
+		r = &net.Resolver{PreferGo: true, Dial: me.t.trackerDialContext}
+	}
+	addrs, err := r.LookupIPAddr(context.Background(), me.u.Hostname())
 	if err != nil {
 		return
 	}
-	if len(ips) == 0 {
+	if len(addrs) == 0 {
 		err = errors.New("no ips")
 		return
 	}
-	for _, ip = range ips {
+	var fallback net.IP
+	for _, addr := range addrs {
+		ip = addr.IP
 		if me.t.cl.ipIsBlocked(ip) {
 			continue
 		}
@@ -87,17 +150,59 @@ func (me *trackerScraper) getIp() (ip net.IP, err error) {
 			if ip.To4() != nil {
 				continue
 			}
+		default:
+			if !me.t.cl.trackerIpPreferred(ip) {
+				if fallback == nil {
+					fallback = ip
+				}
+				continue
+			}
 		}
 		return
 	}
+	if fallback != nil {
+		return fallback, nil
+	}
 	err = errors.New("no acceptable ips")
 	return
 }
 
+// Whether announces to a tracker should go to the IP if there's the choice. See
+// ClientConfig.TrackerIpPreference.
+func (cl *Client) trackerIpPreferred(ip net.IP) bool {
+	switch cl.config.TrackerIpPreference {
+	case IpPreferenceV4:
+		return ip.To4() != nil
+	case IpPreferenceV6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// See ClientConfig.TrackerTLSConfig.
+func (me *trackerScraper) tlsConfig() *tls.Config {
+	if f := me.t.cl.config.TrackerTLSConfig; f != nil && me.u.Scheme == "https" {
+		return f(&me.u)
+	}
+	return nil
+}
+
 func (me *trackerScraper) trackerUrl(ip net.IP) string {
 	u := me.u
-	if u.Port() != "" {
-		u.Host = net.JoinHostPort(ip.String(), u.Port())
+	port := u.Port()
+	if port == "" {
+		// Use the resolved IP with the default port, rather than leaving the hostname to be resolved
+		// again when dialing.
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(ip.String(), port)
 	}
 	return u.String()
 }
@@ -114,62 +219,201 @@ func (me *trackerScraper) announce(event tracker.AnnounceEvent) (ret trackerAnno
 		ret.Err = fmt.Errorf("error getting ip: %s", err)
 		return
 	}
-	me.t.cl.rLock()
+	me.t.cl.lock()
+	// Stopped announces aren't held up, as they're made when leaving the swarm.
+	if event != tracker.Stopped {
+		if !me.t.cl.acquireDiscoverySlot(me.t) {
+			me.t.cl.unlock()
+			ret.Err = errors.New("torrent closed")
+			return
+		}
+		defer func() {
+			me.t.cl.lock()
+			me.t.cl.releaseDiscoverySlot()
+			me.t.cl.unlock()
+		}()
+	}
 	req := me.t.announceRequest(event)
-	me.t.cl.rUnlock()
-	me.t.logger.WithDefaultLevel(log.Debug).Printf("announcing to %q: %#v", me.u.String(), req)
-	res, err := tracker.Announce{
-		HTTPProxy:  me.t.cl.config.HTTPProxy,
-		UserAgent:  me.t.cl.config.HTTPUserAgent,
-		TrackerUrl: me.trackerUrl(ip),
-		Request:    req,
-		HostHeader: me.u.Host,
-		ServerName: me.u.Hostname(),
-		UdpNetwork: me.u.Scheme,
-		ClientIp4:  krpc.NodeAddr{IP: me.t.cl.config.PublicIp4},
-		ClientIp6:  krpc.NodeAddr{IP: me.t.cl.config.PublicIp6},
-	}.Do()
+	ret.WantedPeers = req.NumWant != 0
+	if event == tracker.Started {
+		me.corruptBase = me.t.corruptBytes
+	}
+	corrupt := me.t.corruptBytes - me.corruptBase
+	me.t.cl.unlock()
+	me.logger().WithDefaultLevel(log.Debug).Printf("announcing to %q: %#v", me.u.String(), req)
+	a := tracker.Announce{
+		HTTPProxy:              me.t.cl.config.HTTPProxy,
+		UserAgent:              me.t.cl.config.HTTPUserAgent,
+		TrackerUrl:             me.trackerUrl(ip),
+		Request:                req,
+		HostHeader:             me.u.Host,
+		ServerName:             me.u.Hostname(),
+		UdpNetwork:             me.u.Scheme,
+		ClientIp4:              krpc.NodeAddr{IP: me.t.cl.announceIp4()},
+		ClientIp6:              krpc.NodeAddr{IP: me.t.cl.announceIp6()},
+		DialContext:            me.t.trackerAnnounceDialContext(),
+		TLSConfig:              me.tlsConfig(),
+		MaxRedirects:           me.t.cl.config.TrackerMaxRedirects,
+		AllowRedirectDowngrade: me.t.cl.config.TrackerAllowRedirectDowngrade,
+		ReportCorrupt:          me.t.cl.config.TrackerReportCorrupt,
+		Corrupt:                corrupt,
+	}
+	var res tracker.AnnounceResponse
+	if me.batchAnnounces() {
+		res, err = me.t.cl.batchTrackerAnnounce(a)
+	} else {
+		res, err = a.Do()
+	}
 	if err != nil {
 		ret.Err = fmt.Errorf("error announcing: %s", err)
 		return
 	}
+	if res.RedirectedUrl != "" && me.t.cl.config.TrackerPersistRedirects {
+		me.followRedirect(res.RedirectedUrl)
+	}
+	me.t.cl.lock()
+	me.t.onPeerSourceActivity()
+	// Listing us is a weaker report of our IP than saying so, and is never trusted alone. It's from
+	// the same source, so the tracker still counts once.
+	if ip := me.t.cl.trackerSelfEntry(res.Peers); ip != nil {
+		me.t.cl.onExternalIpReported(me.u.Hostname(), ip, false)
+	}
+	if res.ExternalIp != nil {
+		me.t.cl.onExternalIpReported(me.u.Hostname(), res.ExternalIp, me.t.cl.config.TrustTrackerExternalIp)
+	}
+	me.t.cl.unlock()
+	if res.MalformedPeers != 0 {
+		me.logger().WithDefaultLevel(log.Warning).Printf("skipped %d malformed peers in announce response from %q", res.MalformedPeers, me.u.String())
+	}
 	me.t.AddPeers(Peers(nil).AppendFromTracker(res.Peers))
 	ret.NumPeers = len(res.Peers)
-	ret.Interval = time.Duration(res.Interval) * time.Second
+	ret.Interval = me.clampInterval(time.Duration(res.Interval) * time.Second)
 	return
 }
 
+func (cl *Client) trackerMinAnnounceInterval() time.Duration {
+	if d := cl.config.TrackerMinAnnounceInterval; d > 0 {
+		return d
+	}
+	return defaultTrackerMinAnnounceInterval
+}
+
+// Clamps an announce interval given by the tracker into the range accepted by
+// ClientConfig.TrackerMinAnnounceInterval and TrackerMaxAnnounceInterval.
+func (me *trackerScraper) clampInterval(interval time.Duration) time.Duration {
+	ret := interval
+	if max := me.t.cl.config.TrackerMaxAnnounceInterval; max > 0 && ret > max {
+		ret = max
+	}
+	if min := me.t.cl.trackerMinAnnounceInterval(); ret < min {
+		ret = min
+	}
+	if ret != interval {
+		me.logger().WithDefaultLevel(log.Warning).Printf("clamped announce interval %v from %q to %v", interval, me.u.String(), ret)
+	}
+	return ret
+}
+
+// Announces to the URL that the tracker permanently redirected to from now on. The torrent's
+// trackers are still known by the original URL.
+func (me *trackerScraper) followRedirect(s string) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		me.logger().Printf("ignoring tracker redirect from %q to %q", me.u.String(), s)
+		return
+	}
+	me.logger().Printf("tracker %q redirected to %q", me.u.String(), s)
+	me.t.cl.lock()
+	me.u = *u
+	me.t.cl.unlock()
+}
+
 func (me *trackerScraper) Run() {
-	defer me.announceStopped()
+	// Whether the tracker should be told when we leave the swarm.
+	started := false
+	defer func() {
+		if started {
+			me.announceStopped()
+		}
+	}()
+	// Whether the tracker has been told we completed the download. This happens only once.
+	completedSent := false
+	if !me.waitStartedAnnounceDelay() {
+		return
+	}
 	// make sure first announce is a "started"
 	e := tracker.Started
 	for {
+		if !me.waitNotPaused(e) {
+			return
+		}
+		if e == tracker.Started && !me.waitStartedAnnounceToken() {
+			return
+		}
+		me.t.cl.lock()
+		// A forced completed announce before we have everything doesn't count.
+		haveAll := me.t.haveAllPieces()
+		me.t.cl.unlock()
 		ar := me.announce(e)
-		// after first announce, get back to regular "none"
-		e = tracker.None
+		// Taken here rather than using ar.Completed, so that the wait is measured on the monotonic
+		// clock, and wall clock changes don't affect it.
+		announced := time.Now()
+		started = e != tracker.Stopped
+		if e == tracker.Completed && haveAll {
+			completedSent = true
+		}
+		if started {
+			// after first announce, get back to regular "none"
+			e = tracker.None
+		} else {
+			// A forced stopped announce left the swarm. Rejoin it at the next announce.
+			e = tracker.Started
+		}
 		me.t.cl.lock()
 		me.lastAnnounce = ar
+		me.updateAutoDisable(ar)
 		me.t.cl.unlock()
 
 	wait:
-		// Make sure we don't announce for at least a minute since the last one.
+		// Make sure we don't announce again within the minimum interval since the last one.
+		minInterval := me.t.cl.trackerMinAnnounceInterval()
 		interval := ar.Interval
-		if interval < time.Minute {
-			interval = time.Minute
+		if interval < minInterval {
+			interval = minInterval
 		}
 
 		me.t.cl.lock()
+		if me.t.cl.config.MaxConcurrentDiscovery > 0 && me.t.discoveryPriority() == DiscoveryPriorityLow {
+			// Torrents that don't want peers needn't hear about new ones as often.
+			interval *= 2
+		}
 		wantPeers := me.t.wantPeersEvent.C()
+		if me.autoDisabled != "" {
+			// Only announce again to retest the tracker.
+			interval = me.t.cl.trackerRetestInterval()
+			wantPeers = nil
+		}
 		closed := me.t.closed.C()
+		removed := me.removed.C()
+		paused := me.t.paused.C()
+		var downloadCompleted <-chan struct{}
+		if !completedSent {
+			downloadCompleted = me.t.downloadCompleted.C()
+		}
+		forced := me.forced.C()
 		me.t.cl.unlock()
 
-		// If we want peers, reduce the interval to the minimum.
+		// If we want peers, reduce the interval, but not below the minimum.
 		select {
 		case <-wantPeers:
-			if interval > time.Minute {
-				interval = time.Minute
+			wantPeersInterval := wantPeersAnnounceInterval
+			if wantPeersInterval < minInterval {
+				wantPeersInterval = minInterval
+			}
+			if interval > wantPeersInterval {
+				interval = wantPeersInterval
 			}
-			// Now we're at the minimum, don't trigger on it anymore.
+			// Now we're at the reduced interval, don't trigger on it anymore.
 			wantPeers = nil
 		default:
 		}
@@ -177,14 +421,109 @@ func (me *trackerScraper) Run() {
 		select {
 		case <-closed:
 			return
+		case <-removed:
+			return
+		case <-paused:
+			me.announceStopped()
+			started = false
+			// We'll need to rejoin the swarm when resumed.
+			e = tracker.Started
 		case <-wantPeers:
 			// Recalculate the interval.
 			goto wait
-		case <-time.After(time.Until(ar.Completed.Add(interval))):
+		case <-downloadCompleted:
+			// Tell the tracker promptly, outside the regular interval.
+			e = tracker.Completed
+		case <-forced:
+			me.t.cl.lock()
+			e = me.forcedEvent
+			me.forced.Clear()
+			me.t.cl.unlock()
+		case <-time.After(me.announceWait(announced, interval)):
 		}
 	}
 }
 
+// Returns how long to wait for the interval since the last announce to elapse. The wait is never
+// longer than the interval, in case last has no monotonic clock reading and the wall clock has
+// been set back since.
+func (me *trackerScraper) announceWait(last time.Time, interval time.Duration) time.Duration {
+	elapsed := time.Since(last)
+	if elapsed < 0 {
+		me.logger().Printf("last announce to %q is %v in the future, clock skew?", me.u.String(), -elapsed)
+		elapsed = 0
+	}
+	return interval - elapsed
+}
+
+// Blocks while the torrent is paused, or before a started announce while the torrent is idle.
+// Returns false if the torrent is closed or the tracker removed.
+func (me *trackerScraper) waitNotPaused(e tracker.AnnounceEvent) bool {
+	me.t.cl.lock()
+	defer me.t.cl.unlock()
+	for (me.t.paused.IsSet() || e == tracker.Started && me.t.announceIdle()) && !me.stopped() {
+		me.t.cl.event.Wait()
+	}
+	return !me.stopped()
+}
+
+// Waits for ClientConfig.TrackerStartedAnnounceDelay. Returns false if the torrent is closed or the
+// tracker removed in the meantime.
+func (me *trackerScraper) waitStartedAnnounceDelay() bool {
+	d := me.t.cl.config.TrackerStartedAnnounceDelay
+	if d <= 0 {
+		return true
+	}
+	me.t.cl.lock()
+	closed := me.t.closed.C()
+	removed := me.removed.C()
+	me.t.cl.unlock()
+	select {
+	case <-closed:
+		return false
+	case <-removed:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Waits on ClientConfig.TrackerStartedAnnounceRateLimiter. Returns false if the torrent is closed or
+// the tracker removed.
+func (me *trackerScraper) waitStartedAnnounceToken() bool {
+	cl := me.t.cl
+	l := cl.config.TrackerStartedAnnounceRateLimiter
+	if l == nil {
+		return true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl.lock()
+	closed := me.t.closed.C()
+	removed := me.removed.C()
+	cl.startedAnnouncesWaiting++
+	cl.unlock()
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-removed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := l.Wait(ctx)
+	cl.lock()
+	cl.startedAnnouncesWaiting--
+	cl.unlock()
+	if err != nil && ctx.Err() == nil {
+		// The limiter can't ever allow an announce, which would leave the torrent stuck.
+		me.logger().Printf("waiting on started announce rate limiter: %v", err)
+		return true
+	}
+	return err == nil
+}
+
 func (me *trackerScraper) announceStopped() {
 	me.announce(tracker.Stopped)
 }
@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"math"
+
+	"golang.org/x/time/rate"
+)
+
+// The bounds for Torrent.SetUploadPriority.
+const (
+	minUploadPriority = -16
+	maxUploadPriority = 16
+)
+
+// The torrent's weight for sharing the Client's upload budget, from its upload priority.
+func (t *Torrent) uploadWeight() float64 {
+	return math.Exp2(float64(t.uploadPriority))
+}
+
+// Whether the torrent has peers it's currently serving requests for.
+func (t *Torrent) uploading() bool {
+	for c := range t.conns {
+		if !c.choking && len(c.peerRequests) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the fraction of the upload budget the torrent gets when competing with the other
+// torrents that are uploading. Zero if uploads aren't rate limited, as there's no budget to share.
+func (t *Torrent) uploadShare() float64 {
+	if t.cl.config.UploadRateLimiter.Limit() == rate.Inf {
+		return 0
+	}
+	w := t.uploadWeight()
+	total := w
+	for _, ot := range t.cl.torrents {
+		if ot != t && ot.uploading() {
+			total += ot.uploadWeight()
+		}
+	}
+	return w / total
+}
+
+// Returns whether the connection may take the next chunk from the upload rate limiter. When
+// uploads are rate limited, connections with outstanding requests from their peer take turns a
+// chunk at a time, so that a peer flooding us with requests can't starve the others. Turns go to
+// the torrent that has uploaded the least for its upload priority, and round robin among a
+// torrent's connections.
+func (cl *Client) uploadTurn(c *PeerConn) bool {
+	if cl.config.UploadRateLimiter.Limit() == rate.Inf {
+		return true
+	}
+	queued := false
+	for _, qc := range cl.uploadQueue {
+		if qc == c {
+			return cl.uploadQueueHead() == c
+		}
+		if qc.t == c.t {
+			queued = true
+		}
+	}
+	if !queued {
+		// A torrent that starts uploading again doesn't get to make up for the turns it missed.
+		if head := cl.uploadQueueHead(); head != nil && head.t.uploadQueueBytes > c.t.uploadQueueBytes {
+			c.t.uploadQueueBytes = head.t.uploadQueueBytes
+		}
+	}
+	cl.uploadQueue = append(cl.uploadQueue, c)
+	return cl.uploadQueueHead() == c
+}
+
+// Returns the connection that has the upload turn, or nil if the queue is empty.
+func (cl *Client) uploadQueueHead() (ret *PeerConn) {
+	for _, c := range cl.uploadQueue {
+		if ret == nil || c.t.uploadQueueBytes < ret.t.uploadQueueBytes {
+			ret = c
+		}
+	}
+	return
+}
+
+// Counts the bytes the connection uploaded in its turn against its torrent, and removes it from the
+// upload queue.
+func (cl *Client) uploadServed(c *PeerConn, n int) {
+	hadTurn := cl.uploadQueueHead() == c
+	c.t.uploadQueueBytes += float64(n) / c.t.uploadWeight()
+	cl.removeFromUploadQueue(c, hadTurn)
+}
+
+// Removes the connection from the upload queue, after it's been served or no longer wants to
+// upload. If it had the turn, the next connection is woken.
+func (cl *Client) leaveUploadQueue(c *PeerConn) {
+	cl.removeFromUploadQueue(c, cl.uploadQueueHead() == c)
+}
+
+func (cl *Client) removeFromUploadQueue(c *PeerConn, hadTurn bool) {
+	for i, qc := range cl.uploadQueue {
+		if qc != c {
+			continue
+		}
+		cl.uploadQueue = append(cl.uploadQueue[:i], cl.uploadQueue[i+1:]...)
+		if hadTurn && len(cl.uploadQueue) != 0 {
+			cl.uploadQueueHead().tickleWriter()
+		}
+		return
+	}
+}
@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// How often seeding upload slots are reassigned if ClientConfig.RechokeIntervalMax isn't set.
+	fixedRechokeInterval = 10 * time.Second
+	// Peers with less than this fraction of the pieces are newcomers for seeding upload slots.
+	newcomerPieceFraction = 0.1
+	// The most a torrent's upload priority multiplies or divides its seeding upload slots by.
+	maxUploadSlotScale = 4
+)
+
+// Whether uploads are limited to the peers assigned upload slots, per
+// ClientConfig.SeedingUploadSlots.
+func (t *Torrent) uploadSlotsLimited() bool {
+	return t.cl.config.SeedingUploadSlots > 0 && t.seeding() && t.haveAllPieces()
+}
+
+// The torrent's seeding upload slots, scaled by its upload weight up to maxUploadSlotScale, so a
+// high priority can't make them effectively unlimited. There's at least one.
+func (t *Torrent) seedingUploadSlots() int {
+	scale := math.Min(math.Max(t.uploadWeight(), 1.0/maxUploadSlotScale), maxUploadSlotScale)
+	slots := int(math.Round(float64(t.cl.config.SeedingUploadSlots) * scale))
+	if slots < 1 {
+		return 1
+	}
+	return slots
+}
+
+// The number of upload slots reserved for newcomers.
+func (t *Torrent) newcomerUploadSlots() int {
+	slots := t.seedingUploadSlots()
+	return int(clamp(0, int64(math.Ceil(float64(slots)*t.cl.config.SeedingNewcomerSlotShare)), int64(slots)))
+}
+
+func (c *PeerConn) newcomer() bool {
+	return float64(c.peerPieces().Len()) < newcomerPieceFraction*float64(c.t.numPieces())
+}
+
+// Returns the number of connections in upload slots reserved for newcomers, and in the remaining
+// slots.
+func (t *Torrent) uploadSlotsInUse() (newcomers, established int) {
+	for c := range t.conns {
+		if !c.uploadSlot {
+			continue
+		}
+		if c.newcomerUploadSlot {
+			newcomers++
+		} else {
+			established++
+		}
+	}
+	return
+}
+
+func (c *PeerConn) setUploadSlot(slot, newcomer bool) {
+	if slot && newcomer {
+		c.lastNewcomerUploadSlot = time.Now()
+	}
+	c.newcomerUploadSlot = slot && newcomer
+	if c.uploadSlot != slot {
+		c.uploadSlot = slot
+		c.tickleWriter()
+	}
+}
+
+// Reassigns seeding upload slots among interested peers. Newcomers take turns in the reserved
+// slots, and the remaining slots go to the peers we've recently uploaded the most to.
+func (t *Torrent) rechoke() {
+	if !t.uploadSlotsLimited() {
+		for c := range t.conns {
+			c.setUploadSlot(false, false)
+		}
+		return
+	}
+	var newcomers, established []*PeerConn
+	uploaded := make(map[*PeerConn]int64, len(t.conns))
+	for c := range t.conns {
+		written := c._stats.BytesWrittenData.Int64()
+		uploaded[c] = written - c.rechokeBytesWritten
+		c.rechokeBytesWritten = written
+		if c.closed.IsSet() || !c.peerInterested {
+			c.setUploadSlot(false, false)
+			continue
+		}
+		if c.newcomer() {
+			newcomers = append(newcomers, c)
+		} else {
+			established = append(established, c)
+		}
+	}
+	sort.Slice(newcomers, func(i, j int) bool {
+		return newcomers[i].lastNewcomerUploadSlot.Before(newcomers[j].lastNewcomerUploadSlot)
+	})
+	numNewcomers := t.newcomerUploadSlots()
+	if numNewcomers > len(newcomers) {
+		numNewcomers = len(newcomers)
+	}
+	// Newcomers that missed out on the reserved slots compete with established peers.
+	established = append(established, newcomers[numNewcomers:]...)
+	sort.SliceStable(established, func(i, j int) bool {
+		return uploaded[established[i]] > uploaded[established[j]]
+	})
+	for _, c := range newcomers[:numNewcomers] {
+		c.setUploadSlot(true, true)
+	}
+	for i, c := range established {
+		c.setUploadSlot(i < t.seedingUploadSlots()-numNewcomers, false)
+	}
+}
+
+// Gives the connection a free upload slot, if there is one. Established peers can use free slots
+// reserved for newcomers until the next rechoke, which gives them back to newcomers that want them.
+func (t *Torrent) fillFreeUploadSlot(c *PeerConn) {
+	if !t.uploadSlotsLimited() || c.uploadSlot || !c.peerInterested {
+		return
+	}
+	newcomers, established := t.uploadSlotsInUse()
+	if newcomers+established >= t.seedingUploadSlots() {
+		return
+	}
+	c.setUploadSlot(true, c.newcomer() && newcomers < t.newcomerUploadSlots())
+}
+
+// Starts reassigning upload slots periodically if they're limited.
+func (t *Torrent) startRechokeTimer() {
+	if t.rechokeTimer != nil || t.cl.config.SeedingUploadSlots <= 0 {
+		return
+	}
+	t.rechokeTimer = time.AfterFunc(t.rechokeInterval(), func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if t.closed.IsSet() {
+			return
+		}
+		t.rechoke()
+		t.rechokeTimer.Reset(t.rechokeInterval())
+	})
+}
+
+// Returns how long until upload slots are next reassigned, scaled by the number of connections
+// between ClientConfig.RechokeIntervalMin and RechokeIntervalMax.
+func (t *Torrent) rechokeInterval() time.Duration {
+	lo, hi := t.cl.config.RechokeIntervalMin, t.cl.config.RechokeIntervalMax
+	if hi <= 0 {
+		return fixedRechokeInterval
+	}
+	if lo > hi {
+		lo = hi
+	}
+	full := t.maxEstablishedConns
+	if full <= 0 {
+		return hi
+	}
+	n := len(t.conns)
+	if n > full {
+		n = full
+	}
+	return lo + (hi-lo)*time.Duration(n)/time.Duration(full)
+}
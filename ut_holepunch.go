@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/anacrolix/dht/v2/krpc"
+
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+// Returns the key used to match peer addresses for holepunching.
+func holepunchAddrKey(addr net.Addr) (string, bool) {
+	ipp, ok := tryIpPortFromNetAddr(addr)
+	if !ok {
+		return "", false
+	}
+	return ipp.String(), true
+}
+
+func (c *PeerConn) sendUtHolepunchMsg(
+	msgType pp.UtHolepunchMsgType,
+	addr net.Addr,
+	errCode pp.UtHolepunchErrCode,
+) {
+	id, ok := c.PeerExtensionIDs[pp.ExtensionNameUtHolepunch]
+	if !ok {
+		return
+	}
+	ipp, _ := tryIpPortFromNetAddr(addr)
+	payload, err := pp.UtHolepunchMsg{
+		MsgType:  msgType,
+		AddrPort: krpc.NodeAddr{IP: ipp.IP, Port: ipp.Port},
+		ErrCode:  errCode,
+	}.MarshalBinary()
+	if err != nil {
+		c.logger.Printf("error marshalling holepunch message: %v", err)
+		return
+	}
+	c.post(pp.Message{
+		Type:            pp.Extended,
+		ExtendedID:      id,
+		ExtendedPayload: payload,
+	})
+}
+
+// Returns the connection to the peer at the address, matching the address a peer would be dialed
+// at.
+func (t *Torrent) connWithDialAddr(key string) *PeerConn {
+	for c := range t.conns {
+		if k, ok := holepunchAddrKey(c.dialAddr()); ok && k == key {
+			return c
+		}
+	}
+	return nil
+}
+
+func (t *Torrent) handleReceivedUtHolepunchMsg(msg pp.UtHolepunchMsg, sender *PeerConn) error {
+	addr := ipPortAddr{msg.AddrPort.IP, msg.AddrPort.Port}
+	switch msg.MsgType {
+	case pp.UtHolepunchRendezvous:
+		// We're the relay.
+		torrent.Add("holepunch rendezvous received", 1)
+		senderKey, _ := holepunchAddrKey(sender.dialAddr())
+		key := addr.String()
+		if addr.IP.IsUnspecified() || addr.Port == 0 {
+			sender.sendUtHolepunchMsg(pp.UtHolepunchError, addr, pp.UtHolepunchNoSuchPeer)
+			return nil
+		}
+		if key == senderKey {
+			sender.sendUtHolepunchMsg(pp.UtHolepunchError, addr, pp.UtHolepunchNoSelf)
+			return nil
+		}
+		target := t.connWithDialAddr(key)
+		if target == nil {
+			sender.sendUtHolepunchMsg(pp.UtHolepunchError, addr, pp.UtHolepunchNotConnected)
+			return nil
+		}
+		if !target.supportsExtension(pp.ExtensionNameUtHolepunch) {
+			sender.sendUtHolepunchMsg(pp.UtHolepunchError, addr, pp.UtHolepunchNoSupport)
+			return nil
+		}
+		sender.sendUtHolepunchMsg(pp.UtHolepunchConnect, target.dialAddr(), 0)
+		target.sendUtHolepunchMsg(pp.UtHolepunchConnect, sender.dialAddr(), 0)
+		torrent.Add("holepunch connects relayed", 1)
+		return nil
+	case pp.UtHolepunchConnect:
+		// Both ends connect to each other at the same time, so that each end's NAT lets the other
+		// through.
+		torrent.Add("holepunch connects received", 1)
+		t.initiateConn(Peer{
+			Addr:   addr,
+			Source: PeerSourceUtHolepunch,
+		})
+		return nil
+	case pp.UtHolepunchError:
+		switch msg.ErrCode {
+		case pp.UtHolepunchNoSuchPeer, pp.UtHolepunchNotConnected, pp.UtHolepunchNoSupport, pp.UtHolepunchNoSelf:
+			// The key is only made from the codes we know, as the peer chooses it.
+			torrent.Add(fmt.Sprintf("holepunch errors received with code %d", msg.ErrCode), 1)
+		default:
+			torrent.Add("holepunch errors received with unknown code", 1)
+		}
+		t.logger.Printf("holepunch rendezvous for %v through %v failed with code %d", addr, sender, msg.ErrCode)
+		return nil
+	default:
+		return fmt.Errorf("unknown holepunch message type: %v", msg.MsgType)
+	}
+}
+
+// After failing to connect to the address directly, asks a connected peer that has told us it's
+// connected to the address to relay a holepunch. Returns whether a rendezvous was requested.
+func (t *Torrent) startHolepunchRendezvous(addr net.Addr) bool {
+	key, ok := holepunchAddrKey(addr)
+	if !ok {
+		return false
+	}
+	for c := range t.conns {
+		if !c.supportsExtension(pp.ExtensionNameUtHolepunch) || !c.pex.remotePeerConnected(key) {
+			continue
+		}
+		c.sendUtHolepunchMsg(pp.UtHolepunchRendezvous, addr, 0)
+		torrent.Add("holepunch rendezvous sent", 1)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package torrent
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/anacrolix/torrent/metainfo"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+// Returns the holepunch messages posted to the connection.
+func postedUtHolepunchMsgs(t *testing.T, c *PeerConn) (ret []pp.UtHolepunchMsg) {
+	d := pp.Decoder{R: bufio.NewReader(c.writeBuffer), MaxLength: 1 << 20}
+	for {
+		var msg pp.Message
+		if d.Decode(&msg) != nil {
+			return
+		}
+		if msg.Type != pp.Extended || msg.ExtendedID != utHolepunchExtendedId {
+			continue
+		}
+		var hm pp.UtHolepunchMsg
+		require.NoError(t, hm.UnmarshalBinary(msg.ExtendedPayload))
+		ret = append(ret, hm)
+	}
+}
+
+func newUtHolepunchTestTorrent(t *testing.T) (*Client, *Torrent, func(ip net.IP, holepunch bool) *PeerConn) {
+	cl := &Client{
+		config:          TestingConfig(),
+		dialRateLimiter: rate.NewLimiter(10, 10),
+	}
+	cl.initLogger()
+	copy(cl.peerID[:], "-GT0000-")
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	return cl, tt, func(ip net.IP, holepunch bool) *PeerConn {
+		c := cl.newConnection(nil, true, &net.TCPAddr{IP: ip, Port: 6881}, "", "")
+		c.PeerExtensionIDs = make(map[pp.ExtensionName]pp.ExtensionNumber)
+		if holepunch {
+			// Peers use our IDs in the tests for simplicity.
+			c.PeerExtensionIDs[pp.ExtensionNameUtHolepunch] = utHolepunchExtendedId
+		}
+		c.setTorrent(tt)
+		require.NoError(t, tt.addConnection(c))
+		return c
+	}
+}
+
+func TestUtHolepunchRelay(t *testing.T) {
+	cl, tt, newConn := newUtHolepunchTestTorrent(t)
+	cl.lock()
+	defer cl.unlock()
+	sender := newConn(net.IPv4(1, 1, 1, 1), true)
+	target := newConn(net.IPv4(2, 2, 2, 2), true)
+	unsupported := newConn(net.IPv4(3, 3, 3, 3), false)
+	rendezvous := func(ip net.IP) {
+		require.NoError(t, tt.handleReceivedUtHolepunchMsg(pp.UtHolepunchMsg{
+			MsgType:  pp.UtHolepunchRendezvous,
+			AddrPort: krpc.NodeAddr{IP: ip, Port: 6881},
+		}, sender))
+	}
+	rendezvous(net.IPv4(2, 2, 2, 2))
+	assert.Equal(t, []pp.UtHolepunchMsg{{
+		MsgType:  pp.UtHolepunchConnect,
+		AddrPort: krpc.NodeAddr{IP: net.IPv4(2, 2, 2, 2).To4(), Port: 6881},
+	}}, postedUtHolepunchMsgs(t, sender))
+	assert.Equal(t, []pp.UtHolepunchMsg{{
+		MsgType:  pp.UtHolepunchConnect,
+		AddrPort: krpc.NodeAddr{IP: net.IPv4(1, 1, 1, 1).To4(), Port: 6881},
+	}}, postedUtHolepunchMsgs(t, target))
+	errCode := func(ip net.IP) pp.UtHolepunchErrCode {
+		rendezvous(ip)
+		msgs := postedUtHolepunchMsgs(t, sender)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, pp.UtHolepunchError, msgs[0].MsgType)
+		return msgs[0].ErrCode
+	}
+	assert.Equal(t, pp.UtHolepunchNoSelf, errCode(net.IPv4(1, 1, 1, 1)))
+	assert.Equal(t, pp.UtHolepunchNotConnected, errCode(net.IPv4(4, 4, 4, 4)))
+	assert.Equal(t, pp.UtHolepunchNoSupport, errCode(net.IPv4(3, 3, 3, 3)))
+	assert.Equal(t, pp.UtHolepunchNoSuchPeer, errCode(net.IPv4zero))
+	assert.Empty(t, postedUtHolepunchMsgs(t, unsupported))
+}
+
+func TestUtHolepunchInitiate(t *testing.T) {
+	cl, tt, newConn := newUtHolepunchTestTorrent(t)
+	cl.lock()
+	defer cl.unlock()
+	relay := newConn(net.IPv4(1, 1, 1, 1), true)
+	unreachable := ipPortAddr{net.IPv4(2, 2, 2, 2), 6881}
+	assert.False(t, tt.startHolepunchRendezvous(unreachable))
+	relay.pex.remoteLiveConns = map[string]struct{}{unreachable.String(): {}}
+	assert.True(t, tt.startHolepunchRendezvous(unreachable))
+	msgs := postedUtHolepunchMsgs(t, relay)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, pp.UtHolepunchRendezvous, msgs[0].MsgType)
+	assert.True(t, msgs[0].AddrPort.IP.Equal(unreachable.IP))
+	assert.Equal(t, unreachable.Port, msgs[0].AddrPort.Port)
+	// The relay tells us to connect.
+	require.NoError(t, tt.handleReceivedUtHolepunchMsg(pp.UtHolepunchMsg{
+		MsgType:  pp.UtHolepunchConnect,
+		AddrPort: krpc.NodeAddr{IP: unreachable.IP, Port: unreachable.Port},
+	}, relay))
+	assert.Contains(t, tt.halfOpen, unreachable.String())
+	assert.EqualValues(t, PeerSourceUtHolepunch, tt.halfOpen[unreachable.String()].Source)
+}
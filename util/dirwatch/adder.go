@@ -0,0 +1,217 @@
+package dirwatch
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type AdderConfig struct {
+	// Called with each torrent added to the Client, and the file it came from.
+	OnAdded func(t *torrent.Torrent, fileName string)
+	// Called when a torrent file can't be handled, or the directory watch fails. If not set,
+	// errors are logged.
+	OnError func(fileName string, err error)
+	// Delete torrent files once they're added.
+	RemoveAdded bool
+	// If set, torrent files are moved into this directory once they're added. Takes precedence
+	// over RemoveAdded.
+	MoveAddedTo string
+	// How long a file must be unchanged before it's considered completely written. Defaults to a
+	// second.
+	StableDuration time.Duration
+}
+
+// Adds .torrent files that appear in a directory to a Client. Files for torrents already in the
+// Client are not added again, and OnAdded is not called for them, but they're otherwise handled
+// like added files.
+type Adder struct {
+	cl      *torrent.Client
+	dirName string
+	config  AdderConfig
+	w       *fsnotify.Watcher
+	stop    chan struct{}
+	stopped chan struct{}
+	// Files waiting to be stable, and their state when last scanned.
+	pending map[string]pendingFile
+	// Files that have been handled, so they're ignored unless they change.
+	handled map[string]fileState
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+type pendingFile struct {
+	fileState
+	// When the file was first seen in this state.
+	since time.Time
+}
+
+func statFileState(fi os.FileInfo) fileState {
+	return fileState{fi.Size(), fi.ModTime()}
+}
+
+// Starts adding torrent files in the directory to the Client, including those already present.
+func NewAdder(cl *torrent.Client, dirName string, config AdderConfig) (a *Adder, err error) {
+	if config.StableDuration == 0 {
+		config.StableDuration = time.Second
+	}
+	if config.OnError == nil {
+		config.OnError = func(fileName string, err error) {
+			log.Printf("error adding torrent file %q: %v", fileName, err)
+		}
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	err = w.Add(dirName)
+	if err != nil {
+		w.Close()
+		return
+	}
+	a = &Adder{
+		cl:      cl,
+		dirName: dirName,
+		config:  config,
+		w:       w,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		pending: make(map[string]pendingFile),
+		handled: make(map[string]fileState),
+	}
+	go a.run()
+	return
+}
+
+// Stops watching the directory. No torrents are added after this returns.
+func (a *Adder) Close() {
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+	<-a.stopped
+	a.w.Close()
+}
+
+func (a *Adder) run() {
+	defer close(a.stopped)
+	ticker := time.NewTicker(a.config.StableDuration)
+	defer ticker.Stop()
+	a.scan()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case _, ok := <-a.w.Events:
+			if !ok {
+				return
+			}
+			a.scan()
+		case err, ok := <-a.w.Errors:
+			if !ok {
+				return
+			}
+			a.config.OnError(a.dirName, err)
+		case <-ticker.C:
+			a.scan()
+		}
+	}
+}
+
+// Handles files whose state hasn't changed since the last scan.
+func (a *Adder) scan() {
+	d, err := os.Open(a.dirName)
+	if err != nil {
+		a.config.OnError(a.dirName, err)
+		return
+	}
+	fis, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		a.config.OnError(a.dirName, err)
+		return
+	}
+	present := make(map[string]struct{}, len(fis))
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".torrent" {
+			continue
+		}
+		name := filepath.Join(a.dirName, fi.Name())
+		present[name] = struct{}{}
+		fs := statFileState(fi)
+		if h, ok := a.handled[name]; ok && h == fs {
+			continue
+		}
+		if p, ok := a.pending[name]; !ok || p.fileState != fs {
+			// New or still being written.
+			a.pending[name] = pendingFile{fs, time.Now()}
+			continue
+		} else if time.Since(p.since) < a.config.StableDuration {
+			continue
+		}
+		delete(a.pending, name)
+		a.handled[name] = fs
+		a.handleFile(name)
+	}
+	for name := range a.pending {
+		if _, ok := present[name]; !ok {
+			delete(a.pending, name)
+		}
+	}
+	for name := range a.handled {
+		if _, ok := present[name]; !ok {
+			delete(a.handled, name)
+		}
+	}
+}
+
+func (a *Adder) handleFile(name string) {
+	mi, err := metainfo.LoadFromFile(name)
+	if err != nil {
+		a.config.OnError(name, err)
+		return
+	}
+	if len(mi.InfoBytes) == 0 {
+		a.config.OnError(name, errors.New("missing info"))
+		return
+	}
+	t, existed, err := a.cl.AddTorrent(mi)
+	if err != nil {
+		a.config.OnError(name, err)
+		return
+	}
+	if err := a.disposeFile(name); err != nil {
+		a.config.OnError(name, err)
+	}
+	if !existed && a.config.OnAdded != nil {
+		a.config.OnAdded(t, name)
+	}
+}
+
+// Moves or removes the added file, as configured. The file stays handled if that fails, so that
+// it's not added again.
+func (a *Adder) disposeFile(name string) (err error) {
+	switch {
+	case a.config.MoveAddedTo != "":
+		err = os.Rename(name, filepath.Join(a.config.MoveAddedTo, filepath.Base(name)))
+	case a.config.RemoveAdded:
+		err = os.Remove(name)
+	default:
+		return nil
+	}
+	if err == nil {
+		delete(a.handled, name)
+	}
+	return
+}
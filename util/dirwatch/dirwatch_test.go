@@ -3,9 +3,15 @@ package dirwatch
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/internal/testutil"
 )
 
 func TestDirwatch(t *testing.T) {
@@ -19,3 +25,84 @@ func TestDirwatch(t *testing.T) {
 	require.NoError(t, err)
 	defer dw.Close()
 }
+
+func TestAdder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := torrent.TestingConfig()
+	cl, err := torrent.NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	added := make(chan *torrent.Torrent, 2)
+	errs := make(chan string, 2)
+	a, err := NewAdder(cl, dir, AdderConfig{
+		OnAdded:        func(t *torrent.Torrent, _ string) { added <- t },
+		OnError:        func(fileName string, _ error) { errs <- fileName },
+		RemoveAdded:    true,
+		StableDuration: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer a.Close()
+	mi := testutil.GreetingMetaInfo()
+	writeMetainfo := func(name string) {
+		f, err := os.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+		defer f.Close()
+		require.NoError(t, mi.Write(f))
+	}
+	writeMetainfo("greeting.torrent")
+	assert.Equal(t, mi.HashInfoBytes(), (<-added).InfoHash())
+	badName := filepath.Join(dir, "bad.torrent")
+	require.NoError(t, ioutil.WriteFile(badName, []byte("not bencode"), 0644))
+	assert.Equal(t, badName, <-errs)
+	// The same torrent again isn't reported as added, but the file is still handled.
+	writeMetainfo("copy.torrent")
+	for {
+		_, err := os.Stat(filepath.Join(dir, "copy.torrent"))
+		if os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a.Close()
+	_, err = os.Stat(filepath.Join(dir, "greeting.torrent"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, added, 0)
+	assert.Len(t, errs, 0)
+	assert.Len(t, cl.Torrents(), 1)
+}
+
+func TestAdderDisposeError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cl, err := torrent.NewClient(torrent.TestingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	added := make(chan *torrent.Torrent, 2)
+	errs := make(chan string, 10)
+	name := filepath.Join(dir, "greeting.torrent")
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	require.NoError(t, testutil.GreetingMetaInfo().Write(f))
+	f.Close()
+	a, err := NewAdder(cl, dir, AdderConfig{
+		OnAdded: func(t *torrent.Torrent, _ string) { added <- t },
+		OnError: func(fileName string, _ error) { errs <- fileName },
+		// Moving the file fails, as the destination doesn't exist.
+		MoveAddedTo:    filepath.Join(dir, "missing"),
+		StableDuration: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer a.Close()
+	<-added
+	assert.Equal(t, name, <-errs)
+	// The file stays handled, so it's not added or disposed of again.
+	time.Sleep(100 * time.Millisecond)
+	a.Close()
+	assert.Len(t, added, 0)
+	assert.Len(t, errs, 0)
+	_, err = os.Stat(name)
+	assert.NoError(t, err)
+}
@@ -3,10 +3,31 @@
 package torrent
 
 import (
+	"net"
+
 	"github.com/anacrolix/utp"
 )
 
-func NewUtpSocket(network, addr string, _ firewallCallback) (utpSocket, error) {
+func NewUtpSocket(network, addr string, fc firewallCallback) (utpSocket, error) {
+	return newUtpSocket(network, addr, fc, socketBufferSizes{}, 0)
+}
+
+func newUtpSocket(network, addr string, _ firewallCallback, bufs socketBufferSizes, dscp int) (utpSocket, error) {
+	if !bufs.isZero() || dscp != 0 {
+		pc, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setUdpSocketBuffers(pc, bufs); err != nil {
+			pc.Close()
+			return nil, err
+		}
+		if err := setUdpSocketDscp(pc, dscp); err != nil {
+			pc.Close()
+			return nil, err
+		}
+		return utp.NewSocketFromPacketConn(pc)
+	}
 	s, err := utp.NewSocket(network, addr)
 	if s == nil {
 		return nil, err
@@ -3,10 +3,23 @@
 package torrent
 
 import (
+	"errors"
+
 	"github.com/anacrolix/go-libutp"
 )
 
 func NewUtpSocket(network, addr string, fc firewallCallback) (utpSocket, error) {
+	return newUtpSocket(network, addr, fc, socketBufferSizes{}, 0)
+}
+
+// libutp owns its UDP socket, so buffer sizes and DSCP can't be set on it.
+func newUtpSocket(network, addr string, fc firewallCallback, bufs socketBufferSizes, dscp int) (utpSocket, error) {
+	if !bufs.isZero() {
+		return nil, errors.New("uTP socket buffer sizes require building with disable_libutp")
+	}
+	if dscp != 0 {
+		return nil, errors.New("uTP socket DSCP requires building with disable_libutp")
+	}
 	s, err := utp.NewSocket(network, addr)
 	if s == nil {
 		return nil, err
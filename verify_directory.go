@@ -0,0 +1,46 @@
+package torrent
+
+import (
+	"os"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Hashes the torrent's data in dir, and returns which pieces are complete, without a Client. dir
+// is laid out as for file storage, so the data is at dir/<info name>. Pieces of missing or short
+// files are incomplete, including the piece where a missing zero-length file would be. Nothing in
+// dir is created or modified. Errors are only returned for bad info.
+func VerifyDirectory(mi *metainfo.MetaInfo, dir string) (complete []bool, err error) {
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, err
+	}
+	cs := storage.NewFileReadOnly(dir)
+	defer cs.Close()
+	ts, err := cs.OpenTorrent(&info, mi.HashInfoBytes())
+	if err != nil {
+		return nil, err
+	}
+	defer ts.Close()
+	complete = make([]bool, info.NumPieces())
+	for i := range complete {
+		p := info.Piece(i)
+		sum, err := hashPieceData(ts.Piece(p), p.Length())
+		complete[i] = err == nil && sum == p.Hash()
+	}
+	var off int64
+	for _, fi := range info.UpvertedFiles() {
+		if fi.Length == 0 && len(complete) != 0 {
+			if _, err := os.Stat(storage.FilePath(dir, &info, fi)); err != nil {
+				i := off / info.PieceLength
+				if i >= int64(len(complete)) {
+					i = int64(len(complete)) - 1
+				}
+				complete[i] = false
+			}
+		}
+		off += fi.Length
+	}
+	return
+}
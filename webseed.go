@@ -0,0 +1,455 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Web seeds are abandoned after writing this many pieces that fail verification.
+const maxWebSeedBadPieces = 3
+
+// Web seed requests fail rather than hang on a stalled server.
+const (
+	webSeedDialTimeout           = 15 * time.Second
+	webSeedTLSHandshakeTimeout   = 15 * time.Second
+	webSeedResponseHeaderTimeout = 30 * time.Second
+	// How long a response body may go without delivering any data.
+	webSeedReadTimeout = time.Minute
+	// The longest a busy BEP 17 HTTP seed can have us wait before retrying.
+	maxHttpSeedRetryAfter = 15 * time.Minute
+)
+
+// Returned when a BEP 17 HTTP seed responds that it's busy.
+type httpSeedBusyError struct {
+	url string
+	// How long the seed asked us to wait. Not set if the seed didn't say.
+	retryAfter time.Duration
+	ok         bool
+}
+
+func (me httpSeedBusyError) Error() string {
+	if !me.ok {
+		return fmt.Sprintf("http seed %q busy", me.url)
+	}
+	return fmt.Sprintf("http seed %q busy, retry in %v", me.url, me.retryAfter)
+}
+
+// Parses the body of a busy response from a BEP 17 HTTP seed, which is how many seconds to wait
+// before retrying.
+func parseHttpSeedRetryAfter(b []byte) (time.Duration, bool) {
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	if secs > int64(maxHttpSeedRetryAfter/time.Second) {
+		return maxHttpSeedRetryAfter, true
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// Decides which pieces a torrent's web seeds fetch. See Torrent.SetWebSeedPolicy. Whatever the
+// policy, web seeds skip pieces with chunks requested from peers, and peers aren't sent requests
+// for pieces that web seeds are fetching, so nothing is downloaded from both.
+type WebSeedPolicy int
+
+const (
+	// Web seeds fetch only the pieces that no peer unchoking us has, which keeps web seed traffic
+	// to a minimum.
+	WebSeedPeersFirst WebSeedPolicy = iota
+	// Web seeds fetch the wanted pieces that the fewest connected peers have, whether or not
+	// peers could provide them, to speed up the download.
+	WebSeedRarestFirst
+	// Web seeds aren't used.
+	WebSeedDisabled
+)
+
+func (p WebSeedPolicy) String() string {
+	switch p {
+	case WebSeedPeersFirst:
+		return "peers first"
+	case WebSeedRarestFirst:
+		return "rarest first"
+	case WebSeedDisabled:
+		return "disabled"
+	default:
+		return "unknown"
+	}
+}
+
+// Fetches whole pieces from a BEP 19 web seed with HTTP range requests, or from a BEP 17 HTTP seed
+// by piece index. Peers are preferred, so only pieces that no peer unchoking us has are fetched.
+type webSeed struct {
+	t   *Torrent
+	url string
+	// Whether it's a BEP 17 HTTP seed.
+	bep17  bool
+	client *http.Client
+	// Signalled when there may be a piece to fetch. Uses the Client lock.
+	cond sync.Cond
+	// Pieces the web seed wrote that failed verification.
+	badPieces int
+}
+
+// Web seeds are keyed by URL and protocol, as a URL could be given as both.
+type webSeedKey struct {
+	url   string
+	bep17 bool
+}
+
+// A range of a file to fetch for a piece.
+type webSeedRequest struct {
+	url    string
+	begin  int64
+	length int64
+}
+
+// Adds web seeds that aren't already present, or BEP 17 HTTP seeds if bep17 is set. Invalid URLs
+// are skipped, and reported together in the returned error.
+func (t *Torrent) addWebSeeds(urls []string, bep17 bool) error {
+	var errs []string
+	for _, u := range urls {
+		if err := t.addWebSeed(u, bep17); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("adding web seeds: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (t *Torrent) addWebSeed(s string, bep17 bool) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("unsupported web seed url %q", s)
+	}
+	key := webSeedKey{s, bep17}
+	if _, ok := t.webSeeds[key]; ok {
+		return nil
+	}
+	ws := &webSeed{
+		t:     t,
+		url:   s,
+		bep17: bep17,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 t.cl.config.HTTPProxy,
+				DialContext:           t.webSeedDialContext(),
+				TLSHandshakeTimeout:   webSeedTLSHandshakeTimeout,
+				ResponseHeaderTimeout: webSeedResponseHeaderTimeout,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+	}
+	ws.cond.L = t.cl.locker()
+	if t.webSeeds == nil {
+		t.webSeeds = make(map[webSeedKey]*webSeed)
+	}
+	t.webSeeds[key] = ws
+	if bep17 {
+		t.metainfo.HttpSeeds = append(t.metainfo.HttpSeeds, s)
+	} else {
+		t.metainfo.UrlList = append(t.metainfo.UrlList, s)
+	}
+	go ws.run()
+	return nil
+}
+
+// Returns the dial function for the torrent's web seeds. Like tracker announces, web seeds use
+// TorrentSpec.TrackerDialContext if it's set. Otherwise they dial from the torrent's TCP peer
+// dialer if there is one, such as for TorrentSpec.PeerLocalIp, so that all the torrent's traffic
+// leaves from the same place.
+func (t *Torrent) webSeedDialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := t.trackerDialContext
+	if dial == nil {
+		for _, d := range t.ownPeerDialers() {
+			if nd, ok := d.(NetDialer); ok && strings.HasPrefix(nd.Network, "tcp") {
+				dial = func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return nd.Dial(ctx, addr)
+				}
+				break
+			}
+		}
+	}
+	if dial == nil {
+		dial = t.trackerAnnounceDialContext()
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, webSeedDialTimeout)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
+
+// Wakes web seeds that may have pieces to fetch.
+func (t *Torrent) tickleWebSeeds() {
+	for _, ws := range t.webSeeds {
+		ws.cond.Broadcast()
+	}
+}
+
+// Returns the piece to fetch per the torrent's WebSeedPolicy, from the wanted pieces that aren't
+// already being fetched by a web seed, or requested from peers. Ties go to the most wanted piece.
+// This runs for every fetch, so it only uses the per-piece counts kept up to date as requests and
+// connections change.
+func (ws *webSeed) nextPiece() (ret pieceIndex, ok bool) {
+	t := ws.t
+	if !t.haveInfo() || !t.networkingEnabled || t.dataDownloadDisallowed || t.seedOnly || t.paused.IsSet() {
+		return
+	}
+	if t.cl.config.DisableNetwork || t.webSeedPolicy == WebSeedDisabled {
+		return
+	}
+	fewest := -1
+	t._pendingPieces.IterTyped(func(i pieceIndex) bool {
+		p := &t.pieces[i]
+		if p.webSeedFetching || p.numPeerRequests != 0 || !t.wantPieceIndex(i) {
+			return true
+		}
+		n := p.availability
+		if t.webSeedPolicy == WebSeedPeersFirst {
+			if p.unchokingAvailability != 0 {
+				return true
+			}
+			n = 0
+		}
+		if fewest == -1 || n < fewest {
+			ret, ok, fewest = i, true, n
+		}
+		// Nothing is rarer.
+		return fewest != 0
+	})
+	return
+}
+
+func (ws *webSeed) run() {
+	defer ws.client.CloseIdleConnections()
+	t := ws.t
+	cl := t.cl
+	cl.lock()
+	defer cl.unlock()
+	failures := 0
+	for !t.closed.IsSet() && ws.badPieces < maxWebSeedBadPieces {
+		piece, ok := ws.nextPiece()
+		if !ok {
+			ws.cond.Wait()
+			continue
+		}
+		err := ws.fetchPiece(piece)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		t.logger.Printf("error fetching piece %v from web seed %q: %v", piece, ws.url, err)
+		wait := time.Duration(min(int64(time.Minute), int64(time.Second)<<uint(min(int64(failures), 6))))
+		var busy httpSeedBusyError
+		if errors.As(err, &busy) && busy.ok {
+			// The seed is up, it's told us when to come back.
+			failures = 0
+			wait = busy.retryAfter
+		}
+		closed := t.closed.C()
+		cl.unlock()
+		select {
+		case <-closed:
+		case <-time.After(wait):
+		}
+		cl.lock()
+	}
+}
+
+// Fetches the piece and writes it to storage, then queues it for verification. The lock is
+// released while the piece is fetched and written.
+func (ws *webSeed) fetchPiece(piece pieceIndex) error {
+	t := ws.t
+	cl := t.cl
+	p := t.piece(piece)
+	reqs := ws.pieceRequests(piece)
+	closed := t.closed.C()
+	p.webSeedFetching = true
+	cl.unlock()
+	data, err := ws.get(closed, reqs, int64(p.length()))
+	cl.lock()
+	p.webSeedFetching = false
+	if err != nil {
+		// Peers can request the piece again.
+		for c := range t.conns {
+			c.updateRequests()
+		}
+		return err
+	}
+	if !t.wantPieceIndex(piece) {
+		// Peers got it first.
+		return nil
+	}
+	p.incrementPendingWrites()
+	cl.unlock()
+	n, err := p.writeStorage(data, 0)
+	cl.lock()
+	p.decrementPendingWrites()
+	if err == nil && n != len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		t.onWriteChunkErr(err)
+		return fmt.Errorf("writing piece: %w", err)
+	}
+	t.allStats(add(int64(len(data)), func(cs *ConnStats) *Count { return &cs.BytesReadData }))
+	t.allStats(add(int64(len(data)), func(cs *ConnStats) *Count { return &cs.BytesReadUsefulData }))
+	t.webSeedBytesRead += int64(len(data))
+	for i := 0; i < int(p.numChunks()); i++ {
+		p.unpendChunkIndex(i)
+	}
+	p.webSeedWritten = ws
+	t.queueReceivedPieceCheck(piece)
+	t.publishPieceChange(piece)
+	cl.event.Broadcast()
+	return nil
+}
+
+// Returns the file ranges that make up the piece. HTTP seeds serve the whole piece.
+func (ws *webSeed) pieceRequests(piece pieceIndex) (ret []webSeedRequest) {
+	t := ws.t
+	if ws.bep17 {
+		return []webSeedRequest{{
+			url:    ws.httpSeedUrl(piece),
+			length: int64(t.pieceLength(piece)),
+		}}
+	}
+	begin := int64(piece) * t.info.PieceLength
+	end := begin + int64(t.pieceLength(piece))
+	for _, f := range *t.files {
+		fileEnd := f.offset + f.length
+		if fileEnd <= begin || f.offset >= end {
+			continue
+		}
+		b := max(begin, f.offset)
+		ret = append(ret, webSeedRequest{
+			url:    ws.fileUrl(f),
+			begin:  b - f.offset,
+			length: min(end, fileEnd) - b,
+		})
+	}
+	return
+}
+
+// Returns the URL for the file, per BEP 19.
+func (ws *webSeed) fileUrl(f *File) string {
+	info := ws.t.info
+	u := ws.url
+	if !info.IsDir() {
+		if strings.HasSuffix(u, "/") {
+			u += url.PathEscape(info.Name)
+		}
+		return u
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	u += url.PathEscape(info.Name)
+	for _, c := range f.fi.Path {
+		u += "/" + url.PathEscape(c)
+	}
+	return u
+}
+
+// Returns the URL for the piece, per BEP 17.
+func (ws *webSeed) httpSeedUrl(piece pieceIndex) string {
+	u, _ := url.Parse(ws.url)
+	q := u.Query()
+	q.Set("info_hash", string(ws.t.infoHash[:]))
+	q.Set("piece", strconv.Itoa(piece))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Fetches the requests in order into a buffer of the given length. Gives up if closed is.
+func (ws *webSeed) get(closed <-chan struct{}, reqs []webSeedRequest, length int64) ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// Cancels the requests if the server stops sending.
+	stall := time.AfterFunc(webSeedReadTimeout, cancel)
+	defer stall.Stop()
+	buf := make([]byte, 0, length)
+	for _, r := range reqs {
+		req, err := http.NewRequest("GET", r.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if !ws.bep17 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.begin, r.begin+r.length-1))
+		}
+		req.Header.Set("User-Agent", ws.t.cl.config.HTTPUserAgent)
+		stall.Reset(webSeedReadTimeout)
+		resp, err := ws.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if ws.bep17 && resp.StatusCode == http.StatusServiceUnavailable {
+			b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 32))
+			resp.Body.Close()
+			err := httpSeedBusyError{url: r.url}
+			err.retryAfter, err.ok = parseHttpSeedRetryAfter(b)
+			return nil, err
+		}
+		// Servers that ignore the range send the whole file, which is only of use from the start.
+		if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && r.begin == 0) ||
+			ws.bep17 && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected response for %q: %s", r.url, resp.Status)
+		}
+		n := len(buf)
+		buf = buf[:n+int(r.length)]
+		_, err = io.ReadFull(stallReader{resp.Body, stall}, buf[n:])
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %q: %w", r.url, err)
+		}
+	}
+	return buf, nil
+}
+
+// Pushes back the timer on each read.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (me stallReader) Read(b []byte) (int, error) {
+	me.timer.Reset(webSeedReadTimeout)
+	return me.r.Read(b)
+}
+
+func (ws *webSeed) onBadPiece(piece pieceIndex) {
+	ws.badPieces++
+	ws.t.logger.Printf("piece %v from web seed %q failed verification", piece, ws.url)
+	if ws.badPieces >= maxWebSeedBadPieces {
+		ws.t.logger.Printf("abandoning web seed %q", ws.url)
+		ws.cond.Broadcast()
+	}
+}
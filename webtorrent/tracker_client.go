@@ -1,6 +1,7 @@
 package webtorrent
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -23,6 +24,10 @@ type TrackerClient struct {
 	tracker        *websocket.Conn
 	onConn         onDataChannelOpen
 	logger         log.Logger
+	// Cancels dialing the tracker. Set by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
 }
 
 // outboundOffer represents an outstanding offer.
@@ -40,23 +45,37 @@ type DataChannelContext struct {
 type onDataChannelOpen func(_ datachannel.ReadWriteCloser, dcc DataChannelContext)
 
 func NewTrackerClient(peerId, infoHash [20]byte, onConn onDataChannelOpen, logger log.Logger) *TrackerClient {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &TrackerClient{
 		outboundOffers: make(map[string]outboundOffer),
 		peerIDBinary:   binaryToJsonString(peerId[:]),
 		infoHashBinary: binaryToJsonString(infoHash[:]),
 		onConn:         onConn,
 		logger:         logger,
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 }
 
+// Runs until the connection to the tracker fails, or the client is closed, in which case it
+// returns nil.
 func (c *TrackerClient) Run(ar tracker.AnnounceRequest, url string) error {
-	t, _, err := websocket.DefaultDialer.Dial(url, nil)
+	t, _, err := websocket.DefaultDialer.DialContext(c.ctx, url, nil)
 	if err != nil {
+		if c.ctx.Err() != nil {
+			return nil
+		}
 		return fmt.Errorf("failed to dial tracker: %w", err)
 	}
 	defer t.Close()
 	c.logger.WithDefaultLevel(log.Debug).Printf("dialed tracker %q", url)
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
 	c.tracker = t
+	c.lock.Unlock()
 
 	go func() {
 		err := c.announce(ar)
@@ -64,7 +83,30 @@ func (c *TrackerClient) Run(ar tracker.AnnounceRequest, url string) error {
 			c.logger.WithDefaultLevel(log.Error).Printf("error announcing: %v", err)
 		}
 	}()
-	return c.trackerReadLoop()
+	err = c.trackerReadLoop()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	return err
+}
+
+// Disconnects from the tracker, ending Run. Peer connections made through the tracker aren't
+// affected, but offers it hasn't answered yet are dropped.
+func (c *TrackerClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.cancel()
+	c.outboundOffers = make(map[string]outboundOffer)
+	if c.tracker == nil {
+		return nil
+	}
+	return c.tracker.Close()
 }
 
 func (c *TrackerClient) announce(request tracker.AnnounceRequest) error {
@@ -109,11 +151,10 @@ func (c *TrackerClient) announce(request tracker.AnnounceRequest) error {
 	c.lock.Lock()
 	tracker := c.tracker
 	err = tracker.WriteMessage(websocket.TextMessage, data)
+	c.lock.Unlock()
 	if err != nil {
 		return fmt.Errorf("write AnnounceRequest: %w", err)
-		c.lock.Unlock()
 	}
-	c.lock.Unlock()
 	return nil
 }
 
@@ -159,11 +200,10 @@ func (c *TrackerClient) trackerReadLoop() error {
 
 			c.lock.Lock()
 			err = tracker.WriteMessage(websocket.TextMessage, data)
+			c.lock.Unlock()
 			if err != nil {
 				return fmt.Errorf("write AnnounceResponse: %w", err)
-				c.lock.Unlock()
 			}
-			c.lock.Unlock()
 		case ar.Answer != nil:
 			c.lock.Lock()
 			offer, ok := c.outboundOffers[ar.OfferID]